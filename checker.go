@@ -0,0 +1,350 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Verdicts of a content check, from least to most severe.
+const (
+	VerdictAllow  = "allow"
+	VerdictHold   = "hold"
+	VerdictReject = "reject"
+)
+
+// CheckInput is what a ContentChecker sees of a comment being created.
+type CheckInput struct {
+	// Content is the trimmed source as submitted, before rendering.
+	Content       string
+	Commentable   string
+	CommentableID string
+	ParentID      *string
+	UserID        *string
+	IPAddress     *string
+	UserAgent     *string
+}
+
+// CheckResult is the outcome of one check. Score is the checker's confidence
+// that the comment is unwanted, between 0 and 1; Reason explains any verdict
+// other than allow.
+type CheckResult struct {
+	Verdict string
+	Score   float64
+	Reason  string
+}
+
+// ContentChecker inspects a new comment before it is stored. Checkers are
+// registered through Config.ContentCheckers and run after the built-in ones.
+type ContentChecker interface {
+	Name() string
+	Check(ctx context.Context, input CheckInput) (CheckResult, error)
+}
+
+// CheckOutcome is the combined result of the whole chain: the most severe
+// verdict, the highest score and the reasons of every non-allow verdict.
+type CheckOutcome struct {
+	Verdict string
+	Score   float64
+	Reasons []string
+}
+
+// runContentCheckers runs checkers in order. A reject stops the chain. A
+// checker that fails holds the comment for moderation rather than letting it
+// through unchecked.
+func runContentCheckers(ctx context.Context, checkers []ContentChecker, input CheckInput) CheckOutcome {
+	outcome := CheckOutcome{Verdict: VerdictAllow}
+
+	for _, checker := range checkers {
+		result, err := checker.Check(ctx, input)
+		if err != nil {
+			result = CheckResult{Verdict: VerdictHold, Reason: "check failed"}
+		}
+
+		if result.Score > outcome.Score {
+			outcome.Score = result.Score
+		}
+		if result.Verdict == VerdictAllow || result.Verdict == "" {
+			continue
+		}
+
+		outcome.Reasons = append(outcome.Reasons, checker.Name()+": "+result.Reason)
+		if result.Verdict == VerdictReject {
+			outcome.Verdict = VerdictReject
+			return outcome
+		}
+		outcome.Verdict = VerdictHold
+	}
+
+	return outcome
+}
+
+// buildContentCheckers assembles the chain configured in cfg: the built-in
+// link count, blocked words, duplicate content and external classifier checks
+// (each only when configured), followed by cfg.ContentCheckers.
+func buildContentCheckers(db database.Database, cfg *Config) []ContentChecker {
+	var checkers []ContentChecker
+
+	if cfg.MaxLinks > 0 {
+		checkers = append(checkers, &LinkCountChecker{Max: cfg.MaxLinks})
+	}
+	if len(cfg.BlockedWords) > 0 {
+		checkers = append(checkers, NewBlockedWordsChecker(cfg.BlockedWords))
+	}
+	if cfg.DuplicateWindowSeconds > 0 && db != nil {
+		duplicates := &DuplicateContentChecker{
+			DB:       db,
+			Window:   time.Duration(cfg.DuplicateWindowSeconds) * time.Second,
+			StoredIP: cfg.storedIP,
+		}
+		duplicates.cipher = newCommentCipher(cfg)
+		checkers = append(checkers, duplicates)
+	}
+	if cfg.ClassifierURL != "" {
+		checkers = append(checkers, &ClassifierChecker{
+			Classifier:  &HTTPClassifier{URL: cfg.ClassifierURL},
+			HoldAbove:   cfg.ClassifierHoldScore,
+			RejectAbove: cfg.ClassifierRejectScore,
+		})
+	}
+
+	return append(checkers, cfg.ContentCheckers...)
+}
+
+var linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// LinkCountChecker holds comments with more than Max links for moderation.
+type LinkCountChecker struct {
+	Max int
+}
+
+func (l *LinkCountChecker) Name() string { return "links" }
+
+func (l *LinkCountChecker) Check(_ context.Context, input CheckInput) (CheckResult, error) {
+	links := len(linkPattern.FindAllStringIndex(input.Content, -1))
+	if links <= l.Max {
+		return CheckResult{Verdict: VerdictAllow}, nil
+	}
+	return CheckResult{
+		Verdict: VerdictHold,
+		Score:   0.5,
+		Reason:  fmt.Sprintf("%d links (max %d)", links, l.Max),
+	}, nil
+}
+
+// BlockedWordsChecker rejects comments containing any of a list of words,
+// matched case-insensitively on word boundaries.
+type BlockedWordsChecker struct {
+	pattern *regexp.Regexp
+}
+
+func NewBlockedWordsChecker(words []string) *BlockedWordsChecker {
+	quoted := make([]string, 0, len(words))
+	for _, w := range words {
+		if w = strings.TrimSpace(w); w != "" {
+			quoted = append(quoted, regexp.QuoteMeta(w))
+		}
+	}
+	if len(quoted) == 0 {
+		return &BlockedWordsChecker{}
+	}
+	return &BlockedWordsChecker{
+		pattern: regexp.MustCompile(`(?i)\b(?:` + strings.Join(quoted, "|") + `)\b`),
+	}
+}
+
+func (b *BlockedWordsChecker) Name() string { return "blocked_words" }
+
+func (b *BlockedWordsChecker) Check(_ context.Context, input CheckInput) (CheckResult, error) {
+	if b.pattern == nil {
+		return CheckResult{Verdict: VerdictAllow}, nil
+	}
+	match := b.pattern.FindString(input.Content)
+	if match == "" {
+		return CheckResult{Verdict: VerdictAllow}, nil
+	}
+	return CheckResult{
+		Verdict: VerdictReject,
+		Score:   1,
+		Reason:  fmt.Sprintf("contains blocked word %q", strings.ToLower(match)),
+	}, nil
+}
+
+// DuplicateContentChecker rejects a comment identical to one the same author
+// (or, for anonymous comments, the same IP address) posted on the same target
+// within Window.
+type DuplicateContentChecker struct {
+	DB     database.Database
+	Window time.Duration
+	// StoredIP maps an IP address to the form comments store it in, when
+	// they do not store it as is.
+	StoredIP func(ip string) *string
+	// cipher decrypts the comments stored encrypted, when they are: their
+	// IP addresses are then compared once decrypted.
+	cipher *commentCipher
+}
+
+// duplicateCandidates is the number of recent identical comments whose
+// encrypted IP addresses are compared.
+const duplicateCandidates = 50
+
+func (d *DuplicateContentChecker) Name() string { return "duplicate" }
+
+func (d *DuplicateContentChecker) Check(ctx context.Context, input CheckInput) (CheckResult, error) {
+	conds := []query.Condition{
+		query.Eq("commentable", input.Commentable),
+		query.Eq("commentable_id", input.CommentableID),
+		query.Eq("content", input.Content),
+		query.Gte("created_at", time.Now().UTC().Add(-d.Window)),
+	}
+	switch {
+	case input.UserID != nil:
+		conds = append(conds, query.Eq("user_id", *input.UserID))
+	case input.IPAddress != nil:
+		ip := input.IPAddress
+		if d.StoredIP != nil {
+			ip = d.StoredIP(*ip)
+		}
+		if ip == nil {
+			return CheckResult{Verdict: VerdictAllow}, nil
+		}
+		if d.cipher != nil {
+			return d.checkEncryptedIP(ctx, conds, *ip)
+		}
+		conds = append(conds, query.Eq("ip_address", *ip))
+	default:
+		return CheckResult{Verdict: VerdictAllow}, nil
+	}
+
+	res, err := crud.New[Comment](d.DB).GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      1,
+		Conditions: conds,
+	})
+	if err != nil {
+		return CheckResult{}, err
+	}
+	if len(res.Items) == 0 {
+		return CheckResult{Verdict: VerdictAllow}, nil
+	}
+	return duplicateResult, nil
+}
+
+// checkEncryptedIP looks for ip among the decrypted IP addresses of the
+// latest comments matching conds, since encrypted values cannot be compared
+// in the database. They are read whatever the roles of the caller, who may
+// not read IP addresses.
+func (d *DuplicateContentChecker) checkEncryptedIP(ctx context.Context, conds []query.Condition, ip string) (CheckResult, error) {
+	res, err := storedComments(d.DB, d.cipher).GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      duplicateCandidates,
+		Conditions: append(conds, query.IsNotNull("ip_address")),
+		OrderBy:    []crud.OrderByClause{{Column: "created_at", Direction: query.DESC}},
+	})
+	if err != nil {
+		return CheckResult{}, err
+	}
+	for _, comment := range res.Items {
+		if comment.IpAddress != nil && *comment.IpAddress == ip {
+			return duplicateResult, nil
+		}
+	}
+	return CheckResult{Verdict: VerdictAllow}, nil
+}
+
+var duplicateResult = CheckResult{
+	Verdict: VerdictReject,
+	Score:   1,
+	Reason:  "identical comment posted recently",
+}
+
+// Classifier scores content between 0 (fine) and 1 (certainly unwanted).
+type Classifier interface {
+	Classify(ctx context.Context, input CheckInput) (float64, error)
+}
+
+// ClassifierChecker turns a Classifier score into a verdict: held above
+// HoldAbove, rejected above RejectAbove. A zero threshold disables that
+// verdict.
+type ClassifierChecker struct {
+	Classifier  Classifier
+	HoldAbove   float64
+	RejectAbove float64
+}
+
+func (c *ClassifierChecker) Name() string { return "classifier" }
+
+func (c *ClassifierChecker) Check(ctx context.Context, input CheckInput) (CheckResult, error) {
+	score, err := c.Classifier.Classify(ctx, input)
+	if err != nil {
+		return CheckResult{}, err
+	}
+
+	result := CheckResult{Verdict: VerdictAllow, Score: score}
+	switch {
+	case c.RejectAbove > 0 && score > c.RejectAbove:
+		result.Verdict = VerdictReject
+	case c.HoldAbove > 0 && score > c.HoldAbove:
+		result.Verdict = VerdictHold
+	default:
+		return result, nil
+	}
+	result.Reason = fmt.Sprintf("score %.2f", score)
+	return result, nil
+}
+
+// HTTPClassifier asks an external service for a score. It POSTs
+// {"content", "commentable", "commentableId"} as JSON to URL and expects
+// {"score": <0..1>} back.
+type HTTPClassifier struct {
+	URL    string
+	Client *http.Client
+}
+
+const defaultClassifierTimeout = 3 * time.Second
+
+func (h *HTTPClassifier) Classify(ctx context.Context, input CheckInput) (float64, error) {
+	body, err := json.Marshal(map[string]string{
+		"content":       input.Content,
+		"commentable":   input.Commentable,
+		"commentableId": input.CommentableID,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := h.Client
+	if client == nil {
+		client = &http.Client{Timeout: defaultClassifierTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("classifier returned status %d", resp.StatusCode)
+	}
+
+	var out struct {
+		Score float64 `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return out.Score, nil
+}
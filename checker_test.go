@@ -0,0 +1,185 @@
+package commentable
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+type stubChecker struct {
+	name   string
+	result CheckResult
+	err    error
+	calls  int
+}
+
+func (s *stubChecker) Name() string { return s.name }
+
+func (s *stubChecker) Check(context.Context, CheckInput) (CheckResult, error) {
+	s.calls++
+	return s.result, s.err
+}
+
+func TestRunContentCheckers(t *testing.T) {
+	hold := &stubChecker{name: "hold", result: CheckResult{Verdict: VerdictHold, Score: 0.4, Reason: "suspicious"}}
+	failing := &stubChecker{name: "failing", err: errors.New("boom")}
+	reject := &stubChecker{name: "reject", result: CheckResult{Verdict: VerdictReject, Score: 0.9, Reason: "spam"}}
+	after := &stubChecker{name: "after", result: CheckResult{Verdict: VerdictAllow}}
+
+	outcome := runContentCheckers(context.Background(), []ContentChecker{hold, failing}, CheckInput{})
+	if outcome.Verdict != VerdictHold || outcome.Score != 0.4 || len(outcome.Reasons) != 2 {
+		t.Errorf("expected a hold with both reasons, got %+v", outcome)
+	}
+
+	outcome = runContentCheckers(context.Background(), []ContentChecker{hold, reject, after}, CheckInput{})
+	if outcome.Verdict != VerdictReject || outcome.Score != 0.9 {
+		t.Errorf("expected a reject, got %+v", outcome)
+	}
+	if after.calls != 0 {
+		t.Error("expected a reject to stop the chain")
+	}
+}
+
+func TestBuiltinContentCheckers(t *testing.T) {
+	ctx := context.Background()
+
+	links := &LinkCountChecker{Max: 1}
+	if r, _ := links.Check(ctx, CheckInput{Content: "see https://a.example and www.b.example"}); r.Verdict != VerdictHold {
+		t.Errorf("expected two links to be held, got %+v", r)
+	}
+	if r, _ := links.Check(ctx, CheckInput{Content: "see https://a.example"}); r.Verdict != VerdictAllow {
+		t.Errorf("expected one link to be allowed, got %+v", r)
+	}
+
+	words := NewBlockedWordsChecker([]string{"viagra", " "})
+	if r, _ := words.Check(ctx, CheckInput{Content: "Cheap VIAGRA here"}); r.Verdict != VerdictReject {
+		t.Errorf("expected a blocked word to be rejected, got %+v", r)
+	}
+	if r, _ := words.Check(ctx, CheckInput{Content: "viagrafalls is a place"}); r.Verdict != VerdictAllow {
+		t.Errorf("expected blocked words to match whole words only, got %+v", r)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"score": 0.7}`))
+	}))
+	defer server.Close()
+
+	classifier := &ClassifierChecker{Classifier: &HTTPClassifier{URL: server.URL}, HoldAbove: 0.5, RejectAbove: 0.9}
+	if r, err := classifier.Check(ctx, CheckInput{Content: "hello"}); err != nil || r.Verdict != VerdictHold || r.Score != 0.7 {
+		t.Errorf("expected a held score of 0.7, got %+v (%v)", r, err)
+	}
+}
+
+func TestDuplicateContentChecker(t *testing.T) {
+	db := setupThreadDB(t)
+	id := insertComment(t, db, nil, StatusPublished)
+	setCreatedAt(t, db, id, time.Now().UTC())
+	stmt, args, err := query.New(db.Dialect()).Update("comment").
+		Set("user_id", "author-1").
+		Set("ip_address", "192.0.2.1").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := &DuplicateContentChecker{DB: db, Window: time.Hour}
+	userID := "user-1"
+	input := CheckInput{Content: "c", Commentable: "post", CommentableID: "post-1", UserID: &userID}
+
+	if r, err := checker.Check(context.Background(), input); err != nil || r.Verdict != VerdictAllow {
+		t.Errorf("expected another user's identical comment to be allowed, got %+v (%v)", r, err)
+	}
+
+	ip := "192.0.2.1"
+	input.UserID = nil
+	input.IPAddress = &ip
+	if r, err := checker.Check(context.Background(), input); err != nil || r.Verdict != VerdictReject {
+		t.Errorf("expected an identical comment from the same IP to be rejected, got %+v (%v)", r, err)
+	}
+}
+
+func TestDuplicateContentChecker_EncryptedIP(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := encryptionConfig("k1")
+	cfg.DefaultStatus = StatusPublished
+	cfg.DuplicateWindowSeconds = 3600
+
+	// Anonymous callers have no roles, so they may not read the IP
+	// addresses compared.
+	app := fiber.New()
+	RegisterCommentRoutes(app, db, &cfg)
+	post := func() int {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/comments", strings.NewReader(`{"commentable":"post","commentableId":"post-1","content":"same"}`))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	if status := post(); status != 201 {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if status := post(); status != 400 {
+		t.Errorf("expected the identical comment from the same IP to be rejected, got %d", status)
+	}
+}
+
+func TestCommentHooks_CreateRecordsContentCheck(t *testing.T) {
+	config := DefaultConfig()
+	config.DefaultStatus = StatusPublished
+	config.BlockedWords = []string{"spam"}
+	config.MaxLinks = 3
+	hooks := NewCommentHooks(nil, &config, newTestVoter(t))
+
+	create := func(content string) (int, Comment) {
+		t.Helper()
+		var model Comment
+		app := fiber.New()
+		app.Post("/", func(c fiber.Ctx) error {
+			dto := CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: content}
+			if err := hooks.Create(c, dto, &model); err != nil {
+				return err
+			}
+			return c.SendStatus(201)
+		})
+		resp, err := app.Test(httptest.NewRequest("POST", "/", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, model
+	}
+
+	if status, _ := create("this is spam"); status != 400 {
+		t.Errorf("expected a rejected comment to fail with 400, got %d", status)
+	}
+
+	status, model := create("a http://a.example b http://b.example c http://c.example d http://d.example")
+	if status != 201 {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	if model.Status != StatusAwaiting || model.CheckVerdict == nil || *model.CheckVerdict != VerdictHold || model.CheckReasons == nil {
+		t.Errorf("expected a held comment awaiting moderation with its reasons, got %+v", model)
+	}
+	if model.PublishedAt != nil {
+		t.Error("expected a held comment not to be published")
+	}
+
+	status, model = create("fine")
+	if status != 201 || model.Status != StatusPublished || *model.CheckVerdict != VerdictAllow {
+		t.Errorf("expected a clean comment to be published, got %d %+v", status, model)
+	}
+}
@@ -0,0 +1,103 @@
+package commentable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/plugin"
+)
+
+// rebuildStatsCommand recomputes comment_target_stats, optionally only for
+// the commentable types given as arguments.
+type rebuildStatsCommand struct {
+	db database.Database
+}
+
+func (cmd *rebuildStatsCommand) Name() string {
+	return "rebuild-comment-stats"
+}
+
+func (cmd *rebuildStatsCommand) Description() string {
+	return "Recompute the per-target comment stats from the comment table [commentable types...]"
+}
+
+func (cmd *rebuildStatsCommand) Run(ctx *plugin.CommandContext) *plugin.CommandResult {
+	if cmd.db == nil {
+		return &plugin.CommandResult{Error: errors.New("no database configured")}
+	}
+
+	n, err := RebuildTargetStats(context.Background(), cmd.db, ctx.Args...)
+	if err != nil {
+		return &plugin.CommandResult{Error: err}
+	}
+	return &plugin.CommandResult{
+		Success: true,
+		Message: fmt.Sprintf("Rebuilt comment stats for %d targets", n),
+	}
+}
+
+// purgePIICommand scrubs the IP addresses and user agents of the comments
+// past the retention window, like the plugin's hourly job.
+type purgePIICommand struct {
+	db     database.Database
+	config *Config
+}
+
+func (cmd *purgePIICommand) Name() string {
+	return "purge-comment-pii"
+}
+
+func (cmd *purgePIICommand) Description() string {
+	return "Scrub the IP addresses and user agents of comments older than pii_retention_days"
+}
+
+func (cmd *purgePIICommand) Run(ctx *plugin.CommandContext) *plugin.CommandResult {
+	if cmd.db == nil {
+		return &plugin.CommandResult{Error: errors.New("no database configured")}
+	}
+	if cmd.config.PIIRetentionDays <= 0 {
+		return &plugin.CommandResult{Error: errors.New("pii_retention_days is not set")}
+	}
+
+	n, err := PurgePII(context.Background(), cmd.db, cmd.config, time.Now())
+	if err != nil {
+		return &plugin.CommandResult{Error: err}
+	}
+	return &plugin.CommandResult{
+		Success: true,
+		Message: fmt.Sprintf("Scrubbed the IP addresses and user agents of %d comments", n),
+	}
+}
+
+// reencryptCommand rewraps the data keys of the comments encrypted under a
+// retired key with encryption_key_id, and encrypts those stored in clear.
+type reencryptCommand struct {
+	db     database.Database
+	config *Config
+}
+
+func (cmd *reencryptCommand) Name() string {
+	return "reencrypt-comments"
+}
+
+func (cmd *reencryptCommand) Description() string {
+	return "Re-encrypt the comments not encrypted under encryption_key_id, after a key rotation"
+}
+
+func (cmd *reencryptCommand) Run(ctx *plugin.CommandContext) *plugin.CommandResult {
+	if cmd.db == nil {
+		return &plugin.CommandResult{Error: errors.New("no database configured")}
+	}
+
+	n, err := ReencryptComments(context.Background(), cmd.db, cmd.config)
+	if err != nil {
+		return &plugin.CommandResult{Error: err}
+	}
+	return &plugin.CommandResult{
+		Success: true,
+		Message: fmt.Sprintf("Re-encrypted %d comments", n),
+	}
+}
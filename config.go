@@ -3,32 +3,118 @@ package commentable
 import (
 	"errors"
 	"fmt"
+	"net/url"
+	"slices"
 
 	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
 )
 
 type Config struct {
-	Database           database.Database
-	AllowedTypes       []string `json:"allowed_types" yaml:"allowed_types"`
-	MaxContentLength   int      `json:"max_content_length" yaml:"max_content_length"`
-	PaginationLimit    int      `json:"pagination_limit" yaml:"pagination_limit"`
-	MaxPaginationLimit int      `json:"max_pagination_limit" yaml:"max_pagination_limit"`
-	EnableNesting      bool     `json:"enable_nesting" yaml:"enable_nesting"`
-	MaxNestingDepth    int      `json:"max_nesting_depth" yaml:"max_nesting_depth"`
-	DefaultStatus      string   `json:"default_status" yaml:"default_status"`
-	AllowAnonymous     bool     `json:"allow_anonymous" yaml:"allow_anonymous"`
+	Database              database.Database
+	AllowedTypes          []string `json:"allowed_types" yaml:"allowed_types"`
+	MaxContentLength      int      `json:"max_content_length" yaml:"max_content_length"`
+	PaginationLimit       int      `json:"pagination_limit" yaml:"pagination_limit"`
+	MaxPaginationLimit    int      `json:"max_pagination_limit" yaml:"max_pagination_limit"`
+	EnableNesting         bool     `json:"enable_nesting" yaml:"enable_nesting"`
+	MaxNestingDepth       int      `json:"max_nesting_depth" yaml:"max_nesting_depth"`
+	DefaultStatus         string   `json:"default_status" yaml:"default_status"`
+	AllowAnonymous        bool     `json:"allow_anonymous" yaml:"allow_anonymous"`
+	MaxBulkModerationSize int      `json:"max_bulk_moderation_size" yaml:"max_bulk_moderation_size"`
+
+	// ContentFormats maps a commentable type to the format its comments are
+	// written in (plain or markdown). Types not listed are plain.
+	ContentFormats map[string]string `json:"content_formats" yaml:"content_formats"`
+
+	// Mentions are resolved against MentionUsernameColumn of the users table.
+	// The core auth users table has no username column, so mentions stay
+	// disabled until this names one.
+	MentionUsernameColumn string `json:"mention_username_column" yaml:"mention_username_column"`
+	MaxMentionsPerComment int    `json:"max_mentions_per_comment" yaml:"max_mentions_per_comment"`
+
+	// Content checks run on every new comment, in this order: link count,
+	// blocked words, duplicate content, external classifier, then
+	// ContentCheckers. A zero value disables the corresponding built-in, and
+	// every built-in is disabled by default.
+	MaxLinks               int              `json:"max_links" yaml:"max_links"`
+	BlockedWords           []string         `json:"blocked_words" yaml:"blocked_words"`
+	DuplicateWindowSeconds int              `json:"duplicate_window_seconds" yaml:"duplicate_window_seconds"`
+	ClassifierURL          string           `json:"classifier_url" yaml:"classifier_url"`
+	ClassifierHoldScore    float64          `json:"classifier_hold_score" yaml:"classifier_hold_score"`
+	ClassifierRejectScore  float64          `json:"classifier_reject_score" yaml:"classifier_reject_score"`
+	ContentCheckers        []ContentChecker `json:"-" yaml:"-"`
+
+	// Rate limits on comment creation, counted over a sliding window of
+	// RateLimitWindowSeconds. A zero limit disables that scope, and every
+	// scope is disabled by default. The IP address is the one fiber reports,
+	// so behind a proxy RateLimitPerIP needs fiber's trusted proxy settings.
+	// RateLimitStore, when set, replaces the store selected by
+	// RateLimitBackend.
+	RateLimitWindowSeconds int            `json:"rate_limit_window_seconds" yaml:"rate_limit_window_seconds"`
+	RateLimitPerUser       int            `json:"rate_limit_per_user" yaml:"rate_limit_per_user"`
+	RateLimitPerIP         int            `json:"rate_limit_per_ip" yaml:"rate_limit_per_ip"`
+	RateLimitPerThread     int            `json:"rate_limit_per_thread" yaml:"rate_limit_per_thread"`
+	RateLimitBackend       string         `json:"rate_limit_backend" yaml:"rate_limit_backend"`
+	RateLimitStore         RateLimitStore `json:"-" yaml:"-"`
+
+	// Webhooks are notified of comment lifecycle events. Deliveries are
+	// queued in the database and retried with exponential backoff, up to
+	// WebhookMaxAttempts attempts of at most WebhookTimeoutSeconds each.
+	// Delivered and failed deliveries are deleted WebhookRetentionDays after
+	// their last attempt; zero keeps them.
+	Webhooks              []WebhookConfig `json:"webhooks" yaml:"webhooks"`
+	WebhookMaxAttempts    int             `json:"webhook_max_attempts" yaml:"webhook_max_attempts"`
+	WebhookTimeoutSeconds int             `json:"webhook_timeout_seconds" yaml:"webhook_timeout_seconds"`
+	WebhookRetentionDays  int             `json:"webhook_retention_days" yaml:"webhook_retention_days"`
+
+	// The authors' IP addresses and user agents are stored as PIIStorage
+	// says: raw, truncated or hashed with PIIHashKey. Once PIIRetentionDays
+	// have passed, a background job clears them, or hashes them when
+	// PIIRetentionAction is "hash". A zero retention keeps them forever.
+	PIIStorage         string `json:"pii_storage" yaml:"pii_storage"`
+	PIIHashKey         string `json:"pii_hash_key" yaml:"pii_hash_key"`
+	PIIRetentionDays   int    `json:"pii_retention_days" yaml:"pii_retention_days"`
+	PIIRetentionAction string `json:"pii_retention_action" yaml:"pii_retention_action"`
+
+	// EncryptionKeys, base64 AES keys by id, turn on the encryption at rest of
+	// the authors' IP addresses and user agents, and of the content of drafts
+	// when EncryptDrafts is set. New comments are encrypted under
+	// EncryptionKeyID; older ones stay readable as long as their key is
+	// listed. KeyProvider, when set, replaces these keys, e.g. with a KMS.
+	EncryptionKeys  map[string]string `json:"encryption_keys" yaml:"encryption_keys"`
+	EncryptionKeyID string            `json:"encryption_key_id" yaml:"encryption_key_id"`
+	EncryptDrafts   bool              `json:"encrypt_drafts" yaml:"encrypt_drafts"`
+	KeyProvider     KeyProvider       `json:"-" yaml:"-"`
+
+	// Events, when set, receives the comment events published by the hooks.
+	Events *EventBus `json:"-" yaml:"-"`
 }
 
 func DefaultConfig() Config {
 	return Config{
-		AllowedTypes:       []string{"post"},
-		MaxContentLength:   10000,
-		PaginationLimit:    20,
-		MaxPaginationLimit: 100,
-		EnableNesting:      true,
-		MaxNestingDepth:    10,
-		DefaultStatus:      StatusAwaiting,
-		AllowAnonymous:     true,
+		AllowedTypes:          []string{"post"},
+		MaxContentLength:      10000,
+		PaginationLimit:       20,
+		MaxPaginationLimit:    100,
+		EnableNesting:         true,
+		MaxNestingDepth:       10,
+		DefaultStatus:         StatusAwaiting,
+		AllowAnonymous:        true,
+		MaxBulkModerationSize: 100,
+		MaxMentionsPerComment: 10,
+
+		ClassifierHoldScore:   0.5,
+		ClassifierRejectScore: 0.9,
+
+		RateLimitWindowSeconds: 60,
+		RateLimitBackend:       RateLimitBackendMemory,
+
+		WebhookMaxAttempts:    8,
+		WebhookTimeoutSeconds: 10,
+		WebhookRetentionDays:  30,
+
+		PIIStorage:         PIIStorageRaw,
+		PIIRetentionAction: PIIRetentionNull,
 	}
 }
 
@@ -61,6 +147,107 @@ func (c *Config) Validate() error {
 		return errors.New("max_nesting_depth must be between 1 and 100")
 	}
 
+	if c.MaxBulkModerationSize < 1 || c.MaxBulkModerationSize > 1000 {
+		return errors.New("max_bulk_moderation_size must be between 1 and 1000")
+	}
+
+	if c.MaxMentionsPerComment < 1 || c.MaxMentionsPerComment > 100 {
+		return errors.New("max_mentions_per_comment must be between 1 and 100")
+	}
+
+	if c.MentionUsernameColumn != "" {
+		if err := query.ValidateColumnReference(c.MentionUsernameColumn); err != nil {
+			return fmt.Errorf("invalid mention_username_column: %w", err)
+		}
+	}
+
+	if c.MaxLinks < 0 {
+		return errors.New("max_links cannot be negative")
+	}
+
+	if c.DuplicateWindowSeconds < 0 {
+		return errors.New("duplicate_window_seconds cannot be negative")
+	}
+
+	if c.ClassifierHoldScore < 0 || c.ClassifierHoldScore > 1 || c.ClassifierRejectScore < 0 || c.ClassifierRejectScore > 1 {
+		return errors.New("classifier_hold_score and classifier_reject_score must be between 0 and 1")
+	}
+
+	if c.RateLimitWindowSeconds < 0 || c.RateLimitPerUser < 0 || c.RateLimitPerIP < 0 || c.RateLimitPerThread < 0 {
+		return errors.New("rate limits and rate_limit_window_seconds cannot be negative")
+	}
+
+	if c.RateLimitBackend != RateLimitBackendMemory && c.RateLimitBackend != RateLimitBackendDatabase {
+		return fmt.Errorf("invalid rate_limit_backend: %s (allowed: %s, %s)", c.RateLimitBackend, RateLimitBackendMemory, RateLimitBackendDatabase)
+	}
+
+	if c.WebhookMaxAttempts < 1 || c.WebhookMaxAttempts > 20 {
+		return errors.New("webhook_max_attempts must be between 1 and 20")
+	}
+
+	if c.WebhookTimeoutSeconds < 1 || c.WebhookTimeoutSeconds > 60 {
+		return errors.New("webhook_timeout_seconds must be between 1 and 60")
+	}
+
+	if c.WebhookRetentionDays < 0 {
+		return errors.New("webhook_retention_days cannot be negative")
+	}
+
+	webhookURLs := make(map[string]bool, len(c.Webhooks))
+	for _, webhook := range c.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid webhook url: %s", webhook.URL)
+		}
+		if webhookURLs[webhook.URL] {
+			return fmt.Errorf("duplicate webhook url: %s", webhook.URL)
+		}
+		webhookURLs[webhook.URL] = true
+		if webhook.Secret == "" {
+			return fmt.Errorf("webhook %s has no secret", webhook.URL)
+		}
+		for _, event := range webhook.Events {
+			if !slices.Contains(ValidWebhookEvents, event) {
+				return fmt.Errorf("invalid webhook event for %s: %s (allowed: %v)", webhook.URL, event, ValidWebhookEvents)
+			}
+		}
+	}
+
+	if !slices.Contains(ValidPIIStorageModes, c.PIIStorage) {
+		return fmt.Errorf("invalid pii_storage: %s (allowed: %v)", c.PIIStorage, ValidPIIStorageModes)
+	}
+
+	if !slices.Contains(ValidPIIRetentionActions, c.PIIRetentionAction) {
+		return fmt.Errorf("invalid pii_retention_action: %s (allowed: %v)", c.PIIRetentionAction, ValidPIIRetentionActions)
+	}
+
+	if c.PIIRetentionDays < 0 {
+		return errors.New("pii_retention_days cannot be negative")
+	}
+
+	if c.PIIHashKey == "" && (c.PIIStorage == PIIStorageHashed || (c.PIIRetentionAction == PIIRetentionHash && c.PIIRetentionDays > 0)) {
+		return errors.New("pii_hash_key is required to hash IP addresses and user agents")
+	}
+
+	if len(c.EncryptionKeys) > 0 {
+		if _, err := staticKeyProvider(c.EncryptionKeys, c.EncryptionKeyID); err != nil {
+			return fmt.Errorf("invalid encryption_keys: %w", err)
+		}
+	}
+
+	if c.EncryptDrafts && len(c.EncryptionKeys) == 0 && c.KeyProvider == nil {
+		return errors.New("encryption_keys are required to encrypt drafts")
+	}
+
+	for commentableType, format := range c.ContentFormats {
+		if !c.IsAllowedType(commentableType) {
+			return fmt.Errorf("content_formats refers to a type not in allowed_types: %s", commentableType)
+		}
+		if format != FormatPlain && format != FormatMarkdown {
+			return fmt.Errorf("invalid content format for %s: %s (allowed: %v)", commentableType, format, ValidFormats)
+		}
+	}
+
 	// Validate default status
 	if c.DefaultStatus == "" {
 		return errors.New("default_status cannot be empty")
@@ -88,3 +275,11 @@ func (c *Config) IsAllowedType(commentableType string) bool {
 	}
 	return false
 }
+
+// ContentFormat returns the format comments on commentableType are written in.
+func (c *Config) ContentFormat(commentableType string) string {
+	if format, ok := c.ContentFormats[commentableType]; ok {
+		return format
+	}
+	return FormatPlain
+}
@@ -1,6 +1,7 @@
 package commentable
 
 import (
+	"encoding/base64"
 	"testing"
 )
 
@@ -89,3 +90,186 @@ func stringContains(s, substr string) bool {
 	}
 	return false
 }
+
+func TestConfig_ValidateWebhooks(t *testing.T) {
+	tests := []struct {
+		name        string
+		webhooks    []WebhookConfig
+		errContains string
+	}{
+		{
+			name:     "valid",
+			webhooks: []WebhookConfig{{URL: "https://example.com/hook", Secret: "s", Events: []string{WebhookCommentCreated}}},
+		},
+		{
+			name:        "invalid url",
+			webhooks:    []WebhookConfig{{URL: "ftp://example.com", Secret: "s"}},
+			errContains: "invalid webhook url",
+		},
+		{
+			name:        "missing secret",
+			webhooks:    []WebhookConfig{{URL: "https://example.com/hook"}},
+			errContains: "has no secret",
+		},
+		{
+			name:        "invalid event",
+			webhooks:    []WebhookConfig{{URL: "https://example.com/hook", Secret: "s", Events: []string{"comment.liked"}}},
+			errContains: "invalid webhook event",
+		},
+		{
+			name: "duplicate url",
+			webhooks: []WebhookConfig{
+				{URL: "https://example.com/hook", Secret: "s"},
+				{URL: "https://example.com/hook", Secret: "t"},
+			},
+			errContains: "duplicate webhook url",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			c.Webhooks = tt.webhooks
+
+			err := c.Validate()
+			if (err != nil) != (tt.errContains != "") {
+				t.Fatalf("Config.Validate() error = %v, want error containing %q", err, tt.errContains)
+			}
+			if err != nil && !contains(err.Error(), tt.errContains) {
+				t.Errorf("Config.Validate() error = %v, should contain %v", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidatePII(t *testing.T) {
+	tests := []struct {
+		name        string
+		configure   func(c *Config)
+		errContains string
+	}{
+		{
+			name:      "truncated storage",
+			configure: func(c *Config) { c.PIIStorage = PIIStorageTruncated },
+		},
+		{
+			name:        "invalid storage",
+			configure:   func(c *Config) { c.PIIStorage = "encrypted" },
+			errContains: "invalid pii_storage",
+		},
+		{
+			name:        "hashed storage without key",
+			configure:   func(c *Config) { c.PIIStorage = PIIStorageHashed },
+			errContains: "pii_hash_key is required",
+		},
+		{
+			name: "hash retention without key",
+			configure: func(c *Config) {
+				c.PIIRetentionDays = 30
+				c.PIIRetentionAction = PIIRetentionHash
+			},
+			errContains: "pii_hash_key is required",
+		},
+		{
+			name:        "negative retention",
+			configure:   func(c *Config) { c.PIIRetentionDays = -1 },
+			errContains: "pii_retention_days cannot be negative",
+		},
+		{
+			name:        "invalid retention action",
+			configure:   func(c *Config) { c.PIIRetentionAction = "drop" },
+			errContains: "invalid pii_retention_action",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.configure(&c)
+
+			err := c.Validate()
+			if (err != nil) != (tt.errContains != "") {
+				t.Fatalf("Config.Validate() error = %v, want error containing %q", err, tt.errContains)
+			}
+			if err != nil && !contains(err.Error(), tt.errContains) {
+				t.Errorf("Config.Validate() error = %v, should contain %v", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestConfig_ValidateEncryption(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, 32))
+	tests := []struct {
+		name        string
+		configure   func(c *Config)
+		errContains string
+	}{
+		{
+			name: "static keys",
+			configure: func(c *Config) {
+				c.EncryptionKeys = map[string]string{"k1": key, "k2": key}
+				c.EncryptionKeyID = "k2"
+				c.EncryptDrafts = true
+			},
+		},
+		{
+			name: "unknown active key",
+			configure: func(c *Config) {
+				c.EncryptionKeys = map[string]string{"k1": key}
+				c.EncryptionKeyID = "k2"
+			},
+			errContains: "unknown active encryption key",
+		},
+		{
+			name: "invalid key",
+			configure: func(c *Config) {
+				c.EncryptionKeys = map[string]string{"k1": "c2hvcnQ="}
+				c.EncryptionKeyID = "k1"
+			},
+			errContains: "invalid encryption key k1",
+		},
+		{
+			name:        "drafts without keys",
+			configure:   func(c *Config) { c.EncryptDrafts = true },
+			errContains: "encryption_keys are required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := DefaultConfig()
+			tt.configure(&c)
+
+			err := c.Validate()
+			if (err != nil) != (tt.errContains != "") {
+				t.Fatalf("Config.Validate() error = %v, want error containing %q", err, tt.errContains)
+			}
+			if err != nil && !contains(err.Error(), tt.errContains) {
+				t.Errorf("Config.Validate() error = %v, should contain %v", err, tt.errContains)
+			}
+		})
+	}
+}
+
+func TestDefaultConfig_ContentChecksDisabled(t *testing.T) {
+	config := DefaultConfig()
+	if config.MaxLinks != 0 || config.DuplicateWindowSeconds != 0 {
+		t.Errorf("expected the link and duplicate checks to be off by default, got max_links=%d duplicate_window_seconds=%d",
+			config.MaxLinks, config.DuplicateWindowSeconds)
+	}
+	if checkers := buildContentCheckers(nil, &config); len(checkers) != 0 {
+		t.Errorf("expected no built-in checker by default, got %d", len(checkers))
+	}
+}
+
+func TestDefaultConfig_RateLimitsDisabled(t *testing.T) {
+	config := DefaultConfig()
+	if config.RateLimitPerUser != 0 || config.RateLimitPerIP != 0 || config.RateLimitPerThread != 0 {
+		t.Errorf("expected the rate limits to be off by default, got user=%d ip=%d thread=%d",
+			config.RateLimitPerUser, config.RateLimitPerIP, config.RateLimitPerThread)
+	}
+	if limiter := newRateLimiter(nil, &config); limiter != nil {
+		t.Errorf("expected no rate limiter by default")
+	}
+}
@@ -23,18 +23,68 @@ func (c *CommentConverter) UpdateDTOToModel(dto CommentUpdateDTO) Comment {
 }
 
 func (c *CommentConverter) ModelToResponseDTO(model Comment) CommentResponseDTO {
+	// Tombstones keep their place in the thread so replies stay attached,
+	// but nothing identifying the author or what they wrote.
+	if model.DeletedAt != nil {
+		return CommentResponseDTO{
+			ID:            model.Id,
+			CommentableID: model.CommentableId,
+			Commentable:   model.Commentable,
+			ParentID:      model.ParentId,
+			Depth:         model.Depth,
+			RootID:        model.RootId,
+			Content:       DeletedContentPlaceholder,
+			ContentFormat: FormatPlain,
+			ContentHTML:   renderPlain(DeletedContentPlaceholder),
+			Status:        model.Status,
+			Score:         model.Score,
+			Upvotes:       model.Upvotes,
+			Downvotes:     model.Downvotes,
+			EditCount:     model.EditCount,
+			EditedAt:      model.EditedAt,
+			Deleted:       true,
+			DeletedAt:     model.DeletedAt,
+			CreatedAt:     model.CreatedAt,
+		}
+	}
+
+	// Comments stored before content_html existed are rendered on the fly.
+	var contentHTML string
+	if model.ContentHtml != nil {
+		contentHTML = *model.ContentHtml
+	} else {
+		contentHTML = renderContent(model.ContentFormat, model.Content)
+	}
+
 	return CommentResponseDTO{
-		ID:            model.Id,
-		UserID:        model.UserId,
-		CommentableID: model.CommentableId,
-		Commentable:   model.Commentable,
-		ParentID:      model.ParentId,
-		Content:       model.Content,
-		Status:        model.Status,
-		IPAddress:     model.IpAddress,
-		UserAgent:     model.UserAgent,
-		UpdatedAt:     model.UpdatedAt,
-		CreatedAt:     model.CreatedAt,
+		ID:               model.Id,
+		UserID:           model.UserId,
+		CommentableID:    model.CommentableId,
+		Commentable:      model.Commentable,
+		ParentID:         model.ParentId,
+		Depth:            model.Depth,
+		RootID:           model.RootId,
+		Content:          model.Content,
+		ContentFormat:    model.ContentFormat,
+		ContentHTML:      contentHTML,
+		Mentions:         decodeMentions(model),
+		Status:           model.Status,
+		IPAddress:        model.IpAddress,
+		UserAgent:        model.UserAgent,
+		PublishedAt:      model.PublishedAt,
+		ModeratedAt:      model.ModeratedAt,
+		ModeratedBy:      model.ModeratedBy,
+		ModerationReason: model.ModerationReason,
+		CheckVerdict:     model.CheckVerdict,
+		CheckScore:       model.CheckScore,
+		CheckReasons:     model.CheckReasons,
+		Score:            model.Score,
+		Upvotes:          model.Upvotes,
+		Downvotes:        model.Downvotes,
+		EditCount:        model.EditCount,
+		EditedAt:         model.EditedAt,
+		UpdatedAt:        model.UpdatedAt,
+		CreatedAt:        model.CreatedAt,
 	}
 }
 
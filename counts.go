@@ -0,0 +1,61 @@
+package commentable
+
+import (
+	"context"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// countByTarget counts the comments on each of ids of commentableType that
+// match statusConds, in a single grouped query. Tombstones of deleted comments
+// are not counted. Every id is present, with zero when it has no visible
+// comment.
+func countByTarget(
+	ctx context.Context,
+	db database.Database,
+	commentableType string,
+	ids []string,
+	statusConds []query.Condition,
+) (map[string]int, error) {
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	conds := append([]query.Condition{
+		query.Eq("commentable", commentableType),
+		query.In("commentable_id", values...),
+		query.IsNull("deleted_at"),
+	}, statusConds...)
+
+	stmt, args, err := query.New(db.Dialect()).
+		Select("commentable_id").
+		SelectExpr(query.As(query.Count(query.Col("id")), "total")).
+		From("comment").
+		Where(query.And(conds...)).
+		GroupBy("commentable_id").
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(ids))
+	for _, id := range ids {
+		counts[id] = 0
+	}
+	for rows.Next() {
+		var id string
+		var total int
+		if err := rows.Scan(&id, &total); err != nil {
+			return nil, err
+		}
+		counts[id] = total
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,75 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCommentCounts(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+
+	insertComment(t, db, nil, StatusPublished)
+	root := insertComment(t, db, nil, StatusPublished)
+	insertComment(t, db, &root, StatusPublished)
+	insertComment(t, db, nil, StatusAwaiting)
+	// A deleted comment kept as a tombstone for its reply.
+	tombstone := insertComment(t, db, nil, StatusPublished)
+	insertComment(t, db, &tombstone, StatusPublished)
+	if _, err := db.Exec(ctx, `UPDATE comment SET deleted_at = CURRENT_TIMESTAMP WHERE id = ?`, tombstone); err != nil {
+		t.Fatal(err)
+	}
+	other := insertComment(t, db, nil, StatusPublished)
+	if _, err := db.Exec(ctx, `UPDATE comment SET commentable_id = 'post-2' WHERE id = ?`, other); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := func(roles string, query string) (int, map[string]int) {
+		t.Helper()
+		resp, err := newModerationApp(t, db, &cfg, roles).Test(httptest.NewRequest("GET", "/comments/counts?"+query, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data map[string]int `json:"data"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Data
+	}
+
+	db.queries = 0
+	status, got := counts("reader", "commentable=post&commentableId=post-1&commentableId[]=post-2&commentableId=post-3")
+	if status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	if got["post-1"] != 4 || got["post-2"] != 1 || got["post-3"] != 0 || len(got) != 3 {
+		t.Errorf("unexpected counts %v", got)
+	}
+	if db.queries != 1 {
+		t.Errorf("expected a single query, got %d", db.queries)
+	}
+
+	if _, got := counts("moderator", "commentable=post&commentableId=post-1"); got["post-1"] != 5 {
+		t.Errorf("expected moderators to count awaiting comments, got %v", got)
+	}
+
+	tooMany := make([]string, MaxFilterValuesPerField+1)
+	for i := range tooMany {
+		tooMany[i] = fmt.Sprintf("commentableId=post-%d", i)
+	}
+	for _, query := range []string{
+		"commentableId=post-1",
+		"commentable=post",
+		"commentable=unknown&commentableId=post-1",
+		"commentable=post&" + strings.Join(tooMany, "&"),
+	} {
+		if status, _ := counts("reader", query); status != 400 {
+			t.Errorf("expected 400 for %.60q, got %d", query, status)
+		}
+	}
+}
@@ -14,18 +14,118 @@ type CommentCreateDTO struct {
 type CommentUpdateDTO struct {
 	Content *string `json:"content,omitempty"`
 	Status  *string `json:"status,omitempty"`
+	// Reason explains a status change made by a moderator.
+	Reason *string `json:"reason,omitempty"`
 }
 
 type CommentResponseDTO struct {
-	ID            string     `json:"id"`
-	UserID        *string    `json:"userId,omitempty"`
-	CommentableID string     `json:"commentableId"`
-	Commentable   string     `json:"commentable"`
-	ParentID      *string    `json:"parentId,omitempty"`
-	Content       string     `json:"content"`
-	Status        string     `json:"status"`
-	IPAddress     *string    `json:"ipAddress,omitempty"`
-	UserAgent     *string    `json:"userAgent,omitempty"`
-	UpdatedAt     *time.Time `json:"updatedAt,omitempty"`
-	CreatedAt     *time.Time `json:"createdAt,omitempty"`
+	ID               string           `json:"id"`
+	UserID           *string          `json:"userId,omitempty"`
+	CommentableID    string           `json:"commentableId"`
+	Commentable      string           `json:"commentable"`
+	ParentID         *string          `json:"parentId,omitempty"`
+	Depth            int              `json:"depth"`
+	RootID           *string          `json:"rootId,omitempty"`
+	Content          string           `json:"content"`
+	ContentFormat    string           `json:"contentFormat"`
+	ContentHTML      string           `json:"contentHtml"`
+	Mentions         []CommentMention `json:"mentions,omitempty"`
+	Status           string           `json:"status"`
+	IPAddress        *string          `json:"ipAddress,omitempty"`
+	UserAgent        *string          `json:"userAgent,omitempty"`
+	PublishedAt      *time.Time       `json:"publishedAt,omitempty"`
+	ModeratedAt      *time.Time       `json:"moderatedAt,omitempty"`
+	ModeratedBy      *string          `json:"moderatedBy,omitempty"`
+	ModerationReason *string          `json:"moderationReason,omitempty"`
+	CheckVerdict     *string          `json:"checkVerdict,omitempty"`
+	CheckScore       *float64         `json:"checkScore,omitempty"`
+	CheckReasons     *string          `json:"checkReasons,omitempty"`
+	Score            int              `json:"score"`
+	Upvotes          int              `json:"upvotes"`
+	Downvotes        int              `json:"downvotes"`
+	EditCount        int              `json:"editCount"`
+	EditedAt         *time.Time       `json:"editedAt,omitempty"`
+	Deleted          bool             `json:"deleted,omitempty"`
+	DeletedAt        *time.Time       `json:"deletedAt,omitempty"`
+	UpdatedAt        *time.Time       `json:"updatedAt,omitempty"`
+	CreatedAt        *time.Time       `json:"createdAt,omitempty"`
+}
+
+// CommentVoteDTO casts a vote on a comment: 1 for up, -1 for down.
+type CommentVoteDTO struct {
+	Value int `json:"value"`
+}
+
+// CommentVoteResultDTO reports a comment's counters after a vote, along with
+// the caller's vote on it (0 when withdrawn).
+type CommentVoteResultDTO struct {
+	Score     int `json:"score"`
+	Upvotes   int `json:"upvotes"`
+	Downvotes int `json:"downvotes"`
+	Vote      int `json:"vote"`
+}
+
+// CommentVersionDTO is one version of a comment's content in its edit
+// history, with the line-level changes from the previous version.
+type CommentVersionDTO struct {
+	Version   int        `json:"version"`
+	Content   string     `json:"content"`
+	AuthorID  *string    `json:"authorId,omitempty"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+	Current   bool       `json:"current"`
+	Diff      []DiffLine `json:"diff,omitempty"`
+}
+
+// BulkModerationDTO applies one moderation action to several comments.
+type BulkModerationDTO struct {
+	Action string   `json:"action"`
+	IDs    []string `json:"ids"`
+	Reason *string  `json:"reason,omitempty"`
+}
+
+// BulkModerationResultDTO reports what a bulk moderation request did to one
+// comment.
+type BulkModerationResultDTO struct {
+	ID     string `json:"id"`
+	Result string `json:"result"`
+}
+
+// CommentSubscriptionDTO follows or unfollows the comments on a target, or
+// the replies to one of its comments when CommentId is set.
+type CommentSubscriptionDTO struct {
+	Commentable   string  `json:"commentable"`
+	CommentableId string  `json:"commentableId"`
+	CommentId     *string `json:"commentId,omitempty"`
+}
+
+// CommentNotificationDTO is one entry of the notifications inbox: a comment
+// posted where the user is subscribed.
+type CommentNotificationDTO struct {
+	ID        string             `json:"id"`
+	Reason    string             `json:"reason"`
+	Read      bool               `json:"read"`
+	ReadAt    *time.Time         `json:"readAt,omitempty"`
+	CreatedAt *time.Time         `json:"createdAt,omitempty"`
+	Comment   CommentResponseDTO `json:"comment"`
+}
+
+// MarkNotificationsReadDTO marks the notifications of IDs as read, or all of
+// the user's notifications when All is set.
+type MarkNotificationsReadDTO struct {
+	IDs []string `json:"ids"`
+	All bool     `json:"all"`
+}
+
+// UserErasureDTO erases the comments of a user, see ErasureOptions.
+type UserErasureDTO struct {
+	Mode    string  `json:"mode"`
+	Content *string `json:"content,omitempty"`
+}
+
+// CommentSearchResultDTO is a comment matching a search, see
+// CommentSearchResult.
+type CommentSearchResultDTO struct {
+	CommentResponseDTO
+	Rank    float64 `json:"rank"`
+	Snippet string  `json:"snippet"`
 }
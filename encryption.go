@@ -0,0 +1,489 @@
+package commentable
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// encryptedPrefix marks the values encrypted at rest, so that rows written
+// before encryption was enabled are still read as they are.
+const encryptedPrefix = "enc:v1:"
+
+const (
+	// dataKeySize is the size of the AES-256 key each comment is encrypted
+	// with.
+	dataKeySize = 32
+	// reencryptBatchSize is the number of comments re-encrypted at a time.
+	reencryptBatchSize = 500
+)
+
+// KeyProvider holds the key encryption keys of the envelope encryption of
+// comments at rest. Each comment is encrypted with its own data key, which is
+// stored wrapped by a key of the provider along with that key's id, so that
+// rotating keys only rewraps data keys. Implement it to keep the keys in a
+// KMS; StaticKeyProvider holds them in memory.
+type KeyProvider interface {
+	// ActiveKeyID returns the id of the key new data keys are wrapped with.
+	ActiveKeyID(ctx context.Context) (string, error)
+	// WrapKey encrypts dataKey with the key keyID.
+	WrapKey(ctx context.Context, keyID string, dataKey []byte) ([]byte, error)
+	// UnwrapKey decrypts a data key wrapped with the key keyID.
+	UnwrapKey(ctx context.Context, keyID string, wrapped []byte) ([]byte, error)
+}
+
+// StaticKeyProvider wraps data keys with AES-GCM keys given by id, e.g. from
+// the configuration for local use.
+type StaticKeyProvider struct {
+	keys   map[string]cipher.AEAD
+	active string
+}
+
+// NewStaticKeyProvider returns a provider of keys, which must be 16, 24 or
+// 32 bytes long, wrapping new data keys with the key activeID.
+func NewStaticKeyProvider(keys map[string][]byte, activeID string) (*StaticKeyProvider, error) {
+	p := &StaticKeyProvider{keys: make(map[string]cipher.AEAD, len(keys)), active: activeID}
+	for id, key := range keys {
+		if id == "" || len(id) > 64 {
+			return nil, fmt.Errorf("invalid encryption key id: %q (1 to 64 characters)", id)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %s: %w", id, err)
+		}
+		p.keys[id] = aead
+	}
+	if _, ok := p.keys[activeID]; !ok {
+		return nil, fmt.Errorf("unknown active encryption key: %q", activeID)
+	}
+	return p, nil
+}
+
+func (p *StaticKeyProvider) ActiveKeyID(context.Context) (string, error) {
+	return p.active, nil
+}
+
+func (p *StaticKeyProvider) WrapKey(_ context.Context, keyID string, dataKey []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key: %s", keyID)
+	}
+	return seal(aead, dataKey, []byte(keyID))
+}
+
+func (p *StaticKeyProvider) UnwrapKey(_ context.Context, keyID string, wrapped []byte) ([]byte, error) {
+	aead, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown encryption key: %s", keyID)
+	}
+	return open(aead, wrapped, []byte(keyID))
+}
+
+// staticKeyProvider builds the provider of the base64 keys of the
+// configuration.
+func staticKeyProvider(keys map[string]string, activeID string) (*StaticKeyProvider, error) {
+	decoded := make(map[string][]byte, len(keys))
+	for id, key := range keys {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil {
+			return nil, fmt.Errorf("encryption key %s is not base64", id)
+		}
+		decoded[id] = raw
+	}
+	return NewStaticKeyProvider(decoded, activeID)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, which prefixes the result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted value is too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// commentCipher encrypts and decrypts the columns of comments encrypted at
+// rest: the IP address and user agent, and the content of drafts when drafts
+// is set. A nil commentCipher leaves comments as they are.
+type commentCipher struct {
+	keys   KeyProvider
+	drafts bool
+	// err is why the configured keys cannot be used; every operation fails
+	// with it rather than write in clear.
+	err error
+}
+
+// newCommentCipher returns the cipher of cfg, nil when it has no keys.
+func newCommentCipher(cfg *Config) *commentCipher {
+	if cfg.KeyProvider != nil {
+		return &commentCipher{keys: cfg.KeyProvider, drafts: cfg.EncryptDrafts}
+	}
+	if len(cfg.EncryptionKeys) == 0 {
+		return nil
+	}
+	keys, err := staticKeyProvider(cfg.EncryptionKeys, cfg.EncryptionKeyID)
+	if err != nil {
+		return &commentCipher{err: err}
+	}
+	return &commentCipher{keys: keys, drafts: cfg.EncryptDrafts}
+}
+
+// encryptsContent reports whether the content of a comment with status is
+// encrypted.
+func (cc *commentCipher) encryptsContent(status string) bool {
+	return cc != nil && cc.drafts && status == StatusDraft
+}
+
+// dataKey returns the data key of model, generating and wrapping one with the
+// active key when it has none.
+func (cc *commentCipher) dataKey(ctx context.Context, model *Comment) ([]byte, error) {
+	if cc.err != nil {
+		return nil, cc.err
+	}
+	if model.EncryptionKeyId != nil && model.EncryptedDataKey != nil {
+		wrapped, err := base64.StdEncoding.DecodeString(*model.EncryptedDataKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data key of comment %s: %w", model.Id, err)
+		}
+		return cc.keys.UnwrapKey(ctx, *model.EncryptionKeyId, wrapped)
+	}
+
+	keyID, err := cc.keys.ActiveKeyID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dataKey := make([]byte, dataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	wrapped, err := cc.keys.WrapKey(ctx, keyID, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(wrapped)
+	model.EncryptionKeyId = &keyID
+	model.EncryptedDataKey = &encoded
+	return dataKey, nil
+}
+
+// seal encrypts the columns of model stored encrypted, giving it a data key
+// when it has none.
+func (cc *commentCipher) seal(ctx context.Context, model *Comment) error {
+	if cc == nil {
+		return nil
+	}
+	dataKey, err := cc.dataKey(ctx, model)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+
+	// A copy of model, such as the one the hooks keep in clear, shares the
+	// values behind its pointers: sealed values get pointers of their own.
+	fields := map[string]**string{"ip_address": &model.IpAddress, "user_agent": &model.UserAgent}
+	if cc.encryptsContent(model.Status) {
+		fields["content_html"] = &model.ContentHtml
+		if model.Content != "" && !strings.HasPrefix(model.Content, encryptedPrefix) {
+			if model.Content, err = sealValue(aead, model.Content, model.Id, "content"); err != nil {
+				return err
+			}
+		}
+	}
+	for column, field := range fields {
+		value := *field
+		if value == nil || *value == "" || strings.HasPrefix(*value, encryptedPrefix) {
+			continue
+		}
+		sealed, err := sealValue(aead, *value, model.Id, column)
+		if err != nil {
+			return err
+		}
+		*field = &sealed
+	}
+	return nil
+}
+
+// open decrypts the encrypted columns of model.
+func (cc *commentCipher) open(ctx context.Context, model *Comment) error {
+	fields := []struct {
+		column string
+		value  *string
+	}{
+		{"ip_address", model.IpAddress},
+		{"user_agent", model.UserAgent},
+		{"content", &model.Content},
+		{"content_html", model.ContentHtml},
+	}
+	var aead cipher.AEAD
+	for _, field := range fields {
+		if field.value == nil || !strings.HasPrefix(*field.value, encryptedPrefix) {
+			continue
+		}
+		if aead == nil {
+			if cc == nil {
+				return fmt.Errorf("comment %s is encrypted but no encryption keys are configured", model.Id)
+			}
+			dataKey, err := cc.dataKey(ctx, model)
+			if err != nil {
+				return err
+			}
+			if aead, err = newAEAD(dataKey); err != nil {
+				return err
+			}
+		}
+		plaintext, err := openValue(aead, *field.value, model.Id, field.column)
+		if err != nil {
+			return err
+		}
+		*field.value = plaintext
+	}
+	return nil
+}
+
+// rewrap wraps the data key of model with the active key, leaving the values
+// it encrypts as they are.
+func (cc *commentCipher) rewrap(ctx context.Context, model *Comment) error {
+	dataKey, err := cc.dataKey(ctx, model)
+	if err != nil {
+		return err
+	}
+	keyID, err := cc.keys.ActiveKeyID(ctx)
+	if err != nil {
+		return err
+	}
+	wrapped, err := cc.keys.WrapKey(ctx, keyID, dataKey)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(wrapped)
+	model.EncryptionKeyId = &keyID
+	model.EncryptedDataKey = &encoded
+	return nil
+}
+
+// provider returns the keys comments are decrypted with, nil when there are
+// none.
+func (cc *commentCipher) provider() KeyProvider {
+	if cc == nil {
+		return nil
+	}
+	return cc.keys
+}
+
+// decrypter returns the cipher decrypting comments with keys, nil when there
+// are none.
+func decrypter(keys KeyProvider) *commentCipher {
+	if keys == nil {
+		return nil
+	}
+	return &commentCipher{keys: keys}
+}
+
+// sealRevision encrypts the content of a revision of comment, which is
+// encrypted like the comment's own content.
+func (cc *commentCipher) sealRevision(ctx context.Context, comment *Comment, revision *CommentRevision) error {
+	if !cc.encryptsContent(comment.Status) || comment.EncryptionKeyId == nil || revision.Content == "" {
+		return nil
+	}
+	dataKey, err := cc.dataKey(ctx, comment)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return err
+	}
+	revision.Content, err = sealValue(aead, revision.Content, comment.Id, "revision")
+	return err
+}
+
+// openRevisions decrypts the content of the revisions of comment.
+func (cc *commentCipher) openRevisions(ctx context.Context, comment *Comment, revisions []CommentRevision) error {
+	var aead cipher.AEAD
+	for i := range revisions {
+		if !strings.HasPrefix(revisions[i].Content, encryptedPrefix) {
+			continue
+		}
+		if aead == nil {
+			if cc == nil {
+				return fmt.Errorf("comment %s is encrypted but no encryption keys are configured", comment.Id)
+			}
+			dataKey, err := cc.dataKey(ctx, comment)
+			if err != nil {
+				return err
+			}
+			if aead, err = newAEAD(dataKey); err != nil {
+				return err
+			}
+		}
+		content, err := openValue(aead, revisions[i].Content, comment.Id, "revision")
+		if err != nil {
+			return err
+		}
+		revisions[i].Content = content
+	}
+	return nil
+}
+
+// sealValue encrypts the value of column of the comment id, binding it to
+// both so that it cannot be moved to another.
+func sealValue(aead cipher.AEAD, value, id, column string) (string, error) {
+	sealed, err := seal(aead, []byte(value), []byte(id+"."+column))
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func openValue(aead cipher.AEAD, value, id, column string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted %s of comment %s: %w", column, id, err)
+	}
+	plaintext, err := open(aead, sealed, []byte(id+"."+column))
+	if err != nil {
+		return "", fmt.Errorf("decrypt %s of comment %s: %w", column, id, err)
+	}
+	return string(plaintext), nil
+}
+
+// ReencryptComments brings every comment holding PII under the active key of
+// cfg, and returns how many it changed: the data keys wrapped with another key are
+// rewrapped, without decrypting the values they encrypt, and the values
+// stored in clear, e.g. before encryption was enabled, are encrypted. Run it
+// after rotating keys, before retiring the previous ones.
+func ReencryptComments(ctx context.Context, db database.Database, cfg *Config) (int, error) {
+	cc := newCommentCipher(cfg)
+	if cc == nil {
+		return 0, errors.New("no encryption keys are configured")
+	}
+	if cc.err != nil {
+		return 0, cc.err
+	}
+	activeID, err := cc.keys.ActiveKeyID(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	// Comments without PII have nothing to encrypt, and keep no data key.
+	stale := []query.Condition{
+		query.Ne("encryption_key_id", activeID),
+		query.NotLike("ip_address", encryptedPrefix+"%"),
+		query.NotLike("user_agent", encryptedPrefix+"%"),
+	}
+	if cc.drafts {
+		// Drafts written before their content was encrypted.
+		stale = append(stale, query.And(
+			query.Eq("status", StatusDraft),
+			query.Ne("content", ""),
+			query.NotLike("content", encryptedPrefix+"%"),
+		))
+	}
+
+	total := 0
+	after := ""
+	for {
+		stmt, args, err := query.New(db.Dialect()).
+			Select("id", "status", "content", "content_html", "ip_address", "user_agent", "encryption_key_id", "encrypted_data_key").
+			From("comment").
+			Where(query.And(query.Gt("id", after), query.Or(stale...))).
+			OrderBy("id", query.ASC).
+			Limit(reencryptBatchSize).
+			Build()
+		if err != nil {
+			return total, err
+		}
+		rows, err := db.Query(ctx, stmt, args...)
+		if err != nil {
+			return total, err
+		}
+		var batch []Comment
+		for rows.Next() {
+			var row Comment
+			if err := rows.Scan(&row.Id, &row.Status, &row.Content, &row.ContentHtml, &row.IpAddress, &row.UserAgent, &row.EncryptionKeyId, &row.EncryptedDataKey); err != nil {
+				rows.Close()
+				return total, err
+			}
+			batch = append(batch, row)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil || len(batch) == 0 {
+			return total, err
+		}
+
+		if err := reencryptBatch(ctx, db, cc, activeID, batch); err != nil {
+			return total, err
+		}
+		total += len(batch)
+		if len(batch) < reencryptBatchSize {
+			return total, nil
+		}
+		after = batch[len(batch)-1].Id
+	}
+}
+
+func reencryptBatch(ctx context.Context, db database.Database, cc *commentCipher, activeID string, batch []Comment) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	for _, row := range batch {
+		err := func() error {
+			if row.EncryptionKeyId != nil && *row.EncryptionKeyId != activeID {
+				if err := cc.rewrap(ctx, &row); err != nil {
+					return err
+				}
+			}
+			if err := cc.seal(ctx, &row); err != nil {
+				return err
+			}
+			stmt, args, err := query.New(db.Dialect()).Update("comment").
+				Set("content", row.Content).
+				Set("content_html", row.ContentHtml).
+				Set("ip_address", row.IpAddress).
+				Set("user_agent", row.UserAgent).
+				Set("encryption_key_id", row.EncryptionKeyId).
+				Set("encrypted_data_key", row.EncryptedDataKey).
+				Where(query.Eq("id", row.Id)).
+				Build()
+			if err != nil {
+				return err
+			}
+			_, err = tx.Exec(ctx, stmt, args...)
+			return err
+		}()
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,192 @@
+package commentable
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// encryptionConfig encrypts comments under the last of keyIDs.
+func encryptionConfig(keyIDs ...string) Config {
+	cfg := DefaultConfig()
+	cfg.EncryptionKeys = map[string]string{}
+	for i, id := range keyIDs {
+		key := make([]byte, 32)
+		key[0] = byte(i + 1)
+		cfg.EncryptionKeys[id] = base64.StdEncoding.EncodeToString(key)
+		cfg.EncryptionKeyID = id
+	}
+	return cfg
+}
+
+// storedComment reads the columns of a comment encrypted at rest as stored.
+func storedComment(t *testing.T, db database.Database, id string) Comment {
+	t.Helper()
+	comment := Comment{Id: id}
+	err := db.QueryRow(context.Background(),
+		`SELECT status, content, ip_address, user_agent, encryption_key_id, encrypted_data_key FROM comment WHERE id = ?`, id,
+	).Scan(&comment.Status, &comment.Content, &comment.IpAddress, &comment.UserAgent, &comment.EncryptionKeyId, &comment.EncryptedDataKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return comment
+}
+
+func TestCommentCipher(t *testing.T) {
+	ctx := context.Background()
+	cfg := encryptionConfig("k1")
+	cc := newCommentCipher(&cfg)
+
+	ip, ua := "203.0.113.7", "Mozilla/5.0"
+	comment := Comment{Id: "c-1", Status: StatusPublished, Content: "hello", IpAddress: &ip, UserAgent: &ua}
+	if err := cc.seal(ctx, &comment); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(*comment.IpAddress, encryptedPrefix) || !strings.HasPrefix(*comment.UserAgent, encryptedPrefix) {
+		t.Fatalf("expected the IP address and user agent to be encrypted, got %q %q", *comment.IpAddress, *comment.UserAgent)
+	}
+	if comment.Content != "hello" || comment.EncryptionKeyId == nil || *comment.EncryptionKeyId != "k1" {
+		t.Fatalf("expected the content in clear and the key id, got %+v", comment)
+	}
+	if ip != "203.0.113.7" || ua != "Mozilla/5.0" {
+		t.Fatalf("expected the values sealed to be left in clear, got %q %q", ip, ua)
+	}
+
+	moved := comment
+	moved.Id = "c-2"
+	if err := cc.open(ctx, &moved); err == nil {
+		t.Error("expected values moved to another comment not to decrypt")
+	}
+	if err := (*commentCipher)(nil).open(ctx, &Comment{Id: "c-1", IpAddress: comment.IpAddress}); err == nil {
+		t.Error("expected encrypted values not to be read without keys")
+	}
+	if err := cc.open(ctx, &comment); err != nil {
+		t.Fatal(err)
+	}
+	if *comment.IpAddress != ip || *comment.UserAgent != ua {
+		t.Errorf("expected the values back, got %q %q", *comment.IpAddress, *comment.UserAgent)
+	}
+}
+
+func TestCreateEncryptsPII(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := encryptionConfig("k1")
+	cfg.EncryptDrafts = true
+	cfg.DefaultStatus = StatusDraft
+
+	request := func(method, path, body string, roles ...string) *httpResult {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := newModerationApp(t, db, &cfg, roles...).Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+
+	res := request("POST", "/comments", `{"commentable":"post","commentableId":"post-1","content":"secret plans"}`, "reader")
+	if res.status != 201 || res.body["content"] != "secret plans" {
+		t.Fatalf("expected the draft in clear, got %d %v", res.status, res.body)
+	}
+	id := res.body["id"].(string)
+
+	stored := storedComment(t, db, id)
+	for column, value := range map[string]*string{"content": &stored.Content, "ip_address": stored.IpAddress, "user_agent": stored.UserAgent} {
+		if value == nil || !strings.HasPrefix(*value, encryptedPrefix) {
+			t.Errorf("expected %s to be encrypted at rest, got %v", column, value)
+		}
+	}
+
+	if res := request("GET", "/comments/"+id, "", "moderator"); res.body["ipAddress"] != "0.0.0.0" || res.body["userAgent"] != "Mozilla/5.0" {
+		t.Errorf("expected moderators to read the PII in clear, got %v", res.body)
+	}
+	if res := request("GET", "/comments/"+id, "", "reader"); res.body["content"] != "secret plans" || res.body["ipAddress"] != nil {
+		t.Errorf("expected readers to read the content only, got %v", res.body)
+	}
+
+	// The revision of a draft is encrypted like its content.
+	if res := request("PUT", "/comments/"+id, `{"content":"new plans"}`, "reader"); res.status != 200 || res.body["content"] != "new plans" {
+		t.Fatalf("expected the edit, got %d %v", res.status, res.body)
+	}
+	var revision string
+	if err := db.QueryRow(context.Background(), `SELECT content FROM comment_revision WHERE comment_id = ?`, id).Scan(&revision); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(revision, encryptedPrefix) {
+		t.Errorf("expected the revision to be encrypted at rest, got %q", revision)
+	}
+	res = request("GET", "/comments/"+id+"/revisions", "", "moderator")
+	if versions, _ := res.body["data"].([]any); len(versions) != 2 || versions[0].(map[string]any)["content"] != "secret plans" {
+		t.Errorf("expected the revisions in clear, got %v", res.body)
+	}
+
+	// Published comments are stored in clear.
+	if res := request("PUT", "/comments/"+id, `{"status":"published"}`, "admin"); res.status != 200 {
+		t.Fatalf("expected the draft to be published, got %d %v", res.status, res.body)
+	}
+	if stored := storedComment(t, db, id); stored.Content != "new plans" {
+		t.Errorf("expected the published content in clear, got %q", stored.Content)
+	}
+}
+
+func TestReencryptComments(t *testing.T) {
+	ctx := context.Background()
+	db := setupThreadDB(t)
+	id := insertComment(t, db, nil, StatusPublished)
+	stmt, args, _ := query.New(db.Dialect()).Update("comment").
+		Set("ip_address", "203.0.113.7").
+		Set("user_agent", "Mozilla/5.0").
+		Where(query.Eq("id", id)).
+		Build()
+	if _, err := db.Exec(ctx, stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	bare := insertComment(t, db, nil, StatusPublished)
+
+	// Comments stored before encryption was enabled are encrypted, those
+	// without PII left alone.
+	cfg := encryptionConfig("k1")
+	if n, err := ReencryptComments(ctx, db, &cfg); err != nil || n != 1 {
+		t.Fatalf("expected 1 comment to be encrypted, got %d (%v)", n, err)
+	}
+	if stored := storedComment(t, db, bare); stored.EncryptionKeyId != nil || stored.EncryptedDataKey != nil {
+		t.Errorf("expected the comment without PII to get no data key, got %+v", stored)
+	}
+	before := storedComment(t, db, id)
+	if !strings.HasPrefix(*before.IpAddress, encryptedPrefix) || *before.EncryptionKeyId != "k1" {
+		t.Fatalf("expected the comment to be encrypted under k1, got %+v", before)
+	}
+	if n, err := ReencryptComments(ctx, db, &cfg); err != nil || n != 0 {
+		t.Fatalf("expected nothing left to encrypt, got %d (%v)", n, err)
+	}
+
+	// Rotating rewraps the data key under the new key only.
+	cfg = encryptionConfig("k1", "k2")
+	if n, err := ReencryptComments(ctx, db, &cfg); err != nil || n != 1 {
+		t.Fatalf("expected 1 comment to be re-encrypted, got %d (%v)", n, err)
+	}
+	after := storedComment(t, db, id)
+	if *after.EncryptionKeyId != "k2" || *after.IpAddress != *before.IpAddress {
+		t.Fatalf("expected the data key to be rewrapped under k2, got %+v", after)
+	}
+
+	// k1 can then be retired.
+	delete(cfg.EncryptionKeys, "k1")
+	if err := newCommentCipher(&cfg).open(ctx, &after); err != nil {
+		t.Fatal(err)
+	}
+	if *after.IpAddress != "203.0.113.7" || *after.UserAgent != "Mozilla/5.0" {
+		t.Errorf("expected the PII back with k2 alone, got %q %q", *after.IpAddress, *after.UserAgent)
+	}
+}
@@ -0,0 +1,233 @@
+package commentable
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	auth "github.com/nicolasbonnici/gorest/auth"
+	"github.com/nicolasbonnici/gorest/logger"
+)
+
+// SubscriberMode selects how an EventBus subscriber is run.
+type SubscriberMode int
+
+const (
+	// Sync subscribers run in the request that caused the event, one after
+	// the other in subscription order, before the response is sent.
+	Sync SubscriberMode = iota
+	// Async subscribers run in a goroutine of their own, with a context
+	// that is not canceled when the request ends.
+	Async
+)
+
+// CommentCreatedEvent is published once a new comment is stored.
+type CommentCreatedEvent struct {
+	Comment Comment
+	ActorID *string
+}
+
+// CommentUpdatedEvent is published once the content of a comment changed.
+type CommentUpdatedEvent struct {
+	Comment         Comment
+	PreviousContent string
+	ActorID         *string
+}
+
+// CommentStatusChangedEvent is published once a comment moved from one
+// status to another, through an update or bulk moderation.
+type CommentStatusChangedEvent struct {
+	Comment Comment
+	From    string
+	To      string
+	ActorID *string
+}
+
+// CommentDeletedEvent is published once a comment was deleted. Comment is its
+// state right before the deletion.
+type CommentDeletedEvent struct {
+	Comment Comment
+	ActorID *string
+}
+
+// CommentVotedEvent is published once a vote was cast, changed or withdrawn.
+// Value and Previous are 1, -1, or 0 for no vote; the counters are the
+// comment's after the vote.
+type CommentVotedEvent struct {
+	CommentID string
+	UserID    string
+	Value     int
+	Previous  int
+	Score     int
+	Upvotes   int
+	Downvotes int
+}
+
+type subscriber[E any] struct {
+	mode    SubscriberMode
+	handler func(context.Context, E)
+}
+
+// topic holds the subscribers of one event type.
+type topic[E any] struct {
+	name string
+	mu   sync.RWMutex
+	subs []subscriber[E]
+}
+
+func (t *topic[E]) subscribe(mode SubscriberMode, handler func(context.Context, E)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.subs = append(t.subs, subscriber[E]{mode: mode, handler: handler})
+}
+
+func (t *topic[E]) active() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.subs) > 0
+}
+
+func (t *topic[E]) publish(ctx context.Context, wg *sync.WaitGroup, event E) {
+	t.mu.RLock()
+	subs := t.subs
+	t.mu.RUnlock()
+
+	for _, sub := range subs {
+		if sub.mode == Async {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				t.run(context.WithoutCancel(ctx), sub.handler, event)
+			}()
+			continue
+		}
+		t.run(ctx, sub.handler, event)
+	}
+}
+
+// run calls handler, isolating the caller and the other subscribers from its
+// panics.
+func (t *topic[E]) run(ctx context.Context, handler func(context.Context, E), event E) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Log.Error("comment event subscriber panicked", "event", t.name, "panic", fmt.Sprint(r))
+		}
+	}()
+	handler(ctx, event)
+}
+
+// EventBus lets other plugins react to comments in-process. Events are
+// published after the change that caused them is committed, so a subscriber
+// never sees a change that is rolled back afterwards, and nothing it does can
+// roll the change back. A panicking subscriber is logged and skipped.
+//
+// The bus of the plugin is returned by CommentablePlugin.Events; it can also
+// be set on Config.Events when registering the routes directly.
+type EventBus struct {
+	created       topic[CommentCreatedEvent]
+	updated       topic[CommentUpdatedEvent]
+	statusChanged topic[CommentStatusChangedEvent]
+	deleted       topic[CommentDeletedEvent]
+	voted         topic[CommentVotedEvent]
+	async         sync.WaitGroup
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		created:       topic[CommentCreatedEvent]{name: "comment.created"},
+		updated:       topic[CommentUpdatedEvent]{name: "comment.updated"},
+		statusChanged: topic[CommentStatusChangedEvent]{name: "comment.status_changed"},
+		deleted:       topic[CommentDeletedEvent]{name: "comment.deleted"},
+		voted:         topic[CommentVotedEvent]{name: "comment.voted"},
+	}
+}
+
+func (b *EventBus) OnCommentCreated(mode SubscriberMode, handler func(context.Context, CommentCreatedEvent)) {
+	b.created.subscribe(mode, handler)
+}
+
+func (b *EventBus) OnCommentUpdated(mode SubscriberMode, handler func(context.Context, CommentUpdatedEvent)) {
+	b.updated.subscribe(mode, handler)
+}
+
+func (b *EventBus) OnCommentStatusChanged(mode SubscriberMode, handler func(context.Context, CommentStatusChangedEvent)) {
+	b.statusChanged.subscribe(mode, handler)
+}
+
+func (b *EventBus) OnCommentDeleted(mode SubscriberMode, handler func(context.Context, CommentDeletedEvent)) {
+	b.deleted.subscribe(mode, handler)
+}
+
+func (b *EventBus) OnCommentVoted(mode SubscriberMode, handler func(context.Context, CommentVotedEvent)) {
+	b.voted.subscribe(mode, handler)
+}
+
+// Wait blocks until the async subscribers running so far have returned, e.g.
+// on shutdown.
+func (b *EventBus) Wait() {
+	b.async.Wait()
+}
+
+// The publish methods are no-ops on a nil bus.
+
+func (b *EventBus) publishCreated(ctx context.Context, event CommentCreatedEvent) {
+	if b != nil {
+		b.created.publish(ctx, &b.async, event)
+	}
+}
+
+func (b *EventBus) publishUpdated(ctx context.Context, event CommentUpdatedEvent) {
+	if b != nil {
+		b.updated.publish(ctx, &b.async, event)
+	}
+}
+
+func (b *EventBus) publishStatusChanged(ctx context.Context, event CommentStatusChangedEvent) {
+	if b != nil {
+		b.statusChanged.publish(ctx, &b.async, event)
+	}
+}
+
+func (b *EventBus) publishDeleted(ctx context.Context, event CommentDeletedEvent) {
+	if b != nil {
+		b.deleted.publish(ctx, &b.async, event)
+	}
+}
+
+func (b *EventBus) publishVoted(ctx context.Context, event CommentVotedEvent) {
+	if b != nil {
+		b.voted.publish(ctx, &b.async, event)
+	}
+}
+
+// observes reports whether a subscriber needs the state of comments before
+// they are updated or deleted, which is only loaded for them.
+func (b *EventBus) observes() bool {
+	return b != nil && (b.updated.active() || b.statusChanged.active() || b.deleted.active())
+}
+
+// publishUpdate tells subscribers how an update changed a comment.
+func (h *CommentHooks) publishUpdate(ctx context.Context, previous, updated Comment, actorID *string) {
+	if updated.Content != previous.Content {
+		h.events.publishUpdated(ctx, CommentUpdatedEvent{
+			Comment:         updated,
+			PreviousContent: previous.Content,
+			ActorID:         actorID,
+		})
+	}
+	if updated.Status != previous.Status {
+		h.events.publishStatusChanged(ctx, CommentStatusChangedEvent{
+			Comment: updated,
+			From:    previous.Status,
+			To:      updated.Status,
+			ActorID: actorID,
+		})
+	}
+}
+
+func userIDOf(user *auth.AuthenticatedUser) *string {
+	if user == nil {
+		return nil
+	}
+	return &user.UserID
+}
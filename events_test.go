@@ -0,0 +1,231 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `INSERT INTO users (id) VALUES ('moderator-1')`); err != nil {
+		t.Fatal(err)
+	}
+
+	// Subscribing before Initialize is how sibling plugins get hold of it.
+	p := &CommentablePlugin{}
+	bus := p.Events()
+	if err := p.Initialize(map[string]interface{}{"database": db}); err != nil {
+		t.Fatal(err)
+	}
+	cfg := p.config
+	cfg.DefaultStatus = StatusPublished
+	if cfg.Events != bus {
+		t.Fatalf("expected the plugin bus to be passed to the hooks")
+	}
+
+	var mu sync.Mutex
+	var seen []string
+	record := func(s string) {
+		mu.Lock()
+		defer mu.Unlock()
+		seen = append(seen, s)
+	}
+
+	bus.OnCommentCreated(Sync, func(context.Context, CommentCreatedEvent) {
+		panic("broken subscriber")
+	})
+	bus.OnCommentCreated(Sync, func(_ context.Context, e CommentCreatedEvent) {
+		record("created:" + e.Comment.Content + ":" + *e.ActorID)
+	})
+	bus.OnCommentUpdated(Sync, func(_ context.Context, e CommentUpdatedEvent) {
+		record("updated:" + e.PreviousContent + "->" + e.Comment.Content)
+	})
+	bus.OnCommentStatusChanged(Sync, func(_ context.Context, e CommentStatusChangedEvent) {
+		record("status:" + e.From + "->" + e.To)
+	})
+	bus.OnCommentVoted(Sync, func(_ context.Context, e CommentVotedEvent) {
+		record("voted:" + e.UserID)
+	})
+	bus.OnCommentDeleted(Async, func(ctx context.Context, e CommentDeletedEvent) {
+		if ctx.Err() != nil {
+			record("canceled")
+		}
+		record("deleted:" + e.Comment.Content)
+	})
+
+	app := newModerationApp(t, db, &cfg, "writer")
+	send := func(method, path, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rec := httptest.NewRecorder()
+		rec.Code = resp.StatusCode
+		_, _ = rec.Body.ReadFrom(resp.Body)
+		return rec
+	}
+
+	created := send("POST", "/comments", `{"commentable":"post","commentableId":"post-1","content":"first"}`)
+	if created.Code != 201 {
+		t.Fatalf("expected a panicking subscriber not to fail the request, got %d", created.Code)
+	}
+	var dto CommentResponseDTO
+	_ = json.Unmarshal(created.Body.Bytes(), &dto)
+
+	if rec := send("PUT", "/comments/"+dto.ID, `{"content":"second"}`); rec.Code != 200 {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	if rec := send("PUT", "/comments/"+dto.ID, `{"status":"draft"}`); rec.Code != 200 {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+
+	other := insertComment(t, db, nil, StatusPublished)
+	if rec := send("POST", "/comments/"+other+"/vote", `{"value":1}`); rec.Code != 200 {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	// Voting the same way again changes nothing and publishes nothing.
+	send("POST", "/comments/"+other+"/vote", `{"value":1}`)
+
+	if rec := send("DELETE", "/comments/"+dto.ID, ""); rec.Code != 204 {
+		t.Fatalf("expected 204, got %d", rec.Code)
+	}
+	bus.Wait()
+
+	want := []string{
+		"created:first:moderator-1",
+		"updated:first->second",
+		"status:published->draft",
+		"voted:moderator-1",
+		"deleted:second",
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if strings.Join(seen, "|") != strings.Join(want, "|") {
+		t.Errorf("expected events %v, got %v", want, seen)
+	}
+}
+
+func TestEventBusBulkModeration(t *testing.T) {
+	db := setupThreadDB(t)
+	bus := NewEventBus()
+	cfg := DefaultConfig()
+	cfg.Events = bus
+
+	var changes []CommentStatusChangedEvent
+	bus.OnCommentStatusChanged(Sync, func(_ context.Context, e CommentStatusChangedEvent) {
+		changes = append(changes, e)
+	})
+
+	awaiting := insertComment(t, db, nil, StatusAwaiting)
+	published := insertComment(t, db, nil, StatusPublished)
+
+	body, _ := json.Marshal(BulkModerationDTO{Action: ModerationApprove, IDs: []string{awaiting, published}})
+	req := httptest.NewRequest("POST", "/comments/moderation/bulk", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	if _, err := newModerationApp(t, db, &cfg, "moderator").Test(req); err != nil {
+		t.Fatal(err)
+	}
+
+	// Approving the already published comment changes nothing.
+	if len(changes) != 1 || changes[0].Comment.Id != awaiting || changes[0].From != StatusAwaiting || changes[0].To != StatusPublished {
+		t.Errorf("expected a single awaiting->published change, got %+v", changes)
+	}
+	if changes[0].Comment.PublishedAt == nil || changes[0].ActorID == nil || *changes[0].ActorID != "moderator-1" {
+		t.Errorf("expected the event to carry the moderated comment and its moderator, got %+v", changes[0])
+	}
+}
+
+func TestEventBus_UpdateDoesNotReloadComment(t *testing.T) {
+	db := setupThreadDB(t)
+
+	update := func(cfg *Config) int {
+		t.Helper()
+		id := insertComment(t, db, nil, StatusPublished)
+		app := newModerationApp(t, db, cfg, "moderator")
+		req := httptest.NewRequest("PUT", "/comments/"+id, strings.NewReader(`{"content":"edited"}`))
+		req.Header.Set("Content-Type", "application/json")
+		db.queries = 0
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+		return db.queries
+	}
+
+	cfg := DefaultConfig()
+	unobserved := update(&cfg)
+
+	// Subscribers get the comment as the update hook loaded it.
+	cfg.Events = NewEventBus()
+	var previous, current string
+	cfg.Events.OnCommentUpdated(Sync, func(_ context.Context, e CommentUpdatedEvent) {
+		previous, current = e.PreviousContent, e.Comment.Content
+	})
+	if observed := update(&cfg); observed != unobserved {
+		t.Errorf("expected subscribers not to cost queries, got %d instead of %d", observed, unobserved)
+	}
+	if previous == "" || current != "edited" {
+		t.Errorf("expected the change from the loaded content, got %q -> %q", previous, current)
+	}
+}
+
+func TestEventBus_SubscribersGetWholeComment(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.Events = NewEventBus()
+	var created, updated Comment
+	cfg.Events.OnCommentCreated(Sync, func(_ context.Context, e CommentCreatedEvent) {
+		created = e.Comment
+	})
+	cfg.Events.OnCommentUpdated(Sync, func(_ context.Context, e CommentUpdatedEvent) {
+		updated = e.Comment
+	})
+
+	app := newModerationApp(t, db, &cfg, "reader")
+	send := func(method, path, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "test-agent")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send("POST", "/comments", `{"commentable":"post","commentableId":"post-1","content":"first"}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var dto CommentResponseDTO
+	if err := json.NewDecoder(resp.Body).Decode(&dto); err != nil {
+		t.Fatal(err)
+	}
+	if dto.PublishedAt != nil || dto.UserAgent != nil {
+		t.Errorf("expected the response to leave out what readers may not read, got %+v", dto)
+	}
+	if created.PublishedAt == nil || created.UserAgent == nil || *created.UserAgent != "test-agent" {
+		t.Errorf("expected subscribers to get the whole comment, got %+v", created)
+	}
+
+	if resp := send("PUT", "/comments/"+dto.ID, `{"content":"second"}`); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if updated.PublishedAt == nil || updated.UserAgent == nil {
+		t.Errorf("expected subscribers to get the whole updated comment, got %+v", updated)
+	}
+}
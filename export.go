@@ -0,0 +1,309 @@
+package commentable
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Export formats. NDJSON and CSV hold one comment per line; JSON holds one
+// nested thread snapshot per target.
+const (
+	ExportNDJSON = "ndjson"
+	ExportCSV    = "csv"
+	ExportJSON   = "json"
+)
+
+var ValidExportFormats = []string{ExportNDJSON, ExportCSV, ExportJSON}
+
+// exportBatchSize is the number of comments loaded at a time by an export.
+var exportBatchSize = 500
+
+// ExportOptions selects the comments written by ExportComments. Every
+// comment matches when nothing is set.
+type ExportOptions struct {
+	// Format is one of ValidExportFormats, ExportNDJSON when empty.
+	Format string
+	// Commentable restricts the export to one type, and CommentableIds to
+	// some of its targets.
+	Commentable    string
+	CommentableIds []string
+	// From and To restrict the export to the comments created in [From, To).
+	From *time.Time
+	To   *time.Time
+	// IncludePII adds the authors' IP addresses and user agents, which are
+	// left out otherwise.
+	IncludePII bool
+	// KeyProvider decrypts the comments encrypted at rest.
+	KeyProvider KeyProvider
+}
+
+// ExportThreadDTO is the snapshot of the discussion on one target written by
+// JSON exports.
+type ExportThreadDTO struct {
+	Commentable   string              `json:"commentable"`
+	CommentableId string              `json:"commentableId"`
+	Comments      []*CommentThreadDTO `json:"comments"`
+}
+
+// exportCSVHeader names the columns of CSV exports, followed by ip_address
+// and user_agent when they are included.
+var exportCSVHeader = []string{
+	"id", "commentable", "commentable_id", "parent_id", "root_id", "depth",
+	"user_id", "status", "content", "content_format",
+	"upvotes", "downvotes", "score", "edit_count", "deleted",
+	"published_at", "edited_at", "deleted_at", "updated_at", "created_at",
+}
+
+// ExportComments writes the comments selected by opts to w and returns how
+// many were written. Comments are loaded in batches ordered by target and
+// thread, so only one batch is held in memory at a time, or, for JSON, the
+// comments of one target. Tombstones are exported as in responses.
+//
+// Comments are read as an admin would: moderation and content check fields
+// are always written, whatever the roles in ctx, so only let admins export.
+// In JSON snapshots of a date range, replies to comments outside of it are
+// left out with their branches.
+func ExportComments(ctx context.Context, db database.Database, w io.Writer, opts ExportOptions) (int, error) {
+	if opts.Format == "" {
+		opts.Format = ExportNDJSON
+	}
+	if !slices.Contains(ValidExportFormats, opts.Format) {
+		return 0, fmt.Errorf("invalid export format: %s (allowed: %v)", opts.Format, ValidExportFormats)
+	}
+	if len(opts.CommentableIds) > 0 && opts.Commentable == "" {
+		return 0, fmt.Errorf("exporting targets requires their commentable type")
+	}
+
+	buf := bufio.NewWriter(w)
+	out := &exporter{w: buf, format: opts.Format, pii: opts.IncludePII}
+	if err := out.begin(); err != nil {
+		return 0, err
+	}
+
+	conds := exportConditions(opts)
+	c := storedComments(db, decrypter(opts.KeyProvider))
+	var last *Comment
+	for {
+		page := conds
+		if last != nil {
+			page = append(append([]query.Condition{}, conds...), exportAfter(last))
+		}
+		res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+			Limit:      exportBatchSize,
+			Conditions: page,
+			OrderBy: []crud.OrderByClause{
+				{Column: "commentable", Direction: query.ASC},
+				{Column: "commentable_id", Direction: query.ASC},
+				{Column: "path", Direction: query.ASC},
+			},
+		})
+		if err != nil {
+			return out.count, err
+		}
+		for _, comment := range res.Items {
+			if !opts.IncludePII {
+				comment.IpAddress, comment.UserAgent = nil, nil
+			}
+			if err := out.add(comment); err != nil {
+				return out.count, err
+			}
+		}
+		if len(res.Items) < exportBatchSize {
+			break
+		}
+		last = &res.Items[len(res.Items)-1]
+	}
+
+	if err := out.end(); err != nil {
+		return out.count, err
+	}
+	return out.count, buf.Flush()
+}
+
+func exportConditions(opts ExportOptions) []query.Condition {
+	var conds []query.Condition
+	if opts.Commentable != "" {
+		conds = append(conds, query.Eq("commentable", opts.Commentable))
+	}
+	if len(opts.CommentableIds) > 0 {
+		ids := make([]any, len(opts.CommentableIds))
+		for i, id := range opts.CommentableIds {
+			ids[i] = id
+		}
+		conds = append(conds, query.In("commentable_id", ids...))
+	}
+	if opts.From != nil {
+		conds = append(conds, query.Gte("created_at", opts.From.UTC()))
+	}
+	if opts.To != nil {
+		conds = append(conds, query.Lt("created_at", opts.To.UTC()))
+	}
+	return conds
+}
+
+// exportAfter matches the comments that come after last in export order.
+func exportAfter(last *Comment) query.Condition {
+	path := ""
+	if last.Path != nil {
+		path = *last.Path
+	}
+	return query.Or(
+		query.Gt("commentable", last.Commentable),
+		query.And(
+			query.Eq("commentable", last.Commentable),
+			query.Gt("commentable_id", last.CommentableId),
+		),
+		query.And(
+			query.Eq("commentable", last.Commentable),
+			query.Eq("commentable_id", last.CommentableId),
+			query.Gt("path", path),
+		),
+	)
+}
+
+// exporter writes comments, handed to it in export order, in one format.
+type exporter struct {
+	w      *bufio.Writer
+	format string
+	pii    bool
+	csv    *csv.Writer
+	conv   CommentConverter
+	count  int
+
+	// The comments of the current target, for JSON.
+	thread  []Comment
+	threads int
+}
+
+func (e *exporter) begin() error {
+	switch e.format {
+	case ExportCSV:
+		e.csv = csv.NewWriter(e.w)
+		header := exportCSVHeader
+		if e.pii {
+			header = append(slices.Clone(header), "ip_address", "user_agent")
+		}
+		return e.csv.Write(header)
+	case ExportJSON:
+		_, err := e.w.WriteString("[")
+		return err
+	}
+	return nil
+}
+
+func (e *exporter) add(comment Comment) error {
+	e.count++
+	switch e.format {
+	case ExportCSV:
+		return e.csv.Write(e.csvRecord(e.conv.ModelToResponseDTO(comment)))
+	case ExportJSON:
+		if len(e.thread) > 0 && (e.thread[0].Commentable != comment.Commentable || e.thread[0].CommentableId != comment.CommentableId) {
+			if err := e.flushThread(); err != nil {
+				return err
+			}
+		}
+		e.thread = append(e.thread, comment)
+		return nil
+	default:
+		data, err := json.Marshal(e.conv.ModelToResponseDTO(comment))
+		if err != nil {
+			return err
+		}
+		_, err = e.w.Write(append(data, '\n'))
+		return err
+	}
+}
+
+func (e *exporter) end() error {
+	switch e.format {
+	case ExportCSV:
+		e.csv.Flush()
+		return e.csv.Error()
+	case ExportJSON:
+		if err := e.flushThread(); err != nil {
+			return err
+		}
+		_, err := e.w.WriteString("]\n")
+		return err
+	}
+	return nil
+}
+
+// flushThread writes the snapshot of the current target.
+func (e *exporter) flushThread() error {
+	if len(e.thread) == 0 {
+		return nil
+	}
+	snapshot := ExportThreadDTO{
+		Commentable:   e.thread[0].Commentable,
+		CommentableId: e.thread[0].CommentableId,
+		Comments:      assembleTree(e.thread, nil, 0, SortOld),
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if e.threads > 0 {
+		if err := e.w.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	e.threads++
+	e.thread = nil
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *exporter) csvRecord(dto CommentResponseDTO) []string {
+	record := []string{
+		dto.ID,
+		dto.Commentable,
+		dto.CommentableID,
+		csvString(dto.ParentID),
+		csvString(dto.RootID),
+		strconv.Itoa(dto.Depth),
+		csvString(dto.UserID),
+		dto.Status,
+		dto.Content,
+		dto.ContentFormat,
+		strconv.Itoa(dto.Upvotes),
+		strconv.Itoa(dto.Downvotes),
+		strconv.Itoa(dto.Score),
+		strconv.Itoa(dto.EditCount),
+		strconv.FormatBool(dto.Deleted),
+		csvTime(dto.PublishedAt),
+		csvTime(dto.EditedAt),
+		csvTime(dto.DeletedAt),
+		csvTime(dto.UpdatedAt),
+		csvTime(dto.CreatedAt),
+	}
+	if e.pii {
+		record = append(record, csvString(dto.IPAddress), csvString(dto.UserAgent))
+	}
+	return record
+}
+
+func csvString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+func csvTime(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,132 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+func TestExportComments(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+
+	// Small batches so that the export has to resume after each one.
+	defer func(size int) { exportBatchSize = size }(exportBatchSize)
+	exportBatchSize = 2
+
+	root := insertComment(t, db, nil, StatusPublished)
+	reply := insertComment(t, db, &root, StatusAwaiting)
+	insertComment(t, db, &reply, StatusPublished)
+	other := insertComment(t, db, nil, StatusPublished)
+	stmt, args, _ := query.New(db.Dialect()).Update("comment").
+		Set("commentable_id", "post-2").
+		Set("ip_address", "203.0.113.7").
+		Set("moderation_reason", "off topic").
+		Where(query.Eq("id", other)).
+		Build()
+	if _, err := db.Exec(ctx, stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+	setCreatedAt(t, db, other, time.Now().Add(-48*time.Hour))
+
+	export := func(opts ExportOptions) (int, string) {
+		t.Helper()
+		var buf bytes.Buffer
+		n, err := ExportComments(ctx, db, &buf, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n, buf.String()
+	}
+
+	n, out := export(ExportOptions{})
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if n != 4 || len(lines) != 4 {
+		t.Fatalf("expected 4 comments, got %d in %q", n, out)
+	}
+	var first, last CommentResponseDTO
+	_ = json.Unmarshal([]byte(lines[0]), &first)
+	_ = json.Unmarshal([]byte(lines[3]), &last)
+	if first.ID != root || last.ID != other || last.IPAddress != nil {
+		t.Errorf("expected comments in target and thread order without PII, got %s", out)
+	}
+	// Exports carry the moderation fields whatever the roles in ctx.
+	if last.ModerationReason == nil || *last.ModerationReason != "off topic" {
+		t.Errorf("expected the moderation fields, got %s", lines[3])
+	}
+	if _, out := export(ExportOptions{IncludePII: true, Commentable: "post", CommentableIds: []string{"post-2"}}); !strings.Contains(out, `"ipAddress":"203.0.113.7"`) {
+		t.Errorf("expected the IP address when asked for, got %s", out)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	n, out = export(ExportOptions{Format: ExportCSV, From: &since, IncludePII: true})
+	records, err := csv.NewReader(strings.NewReader(out)).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 || len(records) != 4 || records[0][len(records[0])-2] != "ip_address" || records[2][3] != root {
+		t.Errorf("expected a header and the 3 recent comments, got %v", records)
+	}
+
+	_, out = export(ExportOptions{Format: ExportJSON})
+	var snapshots []ExportThreadDTO
+	if err := json.Unmarshal([]byte(out), &snapshots); err != nil {
+		t.Fatalf("invalid JSON export %q: %v", out, err)
+	}
+	if len(snapshots) != 2 || snapshots[0].CommentableId != "post-1" || len(snapshots[0].Comments) != 1 {
+		t.Fatalf("expected one snapshot per target, got %+v", snapshots)
+	}
+	if children := snapshots[0].Comments[0].Children; len(children) != 1 || children[0].ID != reply || len(children[0].Children) != 1 {
+		t.Errorf("expected the replies to be nested, got %+v", snapshots[0].Comments[0])
+	}
+
+	if _, err := ExportComments(ctx, db, io.Discard, ExportOptions{Format: "xml"}); err == nil {
+		t.Errorf("expected an unknown format to be rejected")
+	}
+}
+
+func TestExportEndpoint(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	id := insertComment(t, db, nil, StatusPublished)
+
+	get := func(roles, params string) (int, string, string) {
+		t.Helper()
+		resp, err := newModerationApp(t, db, &cfg, roles).Test(httptest.NewRequest("GET", "/comments/export?"+params, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(body)
+	}
+
+	status, contentType, body := get("admin", "format=csv&commentable=post&commentableId=post-1")
+	if status != 200 || !strings.HasPrefix(contentType, "text/csv") || !strings.Contains(body, id) || strings.Contains(body, "ip_address") {
+		t.Errorf("expected a CSV export without PII, got %d %q %q", status, contentType, body)
+	}
+	if status, _, body := get("admin", "pii=true"); status != 200 || !strings.Contains(body, id) {
+		t.Errorf("expected an NDJSON export, got %d %q", status, body)
+	}
+	for params, want := range map[string]int{
+		"format=xml":              400,
+		"commentableId=post-1":    400,
+		"commentable=unknown":     400,
+		"from=yesterday":          400,
+		"to=2026-01-01T00:00:00Z": 200,
+	} {
+		if status, _, _ := get("admin", params); status != want {
+			t.Errorf("expected %d for %s, got %d", want, params, status)
+		}
+	}
+	if status, _, _ := get("moderator", ""); status != 403 {
+		t.Errorf("expected 403 for moderators, got %d", status)
+	}
+}
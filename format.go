@@ -0,0 +1,182 @@
+package commentable
+
+import (
+	"bytes"
+	"html"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+	gmhtml "github.com/yuin/goldmark/renderer/html"
+	xhtml "golang.org/x/net/html"
+)
+
+// Content formats selectable per commentable type through
+// Config.ContentFormats.
+const (
+	FormatPlain    = "plain"
+	FormatMarkdown = "markdown"
+)
+
+var ValidFormats = []string{FormatPlain, FormatMarkdown}
+
+// markdown renders CommonMark with strikethrough and autolinks. Raw HTML in
+// the source is dropped by goldmark itself; whatever it does output still goes
+// through sanitizeHTML.
+var markdown = goldmark.New(
+	goldmark.WithExtensions(extension.Strikethrough, extension.Linkify),
+	goldmark.WithRendererOptions(gmhtml.WithHardWraps()),
+)
+
+// renderContent turns the stored source of a comment into the HTML served as
+// contentHtml. Unknown formats render as plain text.
+func renderContent(format, source string) string {
+	if format == FormatMarkdown {
+		var buf bytes.Buffer
+		if err := markdown.Convert([]byte(source), &buf); err == nil {
+			return sanitizeHTML(buf.String())
+		}
+	}
+	return renderPlain(source)
+}
+
+var blankLines = regexp.MustCompile(`\n\s*\n`)
+
+// renderPlain escapes text and keeps its paragraphs and line breaks.
+func renderPlain(source string) string {
+	source = strings.ReplaceAll(strings.TrimSpace(source), "\r\n", "\n")
+	if source == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	for _, paragraph := range blankLines.Split(source, -1) {
+		b.WriteString("<p>")
+		b.WriteString(strings.ReplaceAll(html.EscapeString(paragraph), "\n", "<br>\n"))
+		b.WriteString("</p>\n")
+	}
+	return b.String()
+}
+
+// allowedTags lists the elements kept by sanitizeHTML with the attributes
+// each may carry. Anything else is removed, keeping its text.
+var allowedTags = map[string][]string{
+	"p": nil, "br": nil, "hr": nil,
+	"strong": nil, "em": nil, "del": nil,
+	"code": {"class"}, "pre": nil, "blockquote": nil,
+	"ul": nil, "ol": {"start"}, "li": nil,
+	"h1": nil, "h2": nil, "h3": nil, "h4": nil, "h5": nil, "h6": nil,
+	"a": {"href", "title"},
+}
+
+// droppedTags are removed together with everything inside them.
+var droppedTags = map[string]bool{
+	"script": true, "style": true, "iframe": true, "object": true,
+	"embed": true, "textarea": true, "title": true, "template": true,
+}
+
+var (
+	codeClass  = regexp.MustCompile(`^language-[A-Za-z0-9_+-]+$`)
+	listStart  = regexp.MustCompile(`^[0-9]{1,9}$`)
+	safeScheme = map[string]bool{"http": true, "https": true, "mailto": true}
+)
+
+// sanitizeHTML keeps only allowedTags and their allowed attributes, drops
+// links to anything but http(s), mailto and relative URLs, and marks every
+// link rel="nofollow ugc".
+func sanitizeHTML(input string) string {
+	var b strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(input))
+	skipping := 0
+
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			return b.String()
+
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if droppedTags[token.Data] {
+				if tt == xhtml.StartTagToken {
+					skipping++
+				}
+				continue
+			}
+			attrs, ok := allowedTags[token.Data]
+			if skipping > 0 || !ok {
+				continue
+			}
+			writeStartTag(&b, token, attrs)
+
+		case xhtml.EndTagToken:
+			token := tokenizer.Token()
+			if droppedTags[token.Data] {
+				if skipping > 0 {
+					skipping--
+				}
+				continue
+			}
+			if _, ok := allowedTags[token.Data]; skipping > 0 || !ok || isVoid(token.Data) {
+				continue
+			}
+			b.WriteString("</" + token.Data + ">")
+
+		case xhtml.TextToken:
+			if skipping == 0 {
+				b.WriteString(html.EscapeString(string(tokenizer.Text())))
+			}
+		}
+	}
+}
+
+func writeStartTag(b *strings.Builder, token xhtml.Token, allowed []string) {
+	b.WriteString("<" + token.Data)
+
+	hasHref := false
+	for _, attr := range token.Attr {
+		if attr.Namespace != "" || !slices.Contains(allowed, attr.Key) {
+			continue
+		}
+		switch {
+		case attr.Key == "href":
+			if !isSafeURL(attr.Val) {
+				continue
+			}
+			hasHref = true
+		case token.Data == "code" && attr.Key == "class":
+			if !codeClass.MatchString(attr.Val) {
+				continue
+			}
+		case attr.Key == "start":
+			if !listStart.MatchString(attr.Val) {
+				continue
+			}
+		}
+		b.WriteString(" " + attr.Key + `="` + html.EscapeString(attr.Val) + `"`)
+	}
+	if token.Data == "a" && hasHref {
+		b.WriteString(` rel="nofollow ugc"`)
+	}
+
+	b.WriteString(">")
+}
+
+func isSafeURL(raw string) bool {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "" || safeScheme[strings.ToLower(u.Scheme)]
+}
+
+func isVoid(tag string) bool {
+	return tag == "br" || tag == "hr"
+}
@@ -0,0 +1,118 @@
+package commentable
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRenderContent(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		source string
+		want   []string
+		reject []string
+	}{
+		{
+			name:   "plain escapes and keeps line breaks",
+			format: FormatPlain,
+			source: "a <b> & c\nnext\n\nsecond",
+			want:   []string{"<p>a &lt;b&gt; &amp; c<br>\nnext</p>", "<p>second</p>"},
+		},
+		{
+			name:   "markdown formatting",
+			format: FormatMarkdown,
+			source: "**bold** _em_ ~~gone~~\n\n> quote\n\n```go\nx := 1\n```",
+			want:   []string{"<strong>bold</strong>", "<em>em</em>", "<del>gone</del>", "<blockquote>", `<code class="language-go">`},
+		},
+		{
+			name:   "links get nofollow ugc",
+			format: FormatMarkdown,
+			source: "[site](https://example.com) and https://auto.example",
+			want:   []string{`<a href="https://example.com" rel="nofollow ugc">site</a>`, `<a href="https://auto.example" rel="nofollow ugc">`},
+		},
+		{
+			name:   "raw html and scripts are dropped",
+			format: FormatMarkdown,
+			source: "<script>alert(1)</script>\n\nhi <img src=x onerror=alert(1)> <b onclick=x>b</b>",
+			reject: []string{"<script", "alert", "<img", "onerror", "onclick"},
+		},
+		{
+			name:   "dangerous link schemes are removed",
+			format: FormatMarkdown,
+			source: "[x](javascript:alert(1)) [y](data:text/html,hi)",
+			reject: []string{"javascript:", "data:", "rel="},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := renderContent(tt.format, tt.source)
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("expected %q in %q", want, got)
+				}
+			}
+			for _, reject := range tt.reject {
+				if strings.Contains(got, reject) {
+					t.Errorf("did not expect %q in %q", reject, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeHTML(t *testing.T) {
+	got := sanitizeHTML(`<p style="x">a<iframe src="x">b</iframe><a href="/rel" target="_blank">c</a><code class="evil">d</code></p>`)
+	want := `<p>a<a href="/rel" rel="nofollow ugc">c</a><code>d</code></p>`
+	if got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestCommentCreate_StoresSourceAndRendersHTML(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.ContentFormats = map[string]string{"post": FormatMarkdown}
+	app := newModerationApp(t, db, &cfg, "reader")
+
+	payload, _ := json.Marshal(CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "**a** & <b>"})
+	req := httptest.NewRequest("POST", "/comments", bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	var created CommentResponseDTO
+	if err := json.NewDecoder(resp.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Content != "**a** & <b>" || created.ContentFormat != FormatMarkdown {
+		t.Errorf("expected the source to be stored as written, got %q (%s)", created.Content, created.ContentFormat)
+	}
+	if !strings.Contains(created.ContentHTML, "<strong>a</strong> &amp;") || strings.Contains(created.ContentHTML, "<b>") {
+		t.Errorf("unexpected contentHtml %q", created.ContentHTML)
+	}
+
+	// Comments stored before content_html existed are rendered when read.
+	legacy := insertComment(t, db, nil, StatusPublished)
+	resp, err = app.Test(httptest.NewRequest("GET", "/comments/"+legacy, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read CommentResponseDTO
+	if err := json.NewDecoder(resp.Body).Decode(&read); err != nil {
+		t.Fatal(err)
+	}
+	if read.ContentHTML != "<p>c</p>\n" {
+		t.Errorf("expected legacy content to render as plain text, got %q", read.ContentHTML)
+	}
+}
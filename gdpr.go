@@ -0,0 +1,397 @@
+package commentable
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Erasure modes. Anonymizing keeps the comments, detached from their author;
+// deleting removes them like their author would, leaving tombstones where
+// they have replies.
+const (
+	ErasureAnonymize = "anonymize"
+	ErasureDelete    = "delete"
+)
+
+var ValidErasureModes = []string{ErasureAnonymize, ErasureDelete}
+
+// UserDataArchive is everything stored about the comments of one user, as
+// returned by ExportUserData.
+type UserDataArchive struct {
+	UserID     string               `json:"userId"`
+	ExportedAt time.Time            `json:"exportedAt"`
+	Comments   []UserDataCommentDTO `json:"comments"`
+}
+
+// UserDataCommentDTO is a comment as stored, with its author's IP address and
+// user agent and the content it had before each edit. The content of
+// tombstones is empty.
+type UserDataCommentDTO struct {
+	ID            string                `json:"id"`
+	Commentable   string                `json:"commentable"`
+	CommentableID string                `json:"commentableId"`
+	ParentID      *string               `json:"parentId,omitempty"`
+	Content       string                `json:"content"`
+	ContentFormat string                `json:"contentFormat"`
+	Status        string                `json:"status"`
+	IPAddress     *string               `json:"ipAddress,omitempty"`
+	UserAgent     *string               `json:"userAgent,omitempty"`
+	EditCount     int                   `json:"editCount"`
+	EditedAt      *time.Time            `json:"editedAt,omitempty"`
+	DeletedAt     *time.Time            `json:"deletedAt,omitempty"`
+	UpdatedAt     *time.Time            `json:"updatedAt,omitempty"`
+	CreatedAt     *time.Time            `json:"createdAt,omitempty"`
+	Revisions     []UserDataRevisionDTO `json:"revisions"`
+}
+
+// UserDataRevisionDTO is the content of a comment before one of its edits.
+type UserDataRevisionDTO struct {
+	Version   int        `json:"version"`
+	Content   string     `json:"content"`
+	CreatedAt *time.Time `json:"createdAt,omitempty"`
+}
+
+// ErasureOptions configures EraseUserData.
+type ErasureOptions struct {
+	// Mode is one of ValidErasureModes, ErasureAnonymize when empty.
+	Mode string
+	// Content replaces the content of anonymized comments, which is kept
+	// when nil. Their revisions and mentions go with the content.
+	Content *string
+}
+
+// ErasureResult counts the comments an erasure changed.
+type ErasureResult struct {
+	Anonymized int `json:"anonymized"`
+	Deleted    int `json:"deleted"`
+}
+
+// ExportUserData returns every comment userID authored, tombstones included,
+// oldest first, whatever the roles in ctx. keys decrypts the comments
+// encrypted at rest.
+func ExportUserData(ctx context.Context, db database.Database, userID string, keys KeyProvider) (*UserDataArchive, error) {
+	archive := &UserDataArchive{
+		UserID:     userID,
+		ExportedAt: time.Now().UTC(),
+		Comments:   []UserDataCommentDTO{},
+	}
+
+	cc := decrypter(keys)
+	c := storedComments(db, cc)
+	revisions := crud.New[CommentRevision](db)
+	for offset := 0; ; offset += exportBatchSize {
+		res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+			Limit:      exportBatchSize,
+			Offset:     offset,
+			Conditions: []query.Condition{query.Eq("user_id", userID)},
+			OrderBy: []crud.OrderByClause{
+				{Column: "created_at", Direction: query.ASC},
+				{Column: "id", Direction: query.ASC},
+			},
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		byComment, err := fetchUserRevisions(ctx, revisions, cc, res.Items)
+		if err != nil {
+			return nil, err
+		}
+		for _, comment := range res.Items {
+			archive.Comments = append(archive.Comments, userDataComment(comment, byComment[comment.Id]))
+		}
+		if len(res.Items) < exportBatchSize {
+			break
+		}
+	}
+	return archive, nil
+}
+
+// fetchUserRevisions loads the revisions of comments, oldest first, by
+// comment id, decrypted with cc.
+func fetchUserRevisions(ctx context.Context, c *crud.CRUD[CommentRevision], cc *commentCipher, comments []Comment) (map[string][]UserDataRevisionDTO, error) {
+	byComment := make(map[string][]UserDataRevisionDTO, len(comments))
+	if len(comments) == 0 {
+		return byComment, nil
+	}
+	ids := make([]any, len(comments))
+	byID := make(map[string]*Comment, len(comments))
+	for i := range comments {
+		ids[i] = comments[i].Id
+		byID[comments[i].Id] = &comments[i]
+	}
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Conditions: []query.Condition{query.In("comment_id", ids...)},
+		OrderBy:    []crud.OrderByClause{{Column: "version", Direction: query.ASC}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	grouped := make(map[string][]CommentRevision, len(comments))
+	for _, revision := range res.Items {
+		grouped[revision.CommentId] = append(grouped[revision.CommentId], revision)
+	}
+	for commentID, revisions := range grouped {
+		if err := cc.openRevisions(ctx, byID[commentID], revisions); err != nil {
+			return nil, err
+		}
+		for _, revision := range revisions {
+			byComment[commentID] = append(byComment[commentID], UserDataRevisionDTO{
+				Version:   revision.Version,
+				Content:   revision.Content,
+				CreatedAt: revision.CreatedAt,
+			})
+		}
+	}
+	return byComment, nil
+}
+
+func userDataComment(comment Comment, revisions []UserDataRevisionDTO) UserDataCommentDTO {
+	if revisions == nil {
+		revisions = []UserDataRevisionDTO{}
+	}
+	return UserDataCommentDTO{
+		ID:            comment.Id,
+		Commentable:   comment.Commentable,
+		CommentableID: comment.CommentableId,
+		ParentID:      comment.ParentId,
+		Content:       comment.Content,
+		ContentFormat: comment.ContentFormat,
+		Status:        comment.Status,
+		IPAddress:     comment.IpAddress,
+		UserAgent:     comment.UserAgent,
+		EditCount:     comment.EditCount,
+		EditedAt:      comment.EditedAt,
+		DeletedAt:     comment.DeletedAt,
+		UpdatedAt:     comment.UpdatedAt,
+		CreatedAt:     comment.CreatedAt,
+		Revisions:     revisions,
+	}
+}
+
+// EraseUserData erases the comments of userID in one transaction, for
+// account deletion or on the user's request. Either way the comments lose
+// their author, IP address and user agent, as do their tombstones, and
+// userID is cleared from the edits and moderation decisions it is recorded
+// on; deleting removes the comments as in Remove, so that the replies of
+// other users stay in place under tombstones. The votes, subscriptions,
+// notifications and rate limit hits of the user go too, as do the webhook
+// deliveries of its comments, sent or not.
+//
+// Erasure is not published to webhooks or the event bus: nothing identifying
+// the user may be sent once it is done.
+func EraseUserData(ctx context.Context, db database.Database, userID string, opts ErasureOptions) (ErasureResult, error) {
+	var result ErasureResult
+	if opts.Mode == "" {
+		opts.Mode = ErasureAnonymize
+	}
+	if !slices.Contains(ValidErasureModes, opts.Mode) {
+		return result, fmt.Errorf("invalid erasure mode: %s (allowed: %v)", opts.Mode, ValidErasureModes)
+	}
+	if userID == "" {
+		return result, errors.New("a user id is required")
+	}
+	if opts.Mode == ErasureDelete && opts.Content != nil {
+		return result, errors.New("replacement content only applies to anonymized comments")
+	}
+
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return result, err
+	}
+	result, err = eraseUserData(ctx, db, tx, userID, opts)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return result, err
+	}
+	return result, tx.Commit(ctx)
+}
+
+func eraseUserData(ctx context.Context, db database.Database, q sqlExecutor, userID string, opts ErasureOptions) (ErasureResult, error) {
+	var result ErasureResult
+	ids, targets, err := userComments(ctx, db, q, userID)
+	if err != nil {
+		return result, err
+	}
+
+	builder := func() *query.Builder { return query.New(db.Dialect()) }
+	exec := func(stmt string, args []any, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, stmt, args...)
+		return err
+	}
+
+	// Removal and votes only need the database: they are done without an
+	// actor, so tombstones do not record who deleted them.
+	h := &CommentHooks{db: db}
+	owned := builder().Select("id").From("comment").Where(query.Eq("user_id", userID))
+
+	// Queued webhook payloads hold the author and content of the comments,
+	// and deletion may remove the comments they point to.
+	if err := exec(builder().Delete("comment_webhook_delivery").Where(query.InSubquery("comment_id", owned)).Build()); err != nil {
+		return result, err
+	}
+	// Withdrawing the votes keeps the scores of the comments right.
+	voted, err := userVotes(ctx, db, q, userID)
+	if err != nil {
+		return result, err
+	}
+	for _, commentID := range voted {
+		if _, _, err := h.vote(ctx, q, commentID, userID, 0); err != nil {
+			return result, err
+		}
+	}
+	for _, table := range []string{"comment_subscription", "comment_notification"} {
+		if err := exec(builder().Delete(table).Where(query.Eq("user_id", userID)).Build()); err != nil {
+			return result, err
+		}
+	}
+	// The in-memory store forgets the key once its window has passed.
+	for _, table := range []string{"comment_rate_limit", "comment_rate_limit_key"} {
+		if err := exec(builder().Delete(table).Where(query.Eq("rate_key", "user:"+userID)).Build()); err != nil {
+			return result, err
+		}
+	}
+
+	live := query.And(query.Eq("user_id", userID), query.IsNull("deleted_at"))
+	if opts.Mode == ErasureDelete {
+		// Tombstones would keep the revisions otherwise.
+		if err := exec(builder().Delete("comment_revision").Where(query.InSubquery("comment_id", owned)).Build()); err != nil {
+			return result, err
+		}
+		for _, id := range ids {
+			found, err := h.removeComment(ctx, q, id, nil)
+			if err != nil {
+				return result, err
+			}
+			if found {
+				result.Deleted++
+			}
+		}
+	} else if opts.Content != nil {
+		// The previous content and mentions would give the comments away.
+		liveIDs := builder().Select("id").From("comment").Where(live)
+		for _, table := range []string{"comment_revision", "comment_mention"} {
+			if err := exec(builder().Delete(table).Where(query.InSubquery("comment_id", liveIDs)).Build()); err != nil {
+				return result, err
+			}
+		}
+		now := time.Now().UTC()
+		if err := exec(builder().Update("comment").
+			Set("content", *opts.Content).
+			Set("content_format", FormatPlain).
+			Set("content_html", renderPlain(*opts.Content)).
+			Set("mentions", nil).
+			Set("edit_count", 0).
+			Set("edited_at", nil).
+			Set("updated_at", now).
+			Where(live).
+			Build()); err != nil {
+			return result, err
+		}
+	}
+
+	// Tombstones left by a deletion keep the author until here.
+	if err := exec(builder().Update("comment").
+		Set("user_id", nil).
+		Set("ip_address", nil).
+		Set("user_agent", nil).
+		Where(query.Eq("user_id", userID)).
+		Build()); err != nil {
+		return result, err
+	}
+	if opts.Mode == ErasureAnonymize {
+		result.Anonymized = len(ids)
+	}
+	for column, table := range map[string]string{
+		"edited_by":    "comment_revision",
+		"moderated_by": "comment",
+		"deleted_by":   "comment",
+	} {
+		if err := exec(builder().Update(table).
+			Set(column, nil).
+			Where(query.Eq(column, userID)).
+			Build()); err != nil {
+			return result, err
+		}
+	}
+
+	for _, target := range targets {
+		if err := refreshTargetStats(ctx, db, q, target); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// userVotes returns the ids of the comments userID voted on.
+func userVotes(ctx context.Context, db database.Database, q sqlExecutor, userID string) ([]string, error) {
+	stmt, args, err := query.New(db.Dialect()).
+		Select("comment_id").
+		From("comment_vote").
+		Where(query.Eq("user_id", userID)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// userComments returns the ids of the comments userID authored, deepest
+// first, and the targets they are on.
+func userComments(ctx context.Context, db database.Database, q sqlExecutor, userID string) ([]string, []CommentTarget, error) {
+	stmt, args, err := query.New(db.Dialect()).
+		Select("id", "commentable", "commentable_id").
+		From("comment").
+		Where(query.Eq("user_id", userID)).
+		OrderBy("depth", query.DESC).
+		Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	var targets []CommentTarget
+	seen := map[CommentTarget]bool{}
+	for rows.Next() {
+		var id string
+		var target CommentTarget
+		if err := rows.Scan(&id, &target.Commentable, &target.CommentableId); err != nil {
+			return nil, nil, err
+		}
+		ids = append(ids, id)
+		if !seen[target] {
+			seen[target] = true
+			targets = append(targets, target)
+		}
+	}
+	return ids, targets, rows.Err()
+}
@@ -0,0 +1,268 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+// setupUserComments gives u-alice a root comment with a reply of u-bob, and
+// an edited comment, and returns their ids.
+func setupUserComments(t *testing.T, db database.Database) (root, reply, edited string) {
+	t.Helper()
+	ctx := context.Background()
+	root = insertComment(t, db, nil, StatusPublished)
+	reply = insertComment(t, db, &root, StatusPublished)
+	edited = insertComment(t, db, nil, StatusPublished)
+
+	for id, userID := range map[string]string{root: "u-alice", reply: "u-bob", edited: "u-alice"} {
+		stmt, args, _ := query.New(db.Dialect()).Update("comment").
+			Set("user_id", userID).
+			Set("ip_address", "203.0.113.7").
+			Set("user_agent", "Mozilla/5.0").
+			Where(query.Eq("id", id)).
+			Build()
+		if _, err := db.Exec(ctx, stmt, args...); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.Exec(ctx, `INSERT INTO comment_revision (id, comment_id, version, content, edited_by) VALUES ('r-1', ?, 1, 'first draft', 'u-alice')`, edited); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE comment SET edit_count = 1 WHERE id = ?`, edited); err != nil {
+		t.Fatal(err)
+	}
+	return root, reply, edited
+}
+
+func TestExportUserData(t *testing.T) {
+	db := setupThreadDB(t)
+	root, _, edited := setupUserComments(t, db)
+
+	archive, err := ExportUserData(context.Background(), db, "u-alice", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.UserID != "u-alice" || len(archive.Comments) != 2 {
+		t.Fatalf("expected the 2 comments of the user, got %+v", archive)
+	}
+	byID := map[string]UserDataCommentDTO{}
+	for _, comment := range archive.Comments {
+		byID[comment.ID] = comment
+	}
+	if comment := byID[root]; comment.IPAddress == nil || *comment.IPAddress != "203.0.113.7" || comment.UserAgent == nil {
+		t.Errorf("expected the IP address and user agent, got %+v", comment)
+	}
+	if revisions := byID[edited].Revisions; len(revisions) != 1 || revisions[0].Content != "first draft" {
+		t.Errorf("expected the revision of the edited comment, got %+v", revisions)
+	}
+}
+
+func TestEraseUserData(t *testing.T) {
+	ctx := context.Background()
+	load := func(t *testing.T, db database.Database, id string) (*Comment, *string) {
+		t.Helper()
+		comment, err := crud.New[Comment](db).GetByID(ctx, id)
+		if err != nil {
+			return nil, nil
+		}
+		var ip *string
+		if err := db.QueryRow(ctx, `SELECT ip_address FROM comment WHERE id = ?`, id).Scan(&ip); err != nil {
+			t.Fatal(err)
+		}
+		return comment, ip
+	}
+	revisions := func(t *testing.T, db database.Database) int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM comment_revision`).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	t.Run("anonymize", func(t *testing.T) {
+		db := setupThreadDB(t)
+		root, reply, edited := setupUserComments(t, db)
+		content := "[removed]"
+
+		result, err := EraseUserData(ctx, db, "u-alice", ErasureOptions{Content: &content})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Anonymized != 2 || result.Deleted != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		for _, id := range []string{root, edited} {
+			comment, ip := load(t, db, id)
+			if comment == nil || comment.UserId != nil || ip != nil || comment.Content != content || comment.DeletedAt != nil {
+				t.Errorf("expected an anonymized comment, got %+v (ip %v)", comment, ip)
+			}
+		}
+		if comment, ip := load(t, db, reply); comment == nil || comment.UserId == nil || ip == nil {
+			t.Errorf("expected the reply of another user to be left alone, got %+v", comment)
+		}
+		if n := revisions(t, db); n != 0 {
+			t.Errorf("expected the revisions to go with the content, got %d", n)
+		}
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		db := setupThreadDB(t)
+		root, reply, edited := setupUserComments(t, db)
+
+		result, err := EraseUserData(ctx, db, "u-alice", ErasureOptions{Mode: ErasureDelete})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Deleted != 2 || result.Anonymized != 0 {
+			t.Errorf("unexpected result %+v", result)
+		}
+		if comment, ip := load(t, db, root); comment == nil || comment.DeletedAt == nil || comment.UserId != nil || ip != nil {
+			t.Errorf("expected an anonymous tombstone holding the reply, got %+v (ip %v)", comment, ip)
+		}
+		if comment, _ := load(t, db, reply); comment == nil || comment.ParentId == nil || *comment.ParentId != root {
+			t.Errorf("expected the reply to stay in place, got %+v", comment)
+		}
+		if comment, _ := load(t, db, edited); comment != nil {
+			t.Errorf("expected the comment without replies to be deleted, got %+v", comment)
+		}
+		if n := revisions(t, db); n != 0 {
+			t.Errorf("expected the revisions to be deleted with their comment, got %d", n)
+		}
+	})
+
+	t.Run("related data", func(t *testing.T) {
+		db := setupThreadDB(t)
+		root, reply, _ := setupUserComments(t, db)
+		hooks := &CommentHooks{db: db}
+		if _, err := hooks.Vote(ctx, reply, "u-alice", 1); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := hooks.Vote(ctx, root, "u-bob", 1); err != nil {
+			t.Fatal(err)
+		}
+		for _, stmt := range []string{
+			`INSERT INTO comment_subscription (id, user_id, commentable, commentable_id) VALUES ('s-1', 'u-alice', 'post', 'post-1'), ('s-2', 'u-bob', 'post', 'post-1')`,
+			`INSERT INTO comment_notification (id, user_id, comment_id, reason) VALUES ('n-1', 'u-alice', '` + reply + `', 'reply'), ('n-2', 'u-bob', '` + root + `', 'reply')`,
+			`INSERT INTO comment_webhook_delivery (id, event_id, event, comment_id, url, payload) VALUES ('d-1', 'e-1', 'comment.created', '` + root + `', 'https://example.com', '{"userId":"u-alice"}'), ('d-2', 'e-2', 'comment.created', '` + reply + `', 'https://example.com', '{"userId":"u-bob"}')`,
+			`INSERT INTO comment_rate_limit (rate_key, hit_at) VALUES ('user:u-alice', 1), ('user:u-bob', 1)`,
+			`INSERT INTO comment_rate_limit_key (rate_key, updated_at) VALUES ('user:u-alice', 1), ('user:u-bob', 1)`,
+		} {
+			if _, err := db.Exec(ctx, stmt); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := EraseUserData(ctx, db, "u-alice", ErasureOptions{}); err != nil {
+			t.Fatal(err)
+		}
+		for _, count := range []string{
+			`SELECT COUNT(*) FROM comment_vote WHERE user_id = 'u-alice'`,
+			`SELECT COUNT(*) FROM comment_subscription WHERE user_id = 'u-alice'`,
+			`SELECT COUNT(*) FROM comment_notification WHERE user_id = 'u-alice'`,
+			`SELECT COUNT(*) FROM comment_webhook_delivery WHERE payload LIKE '%u-alice%'`,
+			`SELECT COUNT(*) FROM comment_rate_limit WHERE rate_key = 'user:u-alice'`,
+			`SELECT COUNT(*) FROM comment_rate_limit_key WHERE rate_key = 'user:u-alice'`,
+			`SELECT upvotes + score FROM comment WHERE id = '` + reply + `'`,
+		} {
+			var n int
+			if err := db.QueryRow(ctx, count).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Errorf("expected nothing of the user left, got %d for %s", n, count)
+			}
+		}
+		// Nothing of the other user goes.
+		for _, count := range []string{
+			`SELECT COUNT(*) FROM comment_vote`,
+			`SELECT COUNT(*) FROM comment_subscription`,
+			`SELECT COUNT(*) FROM comment_notification`,
+			`SELECT COUNT(*) FROM comment_webhook_delivery`,
+			`SELECT COUNT(*) FROM comment_rate_limit`,
+			`SELECT COUNT(*) FROM comment_rate_limit_key`,
+		} {
+			var n int
+			if err := db.QueryRow(ctx, count).Scan(&n); err != nil {
+				t.Fatal(err)
+			}
+			if n != 1 {
+				t.Errorf("expected the row of the other user to stay, got %d for %s", n, count)
+			}
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		db := setupThreadDB(t)
+		content := "x"
+		for _, opts := range []ErasureOptions{{Mode: "forget"}, {Mode: ErasureDelete, Content: &content}} {
+			if _, err := EraseUserData(ctx, db, "u-alice", opts); err == nil {
+				t.Errorf("expected %+v to be rejected", opts)
+			}
+		}
+	})
+}
+
+func TestUserDataEndpoints(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	setupUserComments(t, db)
+
+	request := func(userID, role, method, path string, body any) *httpResult {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{role}))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+
+	if res := request("u-bob", "writer", "GET", "/comments/users/u-alice/data", nil); res.status != 403 {
+		t.Errorf("expected 403 for another user, got %d", res.status)
+	}
+	for _, caller := range [][2]string{{"u-alice", "reader"}, {"admin-1", "admin"}} {
+		res := request(caller[0], caller[1], "GET", "/comments/users/u-alice/data", nil)
+		if comments, _ := res.body["comments"].([]any); res.status != 200 || len(comments) != 2 {
+			t.Errorf("expected the archive for %s, got %d %v", caller[0], res.status, res.body)
+		}
+	}
+
+	if res := request("u-bob", "writer", "POST", "/comments/users/u-alice/erase", UserErasureDTO{}); res.status != 403 {
+		t.Errorf("expected 403 for another user, got %d", res.status)
+	}
+	if res := request("u-alice", "reader", "POST", "/comments/users/u-alice/erase", UserErasureDTO{Mode: "forget"}); res.status != 400 {
+		t.Errorf("expected 400 for an unknown mode, got %d", res.status)
+	}
+	res := request("admin-1", "admin", "POST", "/comments/users/u-alice/erase", UserErasureDTO{Mode: ErasureDelete})
+	if res.status != 200 || res.body["deleted"] != float64(2) {
+		t.Errorf("expected 2 deleted comments, got %d %v", res.status, res.body)
+	}
+	if res := request("u-alice", "reader", "GET", "/comments/users/u-alice/data", nil); res.status != 200 || len(res.body["comments"].([]any)) != 0 {
+		t.Errorf("expected nothing left after erasure, got %v", res.body)
+	}
+}
@@ -2,10 +2,13 @@ package commentable
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
-	"html"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/google/uuid"
@@ -20,19 +23,70 @@ type CommentHooks struct {
 	db         database.Database
 	config     *Config
 	voter      rbac.Voter
+	checkers   []ContentChecker
+	limiter    *rateLimiter
+	webhooks   *webhookDispatcher
+	events     *EventBus
+	cipher     *commentCipher
 	getComment func(ctx context.Context, id any) (*Comment, error)
+
+	// stop cancels the background workers run by Start.
+	stop    context.CancelFunc
+	workers sync.WaitGroup
 }
 
 func NewCommentHooks(db database.Database, config *Config, voter rbac.Voter) *CommentHooks {
 	h := &CommentHooks{
-		db:     db,
-		config: config,
-		voter:  voter,
+		db:       db,
+		config:   config,
+		voter:    voter,
+		checkers: buildContentCheckers(db, config),
+		limiter:  newRateLimiter(db, config),
+		webhooks: newWebhookDispatcher(db, config, voter),
+		events:   config.Events,
+		cipher:   newCommentCipher(config),
 	}
 	h.getComment = h.defaultGetComment
 	return h
 }
 
+// Start runs the background workers of the hooks, i.e. the webhook delivery
+// worker and the PII purge, until Close is called. The plugin starts them once its routes are
+// set up; applications registering the routes themselves have to do so too.
+func (h *CommentHooks) Start() {
+	if h.stop != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h.stop = cancel
+	if h.webhooks != nil {
+		h.workers.Add(1)
+		go func() {
+			defer h.workers.Done()
+			h.webhooks.run(ctx)
+		}()
+	}
+	if h.db != nil && h.config.PIIRetentionDays > 0 {
+		h.workers.Add(1)
+		go func() {
+			defer h.workers.Done()
+			runPIIPurge(ctx, h.db, h.config)
+		}()
+	}
+}
+
+// Close stops the workers run by Start and waits for them to return. A
+// delivery in flight is abandoned and retried by the next run, as are the
+// comments a purge in flight had left to scrub.
+func (h *CommentHooks) Close() {
+	if h.stop == nil {
+		return
+	}
+	h.stop()
+	h.workers.Wait()
+	h.stop = nil
+}
+
 func (h *CommentHooks) Create(c fiber.Ctx, dto CommentCreateDTO, model *Comment) error {
 	if !h.config.IsAllowedType(dto.Commentable) {
 		return fiber.NewError(400, "commentable type is not allowed")
@@ -52,7 +106,12 @@ func (h *CommentHooks) Create(c fiber.Ctx, dto CommentCreateDTO, model *Comment)
 		return fiber.NewError(400, "content exceeds maximum length")
 	}
 
-	model.Content = html.EscapeString(content)
+	model.Content = content
+
+	parent, err := h.validateParent(c, dto)
+	if err != nil {
+		return err
+	}
 
 	// Set system fields
 	if model.Id == "" {
@@ -66,15 +125,8 @@ func (h *CommentHooks) Create(c fiber.Ctx, dto CommentCreateDTO, model *Comment)
 		model.UserId = &user.UserID
 	}
 
-	ipAddress := c.IP()
-	if ipAddress != "" {
-		model.IpAddress = &ipAddress
-	}
-
-	userAgent := c.Get("User-Agent")
-	if userAgent != "" {
-		model.UserAgent = &userAgent
-	}
+	model.IpAddress = h.config.storedIP(c.IP())
+	model.UserAgent = h.config.storedUserAgent(c.Get("User-Agent"))
 
 	// Validate RBAC for authenticated users
 	// For anonymous users, the CRUD layer's NoOpHooks will allow all fields
@@ -105,12 +157,104 @@ func (h *CommentHooks) Create(c fiber.Ctx, dto CommentCreateDTO, model *Comment)
 		model.Status = tempStatus
 	}
 
+	// Only valid attempts count against the limits; the content checks come
+	// after them, so a flood of rejected comments is still limited.
+	if err := h.checkRateLimit(c, dto, user); err != nil {
+		return err
+	}
+
+	check := h.checkContent(c, dto, content, user)
+	if check.Verdict == VerdictReject {
+		return fiber.NewError(400, "comment rejected by content checks")
+	}
+	if check.Verdict == VerdictHold {
+		model.Status = StatusAwaiting
+	}
+
+	model.ContentFormat = h.config.ContentFormat(dto.Commentable)
+	contentHTML := renderContent(model.ContentFormat, content)
+	model.ContentHtml = &contentHTML
+
+	mentions, err := h.resolveMentions(auth.Context(c), content, model.UserId)
+	if err != nil {
+		return fiber.NewError(500, "failed to resolve mentions")
+	}
+	setMentions(model, mentions)
+
+	model.CheckVerdict = &check.Verdict
+	model.CheckScore = &check.Score
+	if len(check.Reasons) > 0 {
+		reasons := strings.Join(check.Reasons, "; ")
+		model.CheckReasons = &reasons
+	}
+
+	// The path sorts siblings by creation time, so it is derived from the
+	// created_at that is stored, as the backfill derives it.
+	now := time.Now().UTC()
+	model.CreatedAt = &now
+	if model.Status == StatusPublished {
+		published := now
+		model.PublishedAt = &published
+	}
+
+	setThreadPosition(model, parent, now)
+
 	return nil
 }
 
-func (h *CommentHooks) Update(c fiber.Ctx, dto CommentUpdateDTO, model *Comment) error {
+// checkRateLimit counts a comment attempt against the per-user, per-IP and
+// per-thread limits, returning a 429 once one of them is exhausted. Admins are
+// not limited.
+func (h *CommentHooks) checkRateLimit(c fiber.Ctx, dto CommentCreateDTO, user *auth.AuthenticatedUser) error {
+	if h.limiter == nil || h.isAdmin(c) {
+		return nil
+	}
+
+	keys := map[string]string{
+		"ip":     c.IP(),
+		"thread": dto.Commentable + ":" + dto.CommentableId,
+	}
+	if user != nil {
+		keys["user"] = user.UserID
+	}
+
+	retryAfter, err := h.limiter.allow(auth.Context(c), keys)
+	if err != nil {
+		return fiber.NewError(500, "failed to check comment rate limit")
+	}
+	if retryAfter > 0 {
+		return rateLimitError(c, retryAfter)
+	}
+	return nil
+}
+
+// checkContent runs the content checker chain on a comment being created.
+func (h *CommentHooks) checkContent(c fiber.Ctx, dto CommentCreateDTO, content string, user *auth.AuthenticatedUser) CheckOutcome {
+	input := CheckInput{
+		Content:       content,
+		Commentable:   dto.Commentable,
+		CommentableID: dto.CommentableId,
+		ParentID:      dto.ParentId,
+	}
+	if user != nil {
+		input.UserID = &user.UserID
+	}
+	if ip := c.IP(); ip != "" {
+		input.IPAddress = &ip
+	}
+	if ua := c.Get("User-Agent"); ua != "" {
+		input.UserAgent = &ua
+	}
+	return runContentCheckers(auth.Context(c), h.checkers, input)
+}
+
+// Update validates and authorizes an update of the comment in the route,
+// applies it to model and returns the comment as it was loaded before, which
+// SaveUpdate needs to record the revision an edit replaces and event
+// subscribers are told the change from.
+func (h *CommentHooks) Update(c fiber.Ctx, dto CommentUpdateDTO, model *Comment) (*Comment, error) {
 	if dto.Content == nil && dto.Status == nil {
-		return fiber.NewError(400, "at least one field must be provided")
+		return nil, fiber.NewError(400, "at least one field must be provided")
 	}
 
 	id := c.Params("id")
@@ -118,30 +262,51 @@ func (h *CommentHooks) Update(c fiber.Ctx, dto CommentUpdateDTO, model *Comment)
 
 	existing, err := h.getComment(ctx, id)
 	if err != nil {
-		return fiber.NewError(404, "Comment not found")
+		return nil, fiber.NewError(404, "Comment not found")
+	}
+
+	if existing.DeletedAt != nil {
+		return nil, fiber.NewError(400, "deleted comments cannot be edited")
 	}
 
 	if err := h.checkOwnership(c, existing); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Populate model from existing
+	loaded := *existing
 	*model = *existing
 
 	if dto.Content != nil {
-		sanitized, err := h.validateAndSanitizeContent(*dto.Content)
+		content, err := h.validateContent(*dto.Content)
 		if err != nil {
-			return err
+			return nil, err
+		}
+		model.Content = content
+		model.ContentFormat = h.config.ContentFormat(existing.Commentable)
+		contentHTML := renderContent(model.ContentFormat, content)
+		model.ContentHtml = &contentHTML
+		mentions, err := h.resolveMentions(ctx, content, existing.UserId)
+		if err != nil {
+			return nil, fiber.NewError(500, "failed to resolve mentions")
 		}
-		model.Content = sanitized
-		existing.Content = sanitized
+		setMentions(model, mentions)
+		existing.Content = content
 	}
 
 	if dto.Status != nil {
 		if err := h.validateStatus(*dto.Status); err != nil {
-			return err
+			return nil, err
+		}
+		actor := h.statusActor(c, existing)
+		if err := checkTransition(existing.Status, *dto.Status, actor, h.config.DefaultStatus); err != nil {
+			return nil, err
+		}
+		var userID *string
+		if user := auth.GetAuthenticatedUser(c); user != nil {
+			userID = &user.UserID
 		}
-		model.Status = *dto.Status
+		applyTransition(model, *dto.Status, actor, userID, dto.Reason, time.Now().UTC())
 		existing.Status = *dto.Status
 	}
 
@@ -152,14 +317,319 @@ func (h *CommentHooks) Update(c fiber.Ctx, dto CommentUpdateDTO, model *Comment)
 	updateItem.UpdatedAt = nil
 	updateItem.IpAddress = nil
 	updateItem.UserAgent = nil
+	updateItem.Depth = 0
+	updateItem.RootId = nil
+	updateItem.Path = nil
+	updateItem.DeletedAt = nil
+	updateItem.DeletedBy = nil
+	updateItem.EditCount = 0
+	updateItem.EditedAt = nil
+	updateItem.ContentFormat = ""
+	updateItem.ContentHtml = nil
+	updateItem.Mentions = nil
+	updateItem.Upvotes = 0
+	updateItem.Downvotes = 0
+	updateItem.Score = 0
+	updateItem.WilsonScore = 0
+	updateItem.ControversyScore = 0
+	// Status changes are authorized by the transition table above rather
+	// than by the field's RBAC tag.
+	updateItem.Status = ""
+	updateItem.PublishedAt = nil
+	updateItem.ModeratedAt = nil
+	updateItem.ModeratedBy = nil
+	updateItem.ModerationReason = nil
+	updateItem.CheckVerdict = nil
+	updateItem.CheckScore = nil
+	updateItem.CheckReasons = nil
+	updateItem.EncryptionKeyId = nil
+	updateItem.EncryptedDataKey = nil
 
 	if err := h.voter.ValidateWrite(ctx, &updateItem); err != nil {
-		return fiber.NewError(403, fmt.Sprintf("insufficient permissions: %v", err))
+		return nil, fiber.NewError(403, fmt.Sprintf("insufficient permissions: %v", err))
+	}
+
+	return &loaded, nil
+}
+
+// SaveCreate stores a comment Create has prepared, in clear. The comment row,
+// its mentions, the notifications of the subscribers, the stats of its target
+// and its webhooks are written in one transaction, so a failure leaves none of
+// them behind; the webhook worker is woken once it committed.
+func (h *CommentHooks) SaveCreate(ctx context.Context, model *Comment) error {
+	if model.CreatedAt == nil {
+		now := time.Now().UTC()
+		model.CreatedAt = &now
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := h.saveCreate(ctx, tx, model); err != nil {
+		_ = tx.Rollback(ctx)
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	h.webhooks.notify()
+	return nil
+}
+
+func (h *CommentHooks) saveCreate(ctx context.Context, q sqlExecutor, model *Comment) error {
+	// The model stays in clear for the mentions and notifications.
+	stored := *model
+	if err := h.cipher.seal(ctx, &stored); err != nil {
+		return err
+	}
+	stmt, args, err := query.New(h.db.Dialect()).
+		Insert("comment").
+		Columns(
+			"id", "user_id", "commentable", "commentable_id", "parent_id",
+			"depth", "root_id", "path", "content", "content_format", "content_html",
+			"mentions", "status", "ip_address", "user_agent",
+			"encryption_key_id", "encrypted_data_key", "remote_source_id", "remote_source",
+			"published_at", "check_verdict", "check_score", "check_reasons", "created_at",
+		).
+		Values(
+			stored.Id, stored.UserId, stored.Commentable, stored.CommentableId, stored.ParentId,
+			stored.Depth, stored.RootId, stored.Path, stored.Content, stored.ContentFormat, stored.ContentHtml,
+			stored.Mentions, stored.Status, stored.IpAddress, stored.UserAgent,
+			stored.EncryptionKeyId, stored.EncryptedDataKey, stored.RemoteSourceId, stored.RemoteSource,
+			stored.PublishedAt, stored.CheckVerdict, stored.CheckScore, stored.CheckReasons, stored.CreatedAt,
+		).
+		Build()
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return err
+	}
+
+	if err := h.SaveMentions(ctx, q, model); err != nil {
+		return err
+	}
+	if err := h.NotifySubscribers(ctx, q, model); err != nil {
+		return err
+	}
+	target := CommentTarget{model.Commentable, model.CommentableId}
+	if err := adjustTargetStats(ctx, h.db, q, target, statsEntry{}, statsEntryOf(model)); err != nil {
+		return err
+	}
+
+	events := []string{WebhookCommentCreated}
+	if model.Status == StatusPublished {
+		events = append(events, WebhookCommentPublished)
+	}
+	for _, event := range events {
+		if err := h.webhooks.enqueue(ctx, q, event, *model); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveUpdate writes the columns an Update with dto may have changed. The model
+// was loaded through the caller's RBAC read filter, so moderator-only columns
+// may read as empty without being so: the status stamps are only written when
+// set, which is always the case when this update's transition stamped them.
+//
+// An edit of the content is recorded as a revision of previous, the comment
+// as Update loaded it, by editorID. The revision, the comment row, its
+// mentions, the stats of its target and its webhooks are written in one
+// transaction, so a failed update leaves none of them behind.
+func (h *CommentHooks) SaveUpdate(ctx context.Context, dto CommentUpdateDTO, previous, model *Comment, editorID *string) error {
+	now := time.Now().UTC()
+	model.UpdatedAt = &now
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := h.saveUpdate(ctx, tx, dto, previous, model, editorID, now); err != nil {
+		_ = tx.Rollback(ctx)
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	h.webhooks.notify()
+	return nil
+}
+
+// saveUpdate implements SaveUpdate on q.
+func (h *CommentHooks) saveUpdate(ctx context.Context, q sqlExecutor, dto CommentUpdateDTO, previous, model *Comment, editorID *string, now time.Time) error {
+	if dto.Content != nil && model.Content != previous.Content {
+		version, err := h.recordRevision(ctx, q, previous, editorID, now)
+		if err != nil {
+			return err
+		}
+		model.EditCount = version
+		model.EditedAt = &now
+	}
+
+	// The content of drafts may be stored encrypted, so it is written again
+	// when the status changes.
+	stored := *model
+	if err := h.cipher.seal(ctx, &stored); err != nil {
+		return err
+	}
+
+	b := query.New(h.db.Dialect()).Update("comment").
+		Set("updated_at", now)
+	if model.EncryptionKeyId == nil && stored.EncryptionKeyId != nil {
+		b = b.Set("encryption_key_id", stored.EncryptionKeyId).
+			Set("encrypted_data_key", stored.EncryptedDataKey)
+	}
+	if dto.Content != nil || (dto.Status != nil && h.cipher != nil && h.cipher.drafts) {
+		b = b.Set("content", stored.Content).
+			Set("content_html", stored.ContentHtml)
+	}
+	if dto.Content != nil {
+		b = b.Set("content_format", model.ContentFormat).
+			Set("mentions", model.Mentions).
+			Set("edit_count", model.EditCount).
+			Set("edited_at", model.EditedAt)
+	}
+	if dto.Status != nil {
+		b = b.Set("status", model.Status)
+		if model.PublishedAt != nil {
+			b = b.Set("published_at", model.PublishedAt)
+		}
+		if model.ModeratedAt != nil {
+			b = b.Set("moderated_at", model.ModeratedAt).
+				Set("moderated_by", model.ModeratedBy).
+				Set("moderation_reason", model.ModerationReason)
+		}
+	}
+
+	stmt, args, err := b.Where(query.Eq("id", model.Id)).Build()
+	if err != nil {
+		return err
+	}
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return err
+	}
+
+	if dto.Content != nil {
+		if err := h.SaveMentions(ctx, q, model); err != nil {
+			return err
+		}
+	}
+	if dto.Status != nil {
+		target := CommentTarget{model.Commentable, model.CommentableId}
+		if err := adjustTargetStats(ctx, h.db, q, target, statsEntryOf(previous), statsEntryOf(model)); err != nil {
+			return err
+		}
 	}
 
+	var events []string
+	if dto.Status != nil {
+		events = append(events, statusWebhookEvent(model.Status))
+	}
+	if dto.Content != nil && !slices.Contains(events, WebhookCommentUpdated) {
+		events = append(events, WebhookCommentUpdated)
+	}
+	for _, event := range events {
+		if err := h.webhooks.enqueue(ctx, q, event, *model); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// recordRevision snapshots the content existing is about to lose and returns
+// its version number, which is also the comment's new edit count. Numbering
+// follows the stored revisions rather than EditCount, and the unique
+// (comment_id, version) index rejects two edits racing for the same version.
+func (h *CommentHooks) recordRevision(ctx context.Context, q sqlExecutor, existing *Comment, editorID *string, now time.Time) (int, error) {
+	builder := query.New(h.db.Dialect())
+
+	stmt, args, err := builder.Select("version").
+		From("comment_revision").
+		Where(query.Eq("comment_id", existing.Id)).
+		OrderBy("version", query.DESC).
+		Limit(1).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	var latest int
+	if _, err := scanFirst(ctx, q, stmt, args, &latest); err != nil {
+		return 0, err
+	}
+
+	revision := CommentRevision{
+		Id:        uuid.New().String(),
+		CommentId: existing.Id,
+		Version:   latest + 1,
+		Content:   existing.Content,
+		EditedBy:  editorID,
+	}
+	if err := h.cipher.sealRevision(ctx, existing, &revision); err != nil {
+		return 0, err
+	}
+
+	stmt, args, err = builder.Insert("comment_revision").
+		Columns("id", "comment_id", "version", "content", "edited_by", "created_at").
+		Values(revision.Id, revision.CommentId, revision.Version, revision.Content, revision.EditedBy, now).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return 0, err
+	}
+	return revision.Version, nil
+}
+
+// validateParent enforces the nesting rules for replies: nesting must be
+// enabled, the parent must exist on the same commentable target, and the new
+// comment must not sit deeper than MaxNestingDepth (roots are level 1), which
+// is the deepest level fetchThread will ever load. A parent the caller cannot
+// see is reported as missing, so replies do not reveal hidden comments. It
+// returns the parent, or nil for a root comment.
+func (h *CommentHooks) validateParent(c fiber.Ctx, dto CommentCreateDTO) (*Comment, error) {
+	if dto.ParentId == nil {
+		return nil, nil
+	}
+
+	if !h.config.EnableNesting {
+		return nil, fiber.NewError(400, "nested comments are disabled")
+	}
+
+	res, err := storedComments(h.db, h.cipher).GetAllPaginated(auth.Context(c), crud.PaginationOptions{
+		Limit:      1,
+		Conditions: append([]query.Condition{query.Eq("id", *dto.ParentId)}, h.statusConditions(c)...),
+	})
+	if err != nil || len(res.Items) == 0 {
+		return nil, fiber.NewError(400, "parent comment not found")
+	}
+	parent := &res.Items[0]
+
+	if parent.DeletedAt != nil {
+		return nil, fiber.NewError(400, "cannot reply to a deleted comment")
+	}
+
+	if parent.Commentable != dto.Commentable || parent.CommentableId != dto.CommentableId {
+		return nil, fiber.NewError(400, "parent comment belongs to a different commentable target")
+	}
+
+	// depth is zero-based, so the reply lands on level parent.Depth+2.
+	if parent.Depth+2 > h.config.MaxNestingDepth {
+		return nil, fiber.NewError(400, fmt.Sprintf("maximum nesting depth of %d exceeded", h.config.MaxNestingDepth))
+	}
+
+	return parent, nil
+}
+
+// statusActor returns the role the caller plays in a status transition of
+// existing. Moderators act as the author on their own comments.
+func (h *CommentHooks) statusActor(c fiber.Ctx, existing *Comment) string {
+	return transitionActor(h.isAdmin(c), h.isModerator(c), auth.GetAuthenticatedUser(c), existing.UserId)
+}
+
 func (h *CommentHooks) checkOwnership(c fiber.Ctx, existing *Comment) error {
 	// Anonymous comment - only moderators can edit
 	if existing.UserId == nil {
@@ -182,7 +652,9 @@ func (h *CommentHooks) checkOwnership(c fiber.Ctx, existing *Comment) error {
 	return fiber.NewError(403, "You can only edit your own comments")
 }
 
-func (h *CommentHooks) validateAndSanitizeContent(content string) (string, error) {
+// validateContent trims content and checks its length. Content is stored as
+// written; contentHtml is the only rendered form.
+func (h *CommentHooks) validateContent(content string) (string, error) {
 	trimmed := strings.TrimSpace(content)
 	if trimmed == "" {
 		return "", fiber.NewError(400, "content cannot be empty")
@@ -192,7 +664,7 @@ func (h *CommentHooks) validateAndSanitizeContent(content string) (string, error
 		return "", fiber.NewError(400, "content exceeds maximum length")
 	}
 
-	return html.EscapeString(trimmed), nil
+	return trimmed, nil
 }
 
 func (h *CommentHooks) validateStatus(status string) error {
@@ -208,7 +680,7 @@ func (h *CommentHooks) Delete(c fiber.Ctx, id any) error {
 	ctx := auth.Context(c)
 
 	existing, err := h.getComment(ctx, id)
-	if err != nil {
+	if err != nil || existing.DeletedAt != nil {
 		return fiber.NewError(404, "Comment not found")
 	}
 
@@ -233,6 +705,252 @@ func (h *CommentHooks) Delete(c fiber.Ctx, id any) error {
 	return fiber.NewError(403, "You can only delete your own comments")
 }
 
+// sqlExecutor is the part of database.Database and database.Tx used to
+// remove comments, so removal runs the same standalone or inside a bulk
+// moderation transaction.
+type sqlExecutor interface {
+	Query(ctx context.Context, query string, args ...interface{}) (database.Rows, error)
+	Exec(ctx context.Context, query string, args ...interface{}) (database.Result, error)
+}
+
+// Remove deletes a comment once Delete has authorized it. A comment with
+// replies is turned into a tombstone (content cleared, deleted_at/deleted_by
+// set) so the parent_id ON DELETE CASCADE never takes its replies with it; a
+// leaf is deleted outright, along with any tombstoned ancestors it was the
+// last reply of.
+//
+// The removal, the update of the target's stats and the comment.deleted
+// webhooks run in one transaction; subscribers are told once it committed.
+func (h *CommentHooks) Remove(c fiber.Ctx, id string) error {
+	ctx := auth.Context(c)
+	user := auth.GetAuthenticatedUser(c)
+
+	removed, err := h.eventComments(ctx, []string{id})
+	if err != nil {
+		return err
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+
+	target, entry, found, err := loadStatsEntry(ctx, h.db, tx, id)
+	if err == nil && found {
+		found, err = h.removeComment(ctx, tx, id, user)
+	}
+	if err == nil && found {
+		err = adjustTargetStats(ctx, h.db, tx, target, entry, statsEntry{})
+	}
+	if comment, ok := removed[id]; ok && err == nil && found {
+		err = h.webhooks.enqueue(ctx, tx, WebhookCommentDeleted, deletedComment(comment, user))
+	}
+	if err != nil || !found {
+		_ = tx.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		return fiber.NewError(404, "Comment not found")
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	h.webhooks.notify()
+	if comment, ok := removed[id]; ok {
+		h.events.publishDeleted(ctx, CommentDeletedEvent{Comment: comment, ActorID: userIDOf(user)})
+	}
+	return nil
+}
+
+// removeComment implements Remove on q. It reports false when there is no
+// such comment or it is already a tombstone.
+func (h *CommentHooks) removeComment(ctx context.Context, q sqlExecutor, id string, user *auth.AuthenticatedUser) (bool, error) {
+	parentID, deleted, found, err := h.removalState(ctx, q, id)
+	if err != nil || !found || deleted {
+		return false, err
+	}
+
+	hasReplies, err := h.hasReplies(ctx, q, id)
+	if err != nil {
+		return false, err
+	}
+
+	if hasReplies {
+		return true, h.tombstone(ctx, q, id, user)
+	}
+
+	if err := h.hardDelete(ctx, q, id); err != nil {
+		return false, err
+	}
+
+	// Prune tombstones left without any reply to hold in place. Bounded by
+	// the nesting depth since each step moves one level up.
+	for parentID != nil {
+		id := *parentID
+		grandparentID, deleted, found, err := h.removalState(ctx, q, id)
+		if err != nil || !found || !deleted {
+			return true, err
+		}
+		hasReplies, err := h.hasReplies(ctx, q, id)
+		if err != nil || hasReplies {
+			return true, err
+		}
+		if err := h.hardDelete(ctx, q, id); err != nil {
+			return true, err
+		}
+		parentID = grandparentID
+	}
+
+	return true, nil
+}
+
+// removalState loads what removal needs to know about a comment: its parent
+// and whether it is already a tombstone.
+func (h *CommentHooks) removalState(ctx context.Context, q sqlExecutor, id string) (parentID *string, deleted bool, found bool, err error) {
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("parent_id").
+		SelectExpr(query.RawExpr("CASE WHEN deleted_at IS NULL THEN 0 ELSE 1 END")).
+		From("comment").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return nil, false, false, err
+	}
+
+	var parent sql.NullString
+	var isDeleted int
+	found, err = scanFirst(ctx, q, stmt, args, &parent, &isDeleted)
+	if err != nil || !found {
+		return nil, false, found, err
+	}
+	if parent.Valid {
+		parentID = &parent.String
+	}
+	return parentID, isDeleted == 1, true, nil
+}
+
+// tombstone clears a comment's content and marks it deleted. Only those
+// columns are written: the row was read through the caller's RBAC filter, so
+// writing it back whole would wipe fields they cannot see.
+func (h *CommentHooks) tombstone(ctx context.Context, q sqlExecutor, id string, user *auth.AuthenticatedUser) error {
+	now := time.Now().UTC()
+	var deletedBy *string
+	if user != nil {
+		deletedBy = &user.UserID
+	}
+
+	stmt, args, err := query.New(h.db.Dialect()).Update("comment").
+		Set("content", "").
+		Set("content_html", nil).
+		Set("mentions", nil).
+		Set("deleted_at", now).
+		Set("deleted_by", deletedBy).
+		Set("updated_at", now).
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return err
+	}
+
+	// The mentions went with the content.
+	stmt, args, err = query.New(h.db.Dialect()).Delete("comment_mention").
+		Where(query.Eq("comment_id", id)).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(ctx, stmt, args...)
+	return err
+}
+
+func (h *CommentHooks) hardDelete(ctx context.Context, q sqlExecutor, id string) error {
+	stmt, args, err := query.New(h.db.Dialect()).Delete("comment").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	_, err = q.Exec(ctx, stmt, args...)
+	return err
+}
+
+// hasReplies reports whether any comment, whatever its status, replies
+// directly to id.
+func (h *CommentHooks) hasReplies(ctx context.Context, q sqlExecutor, id string) (bool, error) {
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("id").
+		From("comment").
+		Where(query.Eq("parent_id", id)).
+		Limit(1).
+		Build()
+	if err != nil {
+		return false, err
+	}
+
+	var replyID string
+	return scanFirst(ctx, q, stmt, args, &replyID)
+}
+
+// scanFirst scans the first row of a query into dest and reports whether
+// there was one. The cursor is closed before returning, since SQLite cannot
+// write to a table while a read cursor on it is still open.
+func scanFirst(ctx context.Context, q sqlExecutor, stmt string, args []any, dest ...any) (bool, error) {
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		return false, rows.Err()
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// upsertStatement builds an insert of one row of columns into table that, when
+// a row with the same key already exists, updates it instead: the columns in
+// add are incremented by the inserted value and the others overwritten with
+// it. The query builder only knows ON CONFLICT DO NOTHING, so the statement is
+// written by hand; its placeholders follow the order of columns.
+func upsertStatement(db database.Database, table string, key, columns, add []string) string {
+	dialect := db.Dialect()
+	placeholders := make([]string, len(columns))
+	for i := range columns {
+		placeholders[i] = dialect.Placeholder(i + 1)
+	}
+
+	isMySQL := db.DriverName() == "mysql"
+	var set []string
+	for _, column := range columns {
+		if slices.Contains(key, column) {
+			continue
+		}
+		value := "excluded." + column
+		if isMySQL {
+			value = "VALUES(" + column + ")"
+		}
+		if slices.Contains(add, column) {
+			value = column + " + " + value
+		}
+		set = append(set, column+" = "+value)
+	}
+
+	stmt := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s) ", table, strings.Join(columns, ", "), strings.Join(placeholders, ", "))
+	if isMySQL {
+		return stmt + "ON DUPLICATE KEY UPDATE " + strings.Join(set, ", ")
+	}
+	return stmt + "ON CONFLICT (" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(set, ", ")
+}
+
 func (h *CommentHooks) GetByID(c fiber.Ctx, id any) error {
 	ctx := auth.Context(c)
 
@@ -250,6 +968,16 @@ func (h *CommentHooks) GetByID(c fiber.Ctx, id any) error {
 
 func (h *CommentHooks) GetAll(c fiber.Ctx, conditions *[]query.Condition, orderBy *[]crud.OrderByClause) error {
 	*conditions = append(*conditions, h.statusConditions(c)...)
+
+	// An explicit sort takes precedence over order[] parameters, which then
+	// only break its ties.
+	if value := c.Query("sort"); value != "" {
+		sortMode, err := parseSort(value)
+		if err != nil {
+			return fiber.NewError(400, err.Error())
+		}
+		*orderBy = append(listOrder(sortMode), *orderBy...)
+	}
 	return nil
 }
 
@@ -291,5 +1019,5 @@ func (h *CommentHooks) defaultGetComment(ctx context.Context, id any) (*Comment,
 	if !ok {
 		return nil, errors.New("invalid ID type")
 	}
-	return crud.New[Comment](h.db).GetByID(ctx, idStr)
+	return storedComments(h.db, h.cipher).GetByID(ctx, idStr)
 }
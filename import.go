@@ -0,0 +1,366 @@
+package commentable
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// ImportedComment is a comment coming from another system, as handed to an
+// Importer by the parsers of the importer package.
+type ImportedComment struct {
+	// RemoteID identifies the comment in its source; RemoteParentID, when
+	// set, is the RemoteID of the comment it replies to.
+	RemoteID       string
+	RemoteParentID string
+	Target         CommentTarget
+	UserId         *string
+	Content        string
+	Status         string
+	IpAddress      *string
+	UserAgent      *string
+	CreatedAt      time.Time
+	// Deleted comments are imported as tombstones, so that their replies
+	// keep their place in the thread.
+	Deleted bool
+}
+
+// ImportStats counts what an import did.
+type ImportStats struct {
+	// Imported comments were stored by this run.
+	Imported int `json:"imported"`
+	// Existing comments had been imported before and were left untouched.
+	Existing int `json:"existing"`
+	// Updated comments had been imported before and were updated with what
+	// the source says now.
+	Updated int `json:"updated"`
+	// Orphaned comments reply to a comment missing from the source; they
+	// were imported as roots.
+	Orphaned int `json:"orphaned"`
+}
+
+// Importer stores comments imported from one source. Comments are tracked by
+// remote_source and remote_source_id, whose unique index makes a re-run skip
+// what was already imported, or update it when UpdateExisting is set.
+//
+// A reply can be added before the comment it replies to: it is held back
+// until its parent is stored, or imported as a root by Finish. Imports do not
+// go through the hooks: there are no content checks, mentions, notifications,
+// webhooks or events, and the target stats are refreshed once by Finish.
+type Importer struct {
+	db     database.Database
+	config *Config
+	cipher *commentCipher
+	source string
+
+	// UpdateExisting updates the comments imported before with what the
+	// source says now. They keep their place in their thread, and what was
+	// decided about them here is kept: tombstones and comments whose author
+	// was erased are left untouched, moderated comments keep their status,
+	// and scrubbed ones are not given their IP address and user agent back.
+	UpdateExisting bool
+
+	// positions holds the thread position of the comments stored or found
+	// so far, by remote id, for their replies to be placed under them.
+	positions map[string]*Comment
+	pending   map[string][]ImportedComment
+	targets   map[CommentTarget]bool
+	stats     ImportStats
+}
+
+func NewImporter(db database.Database, config *Config, source string) *Importer {
+	return &Importer{
+		db:        db,
+		config:    config,
+		cipher:    newCommentCipher(config),
+		source:    source,
+		positions: map[string]*Comment{},
+		pending:   map[string][]ImportedComment{},
+		targets:   map[CommentTarget]bool{},
+	}
+}
+
+// Add stores comment, or holds it back until its parent is stored.
+func (im *Importer) Add(ctx context.Context, comment ImportedComment) error {
+	if comment.RemoteID == "" {
+		return fmt.Errorf("imported comment has no remote id")
+	}
+	if !im.config.IsAllowedType(comment.Target.Commentable) {
+		return fmt.Errorf("comment %s: commentable type is not allowed: %s", comment.RemoteID, comment.Target.Commentable)
+	}
+	if comment.Status != "" && !slices.Contains(ValidStatuses, comment.Status) {
+		return fmt.Errorf("comment %s: invalid status: %s", comment.RemoteID, comment.Status)
+	}
+
+	var parent *Comment
+	if comment.RemoteParentID != "" {
+		var err error
+		parent, err = im.position(ctx, comment.RemoteParentID)
+		if err != nil {
+			return err
+		}
+		if parent == nil {
+			im.pending[comment.RemoteParentID] = append(im.pending[comment.RemoteParentID], comment)
+			return nil
+		}
+	}
+	return im.store(ctx, comment, parent)
+}
+
+// Finish imports the replies whose parent never showed up as roots, then
+// refreshes the stats of every target comments were imported on.
+func (im *Importer) Finish(ctx context.Context) (ImportStats, error) {
+	for len(im.pending) > 0 {
+		for parentID, replies := range im.pending {
+			delete(im.pending, parentID)
+			for _, reply := range replies {
+				existing, err := im.position(ctx, reply.RemoteID)
+				if err != nil {
+					return im.stats, err
+				}
+				if existing == nil {
+					im.stats.Orphaned++
+				}
+				if err := im.store(ctx, reply, nil); err != nil {
+					return im.stats, err
+				}
+			}
+		}
+	}
+
+	for target := range im.targets {
+		if err := updateTargetStats(ctx, im.db, target); err != nil {
+			return im.stats, err
+		}
+	}
+	return im.stats, nil
+}
+
+// position returns the thread position of the comment imported as remoteID,
+// or nil when it is not stored yet.
+func (im *Importer) position(ctx context.Context, remoteID string) (*Comment, error) {
+	if position, ok := im.positions[remoteID]; ok {
+		return position, nil
+	}
+
+	stmt, args, err := query.New(im.db.Dialect()).
+		Select("id", "depth", "root_id", "path").
+		From("comment").
+		Where(query.And(
+			query.Eq("remote_source", im.source),
+			query.Eq("remote_source_id", remoteID),
+		)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	var position Comment
+	var rootID, path sql.NullString
+	found, err := scanFirst(ctx, im.db, stmt, args, &position.Id, &position.Depth, &rootID, &path)
+	if err != nil || !found {
+		return nil, err
+	}
+	if rootID.Valid {
+		position.RootId = &rootID.String
+	}
+	if path.Valid {
+		position.Path = &path.String
+	}
+	im.positions[remoteID] = &position
+	return &position, nil
+}
+
+// store inserts comment under parent unless it was imported before, then
+// stores the replies held back for it.
+func (im *Importer) store(ctx context.Context, comment ImportedComment, parent *Comment) error {
+	existing, err := im.position(ctx, comment.RemoteID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case existing != nil && im.UpdateExisting:
+		updated, err := im.update(ctx, existing.Id, im.model(comment, nil))
+		if err != nil {
+			return fmt.Errorf("import comment %s: %w", comment.RemoteID, err)
+		}
+		if updated {
+			im.targets[comment.Target] = true
+			im.stats.Updated++
+		} else {
+			im.stats.Existing++
+		}
+	case existing != nil:
+		im.stats.Existing++
+	default:
+		model := im.model(comment, parent)
+		if err := im.insert(ctx, model); err != nil {
+			return fmt.Errorf("import comment %s: %w", comment.RemoteID, err)
+		}
+		im.positions[comment.RemoteID] = &Comment{Id: model.Id, Depth: model.Depth, RootId: model.RootId, Path: model.Path}
+		im.targets[comment.Target] = true
+		im.stats.Imported++
+	}
+
+	replies := im.pending[comment.RemoteID]
+	delete(im.pending, comment.RemoteID)
+	for _, reply := range replies {
+		if err := im.store(ctx, reply, im.positions[comment.RemoteID]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insert writes model with its own timestamps, which the CRUD layer would
+// replace.
+func (im *Importer) insert(ctx context.Context, model Comment) error {
+	if err := im.cipher.seal(ctx, &model); err != nil {
+		return err
+	}
+	stmt, args, err := query.New(im.db.Dialect()).
+		Insert("comment").
+		Columns(
+			"id", "user_id", "commentable", "commentable_id", "parent_id",
+			"depth", "root_id", "path", "content", "content_format", "content_html",
+			"status", "ip_address", "user_agent", "remote_source_id", "remote_source",
+			"published_at", "deleted_at", "updated_at", "created_at",
+			"encryption_key_id", "encrypted_data_key",
+		).
+		Values(
+			model.Id, model.UserId, model.Commentable, model.CommentableId, model.ParentId,
+			model.Depth, model.RootId, model.Path, model.Content, model.ContentFormat, model.ContentHtml,
+			model.Status, model.IpAddress, model.UserAgent, model.RemoteSourceId, model.RemoteSource,
+			model.PublishedAt, model.DeletedAt, model.UpdatedAt, model.CreatedAt,
+			model.EncryptionKeyId, model.EncryptedDataKey,
+		).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = im.db.Exec(ctx, stmt, args...)
+	return err
+}
+
+// update overwrites the imported columns of the comment id with model, except
+// its target and thread position, and reports whether it did. Tombstones and
+// comments whose author was erased are left as they are; moderated comments
+// keep their status, and comments scrubbed of their PII keep them scrubbed.
+// The comment keeps its data key, which the columns kept may be encrypted
+// with.
+func (im *Importer) update(ctx context.Context, id string, model Comment) (bool, error) {
+	stmt, args, err := query.New(im.db.Dialect()).
+		Select(
+			"user_id", "status", "ip_address", "user_agent", "published_at",
+			"moderated_at", "pii_scrubbed_at", "deleted_at",
+			"encryption_key_id", "encrypted_data_key",
+		).
+		From("comment").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	var local Comment
+	var scrubbedAt *time.Time
+	found, err := scanFirst(ctx, im.db, stmt, args,
+		&local.UserId, &local.Status, &local.IpAddress, &local.UserAgent, &local.PublishedAt,
+		&local.ModeratedAt, &scrubbedAt, &local.DeletedAt,
+		&local.EncryptionKeyId, &local.EncryptedDataKey,
+	)
+	if err != nil || !found {
+		return false, err
+	}
+	// Erasure removes the author the source still names.
+	if local.DeletedAt != nil || (local.UserId == nil && model.UserId != nil) {
+		return false, nil
+	}
+	if local.ModeratedAt != nil {
+		model.Status, model.PublishedAt = local.Status, local.PublishedAt
+	}
+	if scrubbedAt != nil {
+		model.IpAddress, model.UserAgent = local.IpAddress, local.UserAgent
+	}
+	model.EncryptionKeyId, model.EncryptedDataKey = local.EncryptionKeyId, local.EncryptedDataKey
+
+	model.Id = id
+	if err := im.cipher.seal(ctx, &model); err != nil {
+		return false, err
+	}
+	stmt, args, err = query.New(im.db.Dialect()).
+		Update("comment").
+		Set("user_id", model.UserId).
+		Set("content", model.Content).
+		Set("content_format", model.ContentFormat).
+		Set("content_html", model.ContentHtml).
+		Set("status", model.Status).
+		Set("ip_address", model.IpAddress).
+		Set("user_agent", model.UserAgent).
+		Set("published_at", model.PublishedAt).
+		Set("deleted_at", model.DeletedAt).
+		Set("updated_at", time.Now().UTC()).
+		Set("created_at", model.CreatedAt).
+		Set("encryption_key_id", model.EncryptionKeyId).
+		Set("encrypted_data_key", model.EncryptedDataKey).
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	_, err = im.db.Exec(ctx, stmt, args...)
+	return err == nil, err
+}
+
+// model builds the comment row for an imported comment.
+func (im *Importer) model(comment ImportedComment, parent *Comment) Comment {
+	createdAt := comment.CreatedAt.UTC()
+	if comment.CreatedAt.IsZero() {
+		createdAt = time.Now().UTC()
+	}
+	remoteID := comment.RemoteID
+	source := im.source
+
+	model := Comment{
+		Id:             uuid.New().String(),
+		UserId:         comment.UserId,
+		Commentable:    comment.Target.Commentable,
+		CommentableId:  comment.Target.CommentableId,
+		Status:         comment.Status,
+		ContentFormat:  im.config.ContentFormat(comment.Target.Commentable),
+		RemoteSourceId: &remoteID,
+		RemoteSource:   &source,
+		CreatedAt:      &createdAt,
+		UpdatedAt:      &createdAt,
+	}
+	if comment.IpAddress != nil {
+		model.IpAddress = im.config.storedIP(*comment.IpAddress)
+	}
+	if comment.UserAgent != nil {
+		model.UserAgent = im.config.storedUserAgent(*comment.UserAgent)
+	}
+	if model.Status == "" {
+		model.Status = im.config.DefaultStatus
+	}
+	if model.Status == StatusPublished {
+		model.PublishedAt = &createdAt
+	}
+	if parent != nil {
+		model.ParentId = &parent.Id
+	}
+	setThreadPosition(&model, parent, createdAt)
+
+	if comment.Deleted {
+		model.DeletedAt = &createdAt
+		return model
+	}
+	model.Content = strings.TrimSpace(comment.Content)
+	contentHTML := renderContent(model.ContentFormat, model.Content)
+	model.ContentHtml = &contentHTML
+	return model
+}
@@ -0,0 +1,175 @@
+package importer
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	commentable "github.com/nicolasbonnici/gorest-commentable"
+	"github.com/nicolasbonnici/gorest/database"
+)
+
+// SourceDisqus is the remote_source of comments imported from Disqus.
+const SourceDisqus = "disqus"
+
+// DisqusThread is a discussion of a Disqus export, usually one page of the
+// site. ID is its Disqus id; Identifier is the one the site gave it when
+// embedding Disqus, if any.
+type DisqusThread struct {
+	ID         string `xml:"id,attr"`
+	Identifier string `xml:"id"`
+	Link       string `xml:"link"`
+	Title      string `xml:"title"`
+}
+
+// DisqusAuthor is the author of a Disqus comment.
+type DisqusAuthor struct {
+	Name      string `xml:"name"`
+	Email     string `xml:"email"`
+	Username  string `xml:"username"`
+	Anonymous bool   `xml:"isAnonymous"`
+}
+
+type disqusRef struct {
+	ID string `xml:"id,attr"`
+}
+
+type disqusPost struct {
+	ID        string       `xml:"id,attr"`
+	Message   string       `xml:"message"`
+	CreatedAt string       `xml:"createdAt"`
+	IsDeleted bool         `xml:"isDeleted"`
+	IsSpam    bool         `xml:"isSpam"`
+	Author    DisqusAuthor `xml:"author"`
+	IPAddress string       `xml:"ipAddress"`
+	Thread    disqusRef    `xml:"thread"`
+	Parent    disqusRef    `xml:"parent"`
+}
+
+// DisqusOptions configures ImportDisqus.
+type DisqusOptions struct {
+	// ResolveThread maps a thread to the target its comments are imported
+	// on. Returning false skips the comments of the thread. Required.
+	ResolveThread func(ctx context.Context, thread DisqusThread) (commentable.CommentTarget, bool, error)
+	// ResolveAuthor maps an author to the id of a user. Comments whose
+	// author is not mapped, or all of them when it is nil, are imported
+	// without one.
+	ResolveAuthor func(ctx context.Context, author DisqusAuthor) (*string, error)
+}
+
+// ImportDisqus imports the comments of a Disqus XML export read from r.
+// Comments keep their thread, replies, creation time and author's IP
+// address; spam is imported as moderated and deleted comments as tombstones.
+// Messages are converted from HTML to text.
+//
+// Threads and comments are decoded one at a time. Comments already imported
+// from Disqus are left as they are, so an interrupted import can be run
+// again.
+func ImportDisqus(ctx context.Context, db database.Database, config *commentable.Config, r io.Reader, opts DisqusOptions) (Result, error) {
+	var result Result
+	if opts.ResolveThread == nil {
+		return result, errors.New("a thread resolver is required")
+	}
+
+	im := commentable.NewImporter(db, config, SourceDisqus)
+	// targets maps the Disqus id of each resolved thread to its target;
+	// threads that were not resolved map to nil.
+	targets := map[string]*commentable.CommentTarget{}
+
+	decoder := xml.NewDecoder(r)
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("read disqus export: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		switch start.Name.Local {
+		case "disqus":
+			// The root element: its children are what is imported.
+		case "thread":
+			var thread DisqusThread
+			if err := decoder.DecodeElement(&thread, &start); err != nil {
+				return result, fmt.Errorf("read disqus thread: %w", err)
+			}
+			target, ok, err := opts.ResolveThread(ctx, thread)
+			if err != nil {
+				return result, fmt.Errorf("resolve disqus thread %s: %w", thread.ID, err)
+			}
+			targets[thread.ID] = nil
+			if ok {
+				targets[thread.ID] = &target
+			}
+		case "post":
+			var post disqusPost
+			if err := decoder.DecodeElement(&post, &start); err != nil {
+				return result, fmt.Errorf("read disqus post: %w", err)
+			}
+			target := targets[post.Thread.ID]
+			if target == nil {
+				result.Skipped++
+				continue
+			}
+			comment, err := disqusComment(ctx, post, *target, opts)
+			if err != nil {
+				return result, err
+			}
+			if err := im.Add(ctx, comment); err != nil {
+				return result, err
+			}
+		default:
+			// Categories and anything else are not imported.
+			if err := decoder.Skip(); err != nil {
+				return result, fmt.Errorf("read disqus export: %w", err)
+			}
+		}
+	}
+
+	stats, err := im.Finish(ctx)
+	result.ImportStats = stats
+	return result, err
+}
+
+func disqusComment(ctx context.Context, post disqusPost, target commentable.CommentTarget, opts DisqusOptions) (commentable.ImportedComment, error) {
+	comment := commentable.ImportedComment{
+		RemoteID:       post.ID,
+		RemoteParentID: post.Parent.ID,
+		Target:         target,
+		Content:        htmlToText(post.Message),
+		Status:         commentable.StatusPublished,
+		Deleted:        post.IsDeleted,
+	}
+	if post.IsSpam {
+		comment.Status = commentable.StatusModerated
+	}
+	if ip := strings.TrimSpace(post.IPAddress); ip != "" {
+		comment.IpAddress = &ip
+	}
+
+	if createdAt := strings.TrimSpace(post.CreatedAt); createdAt != "" {
+		t, err := time.Parse(time.RFC3339, createdAt)
+		if err != nil {
+			return comment, fmt.Errorf("disqus post %s: invalid createdAt: %w", post.ID, err)
+		}
+		comment.CreatedAt = t
+	}
+
+	if opts.ResolveAuthor != nil {
+		userID, err := opts.ResolveAuthor(ctx, post.Author)
+		if err != nil {
+			return comment, fmt.Errorf("resolve author of disqus post %s: %w", post.ID, err)
+		}
+		comment.UserId = userID
+	}
+	return comment, nil
+}
@@ -0,0 +1,198 @@
+package importer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	_ "github.com/nicolasbonnici/gorest/database/sqlite"
+	"github.com/nicolasbonnici/gorest/query"
+
+	commentable "github.com/nicolasbonnici/gorest-commentable"
+	"github.com/nicolasbonnici/gorest-commentable/migrations"
+)
+
+func setupDB(t *testing.T) database.Database {
+	t.Helper()
+
+	db, err := database.Open("sqlite", "file:"+t.TempDir()+"/import.db")
+	if err != nil {
+		t.Fatalf("open sqlite: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `CREATE TABLE users (id TEXT PRIMARY KEY)`); err != nil {
+		t.Fatalf("create users: %v", err)
+	}
+	list, err := migrations.GetMigrations().Migrations()
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	for _, m := range list {
+		if err := m.ExecuteUp(ctx, db); err != nil {
+			t.Fatalf("migrate %s: %v", m.FullName(), err)
+		}
+	}
+	return db
+}
+
+// importedComments returns the comments imported from source by remote id.
+func importedComments(t *testing.T, db database.Database, source string) map[string]commentable.Comment {
+	t.Helper()
+	res, err := crud.New[commentable.Comment](db).GetAllPaginated(context.Background(), crud.PaginationOptions{
+		Limit:      100,
+		Conditions: []query.Condition{query.Eq("remote_source", source)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	comments := map[string]commentable.Comment{}
+	for _, comment := range res.Items {
+		comments[*comment.RemoteSourceId] = comment
+	}
+	return comments
+}
+
+const disqusExport = `<?xml version="1.0" encoding="utf-8"?>
+<disqus xmlns="http://disqus.com" xmlns:dsq="http://disqus.com/disqus-internals">
+  <category dsq:id="1"><forum>blog</forum><title>General</title><isDefault>true</isDefault></category>
+  <thread dsq:id="100">
+    <id>post-1</id>
+    <forum>blog</forum>
+    <category dsq:id="1"/>
+    <link>https://blog.example.com/hello</link>
+    <title>Hello</title>
+    <author><name>Admin</name><isAnonymous>false</isAnonymous><username>admin</username></author>
+  </thread>
+  <thread dsq:id="200">
+    <id/>
+    <link>https://blog.example.com/elsewhere</link>
+  </thread>
+  <post dsq:id="2">
+    <message><![CDATA[<p>I agree.</p>]]></message>
+    <createdAt>2015-03-01T10:05:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>false</isSpam>
+    <author><name>Bob</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="100"/>
+    <parent dsq:id="1"/>
+  </post>
+  <post dsq:id="1">
+    <id/>
+    <message><![CDATA[<p>First &amp; foremost,</p><p>see <a href="https://example.com">the docs</a><br>thanks</p>]]></message>
+    <createdAt>2015-03-01T10:00:00Z</createdAt>
+    <isDeleted>false</isDeleted>
+    <isSpam>false</isSpam>
+    <author><name>Alice</name><email>alice@example.com</email><isAnonymous>false</isAnonymous><username>alice</username></author>
+    <ipAddress>203.0.113.7</ipAddress>
+    <thread dsq:id="100"/>
+  </post>
+  <post dsq:id="3">
+    <message><![CDATA[<p>Buy now</p>]]></message>
+    <createdAt>2015-03-02T00:00:00Z</createdAt>
+    <isDeleted>true</isDeleted>
+    <isSpam>true</isSpam>
+    <author><name>Spammer</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="100"/>
+  </post>
+  <post dsq:id="4">
+    <message><![CDATA[<p>Replying to a lost comment</p>]]></message>
+    <createdAt>2015-03-03T00:00:00Z</createdAt>
+    <author><name>Carol</name><isAnonymous>true</isAnonymous></author>
+    <thread dsq:id="100"/>
+    <parent dsq:id="99"/>
+  </post>
+  <post dsq:id="5">
+    <message><![CDATA[<p>Elsewhere</p>]]></message>
+    <createdAt>2015-03-03T00:00:00Z</createdAt>
+    <thread dsq:id="200"/>
+  </post>
+</disqus>`
+
+func TestImportDisqus(t *testing.T) {
+	db := setupDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `INSERT INTO users (id) VALUES ('u-alice')`); err != nil {
+		t.Fatal(err)
+	}
+	cfg := commentable.DefaultConfig()
+	opts := DisqusOptions{
+		ResolveThread: func(_ context.Context, thread DisqusThread) (commentable.CommentTarget, bool, error) {
+			if thread.Identifier == "" {
+				return commentable.CommentTarget{}, false, nil
+			}
+			return commentable.CommentTarget{Commentable: "post", CommentableId: thread.Identifier}, true, nil
+		},
+		ResolveAuthor: func(_ context.Context, author DisqusAuthor) (*string, error) {
+			if author.Username == "alice" {
+				id := "u-alice"
+				return &id, nil
+			}
+			return nil, nil
+		},
+	}
+
+	result, err := ImportDisqus(ctx, db, &cfg, strings.NewReader(disqusExport), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 4 || result.Existing != 0 || result.Orphaned != 1 || result.Skipped != 1 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	comments := importedComments(t, db, SourceDisqus)
+	root, reply := comments["1"], comments["2"]
+	if root.Commentable != "post" || root.CommentableId != "post-1" || root.ParentId != nil {
+		t.Errorf("expected a root comment on post/post-1, got %+v", root)
+	}
+	if root.Content != "First & foremost,\n\nsee the docs (https://example.com)\nthanks" {
+		t.Errorf("unexpected content %q", root.Content)
+	}
+	if root.UserId == nil || *root.UserId != "u-alice" {
+		t.Errorf("expected the author to be kept, got %+v", root.UserId)
+	}
+	// The IP address is only readable by moderators through the CRUD layer.
+	var ip string
+	if err := db.QueryRow(ctx, `SELECT ip_address FROM comment WHERE id = ?`, root.Id).Scan(&ip); err != nil || ip != "203.0.113.7" {
+		t.Errorf("expected the IP address to be kept, got %q (%v)", ip, err)
+	}
+	if root.Status != commentable.StatusPublished || root.CreatedAt == nil || root.CreatedAt.Format("2006-01-02T15:04") != "2015-03-01T10:00" {
+		t.Errorf("expected a published comment keeping its creation time, got %+v", root)
+	}
+
+	// The reply came first in the export and was held back for its parent.
+	if reply.ParentId == nil || *reply.ParentId != root.Id || reply.Depth != 1 || *reply.RootId != root.Id {
+		t.Errorf("expected the reply to be nested under its parent, got %+v", reply)
+	}
+	if reply.UserId != nil || !strings.HasPrefix(*reply.Path, *root.Path) {
+		t.Errorf("expected an anonymous reply below its parent's path, got %+v", reply)
+	}
+	if spam := comments["3"]; spam.Status != commentable.StatusModerated || spam.DeletedAt == nil || spam.Content != "" {
+		t.Errorf("expected a moderated tombstone, got %+v", spam)
+	}
+	if orphan := comments["4"]; orphan.ParentId != nil || orphan.Depth != 0 {
+		t.Errorf("expected the orphaned reply to become a root, got %+v", orphan)
+	}
+
+	stats, err := crud.New[commentable.CommentTargetStats](db).GetAllPaginated(ctx, crud.PaginationOptions{Limit: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats.Items) != 1 || stats.Items[0].PublishedCount != 3 || stats.Items[0].TotalCount != 3 {
+		t.Errorf("expected the target stats to be refreshed, got %+v", stats.Items)
+	}
+
+	again, err := ImportDisqus(ctx, db, &cfg, strings.NewReader(disqusExport), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Imported != 0 || again.Existing != 4 || again.Orphaned != 0 {
+		t.Errorf("expected a re-run to import nothing, got %+v", again)
+	}
+	if n := len(importedComments(t, db, SourceDisqus)); n != 4 {
+		t.Errorf("expected 4 comments after a re-run, got %d", n)
+	}
+}
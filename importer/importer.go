@@ -0,0 +1,90 @@
+// Package importer imports comments exported from other commenting systems.
+// The exports are streamed, so their size is not limited by memory, and
+// stored through commentable.Importer, which makes running an import twice
+// harmless.
+package importer
+
+import (
+	"regexp"
+	"strings"
+
+	commentable "github.com/nicolasbonnici/gorest-commentable"
+	xhtml "golang.org/x/net/html"
+)
+
+// Result counts what an import did. Skipped comments were left out because
+// the resolver did not map their discussion to a target.
+type Result struct {
+	commentable.ImportStats
+	Skipped int `json:"skipped"`
+}
+
+// blockTags end a paragraph of the text extracted by htmlToText.
+var blockTags = map[string]bool{
+	"p": true, "div": true, "blockquote": true, "pre": true,
+	"ul": true, "ol": true, "li": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+}
+
+var extraLines = regexp.MustCompile(`\n{3,}`)
+
+// htmlToText turns the HTML of an exported comment into plain text, keeping
+// its paragraphs and line breaks. Links keep their target after their text.
+func htmlToText(input string) string {
+	var b strings.Builder
+	tokenizer := xhtml.NewTokenizer(strings.NewReader(input))
+	var hrefs []string
+	skipping := 0
+
+	for {
+		tt := tokenizer.Next()
+		switch tt {
+		case xhtml.ErrorToken:
+			text := strings.ReplaceAll(b.String(), "\r\n", "\n")
+			return strings.TrimSpace(extraLines.ReplaceAllString(text, "\n\n"))
+
+		case xhtml.StartTagToken, xhtml.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch {
+			case token.Data == "script" || token.Data == "style":
+				if tt == xhtml.StartTagToken {
+					skipping++
+				}
+			case token.Data == "br":
+				b.WriteString("\n")
+			case token.Data == "a" && tt == xhtml.StartTagToken:
+				href := ""
+				for _, attr := range token.Attr {
+					if attr.Key == "href" {
+						href = attr.Val
+					}
+				}
+				hrefs = append(hrefs, href)
+			case blockTags[token.Data]:
+				b.WriteString("\n\n")
+			}
+
+		case xhtml.EndTagToken:
+			token := tokenizer.Token()
+			switch {
+			case token.Data == "script" || token.Data == "style":
+				if skipping > 0 {
+					skipping--
+				}
+			case token.Data == "a" && len(hrefs) > 0:
+				href := hrefs[len(hrefs)-1]
+				hrefs = hrefs[:len(hrefs)-1]
+				if href != "" && !strings.HasSuffix(b.String(), href) {
+					b.WriteString(" (" + href + ")")
+				}
+			case blockTags[token.Data]:
+				b.WriteString("\n\n")
+			}
+
+		case xhtml.TextToken:
+			if skipping == 0 {
+				b.Write(tokenizer.Text())
+			}
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package importer
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	commentable "github.com/nicolasbonnici/gorest-commentable"
+	"github.com/nicolasbonnici/gorest/database"
+)
+
+// SourceWordPress is the remote_source of comments imported from WordPress.
+const SourceWordPress = "wordpress"
+
+// wxrDateLayout is the layout of the dates of a WXR export.
+const wxrDateLayout = "2006-01-02 15:04:05"
+
+// WXRPost is a post, page or other item of a WordPress export.
+type WXRPost struct {
+	ID    string `xml:"post_id"`
+	Name  string `xml:"post_name"`
+	Type  string `xml:"post_type"`
+	Link  string `xml:"link"`
+	Title string `xml:"title"`
+}
+
+// WXRAuthor is the author of a WordPress comment. UserID is the id of their
+// WordPress account, "0" for guests.
+type WXRAuthor struct {
+	Name   string
+	Email  string
+	URL    string
+	UserID string
+}
+
+type wxrComment struct {
+	ID          string `xml:"comment_id"`
+	Author      string `xml:"comment_author"`
+	AuthorEmail string `xml:"comment_author_email"`
+	AuthorURL   string `xml:"comment_author_url"`
+	AuthorIP    string `xml:"comment_author_IP"`
+	Agent       string `xml:"comment_agent"`
+	Date        string `xml:"comment_date"`
+	DateGMT     string `xml:"comment_date_gmt"`
+	Content     string `xml:"comment_content"`
+	Approved    string `xml:"comment_approved"`
+	Type        string `xml:"comment_type"`
+	Parent      string `xml:"comment_parent"`
+	UserID      string `xml:"comment_user_id"`
+}
+
+type wxrItem struct {
+	WXRPost
+	Comments []wxrComment `xml:"comment"`
+}
+
+// WXROptions configures ImportWXR.
+type WXROptions struct {
+	// ResolvePost maps a post to the target its comments are imported on.
+	// Returning false skips the comments of the post. Required.
+	ResolvePost func(ctx context.Context, post WXRPost) (commentable.CommentTarget, bool, error)
+	// ResolveAuthor maps an author to the id of a user. Comments whose
+	// author is not mapped, or all of them when it is nil, are imported
+	// without one.
+	ResolveAuthor func(ctx context.Context, author WXRAuthor) (*string, error)
+	// RemoteIDPrefix is prepended to the WordPress comment ids, which are
+	// only unique within a site. Set it to tell sites apart when importing
+	// several of them.
+	RemoteIDPrefix string
+}
+
+// ImportWXR imports the comments of a WordPress export (WXR) read from r.
+// Comments keep their replies, creation time, and author's IP address and
+// user agent; approval maps to published, pending to awaiting, spam to
+// moderated, and trashed comments are imported as moderated tombstones.
+// Pingbacks and trackbacks are skipped.
+//
+// Items are decoded one at a time. Comments already imported from WordPress
+// are updated with the export, so a site can be imported again to catch up
+// with the comments it got since. What was decided about them here is kept:
+// see Importer.UpdateExisting.
+func ImportWXR(ctx context.Context, db database.Database, config *commentable.Config, r io.Reader, opts WXROptions) (Result, error) {
+	var result Result
+	if opts.ResolvePost == nil {
+		return result, errors.New("a post resolver is required")
+	}
+
+	im := commentable.NewImporter(db, config, SourceWordPress)
+	im.UpdateExisting = true
+
+	decoder := xml.NewDecoder(r)
+	// Comments are HTML, which exports do not always escape or wrap in
+	// CDATA.
+	decoder.Strict = false
+	decoder.Entity = xml.HTMLEntity
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return result, fmt.Errorf("read wordpress export: %w", err)
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "item" {
+			continue
+		}
+
+		var item wxrItem
+		if err := decoder.DecodeElement(&item, &start); err != nil {
+			return result, fmt.Errorf("read wordpress item: %w", err)
+		}
+		if len(item.Comments) == 0 {
+			continue
+		}
+		target, ok, err := opts.ResolvePost(ctx, item.WXRPost)
+		if err != nil {
+			return result, fmt.Errorf("resolve wordpress post %s: %w", item.ID, err)
+		}
+		if !ok {
+			result.Skipped += len(item.Comments)
+			continue
+		}
+
+		for _, c := range item.Comments {
+			if c.Type == "pingback" || c.Type == "trackback" {
+				result.Skipped++
+				continue
+			}
+			comment, err := wxrImportedComment(ctx, c, target, opts)
+			if err != nil {
+				return result, err
+			}
+			if err := im.Add(ctx, comment); err != nil {
+				return result, err
+			}
+		}
+	}
+
+	stats, err := im.Finish(ctx)
+	result.ImportStats = stats
+	return result, err
+}
+
+func wxrImportedComment(ctx context.Context, c wxrComment, target commentable.CommentTarget, opts WXROptions) (commentable.ImportedComment, error) {
+	id := strings.TrimSpace(c.ID)
+	comment := commentable.ImportedComment{
+		RemoteID: opts.RemoteIDPrefix + id,
+		Target:   target,
+		Content:  htmlToText(c.Content),
+		Status:   wxrStatus(c.Approved),
+	}
+	if parent := strings.TrimSpace(c.Parent); parent != "" && parent != "0" {
+		comment.RemoteParentID = opts.RemoteIDPrefix + parent
+	}
+	switch strings.TrimSpace(c.Approved) {
+	case "trash", "post-trashed":
+		comment.Deleted = true
+	}
+	if ip := strings.TrimSpace(c.AuthorIP); ip != "" {
+		comment.IpAddress = &ip
+	}
+	if agent := strings.TrimSpace(c.Agent); agent != "" {
+		comment.UserAgent = &agent
+	}
+
+	createdAt, err := wxrDate(c)
+	if err != nil {
+		return comment, fmt.Errorf("wordpress comment %s: %w", id, err)
+	}
+	comment.CreatedAt = createdAt
+
+	if opts.ResolveAuthor != nil {
+		userID, err := opts.ResolveAuthor(ctx, WXRAuthor{
+			Name:   strings.TrimSpace(c.Author),
+			Email:  strings.TrimSpace(c.AuthorEmail),
+			URL:    strings.TrimSpace(c.AuthorURL),
+			UserID: strings.TrimSpace(c.UserID),
+		})
+		if err != nil {
+			return comment, fmt.Errorf("resolve author of wordpress comment %s: %w", id, err)
+		}
+		comment.UserId = userID
+	}
+	return comment, nil
+}
+
+// wxrStatus maps wp:comment_approved to a comment status.
+func wxrStatus(approved string) string {
+	switch strings.TrimSpace(approved) {
+	case "1", "approve":
+		return commentable.StatusPublished
+	case "spam", "trash", "post-trashed":
+		return commentable.StatusModerated
+	default:
+		return commentable.StatusAwaiting
+	}
+}
+
+// wxrDate returns the creation time of c. The GMT date is missing from some
+// exports, in which case the local date of the site is taken as UTC.
+func wxrDate(c wxrComment) (time.Time, error) {
+	for _, value := range []string{c.DateGMT, c.Date} {
+		value = strings.TrimSpace(value)
+		if value == "" || strings.HasPrefix(value, "0000-00-00") {
+			continue
+		}
+		t, err := time.Parse(wxrDateLayout, value)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid comment date: %w", err)
+		}
+		return t, nil
+	}
+	return time.Time{}, nil
+}
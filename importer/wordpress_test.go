@@ -0,0 +1,190 @@
+package importer
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	commentable "github.com/nicolasbonnici/gorest-commentable"
+)
+
+const wxrExport = `<?xml version="1.0" encoding="UTF-8" ?>
+<rss version="2.0"
+	xmlns:content="http://purl.org/rss/1.0/modules/content/"
+	xmlns:dc="http://purl.org/dc/elements/1.1/"
+	xmlns:wp="http://wordpress.org/export/1.2/">
+<channel>
+	<title>My Blog</title>
+	<wp:wxr_version>1.2</wp:wxr_version>
+	<wp:base_site_url>https://blog.example.com</wp:base_site_url>
+	<item>
+		<title>Hello world!</title>
+		<link>https://blog.example.com/hello-world/</link>
+		<content:encoded><![CDATA[<p>Welcome to WordPress.</p>]]></content:encoded>
+		<wp:post_id>7</wp:post_id>
+		<wp:post_name><![CDATA[hello-world]]></wp:post_name>
+		<wp:post_type><![CDATA[post]]></wp:post_type>
+		<wp:comment>
+			<wp:comment_id>11</wp:comment_id>
+			<wp:comment_author><![CDATA[Bob]]></wp:comment_author>
+			<wp:comment_author_email><![CDATA[bob@example.com]]></wp:comment_author_email>
+			<wp:comment_author_IP><![CDATA[198.51.100.2]]></wp:comment_author_IP>
+			<wp:comment_agent><![CDATA[Mozilla/5.0]]></wp:comment_agent>
+			<wp:comment_date><![CDATA[2016-05-01 12:30:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[2016-05-01 10:30:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Thanks <strong>Alice</strong>!]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[0]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[comment]]></wp:comment_type>
+			<wp:comment_parent>10</wp:comment_parent>
+			<wp:comment_user_id>0</wp:comment_user_id>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>10</wp:comment_id>
+			<wp:comment_author><![CDATA[Alice]]></wp:comment_author>
+			<wp:comment_author_email><![CDATA[alice@example.com]]></wp:comment_author_email>
+			<wp:comment_author_IP><![CDATA[203.0.113.7]]></wp:comment_author_IP>
+			<wp:comment_date><![CDATA[2016-05-01 12:00:00]]></wp:comment_date>
+			<wp:comment_date_gmt><![CDATA[2016-05-01 10:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Great post.
+
+Really.]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[]]></wp:comment_type>
+			<wp:comment_parent>0</wp:comment_parent>
+			<wp:comment_user_id>2</wp:comment_user_id>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>12</wp:comment_id>
+			<wp:comment_author><![CDATA[Spammer]]></wp:comment_author>
+			<wp:comment_date_gmt><![CDATA[2016-05-02 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Cheap pills]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[spam]]></wp:comment_approved>
+			<wp:comment_parent>0</wp:comment_parent>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>13</wp:comment_id>
+			<wp:comment_date_gmt><![CDATA[2016-05-03 00:00:00]]></wp:comment_date_gmt>
+			<wp:comment_content><![CDATA[Off topic]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[trash]]></wp:comment_approved>
+			<wp:comment_parent>0</wp:comment_parent>
+		</wp:comment>
+		<wp:comment>
+			<wp:comment_id>14</wp:comment_id>
+			<wp:comment_content><![CDATA[[...] linked from elsewhere [...]]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_type><![CDATA[pingback]]></wp:comment_type>
+			<wp:comment_parent>0</wp:comment_parent>
+		</wp:comment>
+	</item>
+	<item>
+		<title>About</title>
+		<wp:post_id>8</wp:post_id>
+		<wp:post_name><![CDATA[about]]></wp:post_name>
+		<wp:post_type><![CDATA[page]]></wp:post_type>
+		<wp:comment>
+			<wp:comment_id>20</wp:comment_id>
+			<wp:comment_content><![CDATA[Nice page]]></wp:comment_content>
+			<wp:comment_approved><![CDATA[1]]></wp:comment_approved>
+			<wp:comment_parent>0</wp:comment_parent>
+		</wp:comment>
+	</item>
+</channel>
+</rss>`
+
+func TestImportWXR(t *testing.T) {
+	db := setupDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `INSERT INTO users (id) VALUES ('u-alice')`); err != nil {
+		t.Fatal(err)
+	}
+	cfg := commentable.DefaultConfig()
+	opts := WXROptions{
+		ResolvePost: func(_ context.Context, post WXRPost) (commentable.CommentTarget, bool, error) {
+			if post.Type != "post" {
+				return commentable.CommentTarget{}, false, nil
+			}
+			return commentable.CommentTarget{Commentable: "post", CommentableId: post.Name}, true, nil
+		},
+		ResolveAuthor: func(_ context.Context, author WXRAuthor) (*string, error) {
+			if author.UserID == "2" {
+				id := "u-alice"
+				return &id, nil
+			}
+			return nil, nil
+		},
+	}
+
+	result, err := ImportWXR(ctx, db, &cfg, strings.NewReader(wxrExport), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Imported != 4 || result.Updated != 0 || result.Skipped != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	comments := importedComments(t, db, SourceWordPress)
+	root, reply := comments["10"], comments["11"]
+	if root.CommentableId != "hello-world" || root.Status != commentable.StatusPublished || root.Content != "Great post.\n\nReally." {
+		t.Errorf("unexpected root comment %+v", root)
+	}
+	if root.UserId == nil || *root.UserId != "u-alice" || root.CreatedAt.Format("2006-01-02 15:04") != "2016-05-01 10:00" {
+		t.Errorf("expected the author and GMT date to be kept, got %+v", root)
+	}
+	if reply.ParentId == nil || *reply.ParentId != root.Id || reply.Status != commentable.StatusAwaiting || reply.Content != "Thanks Alice!" {
+		t.Errorf("expected an awaiting reply nested under its parent, got %+v", reply)
+	}
+	var ip, agent string
+	if err := db.QueryRow(ctx, `SELECT ip_address, user_agent FROM comment WHERE id = ?`, reply.Id).Scan(&ip, &agent); err != nil ||
+		ip != "198.51.100.2" || agent != "Mozilla/5.0" {
+		t.Errorf("expected the IP address and user agent to be kept, got %q %q (%v)", ip, agent, err)
+	}
+	if spam := comments["12"]; spam.Status != commentable.StatusModerated || spam.DeletedAt != nil {
+		t.Errorf("expected spam to be moderated, got %+v", spam)
+	}
+	if trashed := comments["13"]; trashed.Status != commentable.StatusModerated || trashed.DeletedAt == nil {
+		t.Errorf("expected a trashed comment to be a moderated tombstone, got %+v", trashed)
+	}
+
+	// Here, Alice had her data erased, the spam was published by a
+	// moderator and the reply scrubbed of its PII.
+	if _, err := commentable.EraseUserData(ctx, db, "u-alice", commentable.ErasureOptions{Mode: commentable.ErasureAnonymize}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE comment SET status = 'published', moderated_at = CURRENT_TIMESTAMP WHERE id = ?`, comments["12"].Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, `UPDATE comment SET ip_address = NULL, user_agent = NULL, pii_scrubbed_at = CURRENT_TIMESTAMP WHERE id = ?`, reply.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reply got approved and edited on the WordPress site since.
+	updated := strings.Replace(wxrExport, "<![CDATA[0]]>", "<![CDATA[1]]>", 1)
+	updated = strings.Replace(updated, "Thanks <strong>Alice</strong>!", "Thanks a lot!", 1)
+	again, err := ImportWXR(ctx, db, &cfg, strings.NewReader(updated), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Imported != 0 || again.Updated != 2 || again.Existing != 2 {
+		t.Errorf("expected a re-import to update the reply and the spam only, got %+v", again)
+	}
+	comments = importedComments(t, db, SourceWordPress)
+	if len(comments) != 4 {
+		t.Fatalf("expected 4 comments after a re-import, got %d", len(comments))
+	}
+	if reply := comments["11"]; reply.Status != commentable.StatusPublished || reply.Content != "Thanks a lot!" || *reply.ParentId != root.Id {
+		t.Errorf("expected the reply to be updated in place, got %+v", reply)
+	}
+	var scrubbed bool
+	if err := db.QueryRow(ctx, `SELECT ip_address IS NULL AND user_agent IS NULL FROM comment WHERE id = ?`, reply.Id).Scan(&scrubbed); err != nil || !scrubbed {
+		t.Errorf("expected the reply to stay scrubbed (%v)", err)
+	}
+	if root := comments["10"]; root.UserId != nil {
+		t.Errorf("expected the erased author to stay erased, got %v", *root.UserId)
+	}
+	if spam := comments["12"]; spam.Status != commentable.StatusPublished {
+		t.Errorf("expected the moderator's decision to be kept, got %s", spam.Status)
+	}
+	if trashed := comments["13"]; trashed.DeletedAt == nil || trashed.Content != "" {
+		t.Errorf("expected the tombstone to be left alone, got %+v", trashed)
+	}
+}
@@ -0,0 +1,275 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// mentionPattern matches @username where the @ starts a word, so e-mail
+// addresses are not mistaken for mentions. Usernames may contain dots and
+// dashes but not end with one.
+var mentionPattern = regexp.MustCompile(`(?:^|[^\w@/])@([A-Za-z0-9_](?:[A-Za-z0-9_.-]{0,62}[A-Za-z0-9_])?)`)
+
+// CommentMention is a user mentioned in a comment. Mentions are resolved when
+// the content is written, stored in comment_mention for the mentions inbox
+// and denormalized on the comment for display.
+type CommentMention struct {
+	UserID   string `json:"userId"`
+	Username string `json:"username"`
+}
+
+// parseMentions returns the distinct usernames mentioned in content, in order
+// of first appearance, up to max.
+func parseMentions(content string, max int) []string {
+	seen := map[string]bool{}
+	var usernames []string
+	for _, match := range mentionPattern.FindAllStringSubmatch(content, -1) {
+		if len(usernames) == max {
+			break
+		}
+		if username := match[1]; !seen[username] {
+			seen[username] = true
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// resolveMentions looks up the users mentioned in content by the configured
+// username column of the users table. Unknown usernames and the author
+// mentioning themselves are ignored. It returns nil when mentions are
+// disabled.
+func (h *CommentHooks) resolveMentions(ctx context.Context, content string, authorID *string) ([]CommentMention, error) {
+	if h.config.MentionUsernameColumn == "" || h.db == nil {
+		return nil, nil
+	}
+
+	usernames := parseMentions(content, h.config.MaxMentionsPerComment)
+	if len(usernames) == 0 {
+		return nil, nil
+	}
+
+	values := make([]any, len(usernames))
+	for i, username := range usernames {
+		values[i] = username
+	}
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("id", h.config.MentionUsernameColumn).
+		From("users").
+		Where(query.In(h.config.MentionUsernameColumn, values...)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := h.db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := map[string]string{}
+	for rows.Next() {
+		var id, username string
+		if err := rows.Scan(&id, &username); err != nil {
+			return nil, err
+		}
+		ids[username] = id
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var mentions []CommentMention
+	for _, username := range usernames {
+		id, ok := ids[username]
+		if !ok || (authorID != nil && id == *authorID) {
+			continue
+		}
+		mentions = append(mentions, CommentMention{UserID: id, Username: username})
+	}
+	return mentions, nil
+}
+
+// setMentions stores the denormalized mentions of a comment on its model.
+func setMentions(model *Comment, mentions []CommentMention) {
+	model.Mentions = nil
+	if len(mentions) == 0 {
+		return
+	}
+	encoded, err := json.Marshal(mentions)
+	if err != nil {
+		return
+	}
+	s := string(encoded)
+	model.Mentions = &s
+}
+
+// decodeMentions reads the denormalized mentions of a comment.
+func decodeMentions(model Comment) []CommentMention {
+	if model.Mentions == nil {
+		return nil
+	}
+	var mentions []CommentMention
+	if err := json.Unmarshal([]byte(*model.Mentions), &mentions); err != nil {
+		return nil
+	}
+	return mentions
+}
+
+// SaveMentions makes comment_mention match the mentions on model: users no
+// longer mentioned are removed, newly mentioned ones added, and those still
+// mentioned keep their original mention time so an edit does not bump them in
+// the inbox.
+func (h *CommentHooks) SaveMentions(ctx context.Context, q sqlExecutor, model *Comment) error {
+	if h.config.MentionUsernameColumn == "" {
+		return nil
+	}
+
+	builder := query.New(h.db.Dialect())
+	stmt, args, err := builder.Select("user_id").
+		From("comment_mention").
+		Where(query.Eq("comment_id", model.Id)).
+		Build()
+	if err != nil {
+		return err
+	}
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	existing := map[string]bool{}
+	for rows.Next() {
+		var userID string
+		if err := rows.Scan(&userID); err != nil {
+			rows.Close()
+			return err
+		}
+		existing[userID] = true
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, mention := range decodeMentions(*model) {
+		if existing[mention.UserID] {
+			delete(existing, mention.UserID)
+			continue
+		}
+		stmt, args, err := builder.Insert("comment_mention").
+			Columns("id", "comment_id", "user_id", "username", "created_at").
+			Values(uuid.New().String(), model.Id, mention.UserID, mention.Username, now).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+
+	for userID := range existing {
+		stmt, args, err := builder.Delete("comment_mention").
+			Where(query.And(query.Eq("comment_id", model.Id), query.Eq("user_id", userID))).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mentionsPage is one page of the mentions inbox.
+type mentionsPage struct {
+	Items   []Comment
+	HasMore bool
+}
+
+// fetchMentions loads the comments mentioning userID that the caller may see,
+// most recent mention first. Tombstones are left out.
+func fetchMentions(
+	ctx context.Context,
+	db database.Database,
+	c *crud.CRUD[Comment],
+	userID string,
+	statusConds []query.Condition,
+	limit, offset int,
+) (*mentionsPage, error) {
+	conds := append([]query.Condition{
+		query.Eq("comment_mention.user_id", userID),
+		query.IsNull("comment.deleted_at"),
+	}, statusConds...)
+
+	stmt, args, err := query.New(db.Dialect()).
+		Select("comment_mention.comment_id").
+		From("comment_mention").
+		Join("comment", query.ColEq("comment.id", "comment_mention.comment_id")).
+		Where(query.And(conds...)).
+		OrderBy("comment_mention.created_at", query.DESC).
+		OrderBy("comment_mention.comment_id", query.DESC).
+		Limit(limit + 1).
+		Offset(offset).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	var ids []any
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &mentionsPage{Items: []Comment{}}
+	if len(ids) > limit {
+		page.HasMore = true
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      len(ids),
+		Conditions: []query.Condition{query.In("id", ids...)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Comment, len(res.Items))
+	for _, comment := range res.Items {
+		byID[comment.Id] = comment
+	}
+	for _, id := range ids {
+		if comment, ok := byID[id.(string)]; ok {
+			page.Items = append(page.Items, comment)
+		}
+	}
+	return page, nil
+}
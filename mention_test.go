@@ -0,0 +1,102 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+func TestParseMentions(t *testing.T) {
+	got := parseMentions("@alice hi @bob.smith, mail x@carol.example or @dave. @alice again (@eve)", 4)
+	want := []string{"alice", "bob.smith", "dave", "eve"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+
+	if got := parseMentions("@a @b @c", 2); len(got) != 2 {
+		t.Errorf("expected mentions to be capped at 2, got %v", got)
+	}
+}
+
+func TestCommentMentions(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec(ctx, `ALTER TABLE users ADD COLUMN username TEXT`); err != nil {
+		t.Fatal(err)
+	}
+	for id, username := range map[string]string{"u-alice": "alice", "u-bob": "bob"} {
+		if _, err := db.Exec(ctx, `INSERT INTO users (id, username) VALUES (?, ?)`, id, username); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.MentionUsernameColumn = "username"
+
+	request := func(userID, method, path string, body any) *httpResult {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{"writer"}))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+
+	created := request("u-alice", "POST", "/comments", CommentCreateDTO{
+		Commentable:   "post",
+		CommentableId: "post-1",
+		Content:       "hi @bob and @carol, mail me at me@alice.example, signed @alice",
+	})
+	if created.status != 201 {
+		t.Fatalf("expected 201, got %d", created.status)
+	}
+	want := []any{map[string]any{"userId": "u-bob", "username": "bob"}}
+	if !reflect.DeepEqual(created.body["mentions"], want) {
+		t.Errorf("expected only bob to be mentioned, got %v", created.body["mentions"])
+	}
+
+	inbox := request("u-bob", "GET", "/comments/mentions", nil)
+	if data, _ := inbox.body["data"].([]any); len(data) != 1 {
+		t.Fatalf("expected one mention in bob's inbox, got %v", inbox.body)
+	}
+	if inbox := request("u-alice", "GET", "/comments/mentions", nil); len(inbox.body["data"].([]any)) != 0 {
+		t.Errorf("expected alice's inbox to be empty, got %v", inbox.body)
+	}
+
+	id := created.body["id"].(string)
+	content := "never mind"
+	if updated := request("u-alice", "PUT", "/comments/"+id, CommentUpdateDTO{Content: &content}); updated.status != 200 {
+		t.Fatalf("expected 200, got %d", updated.status)
+	}
+	if inbox := request("u-bob", "GET", "/comments/mentions", nil); len(inbox.body["data"].([]any)) != 0 {
+		t.Errorf("expected the mention to be dropped by the edit, got %v", inbox.body)
+	}
+}
+
+type httpResult struct {
+	status int
+	body   map[string]any
+}
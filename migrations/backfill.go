@@ -0,0 +1,151 @@
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// threadPosition is the depth/root_id/path triple computed for one comment.
+type threadPosition struct {
+	id     string
+	depth  int
+	rootID string
+	path   string
+}
+
+// backfillThreadPaths populates depth, root_id and path for comments created
+// before those columns existed. It works one nesting level at a time: roots
+// first, then every comment whose parent already has a path, until a pass
+// finds nothing left to fill.
+func backfillThreadPaths(ctx context.Context, db database.Database) error {
+	roots, err := collectPositions(ctx, db,
+		`SELECT id, created_at, '', '', 0 FROM comment WHERE parent_id IS NULL AND path IS NULL`, true)
+	if err != nil {
+		return err
+	}
+	if err := applyPositions(ctx, db, roots); err != nil {
+		return err
+	}
+
+	for {
+		level, err := collectPositions(ctx, db,
+			`SELECT c.id, c.created_at, p.root_id, p.path, p.depth FROM comment c
+				JOIN comment p ON p.id = c.parent_id
+				WHERE c.path IS NULL AND p.path IS NOT NULL`, false)
+		if err != nil {
+			return err
+		}
+		if len(level) == 0 {
+			return nil
+		}
+		if err := applyPositions(ctx, db, level); err != nil {
+			return err
+		}
+	}
+}
+
+// collectPositions reads a whole level before any update is issued, since
+// SQLite cannot write to a table while a read cursor on it is still open.
+func collectPositions(ctx context.Context, db database.Database, sql string, roots bool) ([]threadPosition, error) {
+	rows, err := db.Query(ctx, sql)
+	if err != nil {
+		return nil, fmt.Errorf("load comments to backfill: %w", err)
+	}
+	defer rows.Close()
+
+	var positions []threadPosition
+	for rows.Next() {
+		var (
+			id, rootID, parentPath string
+			createdAt              time.Time
+			parentDepth            int
+		)
+		if err := rows.Scan(&id, &createdAt, &rootID, &parentPath, &parentDepth); err != nil {
+			return nil, fmt.Errorf("scan comment to backfill: %w", err)
+		}
+
+		pos := threadPosition{id: id, path: parentPath + threadPathSegment(id, createdAt)}
+		if roots {
+			pos.rootID = id
+		} else {
+			pos.depth = parentDepth + 1
+			pos.rootID = rootID
+		}
+		positions = append(positions, pos)
+	}
+	return positions, rows.Err()
+}
+
+func applyPositions(ctx context.Context, db database.Database, positions []threadPosition) error {
+	for _, pos := range positions {
+		sql, args, err := query.New(db.Dialect()).Update("comment").
+			Set("depth", pos.depth).
+			Set("root_id", pos.rootID).
+			Set("path", pos.path).
+			Where(query.Eq("id", pos.id)).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec(ctx, sql, args...); err != nil {
+			return fmt.Errorf("backfill comment %s: %w", pos.id, err)
+		}
+	}
+	return nil
+}
+
+// threadPathSegment mirrors pathSegment in the commentable package: 11 hex
+// digits of creation time in milliseconds followed by the 32 hex digits of the
+// comment UUID. Migrations keep their own copy so they never change behaviour
+// retroactively.
+func threadPathSegment(id string, createdAt time.Time) string {
+	return fmt.Sprintf("%011x", createdAt.UTC().UnixMilli()) + strings.ReplaceAll(id, "-", "")
+}
+
+// rewriteContent applies fn to the content of every comment and comment
+// revision, skipping rows it leaves unchanged.
+func rewriteContent(ctx context.Context, db database.Database, fn func(string) string) error {
+	for _, table := range []string{"comment", "comment_revision"} {
+		// Read everything first, since SQLite cannot write to a table while
+		// a read cursor on it is still open.
+		rows, err := db.Query(ctx, "SELECT id, content FROM "+table)
+		if err != nil {
+			return fmt.Errorf("load %s content: %w", table, err)
+		}
+		changed := map[string]string{}
+		for rows.Next() {
+			var id, content string
+			if err := rows.Scan(&id, &content); err != nil {
+				rows.Close()
+				return fmt.Errorf("scan %s content: %w", table, err)
+			}
+			if rewritten := fn(content); rewritten != content {
+				changed[id] = rewritten
+			}
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+
+		for id, content := range changed {
+			sql, args, err := query.New(db.Dialect()).Update(table).
+				Set("content", content).
+				Where(query.Eq("id", id)).
+				Build()
+			if err != nil {
+				return err
+			}
+			if _, err := db.Exec(ctx, sql, args...); err != nil {
+				return fmt.Errorf("rewrite %s %s: %w", table, id, err)
+			}
+		}
+	}
+	return nil
+}
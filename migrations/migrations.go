@@ -2,6 +2,7 @@ package migrations
 
 import (
 	"context"
+	"html"
 
 	"github.com/nicolasbonnici/gorest/database"
 	"github.com/nicolasbonnici/gorest/migrations"
@@ -229,5 +230,920 @@ func GetMigrations() migrations.MigrationSource {
 		},
 	)
 
+	builder.Add(
+		"20261016000001000",
+		"add_thread_path_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// depth is zero-based (roots are 0), root_id points at the thread
+			// root and path is the concatenation of fixed-width hex segments
+			// from the root down, so ORDER BY path is depth-first display order
+			// and a subtree is a single range scan. SQLite only permits a
+			// single column per ALTER TABLE.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN depth INTEGER NOT NULL DEFAULT 0`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN depth INT NOT NULL DEFAULT 0`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN depth INTEGER NOT NULL DEFAULT 0`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN root_id UUID`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN root_id CHAR(36)`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN root_id TEXT`,
+			}); err != nil {
+				return err
+			}
+			// Paths are pure [0-9a-f]; MySQL stores them as ascii_bin so the
+			// 43 bytes per level at max_nesting_depth 100 fit, and indexes a
+			// prefix to stay under the InnoDB key size limit.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN path TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN path VARCHAR(4300) CHARACTER SET ascii COLLATE ascii_bin`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN path TEXT`,
+			}); err != nil {
+				return err
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_thread_path ON comment(commentable, commentable_id, path)`,
+				MySQL:    `CREATE INDEX idx_comment_thread_path ON comment(commentable, commentable_id, path(768))`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_thread_path ON comment(commentable, commentable_id, path)`,
+			}); err != nil {
+				return err
+			}
+
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_root_path ON comment(root_id, path)`,
+				MySQL:    `CREATE INDEX idx_comment_root_path ON comment(root_id, path(768))`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_root_path ON comment(root_id, path)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_thread_path", "comment")
+			_ = migrations.DropIndex(ctx, db, "idx_comment_root_path", "comment")
+
+			for _, column := range []string{"depth", "root_id", "path"} {
+				if err := migrations.DropColumn(ctx, db, "comment", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000002000",
+		"backfill_thread_path_on_comments",
+		backfillThreadPaths,
+		func(ctx context.Context, db database.Database) error {
+			// The columns are dropped by the previous migration's down step.
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000003000",
+		"add_soft_delete_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// Comments with replies are tombstoned rather than deleted, so the
+			// parent_id ON DELETE CASCADE never removes a reply tree.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN deleted_at TIMESTAMP(0) WITH TIME ZONE`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN deleted_at TIMESTAMP NULL`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN deleted_at DATETIME`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN deleted_by UUID`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN deleted_by CHAR(36)`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN deleted_by TEXT`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			if err := migrations.DropColumn(ctx, db, "comment", "deleted_at"); err != nil {
+				return err
+			}
+			return migrations.DropColumn(ctx, db, "comment", "deleted_by")
+		},
+	)
+
+	builder.Add(
+		"20261016000004000",
+		"create_comment_revisions_table",
+		func(ctx context.Context, db database.Database) error {
+			// SQLite only permits a single column per ALTER TABLE.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN edit_count INTEGER NOT NULL DEFAULT 0`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN edit_count INT NOT NULL DEFAULT 0`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN edit_count INTEGER NOT NULL DEFAULT 0`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN edited_at TIMESTAMP(0) WITH TIME ZONE`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN edited_at TIMESTAMP NULL`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN edited_at DATETIME`,
+			}); err != nil {
+				return err
+			}
+
+			// Each row snapshots the content a comment had before an edit;
+			// version n holds the content that edit n replaced.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_revision (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					comment_id UUID NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					version INTEGER NOT NULL,
+					content TEXT NOT NULL,
+					edited_by UUID,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_revision (
+					id CHAR(36) PRIMARY KEY,
+					comment_id CHAR(36) NOT NULL,
+					version INT NOT NULL,
+					content TEXT NOT NULL,
+					edited_by CHAR(36),
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (comment_id) REFERENCES comment(id) ON DELETE CASCADE
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_revision (
+					id TEXT PRIMARY KEY,
+					comment_id TEXT NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					version INTEGER NOT NULL,
+					content TEXT NOT NULL,
+					edited_by TEXT,
+					created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_revision_version ON comment_revision(comment_id, version)`,
+				MySQL:    `CREATE UNIQUE INDEX idx_comment_revision_version ON comment_revision(comment_id, version)`,
+				SQLite:   `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_revision_version ON comment_revision(comment_id, version)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_revision_version", "comment_revision")
+			if err := migrations.DropTableIfExists(ctx, db, "comment_revision"); err != nil {
+				return err
+			}
+			if err := migrations.DropColumn(ctx, db, "comment", "edit_count"); err != nil {
+				return err
+			}
+			return migrations.DropColumn(ctx, db, "comment", "edited_at")
+		},
+	)
+
+	builder.Add(
+		"20261016000005000",
+		"add_moderation_tracking_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// SQLite only permits a single column per ALTER TABLE.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN published_at TIMESTAMP(0) WITH TIME ZONE`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN published_at TIMESTAMP NULL`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN published_at DATETIME`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN moderated_at TIMESTAMP(0) WITH TIME ZONE`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN moderated_at TIMESTAMP NULL`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN moderated_at DATETIME`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN moderated_by UUID`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN moderated_by CHAR(36)`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN moderated_by TEXT`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN moderation_reason TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN moderation_reason TEXT`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN moderation_reason TEXT`,
+			}); err != nil {
+				return err
+			}
+
+			// Comments published before the column existed are taken to have
+			// been published when they were created.
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `UPDATE comment SET published_at = created_at WHERE status = 'published'`,
+				MySQL:    `UPDATE comment SET published_at = created_at WHERE status = 'published'`,
+				SQLite:   `UPDATE comment SET published_at = created_at WHERE status = 'published'`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			for _, column := range []string{"published_at", "moderated_at", "moderated_by", "moderation_reason"} {
+				if err := migrations.DropColumn(ctx, db, "comment", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000006000",
+		"add_content_check_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// SQLite only permits a single column per ALTER TABLE.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN check_verdict VARCHAR(20)`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN check_verdict VARCHAR(20)`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN check_verdict TEXT`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN check_score DOUBLE PRECISION`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN check_score DOUBLE`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN check_score REAL`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN check_reasons TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN check_reasons TEXT`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN check_reasons TEXT`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			for _, column := range []string{"check_verdict", "check_score", "check_reasons"} {
+				if err := migrations.DropColumn(ctx, db, "comment", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000007000",
+		"create_comment_rate_limit_table",
+		func(ctx context.Context, db database.Database) error {
+			// One row per comment attempt, used by the database-backed rate
+			// limit store. hit_at is in Unix milliseconds so that the window
+			// arithmetic is the same on every dialect.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_rate_limit (
+					rate_key VARCHAR(255) NOT NULL,
+					hit_at BIGINT NOT NULL
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_rate_limit (
+					rate_key VARCHAR(255) NOT NULL,
+					hit_at BIGINT NOT NULL
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_rate_limit (
+					rate_key TEXT NOT NULL,
+					hit_at INTEGER NOT NULL
+				)`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_rate_limit_key ON comment_rate_limit(rate_key, hit_at)`,
+				MySQL:    `CREATE INDEX idx_comment_rate_limit_key ON comment_rate_limit(rate_key, hit_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_rate_limit_key ON comment_rate_limit(rate_key, hit_at)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			return migrations.DropTableIfExists(ctx, db, "comment_rate_limit")
+		},
+	)
+
+	builder.Add(
+		"20261016000008000",
+		"store_raw_comment_content",
+		func(ctx context.Context, db database.Database) error {
+			// content used to be stored HTML-escaped; it now holds the source
+			// as written and content_html its sanitized rendering. Rows left
+			// with a NULL content_html are rendered when read.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN content_format VARCHAR(20) NOT NULL DEFAULT 'plain'`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN content_format VARCHAR(20) NOT NULL DEFAULT 'plain'`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN content_format TEXT NOT NULL DEFAULT 'plain'`,
+			}); err != nil {
+				return err
+			}
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN content_html TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN content_html TEXT`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN content_html TEXT`,
+			}); err != nil {
+				return err
+			}
+			return rewriteContent(ctx, db, html.UnescapeString)
+		},
+		func(ctx context.Context, db database.Database) error {
+			if err := rewriteContent(ctx, db, html.EscapeString); err != nil {
+				return err
+			}
+			for _, column := range []string{"content_format", "content_html"} {
+				if err := migrations.DropColumn(ctx, db, "comment", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000009000",
+		"create_comment_mentions_table",
+		func(ctx context.Context, db database.Database) error {
+			// The mentions of a comment are kept as JSON on the comment for
+			// display, and one row per mentioned user for the mentions inbox.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN mentions TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN mentions TEXT`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN mentions TEXT`,
+			}); err != nil {
+				return err
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_mention (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					comment_id UUID NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					username TEXT NOT NULL,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_mention (
+					id CHAR(36) PRIMARY KEY,
+					comment_id CHAR(36) NOT NULL,
+					user_id CHAR(36) NOT NULL,
+					username VARCHAR(255) NOT NULL,
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (comment_id) REFERENCES comment(id) ON DELETE CASCADE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_mention (
+					id TEXT PRIMARY KEY,
+					comment_id TEXT NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					username TEXT NOT NULL,
+					created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_mention_user ON comment_mention(comment_id, user_id)`,
+				MySQL:    `CREATE UNIQUE INDEX idx_comment_mention_user ON comment_mention(comment_id, user_id)`,
+				SQLite:   `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_mention_user ON comment_mention(comment_id, user_id)`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_mention_inbox ON comment_mention(user_id, created_at)`,
+				MySQL:    `CREATE INDEX idx_comment_mention_inbox ON comment_mention(user_id, created_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_mention_inbox ON comment_mention(user_id, created_at)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			if err := migrations.DropTableIfExists(ctx, db, "comment_mention"); err != nil {
+				return err
+			}
+			return migrations.DropColumn(ctx, db, "comment", "mentions")
+		},
+	)
+
+	builder.Add(
+		"20261016000010000",
+		"create_comment_votes_table",
+		func(ctx context.Context, db database.Database) error {
+			// Vote counters and rankings are denormalized on the comment so
+			// that sorted threads are plain indexed reads. SQLite only permits
+			// a single column per ALTER TABLE.
+			for _, column := range []migrations.DialectSQL{
+				{
+					Postgres: `ALTER TABLE comment ADD COLUMN upvotes INTEGER NOT NULL DEFAULT 0`,
+					MySQL:    `ALTER TABLE comment ADD COLUMN upvotes INT NOT NULL DEFAULT 0`,
+					SQLite:   `ALTER TABLE comment ADD COLUMN upvotes INTEGER NOT NULL DEFAULT 0`,
+				},
+				{
+					Postgres: `ALTER TABLE comment ADD COLUMN downvotes INTEGER NOT NULL DEFAULT 0`,
+					MySQL:    `ALTER TABLE comment ADD COLUMN downvotes INT NOT NULL DEFAULT 0`,
+					SQLite:   `ALTER TABLE comment ADD COLUMN downvotes INTEGER NOT NULL DEFAULT 0`,
+				},
+				{
+					Postgres: `ALTER TABLE comment ADD COLUMN score INTEGER NOT NULL DEFAULT 0`,
+					MySQL:    `ALTER TABLE comment ADD COLUMN score INT NOT NULL DEFAULT 0`,
+					SQLite:   `ALTER TABLE comment ADD COLUMN score INTEGER NOT NULL DEFAULT 0`,
+				},
+				{
+					Postgres: `ALTER TABLE comment ADD COLUMN wilson_score DOUBLE PRECISION NOT NULL DEFAULT 0`,
+					MySQL:    `ALTER TABLE comment ADD COLUMN wilson_score DOUBLE NOT NULL DEFAULT 0`,
+					SQLite:   `ALTER TABLE comment ADD COLUMN wilson_score REAL NOT NULL DEFAULT 0`,
+				},
+				{
+					Postgres: `ALTER TABLE comment ADD COLUMN controversy_score DOUBLE PRECISION NOT NULL DEFAULT 0`,
+					MySQL:    `ALTER TABLE comment ADD COLUMN controversy_score DOUBLE NOT NULL DEFAULT 0`,
+					SQLite:   `ALTER TABLE comment ADD COLUMN controversy_score REAL NOT NULL DEFAULT 0`,
+				},
+			} {
+				if err := migrations.SQL(ctx, db, column); err != nil {
+					return err
+				}
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_vote (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					comment_id UUID NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					value SMALLINT NOT NULL CHECK (value IN (-1, 1)),
+					updated_at TIMESTAMP(0) WITH TIME ZONE,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_vote (
+					id CHAR(36) PRIMARY KEY,
+					comment_id CHAR(36) NOT NULL,
+					user_id CHAR(36) NOT NULL,
+					value TINYINT NOT NULL,
+					updated_at TIMESTAMP NULL,
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (comment_id) REFERENCES comment(id) ON DELETE CASCADE,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					CHECK (value IN (-1, 1))
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_vote (
+					id TEXT PRIMARY KEY,
+					comment_id TEXT NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					value INTEGER NOT NULL CHECK (value IN (-1, 1)),
+					updated_at DATETIME,
+					created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_vote_user ON comment_vote(comment_id, user_id)`,
+				MySQL:    `CREATE UNIQUE INDEX idx_comment_vote_user ON comment_vote(comment_id, user_id)`,
+				SQLite:   `CREATE UNIQUE INDEX IF NOT EXISTS idx_comment_vote_user ON comment_vote(comment_id, user_id)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			if err := migrations.DropTableIfExists(ctx, db, "comment_vote"); err != nil {
+				return err
+			}
+			for _, column := range []string{"upvotes", "downvotes", "score", "wilson_score", "controversy_score"} {
+				if err := migrations.DropColumn(ctx, db, "comment", column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000011000",
+		"create_comment_target_stats_table",
+		func(ctx context.Context, db database.Database) error {
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_target_stats (
+					commentable TEXT NOT NULL,
+					commentable_id UUID NOT NULL,
+					published_count INTEGER NOT NULL DEFAULT 0,
+					total_count INTEGER NOT NULL DEFAULT 0,
+					participant_count INTEGER NOT NULL DEFAULT 0,
+					last_comment_at TIMESTAMP(0) WITH TIME ZONE,
+					last_commenter_id UUID,
+					updated_at TIMESTAMP(0) WITH TIME ZONE,
+					PRIMARY KEY (commentable, commentable_id)
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_target_stats (
+					commentable VARCHAR(255) NOT NULL,
+					commentable_id CHAR(36) NOT NULL,
+					published_count INT NOT NULL DEFAULT 0,
+					total_count INT NOT NULL DEFAULT 0,
+					participant_count INT NOT NULL DEFAULT 0,
+					last_comment_at TIMESTAMP NULL,
+					last_commenter_id CHAR(36),
+					updated_at TIMESTAMP NULL,
+					PRIMARY KEY (commentable, commentable_id)
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_target_stats (
+					commentable TEXT NOT NULL,
+					commentable_id TEXT NOT NULL,
+					published_count INTEGER NOT NULL DEFAULT 0,
+					total_count INTEGER NOT NULL DEFAULT 0,
+					participant_count INTEGER NOT NULL DEFAULT 0,
+					last_comment_at DATETIME,
+					last_commenter_id TEXT,
+					updated_at DATETIME,
+					PRIMARY KEY (commentable, commentable_id)
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			// "Recently active" listings read targets of one type by their
+			// last comment.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_target_stats_activity ON comment_target_stats(commentable, last_comment_at)`,
+				MySQL:    `CREATE INDEX idx_comment_target_stats_activity ON comment_target_stats(commentable, last_comment_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_target_stats_activity ON comment_target_stats(commentable, last_comment_at)`,
+			}); err != nil {
+				return err
+			}
+
+			// Backfill from the existing comments, tombstones excluded, the
+			// same way the hooks compute it.
+			backfill := `INSERT INTO comment_target_stats
+				(commentable, commentable_id, published_count, total_count, participant_count, last_comment_at, updated_at)
+				SELECT commentable, commentable_id,
+					SUM(CASE WHEN status = 'published' THEN 1 ELSE 0 END),
+					COUNT(id),
+					COUNT(DISTINCT CASE WHEN status = 'published' THEN user_id END),
+					MAX(CASE WHEN status = 'published' THEN created_at END),
+					CURRENT_TIMESTAMP
+				FROM comment
+				WHERE deleted_at IS NULL
+				GROUP BY commentable, commentable_id`
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: backfill,
+				MySQL:    backfill,
+				SQLite:   backfill,
+			}); err != nil {
+				return err
+			}
+
+			lastCommenter := `UPDATE comment_target_stats SET last_commenter_id = (
+				SELECT c.user_id FROM comment c
+				WHERE c.commentable = comment_target_stats.commentable
+					AND c.commentable_id = comment_target_stats.commentable_id
+					AND c.status = 'published'
+					AND c.deleted_at IS NULL
+				ORDER BY c.created_at DESC, c.id DESC
+				LIMIT 1
+			)`
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: lastCommenter,
+				MySQL:    lastCommenter,
+				SQLite:   lastCommenter,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_target_stats_activity", "comment_target_stats")
+			return migrations.DropTableIfExists(ctx, db, "comment_target_stats")
+		},
+	)
+
+	builder.Add(
+		"20261016000012000",
+		"create_comment_webhook_delivery_table",
+		func(ctx context.Context, db database.Database) error {
+			// comment_id has no foreign key: the log of comment.deleted
+			// deliveries outlives the comment.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_webhook_delivery (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					event_id UUID NOT NULL,
+					event TEXT NOT NULL,
+					comment_id UUID NOT NULL,
+					url TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					status TEXT NOT NULL DEFAULT 'pending',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at TIMESTAMP(0) WITH TIME ZONE,
+					last_status_code INTEGER,
+					last_error TEXT,
+					delivered_at TIMESTAMP(0) WITH TIME ZONE,
+					updated_at TIMESTAMP(0) WITH TIME ZONE,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_webhook_delivery (
+					id CHAR(36) PRIMARY KEY,
+					event_id CHAR(36) NOT NULL,
+					event VARCHAR(64) NOT NULL,
+					comment_id CHAR(36) NOT NULL,
+					url VARCHAR(2048) NOT NULL,
+					payload MEDIUMTEXT NOT NULL,
+					status VARCHAR(16) NOT NULL DEFAULT 'pending',
+					attempts INT NOT NULL DEFAULT 0,
+					next_attempt_at TIMESTAMP NULL,
+					last_status_code INT,
+					last_error TEXT,
+					delivered_at TIMESTAMP NULL,
+					updated_at TIMESTAMP NULL,
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_webhook_delivery (
+					id TEXT PRIMARY KEY,
+					event_id TEXT NOT NULL,
+					event TEXT NOT NULL,
+					comment_id TEXT NOT NULL,
+					url TEXT NOT NULL,
+					payload TEXT NOT NULL,
+					status TEXT NOT NULL DEFAULT 'pending',
+					attempts INTEGER NOT NULL DEFAULT 0,
+					next_attempt_at DATETIME,
+					last_status_code INTEGER,
+					last_error TEXT,
+					delivered_at DATETIME,
+					updated_at DATETIME,
+					created_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			// The dispatcher polls pending deliveries by due date; the
+			// delivery log is browsed per comment.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_webhook_delivery_due ON comment_webhook_delivery(status, next_attempt_at)`,
+				MySQL:    `CREATE INDEX idx_comment_webhook_delivery_due ON comment_webhook_delivery(status, next_attempt_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_webhook_delivery_due ON comment_webhook_delivery(status, next_attempt_at)`,
+			}); err != nil {
+				return err
+			}
+
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_webhook_delivery_comment ON comment_webhook_delivery(comment_id, created_at)`,
+				MySQL:    `CREATE INDEX idx_comment_webhook_delivery_comment ON comment_webhook_delivery(comment_id, created_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_webhook_delivery_comment ON comment_webhook_delivery(comment_id, created_at)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_webhook_delivery_due", "comment_webhook_delivery")
+			_ = migrations.DropIndex(ctx, db, "idx_comment_webhook_delivery_comment", "comment_webhook_delivery")
+			return migrations.DropTableIfExists(ctx, db, "comment_webhook_delivery")
+		},
+	)
+
+	builder.Add(
+		"20261016000013000",
+		"create_comment_subscriptions_tables",
+		func(ctx context.Context, db database.Database) error {
+			// A subscription without comment_id follows a whole target; with
+			// one, the replies to that comment.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_subscription (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					commentable TEXT NOT NULL,
+					commentable_id UUID NOT NULL,
+					comment_id UUID REFERENCES comment(id) ON DELETE CASCADE,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_subscription (
+					id CHAR(36) PRIMARY KEY,
+					user_id CHAR(36) NOT NULL,
+					commentable VARCHAR(255) NOT NULL,
+					commentable_id CHAR(36) NOT NULL,
+					comment_id CHAR(36),
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (comment_id) REFERENCES comment(id) ON DELETE CASCADE
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_subscription (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					commentable TEXT NOT NULL,
+					commentable_id TEXT NOT NULL,
+					comment_id TEXT REFERENCES comment(id) ON DELETE CASCADE,
+					created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			// Subscribers of a new comment are looked up by target.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_subscription_target ON comment_subscription(commentable, commentable_id, comment_id)`,
+				MySQL:    `CREATE INDEX idx_comment_subscription_target ON comment_subscription(commentable, commentable_id, comment_id)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_subscription_target ON comment_subscription(commentable, commentable_id, comment_id)`,
+			}); err != nil {
+				return err
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_notification (
+					id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+					user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					comment_id UUID NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					reason VARCHAR(20) NOT NULL,
+					read_at TIMESTAMP(0) WITH TIME ZONE,
+					created_at TIMESTAMP(0) WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_notification (
+					id CHAR(36) PRIMARY KEY,
+					user_id CHAR(36) NOT NULL,
+					comment_id CHAR(36) NOT NULL,
+					reason VARCHAR(20) NOT NULL,
+					read_at TIMESTAMP NULL,
+					created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+					FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+					FOREIGN KEY (comment_id) REFERENCES comment(id) ON DELETE CASCADE
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_notification (
+					id TEXT PRIMARY KEY,
+					user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+					comment_id TEXT NOT NULL REFERENCES comment(id) ON DELETE CASCADE,
+					reason TEXT NOT NULL,
+					read_at DATETIME,
+					created_at DATETIME NOT NULL DEFAULT (datetime('now'))
+				)`,
+			}); err != nil {
+				return err
+			}
+
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_notification_inbox ON comment_notification(user_id, created_at)`,
+				MySQL:    `CREATE INDEX idx_comment_notification_inbox ON comment_notification(user_id, created_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_notification_inbox ON comment_notification(user_id, created_at)`,
+			}); err != nil {
+				return err
+			}
+
+			// Subscribe the authors of existing comments to their replies.
+			// Each comment has at most one such subscription, so its id is
+			// reused for it.
+			backfill := `INSERT INTO comment_subscription (id, user_id, commentable, commentable_id, comment_id, created_at)
+				SELECT id, user_id, commentable, commentable_id, id, created_at
+				FROM comment
+				WHERE user_id IS NOT NULL AND deleted_at IS NULL`
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: backfill,
+				MySQL:    backfill,
+				SQLite:   backfill,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_notification_inbox", "comment_notification")
+			_ = migrations.DropIndex(ctx, db, "idx_comment_subscription_target", "comment_subscription")
+			if err := migrations.DropTableIfExists(ctx, db, "comment_notification"); err != nil {
+				return err
+			}
+			return migrations.DropTableIfExists(ctx, db, "comment_subscription")
+		},
+	)
+
+	builder.Add(
+		"20261016000014000",
+		"add_pii_scrubbed_at_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// Set once the retention job scrubbed the comment's IP address and
+			// user agent, so that hashed values are not hashed again.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN pii_scrubbed_at TIMESTAMP(0) WITH TIME ZONE`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN pii_scrubbed_at TIMESTAMP NULL`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN pii_scrubbed_at DATETIME`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_pii_retention ON comment(pii_scrubbed_at, created_at)`,
+				MySQL:    `CREATE INDEX idx_comment_pii_retention ON comment(pii_scrubbed_at, created_at)`,
+				SQLite:   `CREATE INDEX IF NOT EXISTS idx_comment_pii_retention ON comment(pii_scrubbed_at, created_at)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			_ = migrations.DropIndex(ctx, db, "idx_comment_pii_retention", "comment")
+			return migrations.DropColumn(ctx, db, "comment", "pii_scrubbed_at")
+		},
+	)
+
+	builder.Add(
+		"20261016000015000",
+		"add_encryption_keys_to_comments",
+		func(ctx context.Context, db database.Database) error {
+			// Encrypted IP addresses no longer fit VARCHAR(45); SQLite does not
+			// enforce the length.
+			if db.DriverName() != "sqlite" {
+				if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+					Postgres: `ALTER TABLE comment ALTER COLUMN ip_address TYPE VARCHAR(255)`,
+					MySQL:    `ALTER TABLE comment MODIFY ip_address VARCHAR(255)`,
+				}); err != nil {
+					return err
+				}
+			}
+			// The id of the key the comment's data key is wrapped with, and
+			// that wrapped data key.
+			if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN encryption_key_id VARCHAR(64)`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN encryption_key_id VARCHAR(64)`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN encryption_key_id TEXT`,
+			}); err != nil {
+				return err
+			}
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `ALTER TABLE comment ADD COLUMN encrypted_data_key TEXT`,
+				MySQL:    `ALTER TABLE comment ADD COLUMN encrypted_data_key TEXT`,
+				SQLite:   `ALTER TABLE comment ADD COLUMN encrypted_data_key TEXT`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			// ip_address keeps its width: encrypted values would not fit back.
+			if err := migrations.DropColumn(ctx, db, "comment", "encrypted_data_key"); err != nil {
+				return err
+			}
+			return migrations.DropColumn(ctx, db, "comment", "encryption_key_id")
+		},
+	)
+
+	builder.Add(
+		"20261016000016000",
+		"add_comment_search_index",
+		func(ctx context.Context, db database.Database) error {
+			switch db.DriverName() {
+			case "postgres":
+				if err := migrations.SQL(ctx, db, migrations.DialectSQL{
+					Postgres: `ALTER TABLE comment ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED`,
+				}); err != nil {
+					return err
+				}
+				return migrations.SQL(ctx, db, migrations.DialectSQL{
+					Postgres: `CREATE INDEX IF NOT EXISTS idx_comment_search ON comment USING GIN(search_vector)`,
+				})
+			case "mysql":
+				return migrations.SQL(ctx, db, migrations.DialectSQL{
+					MySQL: `CREATE FULLTEXT INDEX idx_comment_search ON comment(content)`,
+				})
+			}
+
+			// SQLite indexes a copy of the content in an FTS5 table, which
+			// triggers keep in sync with the comment table.
+			for _, stmt := range []string{
+				`CREATE VIRTUAL TABLE IF NOT EXISTS comment_search USING fts5(comment_id UNINDEXED, content)`,
+				`CREATE TRIGGER IF NOT EXISTS comment_search_insert AFTER INSERT ON comment BEGIN
+					INSERT INTO comment_search (comment_id, content) VALUES (new.id, new.content);
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS comment_search_update AFTER UPDATE OF content ON comment BEGIN
+					UPDATE comment_search SET content = new.content WHERE comment_id = old.id;
+				END`,
+				`CREATE TRIGGER IF NOT EXISTS comment_search_delete AFTER DELETE ON comment BEGIN
+					DELETE FROM comment_search WHERE comment_id = old.id;
+				END`,
+				`INSERT INTO comment_search (comment_id, content) SELECT id, content FROM comment`,
+			} {
+				if err := migrations.SQL(ctx, db, migrations.DialectSQL{SQLite: stmt}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		func(ctx context.Context, db database.Database) error {
+			switch db.DriverName() {
+			case "postgres":
+				_ = migrations.DropIndex(ctx, db, "idx_comment_search", "comment")
+				return migrations.DropColumn(ctx, db, "comment", "search_vector")
+			case "mysql":
+				return migrations.DropIndex(ctx, db, "idx_comment_search", "comment")
+			}
+			for _, stmt := range []string{
+				`DROP TRIGGER IF EXISTS comment_search_insert`,
+				`DROP TRIGGER IF EXISTS comment_search_update`,
+				`DROP TRIGGER IF EXISTS comment_search_delete`,
+				`DROP TABLE IF EXISTS comment_search`,
+			} {
+				if err := migrations.SQL(ctx, db, migrations.DialectSQL{SQLite: stmt}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	)
+
+	builder.Add(
+		"20261016000017000",
+		"create_comment_rate_limit_key_table",
+		func(ctx context.Context, db database.Database) error {
+			// One row per rate limit key, written at the start of every
+			// attempt so that concurrent attempts on the same key queue up on
+			// its row lock instead of all reading the same count.
+			return migrations.SQL(ctx, db, migrations.DialectSQL{
+				Postgres: `CREATE TABLE IF NOT EXISTS comment_rate_limit_key (
+					rate_key VARCHAR(255) PRIMARY KEY,
+					updated_at BIGINT NOT NULL
+				)`,
+				MySQL: `CREATE TABLE IF NOT EXISTS comment_rate_limit_key (
+					rate_key VARCHAR(255) PRIMARY KEY,
+					updated_at BIGINT NOT NULL
+				) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4 COLLATE=utf8mb4_unicode_ci`,
+				SQLite: `CREATE TABLE IF NOT EXISTS comment_rate_limit_key (
+					rate_key TEXT PRIMARY KEY,
+					updated_at INTEGER NOT NULL
+				)`,
+			})
+		},
+		func(ctx context.Context, db database.Database) error {
+			return migrations.DropTableIfExists(ctx, db, "comment_rate_limit_key")
+		},
+	)
+
 	return builder.Build()
 }
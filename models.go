@@ -11,6 +11,10 @@ const (
 	StatusModerated = "moderated"
 )
 
+// DeletedContentPlaceholder replaces the content of tombstoned comments in
+// responses.
+const DeletedContentPlaceholder = "[deleted]"
+
 var ValidStatuses = []string{
 	StatusAwaiting,
 	StatusPublished,
@@ -19,21 +23,62 @@ var ValidStatuses = []string{
 }
 
 type Comment struct {
-	Id             string     `json:"id,omitempty" db:"id" rbac:"read:*;write:none"`
-	UserId         *string    `json:"userId,omitempty" db:"user_id" rbac:"read:*;write:none"`
-	CommentableId  string     `json:"commentableId" db:"commentable_id" rbac:"read:*;write:*"`
-	Commentable    string     `json:"commentable" db:"commentable" rbac:"read:*;write:*"`
-	ParentId       *string    `json:"parentId,omitempty" db:"parent_id" rbac:"read:*;write:*"`
-	Content        string     `json:"content" db:"content" rbac:"read:*;write:*"`
-	Status         string     `json:"status" db:"status" rbac:"read:*;write:moderator"`
-	IpAddress      *string    `json:"ipAddress,omitempty" db:"ip_address" rbac:"read:moderator;write:none"`
-	UserAgent      *string    `json:"userAgent,omitempty" db:"user_agent" rbac:"read:moderator;write:none"`
-	RemoteSourceId *string    `json:"remoteSourceId,omitempty" db:"remote_source_id" rbac:"read:*;write:none"`
-	RemoteSource   *string    `json:"remoteSource,omitempty" db:"remote_source" rbac:"read:*;write:none"`
-	UpdatedAt      *time.Time `json:"updatedAt,omitempty" db:"updated_at" rbac:"read:*;write:none"`
-	CreatedAt      *time.Time `json:"createdAt,omitempty" db:"created_at" rbac:"read:*;write:none"`
+	Id               string     `json:"id,omitempty" db:"id" rbac:"read:*;write:none"`
+	UserId           *string    `json:"userId,omitempty" db:"user_id" rbac:"read:*;write:none"`
+	CommentableId    string     `json:"commentableId" db:"commentable_id" rbac:"read:*;write:*"`
+	Commentable      string     `json:"commentable" db:"commentable" rbac:"read:*;write:*"`
+	ParentId         *string    `json:"parentId,omitempty" db:"parent_id" rbac:"read:*;write:*"`
+	Depth            int        `json:"depth" db:"depth" rbac:"read:*;write:none"`
+	RootId           *string    `json:"rootId,omitempty" db:"root_id" rbac:"read:*;write:none"`
+	Path             *string    `json:"path,omitempty" db:"path" rbac:"read:*;write:none"`
+	Content          string     `json:"content" db:"content" rbac:"read:*;write:*"`
+	ContentFormat    string     `json:"contentFormat" db:"content_format" rbac:"read:*;write:none"`
+	ContentHtml      *string    `json:"contentHtml,omitempty" db:"content_html" rbac:"read:*;write:none"`
+	Mentions         *string    `json:"mentions,omitempty" db:"mentions" rbac:"read:*;write:none"`
+	Status           string     `json:"status" db:"status" rbac:"read:*;write:moderator"`
+	IpAddress        *string    `json:"ipAddress,omitempty" db:"ip_address" rbac:"read:moderator;write:none"`
+	UserAgent        *string    `json:"userAgent,omitempty" db:"user_agent" rbac:"read:moderator;write:none"`
+	EncryptionKeyId  *string    `json:"-" db:"encryption_key_id" rbac:"read:*;write:none"`
+	EncryptedDataKey *string    `json:"-" db:"encrypted_data_key" rbac:"read:*;write:none"`
+	RemoteSourceId   *string    `json:"remoteSourceId,omitempty" db:"remote_source_id" rbac:"read:*;write:none"`
+	RemoteSource     *string    `json:"remoteSource,omitempty" db:"remote_source" rbac:"read:*;write:none"`
+	PublishedAt      *time.Time `json:"publishedAt,omitempty" db:"published_at" rbac:"read:moderator;write:none"`
+	ModeratedAt      *time.Time `json:"moderatedAt,omitempty" db:"moderated_at" rbac:"read:moderator;write:none"`
+	ModeratedBy      *string    `json:"moderatedBy,omitempty" db:"moderated_by" rbac:"read:moderator;write:none"`
+	ModerationReason *string    `json:"moderationReason,omitempty" db:"moderation_reason" rbac:"read:moderator;write:none"`
+	CheckVerdict     *string    `json:"checkVerdict,omitempty" db:"check_verdict" rbac:"read:moderator;write:none"`
+	CheckScore       *float64   `json:"checkScore,omitempty" db:"check_score" rbac:"read:moderator;write:none"`
+	CheckReasons     *string    `json:"checkReasons,omitempty" db:"check_reasons" rbac:"read:moderator;write:none"`
+	Upvotes          int        `json:"upvotes" db:"upvotes" rbac:"read:*;write:none"`
+	Downvotes        int        `json:"downvotes" db:"downvotes" rbac:"read:*;write:none"`
+	Score            int        `json:"score" db:"score" rbac:"read:*;write:none"`
+	WilsonScore      float64    `json:"wilsonScore" db:"wilson_score" rbac:"read:*;write:none"`
+	ControversyScore float64    `json:"controversyScore" db:"controversy_score" rbac:"read:*;write:none"`
+	EditCount        int        `json:"editCount" db:"edit_count" rbac:"read:*;write:none"`
+	EditedAt         *time.Time `json:"editedAt,omitempty" db:"edited_at" rbac:"read:*;write:none"`
+	DeletedAt        *time.Time `json:"deletedAt,omitempty" db:"deleted_at" rbac:"read:*;write:none"`
+	DeletedBy        *string    `json:"deletedBy,omitempty" db:"deleted_by" rbac:"read:moderator;write:none"`
+	UpdatedAt        *time.Time `json:"updatedAt,omitempty" db:"updated_at" rbac:"read:*;write:none"`
+	CreatedAt        *time.Time `json:"createdAt,omitempty" db:"created_at" rbac:"read:*;write:none"`
 }
 
 func (Comment) TableName() string {
 	return "comment"
 }
+
+// CommentRevision is a snapshot of a comment's content taken right before an
+// edit replaced it. Version is the version number of that content: the
+// original is version 1, and the comment's EditCount is the latest revision's
+// version.
+type CommentRevision struct {
+	Id        string     `json:"id" db:"id" rbac:"read:*;write:none"`
+	CommentId string     `json:"commentId" db:"comment_id" rbac:"read:*;write:none"`
+	Version   int        `json:"version" db:"version" rbac:"read:*;write:none"`
+	Content   string     `json:"content" db:"content" rbac:"read:*;write:none"`
+	EditedBy  *string    `json:"editedBy,omitempty" db:"edited_by" rbac:"read:*;write:none"`
+	CreatedAt *time.Time `json:"createdAt,omitempty" db:"created_at" rbac:"read:*;write:none"`
+}
+
+func (CommentRevision) TableName() string {
+	return "comment_revision"
+}
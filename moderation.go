@@ -0,0 +1,326 @@
+package commentable
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	auth "github.com/nicolasbonnici/gorest/auth"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+const (
+	ModerationApprove = "approve"
+	ModerationReject  = "reject"
+	ModerationDelete  = "delete"
+)
+
+// Per-id outcomes of a bulk moderation request.
+const (
+	ModerationResultApproved = "approved"
+	ModerationResultRejected = "rejected"
+	ModerationResultDeleted  = "deleted"
+	ModerationResultNotFound = "not_found"
+
+	ModerationResultInvalidTransition = "invalid_transition"
+)
+
+// moderationQueue is one page of the moderation queue.
+type moderationQueue struct {
+	Items  []Comment
+	Counts map[string]int
+	Total  int
+}
+
+// queueConditions selects the comments awaiting moderation on the allowed
+// commentable types. Tombstones never await anything.
+func queueConditions(cfg *Config) []query.Condition {
+	types := make([]any, len(cfg.AllowedTypes))
+	for i, t := range cfg.AllowedTypes {
+		types[i] = t
+	}
+	return []query.Condition{
+		query.Eq("status", StatusAwaiting),
+		query.IsNull("deleted_at"),
+		query.In("commentable", types...),
+	}
+}
+
+// fetchModerationQueue loads one page of awaiting comments, oldest first, with
+// the number of awaiting comments per commentable type.
+func fetchModerationQueue(ctx context.Context, db database.Database, c *crud.CRUD[Comment], cfg *Config, limit, offset int) (*moderationQueue, error) {
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      limit,
+		Offset:     offset,
+		Conditions: queueConditions(cfg),
+		OrderBy: []crud.OrderByClause{
+			{Column: "created_at", Direction: query.ASC},
+			{Column: "id", Direction: query.ASC},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	counts, err := countAwaitingByType(ctx, db, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	queue := &moderationQueue{Items: res.Items, Counts: counts}
+	for _, n := range counts {
+		queue.Total += n
+	}
+	return queue, nil
+}
+
+// countAwaitingByType counts the moderation queue per commentable type; every
+// allowed type is present, with zero when nothing awaits.
+func countAwaitingByType(ctx context.Context, db database.Database, cfg *Config) (map[string]int, error) {
+	b := query.New(db.Dialect()).
+		Select("commentable").
+		SelectExpr(query.As(query.Count(query.Col("id")), "total")).
+		From("comment")
+	for _, cond := range queueConditions(cfg) {
+		b = b.Where(cond)
+	}
+	stmt, args, err := b.GroupBy("commentable").Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int, len(cfg.AllowedTypes))
+	for _, t := range cfg.AllowedTypes {
+		counts[t] = 0
+	}
+	for rows.Next() {
+		var commentable string
+		var total int
+		if err := rows.Scan(&commentable, &total); err != nil {
+			return nil, err
+		}
+		counts[commentable] = total
+	}
+	return counts, rows.Err()
+}
+
+// BulkModerate applies one moderation action to every id of dto inside a
+// single transaction. Approvals and rejections follow StatusTransitions like
+// any other status change. Ids that do not exist (or no longer do, e.g. a
+// tombstone pruned by an earlier delete of the same batch) or whose status
+// cannot make the transition are reported as such and do not abort the batch;
+// any database error rolls the whole batch back, webhooks queued for the
+// changed comments included.
+func (h *CommentHooks) BulkModerate(c fiber.Ctx, dto BulkModerationDTO) ([]BulkModerationResultDTO, error) {
+	if !h.isModerator(c) {
+		return nil, fiber.NewError(403, "Only moderators can moderate comments")
+	}
+
+	var status, outcome string
+	switch dto.Action {
+	case ModerationApprove:
+		status, outcome = StatusPublished, ModerationResultApproved
+	case ModerationReject:
+		status, outcome = StatusModerated, ModerationResultRejected
+	case ModerationDelete:
+		outcome = ModerationResultDeleted
+	default:
+		return nil, fiber.NewError(400, fmt.Sprintf("invalid action (allowed: %s, %s, %s)", ModerationApprove, ModerationReject, ModerationDelete))
+	}
+
+	ids := uniqueIDs(dto.IDs)
+	if len(ids) == 0 {
+		return nil, fiber.NewError(400, "ids cannot be empty")
+	}
+	if len(ids) > h.config.MaxBulkModerationSize {
+		return nil, fiber.NewError(400, fmt.Sprintf("at most %d ids can be moderated at once", h.config.MaxBulkModerationSize))
+	}
+
+	ctx := auth.Context(c)
+	user := auth.GetAuthenticatedUser(c)
+	admin := h.isAdmin(c)
+
+	moderated, err := h.eventComments(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]BulkModerationResultDTO, 0, len(ids))
+	var statusChanges []CommentStatusChangedEvent
+	var deletions []CommentDeletedEvent
+	for _, id := range ids {
+		result := BulkModerationResultDTO{ID: id, Result: outcome}
+
+		target, before, found, err := loadStatsEntry(ctx, h.db, tx, id)
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return nil, err
+		}
+
+		comment, queue := moderated[id]
+		previous := comment
+		if dto.Action == ModerationDelete {
+			found, err := h.removeComment(ctx, tx, id, user)
+			if err != nil {
+				_ = tx.Rollback(ctx)
+				return nil, err
+			}
+			if !found {
+				result.Result = ModerationResultNotFound
+			}
+			comment = deletedComment(comment, user)
+		} else {
+			result.Result, err = h.moderateStatus(ctx, tx, id, status, outcome, admin, user, dto.Reason, &comment)
+			if err != nil {
+				_ = tx.Rollback(ctx)
+				return nil, err
+			}
+		}
+
+		if found {
+			_, after, _, err := loadStatsEntry(ctx, h.db, tx, id)
+			if err == nil {
+				err = adjustTargetStats(ctx, h.db, tx, target, before, after)
+			}
+			if err != nil {
+				_ = tx.Rollback(ctx)
+				return nil, err
+			}
+		}
+
+		// Approving a published comment is a no-op that nobody is told about.
+		changed := result.Result == outcome && (dto.Action == ModerationDelete || comment.Status != previous.Status)
+		if queue && changed {
+			event := WebhookCommentDeleted
+			if dto.Action != ModerationDelete {
+				event = statusWebhookEvent(status)
+			}
+			if err := h.webhooks.enqueue(ctx, tx, event, comment); err != nil {
+				_ = tx.Rollback(ctx)
+				return nil, err
+			}
+			if dto.Action == ModerationDelete {
+				deletions = append(deletions, CommentDeletedEvent{Comment: previous, ActorID: userIDOf(user)})
+			} else {
+				statusChanges = append(statusChanges, CommentStatusChangedEvent{Comment: comment, From: previous.Status, To: status, ActorID: userIDOf(user)})
+			}
+		}
+
+		results = append(results, result)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	h.webhooks.notify()
+	for _, event := range statusChanges {
+		h.events.publishStatusChanged(ctx, event)
+	}
+	for _, event := range deletions {
+		h.events.publishDeleted(ctx, event)
+	}
+	return results, nil
+}
+
+// moderateStatus moves a live comment to status on behalf of a moderator and
+// returns the per-id result: outcome, not_found or invalid_transition. The
+// transition is also applied to model, which is the comment as loaded before
+// the batch started.
+func (h *CommentHooks) moderateStatus(
+	ctx context.Context,
+	q sqlExecutor,
+	id, status, outcome string,
+	admin bool,
+	user *auth.AuthenticatedUser,
+	reason *string,
+	model *Comment,
+) (string, error) {
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("status", "user_id").
+		From("comment").
+		Where(query.Eq("id", id)).
+		Where(query.IsNull("deleted_at")).
+		Build()
+	if err != nil {
+		return "", err
+	}
+
+	var current string
+	var owner sql.NullString
+	found, err := scanFirst(ctx, q, stmt, args, &current, &owner)
+	if err != nil {
+		return "", err
+	}
+	if !found {
+		return ModerationResultNotFound, nil
+	}
+
+	var ownerID *string
+	if owner.Valid {
+		ownerID = &owner.String
+	}
+	actor := transitionActor(admin, true, user, ownerID)
+	if err := checkTransition(current, status, actor, h.config.DefaultStatus); err != nil {
+		return ModerationResultInvalidTransition, nil
+	}
+
+	var userID *string
+	if user != nil {
+		userID = &user.UserID
+	}
+	now := time.Now().UTC()
+	changed := Comment{Status: current}
+	applyTransition(&changed, status, actor, userID, reason, now)
+
+	b := query.New(h.db.Dialect()).Update("comment").
+		Set("status", changed.Status).
+		Set("updated_at", now)
+	if changed.PublishedAt != nil {
+		b = b.Set("published_at", changed.PublishedAt)
+	}
+	if changed.ModeratedAt != nil {
+		b = b.Set("moderated_at", changed.ModeratedAt).
+			Set("moderated_by", changed.ModeratedBy).
+			Set("moderation_reason", changed.ModerationReason)
+	}
+	stmt, args, err = b.Where(query.Eq("id", id)).Build()
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return "", err
+	}
+	model.Status = current
+	applyTransition(model, status, actor, userID, reason, now)
+	model.UpdatedAt = &now
+	return outcome, nil
+}
+
+func uniqueIDs(ids []string) []string {
+	seen := make(map[string]bool, len(ids))
+	unique := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
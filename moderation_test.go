@@ -0,0 +1,165 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+func newModerationApp(t *testing.T, db database.Database, cfg *Config, roles ...string) *fiber.App {
+	t.Helper()
+	app := fiber.New()
+	app.Use(func(fc fiber.Ctx) error {
+		fc.Locals("user_id", "moderator-1")
+		fc.SetContext(rbac.WithRoles(context.Background(), roles))
+		return fc.Next()
+	})
+	hooks := RegisterCommentRoutes(app, db, cfg)
+	hooks.Start()
+	t.Cleanup(hooks.Close)
+	return app
+}
+
+func setCreatedAt(t *testing.T, db database.Database, id string, createdAt time.Time) {
+	t.Helper()
+	stmt, args, err := query.New(db.Dialect()).Update("comment").
+		Set("created_at", createdAt).
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestModerationQueue(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	now := time.Now().UTC()
+	newer := insertComment(t, db, nil, StatusAwaiting)
+	older := insertComment(t, db, nil, StatusAwaiting)
+	insertComment(t, db, nil, StatusPublished)
+	setCreatedAt(t, db, newer, now)
+	setCreatedAt(t, db, older, now.Add(-time.Hour))
+
+	resp, err := newModerationApp(t, db, &cfg, "reader").Test(httptest.NewRequest("GET", "/comments/moderation/queue", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 403 {
+		t.Errorf("expected 403 for non-moderators, got %d", resp.StatusCode)
+	}
+
+	resp, err = newModerationApp(t, db, &cfg, "moderator").Test(httptest.NewRequest("GET", "/comments/moderation/queue", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	var body struct {
+		Data   []CommentResponseDTO `json:"data"`
+		Counts map[string]int       `json:"counts"`
+		Total  int                  `json:"total"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Data) != 2 || body.Data[0].ID != older || body.Data[1].ID != newer {
+		t.Errorf("expected awaiting comments oldest first, got %+v", body.Data)
+	}
+	if body.Total != 2 || body.Counts["post"] != 2 {
+		t.Errorf("expected 2 awaiting posts, got total %d counts %v", body.Total, body.Counts)
+	}
+}
+
+func TestBulkModerate(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	c := crud.New[Comment](db)
+	ctx := rbac.WithRoles(context.Background(), []string{"admin"})
+
+	approved := insertComment(t, db, nil, StatusAwaiting)
+	rejected := insertComment(t, db, nil, StatusAwaiting)
+	parent := insertComment(t, db, nil, StatusPublished)
+	reply := insertComment(t, db, &parent, StatusPublished)
+
+	moderate := func(action string, ids ...string) (int, []BulkModerationResultDTO) {
+		t.Helper()
+		payload, _ := json.Marshal(BulkModerationDTO{Action: action, IDs: ids})
+		req := httptest.NewRequest("POST", "/comments/moderation/bulk", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := newModerationApp(t, db, &cfg, "moderator").Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data []BulkModerationResultDTO `json:"data"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Data
+	}
+
+	if status, _ := moderate("publish", approved); status != 400 {
+		t.Errorf("expected 400 for an unknown action, got %d", status)
+	}
+
+	status, results := moderate(ModerationApprove, approved, "missing", approved)
+	if status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	want := []BulkModerationResultDTO{
+		{ID: approved, Result: ModerationResultApproved},
+		{ID: "missing", Result: ModerationResultNotFound},
+	}
+	if len(results) != len(want) || results[0] != want[0] || results[1] != want[1] {
+		t.Errorf("unexpected report %+v", results)
+	}
+
+	if _, results := moderate(ModerationReject, rejected); len(results) != 1 || results[0].Result != ModerationResultRejected {
+		t.Errorf("unexpected report %+v", results)
+	}
+
+	draft := insertComment(t, db, nil, StatusDraft)
+	if _, results := moderate(ModerationApprove, draft); len(results) != 1 || results[0].Result != ModerationResultInvalidTransition {
+		t.Errorf("expected drafts to be left to their author, got %+v", results)
+	}
+
+	for id, status := range map[string]string{approved: StatusPublished, rejected: StatusModerated} {
+		comment, err := c.GetByID(ctx, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if comment.Status != status {
+			t.Errorf("expected %s to be %s, got %s", id, status, comment.Status)
+		}
+		if comment.ModeratedBy == nil || *comment.ModeratedBy != "moderator-1" {
+			t.Errorf("expected %s to record its moderator, got %v", id, comment.ModeratedBy)
+		}
+	}
+
+	// Deleting the parent tombstones it; deleting its only reply afterwards
+	// in the same batch prunes the tombstone.
+	_, results = moderate(ModerationDelete, parent, reply)
+	if len(results) != 2 || results[0].Result != ModerationResultDeleted || results[1].Result != ModerationResultDeleted {
+		t.Errorf("unexpected report %+v", results)
+	}
+	for _, id := range []string{parent, reply} {
+		if _, err := c.GetByID(ctx, id); err == nil {
+			t.Errorf("expected %s to be removed", id)
+		}
+	}
+}
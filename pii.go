@@ -0,0 +1,236 @@
+package commentable
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/netip"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/logger"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// How the authors' IP addresses and user agents are stored. Truncated IP
+// addresses keep their /24 (IPv4) or /48 (IPv6) network, and their user agents
+// are stored as is; hashed ones are replaced by their keyed HMAC-SHA256, so
+// that equal values can still be told apart from different ones.
+const (
+	PIIStorageRaw       = "raw"
+	PIIStorageTruncated = "truncated"
+	PIIStorageHashed    = "hashed"
+)
+
+var ValidPIIStorageModes = []string{PIIStorageRaw, PIIStorageTruncated, PIIStorageHashed}
+
+// What happens to the IP addresses and user agents of comments older than
+// the retention window: they are cleared, or hashed like with
+// PIIStorageHashed.
+const (
+	PIIRetentionNull = "null"
+	PIIRetentionHash = "hash"
+)
+
+var ValidPIIRetentionActions = []string{PIIRetentionNull, PIIRetentionHash}
+
+const (
+	// piiPurgeInterval is how often the purge job looks for comments past the
+	// retention window.
+	piiPurgeInterval = time.Hour
+	// piiPurgeBatchSize is the number of comments scrubbed at a time.
+	piiPurgeBatchSize = 500
+)
+
+// storedIP returns the form ip is stored in, nil for none.
+func (c *Config) storedIP(ip string) *string {
+	if ip == "" {
+		return nil
+	}
+	switch c.PIIStorage {
+	case PIIStorageTruncated:
+		addr, err := netip.ParseAddr(ip)
+		if err != nil {
+			return nil
+		}
+		addr = addr.Unmap()
+		bits := 48
+		if addr.Is4() {
+			bits = 24
+		}
+		prefix, err := addr.Prefix(bits)
+		if err != nil {
+			return nil
+		}
+		truncated := prefix.Addr().String()
+		return &truncated
+	case PIIStorageHashed:
+		hashed := hashPII(c.PIIHashKey, ip)
+		return &hashed
+	}
+	return &ip
+}
+
+// storedUserAgent returns the form userAgent is stored in, nil for none.
+func (c *Config) storedUserAgent(userAgent string) *string {
+	if userAgent == "" {
+		return nil
+	}
+	if c.PIIStorage == PIIStorageHashed {
+		hashed := hashPII(c.PIIHashKey, userAgent)
+		return &hashed
+	}
+	return &userAgent
+}
+
+// hashPII returns the HMAC-SHA256 of value with key, which fits the
+// ip_address column.
+func hashPII(key, value string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// PurgePII scrubs the IP addresses and user agents of the comments created
+// more than cfg.PIIRetentionDays before now, as cfg.PIIRetentionAction says,
+// and returns how many comments it scrubbed. Each comment is scrubbed once,
+// so values that were hashed when stored are left as they are. It does
+// nothing when the retention is 0.
+//
+// The plugin runs it hourly; call it to purge on a schedule of your own.
+func PurgePII(ctx context.Context, db database.Database, cfg *Config, now time.Time) (int, error) {
+	if cfg.PIIRetentionDays <= 0 {
+		return 0, nil
+	}
+	cutoff := now.UTC().AddDate(0, 0, -cfg.PIIRetentionDays)
+	due := query.And(
+		query.Lt("created_at", cutoff),
+		query.IsNull("pii_scrubbed_at"),
+	)
+
+	if cfg.PIIRetentionAction != PIIRetentionHash || cfg.PIIStorage == PIIStorageHashed {
+		update := query.New(db.Dialect()).Update("comment")
+		if cfg.PIIRetentionAction != PIIRetentionHash {
+			update = update.Set("ip_address", nil).Set("user_agent", nil)
+		}
+		stmt, args, err := update.Set("pii_scrubbed_at", now.UTC()).Where(due).Build()
+		if err != nil {
+			return 0, err
+		}
+		res, err := db.Exec(ctx, stmt, args...)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		return int(n), err
+	}
+
+	total := 0
+	after := ""
+	for {
+		n, last, err := hashPIIBatch(ctx, db, cfg, query.And(due, query.Gt("id", after)), now)
+		total += n
+		if err != nil || last == "" {
+			return total, err
+		}
+		after = last
+	}
+}
+
+// hashPIIBatch hashes the IP addresses and user agents of one batch of the
+// comments matching due, in id order, and returns how many it hashed and the
+// last id of the batch when more may follow. Encrypted values are decrypted
+// to be hashed, and the hashes encrypted in turn. A comment that cannot be
+// decrypted, e.g. whose key is unavailable, is logged and left for the next
+// purge, so that it does not hold back the others.
+func hashPIIBatch(ctx context.Context, db database.Database, cfg *Config, due query.Condition, now time.Time) (int, string, error) {
+	stmt, args, err := query.New(db.Dialect()).
+		Select("id", "ip_address", "user_agent", "encryption_key_id", "encrypted_data_key").
+		From("comment").
+		Where(due).
+		OrderBy("id", query.ASC).
+		Limit(piiPurgeBatchSize).
+		Build()
+	if err != nil {
+		return 0, "", err
+	}
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	var batch []Comment
+	for rows.Next() {
+		var row Comment
+		if err := rows.Scan(&row.Id, &row.IpAddress, &row.UserAgent, &row.EncryptionKeyId, &row.EncryptedDataKey); err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		batch = append(batch, row)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil || len(batch) == 0 {
+		return 0, "", err
+	}
+	last := ""
+	if len(batch) == piiPurgeBatchSize {
+		last = batch[len(batch)-1].Id
+	}
+
+	cc := newCommentCipher(cfg)
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return 0, "", err
+	}
+	hashed := 0
+	for _, row := range batch {
+		if err := cc.open(ctx, &row); err != nil {
+			logger.Log.Error("comment PII purge skipped a comment", "comment_id", row.Id, "error", err)
+			continue
+		}
+		for _, value := range []*string{row.IpAddress, row.UserAgent} {
+			if value != nil {
+				*value = hashPII(cfg.PIIHashKey, *value)
+			}
+		}
+		err := cc.seal(ctx, &row)
+		if err == nil {
+			stmt, args, err = query.New(db.Dialect()).Update("comment").
+				Set("ip_address", row.IpAddress).
+				Set("user_agent", row.UserAgent).
+				Set("encryption_key_id", row.EncryptionKeyId).
+				Set("encrypted_data_key", row.EncryptedDataKey).
+				Set("pii_scrubbed_at", now.UTC()).
+				Where(query.Eq("id", row.Id)).
+				Build()
+		}
+		if err == nil {
+			_, err = tx.Exec(ctx, stmt, args...)
+		}
+		if err != nil {
+			_ = tx.Rollback(ctx)
+			return 0, "", err
+		}
+		hashed++
+	}
+	return hashed, last, tx.Commit(ctx)
+}
+
+// runPIIPurge purges the comments past the retention window every
+// piiPurgeInterval, until ctx is cancelled.
+func runPIIPurge(ctx context.Context, db database.Database, cfg *Config) {
+	ticker := time.NewTicker(piiPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := PurgePII(ctx, db, cfg, time.Now()); err != nil && ctx.Err() == nil {
+			logger.Log.Error("comment PII purge failed", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package commentable
+
+import (
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+func TestStoredPII(t *testing.T) {
+	cfg := DefaultConfig()
+	if ip := cfg.storedIP("203.0.113.7"); ip == nil || *ip != "203.0.113.7" {
+		t.Errorf("expected raw IP addresses to be stored as is, got %v", ip)
+	}
+
+	cfg.PIIStorage = PIIStorageTruncated
+	for ip, want := range map[string]string{
+		"203.0.113.7":        "203.0.113.0",
+		"::ffff:203.0.113.7": "203.0.113.0",
+		"2001:db8:1:2::5":    "2001:db8:1::",
+	} {
+		if got := cfg.storedIP(ip); got == nil || *got != want {
+			t.Errorf("expected %s to be truncated to %s, got %v", ip, want, got)
+		}
+	}
+	if ip := cfg.storedIP("not an ip"); ip != nil {
+		t.Errorf("expected an invalid IP address to be dropped, got %v", *ip)
+	}
+	if ua := cfg.storedUserAgent("Mozilla/5.0"); ua == nil || *ua != "Mozilla/5.0" {
+		t.Errorf("expected the user agent to be kept, got %v", ua)
+	}
+
+	cfg.PIIStorage = PIIStorageHashed
+	cfg.PIIHashKey = "secret"
+	a, b := cfg.storedIP("203.0.113.7"), cfg.storedIP("203.0.113.8")
+	if *a == "203.0.113.7" || *a != *cfg.storedIP("203.0.113.7") || *a == *b || len(*a) > 45 {
+		t.Errorf("expected stable hashes that fit the column, got %s and %s", *a, *b)
+	}
+	if ua := cfg.storedUserAgent("Mozilla/5.0"); *ua != hashPII("secret", "Mozilla/5.0") {
+		t.Errorf("expected the user agent to be hashed, got %s", *ua)
+	}
+	if ip := cfg.storedIP(""); ip != nil {
+		t.Errorf("expected no IP address to be stored as none, got %v", *ip)
+	}
+}
+
+func TestPurgePII(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now().UTC()
+
+	setup := func(t *testing.T) (database.Database, string, string) {
+		t.Helper()
+		db := setupThreadDB(t)
+		old := insertComment(t, db, nil, StatusPublished)
+		recent := insertComment(t, db, nil, StatusPublished)
+		stmt, args, _ := query.New(db.Dialect()).Update("comment").
+			Set("ip_address", "203.0.113.7").
+			Set("user_agent", "Mozilla/5.0").
+			Build()
+		if _, err := db.Exec(ctx, stmt, args...); err != nil {
+			t.Fatal(err)
+		}
+		setCreatedAt(t, db, old, now.AddDate(0, 0, -31))
+		setCreatedAt(t, db, recent, now.AddDate(0, 0, -29))
+		return db, old, recent
+	}
+	pii := func(t *testing.T, db database.Database, id string) (ip, ua *string) {
+		t.Helper()
+		if err := db.QueryRow(ctx, `SELECT ip_address, user_agent FROM comment WHERE id = ?`, id).Scan(&ip, &ua); err != nil {
+			t.Fatal(err)
+		}
+		return ip, ua
+	}
+
+	t.Run("null", func(t *testing.T) {
+		db, old, recent := setup(t)
+		cfg := DefaultConfig()
+		cfg.PIIRetentionDays = 30
+
+		n, err := PurgePII(ctx, db, &cfg, now)
+		if err != nil || n != 1 {
+			t.Fatalf("expected 1 comment to be scrubbed, got %d (%v)", n, err)
+		}
+		if ip, ua := pii(t, db, old); ip != nil || ua != nil {
+			t.Errorf("expected the old comment to be scrubbed, got %v %v", ip, ua)
+		}
+		if ip, ua := pii(t, db, recent); ip == nil || ua == nil {
+			t.Errorf("expected the recent comment to be kept for moderators")
+		}
+	})
+
+	t.Run("worker", func(t *testing.T) {
+		db, old, _ := setup(t)
+		cfg := DefaultConfig()
+		cfg.PIIRetentionDays = 30
+		hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+
+		time.Sleep(50 * time.Millisecond)
+		if ip, _ := pii(t, db, old); ip == nil {
+			t.Fatal("expected no purge before Start")
+		}
+		hooks.Start()
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+			// Reads may find the database locked by the purge.
+			var ip *string
+			if err := db.QueryRow(ctx, `SELECT ip_address FROM comment WHERE id = ?`, old).Scan(&ip); err == nil && ip == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("expected Start to run the purge")
+			}
+		}
+
+		closed := make(chan struct{})
+		go func() {
+			hooks.Close()
+			close(closed)
+		}()
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected Close to stop the purge")
+		}
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		db, old, recent := setup(t)
+		cfg := DefaultConfig()
+		cfg.PIIRetentionDays = 30
+		cfg.PIIRetentionAction = PIIRetentionHash
+		cfg.PIIHashKey = "secret"
+
+		for run, want := range []int{1, 0} {
+			if n, err := PurgePII(ctx, db, &cfg, now); err != nil || n != want {
+				t.Fatalf("expected %d comments to be scrubbed by run %d, got %d (%v)", want, run+1, n, err)
+			}
+		}
+		if ip, ua := pii(t, db, old); ip == nil || *ip != hashPII("secret", "203.0.113.7") || ua == nil || *ua != hashPII("secret", "Mozilla/5.0") {
+			t.Errorf("expected the old comment to be hashed once, got %v %v", ip, ua)
+		}
+		if ip, _ := pii(t, db, recent); ip == nil || *ip != "203.0.113.7" {
+			t.Errorf("expected the recent comment to be kept as is, got %v", ip)
+		}
+	})
+
+	t.Run("undecryptable", func(t *testing.T) {
+		db, old, _ := setup(t)
+		cfg := encryptionConfig("k1")
+		cfg.PIIRetentionDays = 30
+		cfg.PIIRetentionAction = PIIRetentionHash
+		cfg.PIIHashKey = "secret"
+
+		// Encrypted under a key that was since retired.
+		broken := insertComment(t, db, nil, StatusPublished)
+		stmt, args, _ := query.New(db.Dialect()).Update("comment").
+			Set("ip_address", encryptedPrefix+"sealed").
+			Set("encryption_key_id", "retired").
+			Set("encrypted_data_key", "d3JhcHBlZA==").
+			Where(query.Eq("id", broken)).
+			Build()
+		if _, err := db.Exec(ctx, stmt, args...); err != nil {
+			t.Fatal(err)
+		}
+		setCreatedAt(t, db, broken, now.AddDate(0, 0, -31))
+
+		if n, err := PurgePII(ctx, db, &cfg, now); err != nil || n != 1 {
+			t.Fatalf("expected the other comment to be scrubbed, got %d (%v)", n, err)
+		}
+		stored := storedComment(t, db, old)
+		if err := newCommentCipher(&cfg).open(ctx, &stored); err != nil {
+			t.Fatal(err)
+		}
+		if stored.IpAddress == nil || *stored.IpAddress != hashPII("secret", "203.0.113.7") {
+			t.Errorf("expected the old comment to be hashed, got %v", stored.IpAddress)
+		}
+		if ip, _ := pii(t, db, broken); ip == nil || *ip != encryptedPrefix+"sealed" {
+			t.Errorf("expected the undecryptable comment to be left for a later purge, got %v", ip)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		db, old, _ := setup(t)
+		cfg := DefaultConfig()
+		if n, err := PurgePII(ctx, db, &cfg, now); err != nil || n != 0 {
+			t.Fatalf("expected nothing to be scrubbed, got %d (%v)", n, err)
+		}
+		if ip, _ := pii(t, db, old); ip == nil {
+			t.Errorf("expected the IP address to be kept without retention")
+		}
+	})
+}
+
+func TestCreateStoresPIIAsConfigured(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.PIIStorage = PIIStorageHashed
+	cfg.PIIHashKey = "secret"
+
+	req := httptest.NewRequest("POST", "/comments", strings.NewReader(`{"commentable":"post","commentableId":"post-1","content":"hi"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	resp, err := newModerationApp(t, db, &cfg, "admin").Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	var ip, ua string
+	if err := db.QueryRow(context.Background(), `SELECT ip_address, user_agent FROM comment`).Scan(&ip, &ua); err != nil {
+		t.Fatal(err)
+	}
+	if ip != hashPII("secret", "0.0.0.0") || ua != hashPII("secret", "Mozilla/5.0") {
+		t.Errorf("expected the IP address and user agent to be hashed, got %q %q", ip, ua)
+	}
+}
@@ -10,6 +10,8 @@ import (
 type CommentablePlugin struct {
 	config Config
 	db     database.Database
+	events *EventBus
+	hooks  *CommentHooks
 }
 
 func NewPlugin() plugin.Plugin {
@@ -20,8 +22,18 @@ func (p *CommentablePlugin) Name() string {
 	return "commentable"
 }
 
+// Events returns the bus other plugins subscribe to in order to react to
+// comments. It can be used before or after Initialize.
+func (p *CommentablePlugin) Events() *EventBus {
+	if p.events == nil {
+		p.events = NewEventBus()
+	}
+	return p.events
+}
+
 func (p *CommentablePlugin) Initialize(config map[string]interface{}) error {
 	p.config = DefaultConfig()
+	p.config.Events = p.Events()
 
 	if db, ok := config["database"].(database.Database); ok {
 		p.db = db
@@ -68,6 +80,157 @@ func (p *CommentablePlugin) Initialize(config map[string]interface{}) error {
 		p.config.AllowAnonymous = allowAnonymous
 	}
 
+	if maxBulkModerationSize, ok := config["max_bulk_moderation_size"].(int); ok {
+		p.config.MaxBulkModerationSize = maxBulkModerationSize
+	}
+
+	if contentFormats, ok := config["content_formats"].(map[string]interface{}); ok {
+		formats := make(map[string]string, len(contentFormats))
+		for commentableType, format := range contentFormats {
+			if str, ok := format.(string); ok {
+				formats[commentableType] = str
+			}
+		}
+		p.config.ContentFormats = formats
+	}
+
+	if mentionColumn, ok := config["mention_username_column"].(string); ok {
+		p.config.MentionUsernameColumn = mentionColumn
+	}
+
+	if maxMentions, ok := config["max_mentions_per_comment"].(int); ok {
+		p.config.MaxMentionsPerComment = maxMentions
+	}
+
+	if maxLinks, ok := config["max_links"].(int); ok {
+		p.config.MaxLinks = maxLinks
+	}
+
+	if blockedWords, ok := config["blocked_words"].([]interface{}); ok {
+		words := make([]string, 0, len(blockedWords))
+		for _, w := range blockedWords {
+			if str, ok := w.(string); ok {
+				words = append(words, str)
+			}
+		}
+		p.config.BlockedWords = words
+	}
+
+	if duplicateWindow, ok := config["duplicate_window_seconds"].(int); ok {
+		p.config.DuplicateWindowSeconds = duplicateWindow
+	}
+
+	if classifierURL, ok := config["classifier_url"].(string); ok {
+		p.config.ClassifierURL = classifierURL
+	}
+
+	if holdScore, ok := config["classifier_hold_score"].(float64); ok {
+		p.config.ClassifierHoldScore = holdScore
+	}
+
+	if rejectScore, ok := config["classifier_reject_score"].(float64); ok {
+		p.config.ClassifierRejectScore = rejectScore
+	}
+
+	if checkers, ok := config["content_checkers"].([]ContentChecker); ok {
+		p.config.ContentCheckers = checkers
+	}
+
+	if window, ok := config["rate_limit_window_seconds"].(int); ok {
+		p.config.RateLimitWindowSeconds = window
+	}
+
+	if perUser, ok := config["rate_limit_per_user"].(int); ok {
+		p.config.RateLimitPerUser = perUser
+	}
+
+	if perIP, ok := config["rate_limit_per_ip"].(int); ok {
+		p.config.RateLimitPerIP = perIP
+	}
+
+	if perThread, ok := config["rate_limit_per_thread"].(int); ok {
+		p.config.RateLimitPerThread = perThread
+	}
+
+	if backend, ok := config["rate_limit_backend"].(string); ok {
+		p.config.RateLimitBackend = backend
+	}
+
+	if store, ok := config["rate_limit_store"].(RateLimitStore); ok {
+		p.config.RateLimitStore = store
+	}
+
+	if webhooks, ok := config["webhooks"].([]interface{}); ok {
+		endpoints := make([]WebhookConfig, 0, len(webhooks))
+		for _, w := range webhooks {
+			entry, ok := w.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			var endpoint WebhookConfig
+			endpoint.URL, _ = entry["url"].(string)
+			endpoint.Secret, _ = entry["secret"].(string)
+			if events, ok := entry["events"].([]interface{}); ok {
+				for _, e := range events {
+					if str, ok := e.(string); ok {
+						endpoint.Events = append(endpoint.Events, str)
+					}
+				}
+			}
+			endpoints = append(endpoints, endpoint)
+		}
+		p.config.Webhooks = endpoints
+	}
+
+	if maxAttempts, ok := config["webhook_max_attempts"].(int); ok {
+		p.config.WebhookMaxAttempts = maxAttempts
+	}
+
+	if timeout, ok := config["webhook_timeout_seconds"].(int); ok {
+		p.config.WebhookTimeoutSeconds = timeout
+	}
+
+	if retentionDays, ok := config["webhook_retention_days"].(int); ok {
+		p.config.WebhookRetentionDays = retentionDays
+	}
+
+	if storage, ok := config["pii_storage"].(string); ok {
+		p.config.PIIStorage = storage
+	}
+
+	if hashKey, ok := config["pii_hash_key"].(string); ok {
+		p.config.PIIHashKey = hashKey
+	}
+
+	if retentionDays, ok := config["pii_retention_days"].(int); ok {
+		p.config.PIIRetentionDays = retentionDays
+	}
+
+	if retentionAction, ok := config["pii_retention_action"].(string); ok {
+		p.config.PIIRetentionAction = retentionAction
+	}
+
+	if keys, ok := config["encryption_keys"].(map[string]interface{}); ok {
+		p.config.EncryptionKeys = make(map[string]string, len(keys))
+		for id, key := range keys {
+			if str, ok := key.(string); ok {
+				p.config.EncryptionKeys[id] = str
+			}
+		}
+	}
+
+	if keyID, ok := config["encryption_key_id"].(string); ok {
+		p.config.EncryptionKeyID = keyID
+	}
+
+	if encryptDrafts, ok := config["encrypt_drafts"].(bool); ok {
+		p.config.EncryptDrafts = encryptDrafts
+	}
+
+	if provider, ok := config["key_provider"].(KeyProvider); ok {
+		p.config.KeyProvider = provider
+	}
+
 	return p.config.Validate()
 }
 
@@ -82,7 +245,17 @@ func (p *CommentablePlugin) SetupEndpoints(router fiber.Router) error {
 		return nil
 	}
 
-	RegisterRoutes(router, p.db, &p.config)
+	p.hooks = RegisterRoutes(router, p.db, &p.config)
+	p.hooks.Start()
+	return nil
+}
+
+// Close stops the background workers started with the endpoints. Call it when
+// shutting the application down.
+func (p *CommentablePlugin) Close() error {
+	if p.hooks != nil {
+		p.hooks.Close()
+	}
 	return nil
 }
 
@@ -94,6 +267,14 @@ func (p *CommentablePlugin) MigrationDependencies() []string {
 	return []string{"gorest-core-auth"}
 }
 
+func (p *CommentablePlugin) Commands() []plugin.Command {
+	return []plugin.Command{
+		&rebuildStatsCommand{db: p.db},
+		&purgePIICommand{db: p.db, config: &p.config},
+		&reencryptCommand{db: p.db, config: &p.config},
+	}
+}
+
 func (p *CommentablePlugin) Dependencies() []string {
 	return []string{}
 }
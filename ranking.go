@@ -0,0 +1,204 @@
+package commentable
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Sort orders accepted by the sort query parameter.
+const (
+	SortOld           = "old"
+	SortNew           = "new"
+	SortTop           = "top"
+	SortBest          = "best"
+	SortControversial = "controversial"
+)
+
+var ValidSorts = []string{SortOld, SortNew, SortTop, SortBest, SortControversial}
+
+// parseSort validates a sort query parameter, defaulting to SortOld.
+func parseSort(value string) (string, error) {
+	if value == "" {
+		return SortOld, nil
+	}
+	for _, s := range ValidSorts {
+		if value == s {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("invalid sort (allowed: %s)", strings.Join(ValidSorts, ", "))
+}
+
+// rankColumn returns the denormalized column a score-based sort orders by,
+// highest first, or "" for the chronological sorts.
+func rankColumn(sortMode string) string {
+	switch sortMode {
+	case SortTop:
+		return "score"
+	case SortBest:
+		return "wilson_score"
+	case SortControversial:
+		return "controversy_score"
+	}
+	return ""
+}
+
+// rankKey is the value of rankColumn for a comment.
+func rankKey(sortMode string, c *Comment) float64 {
+	switch sortMode {
+	case SortTop:
+		return float64(c.Score)
+	case SortBest:
+		return c.WilsonScore
+	case SortControversial:
+		return c.ControversyScore
+	}
+	return 0
+}
+
+// listOrder is the ORDER BY of GET /comments for a sort, ahead of any order[]
+// parameters.
+func listOrder(sortMode string) []crud.OrderByClause {
+	switch sortMode {
+	case SortNew:
+		return []crud.OrderByClause{{Column: "created_at", Direction: query.DESC}}
+	case SortOld:
+		return []crud.OrderByClause{{Column: "created_at", Direction: query.ASC}}
+	}
+	return []crud.OrderByClause{
+		{Column: rankColumn(sortMode), Direction: query.DESC},
+		{Column: "created_at", Direction: query.DESC},
+	}
+}
+
+// threadOrder is the ORDER BY of one thread level. Siblings share their path
+// prefix and each segment starts with the creation time, so path order is
+// chronological order; it also breaks ties between equal ranks.
+func threadOrder(sortMode string) []crud.OrderByClause {
+	switch sortMode {
+	case SortOld:
+		return []crud.OrderByClause{{Column: "path", Direction: query.ASC}}
+	case SortNew:
+		return []crud.OrderByClause{{Column: "path", Direction: query.DESC}}
+	}
+	return []crud.OrderByClause{
+		{Column: rankColumn(sortMode), Direction: query.DESC},
+		{Column: "path", Direction: query.ASC},
+	}
+}
+
+// threadLess orders siblings in memory the same way threadOrder does in SQL.
+func threadLess(sortMode string) func(a, b *Comment) bool {
+	path := func(c *Comment) string {
+		if c.Path == nil {
+			return ""
+		}
+		return *c.Path
+	}
+	switch sortMode {
+	case SortOld:
+		return func(a, b *Comment) bool { return path(a) < path(b) }
+	case SortNew:
+		return func(a, b *Comment) bool { return path(a) > path(b) }
+	}
+	return func(a, b *Comment) bool {
+		ka, kb := rankKey(sortMode, a), rankKey(sortMode, b)
+		if ka != kb {
+			return ka > kb
+		}
+		return path(a) < path(b)
+	}
+}
+
+func sortSiblings(nodes []*CommentThreadDTO, models map[*CommentThreadDTO]*Comment, less func(a, b *Comment) bool) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return less(models[nodes[i]], models[nodes[j]])
+	})
+}
+
+// afterConditions resumes a thread level after the cursor comment.
+func afterConditions(opts threadPageOptions) []query.Condition {
+	switch opts.Sort {
+	case SortOld, "":
+		// Skip the cursor comment and its whole subtree.
+		return []query.Condition{query.Gte("path", opts.After+"g")}
+	case SortNew:
+		return []query.Condition{query.Lt("path", opts.After)}
+	}
+	column := rankColumn(opts.Sort)
+	return []query.Condition{query.Or(
+		query.Lt(column, opts.AfterKey),
+		query.And(query.Eq(column, opts.AfterKey), query.Gt("path", opts.After)),
+	)}
+}
+
+// threadCursor encodes the position of c on its level for the sort: its path,
+// followed by its rank for the score-based sorts.
+func threadCursor(sortMode string, c *Comment) string {
+	if c.Path == nil {
+		return ""
+	}
+	if rankColumn(sortMode) == "" {
+		return encodeThreadCursor(*c.Path)
+	}
+	raw := *c.Path + "~" + strconv.FormatFloat(rankKey(sortMode, c), 'g', -1, 64)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// decodeRankedCursor validates a cursor of a score-based sort and returns its
+// path and rank.
+func decodeRankedCursor(cursor, parentPath string, depth int) (string, float64, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", 0, errors.New("invalid cursor")
+	}
+	path, key, ok := strings.Cut(string(raw), "~")
+	if !ok {
+		return "", 0, errors.New("invalid cursor")
+	}
+	rank, err := strconv.ParseFloat(key, 64)
+	if err != nil || math.IsNaN(rank) || math.IsInf(rank, 0) {
+		return "", 0, errors.New("invalid cursor")
+	}
+	if err := validateThreadPath(path, parentPath, depth); err != nil {
+		return "", 0, err
+	}
+	return path, rank, nil
+}
+
+// wilsonZ is the z-score of the 95% confidence level used by wilsonScore.
+const wilsonZ = 1.96
+
+// wilsonScore is the lower bound of the Wilson score interval for the share
+// of upvotes: a comment needs both a good ratio and enough votes to rank high.
+func wilsonScore(up, down int) float64 {
+	n := float64(up + down)
+	if n == 0 {
+		return 0
+	}
+	p := float64(up) / n
+	z2 := wilsonZ * wilsonZ
+	return (p + z2/(2*n) - wilsonZ*math.Sqrt((p*(1-p)+z2/(4*n))/n)) / (1 + z2/n)
+}
+
+// controversyScore grows with the number of votes and peaks when they are
+// evenly split; it is zero unless a comment has both up and down votes.
+func controversyScore(up, down int) float64 {
+	if up <= 0 || down <= 0 {
+		return 0
+	}
+	magnitude := float64(up + down)
+	balance := float64(down) / float64(up)
+	if up < down {
+		balance = float64(up) / float64(down)
+	}
+	return math.Pow(magnitude, balance)
+}
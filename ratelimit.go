@@ -0,0 +1,311 @@
+package commentable
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Rate limit backends selectable through Config.RateLimitBackend.
+const (
+	RateLimitBackendMemory   = "memory"
+	RateLimitBackendDatabase = "database"
+)
+
+// RateLimitStore records comment attempts per key. The in-memory store only
+// sees the traffic of its own process; use the database store (or your own)
+// when several instances serve comments.
+type RateLimitStore interface {
+	// Take records an attempt at the given time against every limit, unless
+	// one of them already holds Limit attempts at or after since. Then nothing
+	// is recorded and Take returns how long until the attempt would fit, as
+	// rateLimitWait computes it. The check and the record have to be atomic,
+	// or concurrent attempts could all pass the same check. Attempts older
+	// than since are no longer needed and may be dropped.
+	Take(ctx context.Context, limits []RateLimit, at, since time.Time) (time.Duration, error)
+}
+
+// RateLimit is the number of attempts allowed for a key over the window.
+type RateLimit struct {
+	Key   string
+	Limit int
+}
+
+// rateLimitRule caps the attempts of one scope (user, IP or thread) over a
+// sliding window.
+type rateLimitRule struct {
+	scope string
+	limit int
+}
+
+// rateLimiter enforces the per-user, per-IP and per-thread limits of Config
+// on comment creation.
+type rateLimiter struct {
+	store  RateLimitStore
+	window time.Duration
+	rules  []rateLimitRule
+	now    func() time.Time
+}
+
+// newRateLimiter returns nil when no limit is configured.
+func newRateLimiter(db database.Database, cfg *Config) *rateLimiter {
+	var rules []rateLimitRule
+	for _, rule := range []rateLimitRule{
+		{scope: "user", limit: cfg.RateLimitPerUser},
+		{scope: "ip", limit: cfg.RateLimitPerIP},
+		{scope: "thread", limit: cfg.RateLimitPerThread},
+	} {
+		if rule.limit > 0 {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 || cfg.RateLimitWindowSeconds <= 0 {
+		return nil
+	}
+
+	store := cfg.RateLimitStore
+	if store == nil {
+		if cfg.RateLimitBackend == RateLimitBackendDatabase && db != nil {
+			store = &DatabaseRateLimitStore{DB: db}
+		} else {
+			store = NewMemoryRateLimitStore()
+		}
+	}
+
+	return &rateLimiter{
+		store:  store,
+		window: time.Duration(cfg.RateLimitWindowSeconds) * time.Second,
+		rules:  rules,
+		now:    time.Now,
+	}
+}
+
+// allow checks every applicable limit and, when none is exceeded, records the
+// attempt against each of them. keys maps a scope to its key; scopes without
+// a key (e.g. user for anonymous comments) are skipped. It returns how long
+// the caller has to wait when a limit is exceeded, zero otherwise.
+func (l *rateLimiter) allow(ctx context.Context, keys map[string]string) (time.Duration, error) {
+	now := l.now().UTC()
+
+	var limits []RateLimit
+	for _, rule := range l.rules {
+		id, ok := keys[rule.scope]
+		if !ok || id == "" {
+			continue
+		}
+		limits = append(limits, RateLimit{Key: rule.scope + ":" + id, Limit: rule.limit})
+	}
+	if len(limits) == 0 {
+		return 0, nil
+	}
+	return l.store.Take(ctx, limits, now, now.Add(-l.window))
+}
+
+// rateLimitWait returns how long a key holding hits (oldest first, none before
+// since) has to wait for another attempt under limit: until the attempt that
+// has to fall out of the window does. It is zero while the limit is not
+// reached.
+func rateLimitWait(hits []time.Time, limit int, since time.Time) time.Duration {
+	if len(hits) < limit {
+		return 0
+	}
+	// Hits are kept to the millisecond by the database store; an attempt
+	// right at the edge of the window still has that long to go.
+	return max(hits[len(hits)-limit].Sub(since), time.Millisecond)
+}
+
+// rateLimitError is the 429 returned to a caller over a limit, with the wait
+// in whole seconds in Retry-After.
+func rateLimitError(c fiber.Ctx, retryAfter time.Duration) error {
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(seconds))
+	return fiber.NewError(fiber.StatusTooManyRequests, fmt.Sprintf("too many comments, retry in %d seconds", seconds))
+}
+
+// MemoryRateLimitStore keeps attempts in process memory.
+type MemoryRateLimitStore struct {
+	mu    sync.Mutex
+	hits  map[string][]time.Time
+	swept time.Time
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{hits: make(map[string][]time.Time)}
+}
+
+func (m *MemoryRateLimitStore) Take(_ context.Context, limits []RateLimit, at, since time.Time) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var wait time.Duration
+	for _, limit := range limits {
+		hits := m.hits[limit.Key]
+		expired := 0
+		for expired < len(hits) && hits[expired].Before(since) {
+			expired++
+		}
+		hits = hits[expired:]
+		if len(hits) == 0 {
+			delete(m.hits, limit.Key)
+		} else {
+			m.hits[limit.Key] = hits
+		}
+		wait = max(wait, rateLimitWait(hits, limit.Limit, since))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for _, limit := range limits {
+		m.hits[limit.Key] = append(m.hits[limit.Key], at)
+	}
+
+	// Keys that went quiet are never taken again to expire their attempts,
+	// so they are dropped once per window for the map not to grow without
+	// bound.
+	if m.swept.Before(since) {
+		for key, hits := range m.hits {
+			if hits[len(hits)-1].Before(since) {
+				delete(m.hits, key)
+			}
+		}
+		m.swept = at
+	}
+	return 0, nil
+}
+
+// DatabaseRateLimitStore keeps attempts in the comment_rate_limit table, so
+// that every instance sharing the database enforces the same limits. Each
+// attempt first writes the row of its keys in comment_rate_limit_key, which
+// holds concurrent attempts on the same key until it committed.
+type DatabaseRateLimitStore struct {
+	DB database.Database
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+func (d *DatabaseRateLimitStore) Take(ctx context.Context, limits []RateLimit, at, since time.Time) (time.Duration, error) {
+	tx, err := d.DB.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	wait, err := d.take(ctx, tx, limits, at, since)
+	if err != nil || wait > 0 {
+		_ = tx.Rollback(ctx)
+		return wait, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (d *DatabaseRateLimitStore) take(ctx context.Context, q sqlExecutor, limits []RateLimit, at, since time.Time) (time.Duration, error) {
+	// Keys are locked in the same order by every attempt, so that two
+	// attempts sharing several keys cannot deadlock.
+	limits = slices.Clone(limits)
+	slices.SortFunc(limits, func(a, b RateLimit) int { return strings.Compare(a.Key, b.Key) })
+
+	lock := upsertStatement(d.DB, "comment_rate_limit_key", []string{"rate_key"}, []string{"rate_key", "updated_at"}, nil)
+	var wait time.Duration
+	for _, limit := range limits {
+		if _, err := q.Exec(ctx, lock, limit.Key, at.UnixMilli()); err != nil {
+			return 0, err
+		}
+		hits, err := d.hits(ctx, q, limit.Key, since)
+		if err != nil {
+			return 0, err
+		}
+		wait = max(wait, rateLimitWait(hits, limit.Limit, since))
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+
+	builder := query.New(d.DB.Dialect())
+	exec := func(stmt string, args []any, err error) error {
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, stmt, args...)
+		return err
+	}
+	for _, limit := range limits {
+		if err := exec(builder.Delete("comment_rate_limit").
+			Where(query.And(
+				query.Eq("rate_key", limit.Key),
+				query.Lt("hit_at", since.UnixMilli()),
+			)).
+			Build()); err != nil {
+			return 0, err
+		}
+		if err := exec(builder.Insert("comment_rate_limit").
+			Columns("rate_key", "hit_at").
+			Values(limit.Key, at.UnixMilli()).
+			Build()); err != nil {
+			return 0, err
+		}
+	}
+
+	// As in memory, keys that went quiet are dropped once per window.
+	d.mu.Lock()
+	sweep := d.swept.Before(since)
+	if sweep {
+		d.swept = at
+	}
+	d.mu.Unlock()
+	if sweep {
+		if err := exec(builder.Delete("comment_rate_limit").Where(query.Lt("hit_at", since.UnixMilli())).Build()); err != nil {
+			return 0, err
+		}
+		if err := exec(builder.Delete("comment_rate_limit_key").Where(query.Lt("updated_at", since.UnixMilli())).Build()); err != nil {
+			return 0, err
+		}
+	}
+	return 0, nil
+}
+
+// hits returns the times of the attempts recorded for key at or after since,
+// oldest first.
+func (d *DatabaseRateLimitStore) hits(ctx context.Context, q sqlExecutor, key string, since time.Time) ([]time.Time, error) {
+	stmt, args, err := query.New(d.DB.Dialect()).
+		Select("hit_at").
+		From("comment_rate_limit").
+		Where(query.And(
+			query.Eq("rate_key", key),
+			query.Gte("hit_at", since.UnixMilli()),
+		)).
+		OrderBy("hit_at", query.ASC).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hits []time.Time
+	for rows.Next() {
+		var ms int64
+		if err := rows.Scan(&ms); err != nil {
+			return nil, err
+		}
+		hits = append(hits, time.UnixMilli(ms).UTC())
+	}
+	return hits, rows.Err()
+}
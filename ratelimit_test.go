@@ -0,0 +1,180 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter_SlidingWindow(t *testing.T) {
+	db := setupThreadDB(t)
+
+	for name, store := range map[string]RateLimitStore{
+		"memory":   NewMemoryRateLimitStore(),
+		"database": &DatabaseRateLimitStore{DB: db},
+	} {
+		t.Run(name, func(t *testing.T) {
+			start := time.Now().UTC().Truncate(time.Millisecond)
+			now := start
+			limiter := &rateLimiter{
+				store:  store,
+				window: time.Minute,
+				rules:  []rateLimitRule{{scope: "user", limit: 2}, {scope: "ip", limit: 3}},
+				now:    func() time.Time { return now },
+			}
+			ctx := context.Background()
+			keys := map[string]string{"user": "user-1", "ip": "192.0.2.1"}
+
+			allow := func() time.Duration {
+				t.Helper()
+				wait, err := limiter.allow(ctx, keys)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return wait
+			}
+
+			if allow() != 0 {
+				t.Fatal("expected the first attempt to be allowed")
+			}
+			now = start.Add(20 * time.Second)
+			if allow() != 0 {
+				t.Fatal("expected the second attempt to be allowed")
+			}
+			now = start.Add(30 * time.Second)
+			if wait := allow(); wait != 30*time.Second {
+				t.Errorf("expected to wait for the first attempt to expire, got %v", wait)
+			}
+
+			// A refused attempt is not counted, so the first slot frees up
+			// once the first attempt leaves the window.
+			now = start.Add(61 * time.Second)
+			if allow() != 0 {
+				t.Error("expected an attempt once the window slid")
+			}
+
+			// Another user from the same IP fills the IP limit instead.
+			keys = map[string]string{"user": "user-2", "ip": "192.0.2.1"}
+			if allow() != 0 {
+				t.Error("expected another user to be allowed")
+			}
+			if allow() == 0 {
+				t.Error("expected the IP limit to apply")
+			}
+		})
+	}
+}
+
+func TestCommentCreate_RateLimited(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.RateLimitPerUser = 1
+	app := newModerationApp(t, db, &cfg, "reader")
+
+	create := func() (int, string) {
+		t.Helper()
+		payload, _ := json.Marshal(CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "hello"})
+		req := httptest.NewRequest("POST", "/comments", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, resp.Header.Get("Retry-After")
+	}
+
+	if status, _ := create(); status != 201 {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	status, retryAfter := create()
+	if status != 429 {
+		t.Fatalf("expected 429, got %d", status)
+	}
+	if retryAfter == "" || retryAfter == "0" {
+		t.Errorf("expected a Retry-After header, got %q", retryAfter)
+	}
+}
+
+func TestMemoryRateLimitStore_ConcurrentTakes(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Now().UTC()
+	limits := []RateLimit{{Key: "user:user-1", Limit: 5}}
+
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := store.Take(context.Background(), limits, now, now.Add(-time.Minute))
+			if err != nil {
+				t.Error(err)
+			}
+			if wait == 0 {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != 5 {
+		t.Errorf("expected 5 attempts to get through, got %d", got)
+	}
+}
+
+func TestMemoryRateLimitStore_DropsQuietKeys(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	ctx := context.Background()
+	start := time.Now().UTC()
+
+	for _, key := range []string{"ip:192.0.2.1", "ip:192.0.2.2"} {
+		if _, err := store.Take(ctx, []RateLimit{{Key: key, Limit: 1}}, start, start.Add(-time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	later := start.Add(2 * time.Minute)
+	if _, err := store.Take(ctx, []RateLimit{{Key: "ip:192.0.2.3", Limit: 1}}, later, later.Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.hits) != 1 {
+		t.Errorf("expected only the active key to be kept, got %v", store.hits)
+	}
+}
+
+func TestCommentCreate_InvalidAttemptsNotRateLimited(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.RateLimitPerUser = 1
+	app := newModerationApp(t, db, &cfg, "reader")
+
+	create := func(dto CommentCreateDTO) int {
+		t.Helper()
+		payload, _ := json.Marshal(dto)
+		req := httptest.NewRequest("POST", "/comments", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	missing := "00000000-0000-0000-0000-000000000000"
+	for range 3 {
+		status := create(CommentCreateDTO{Commentable: "post", CommentableId: "post-1", ParentId: &missing, Content: "hello"})
+		if status != 400 {
+			t.Fatalf("expected a reply to a missing comment to be refused, got %d", status)
+		}
+	}
+	if status := create(CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "hello"}); status != 201 {
+		t.Errorf("expected the first valid comment to be allowed, got %d", status)
+	}
+}
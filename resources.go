@@ -1,24 +1,42 @@
 package commentable
 
 import (
+	"bufio"
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"time"
+
 	"github.com/gofiber/fiber/v3"
 	auth "github.com/nicolasbonnici/gorest/auth"
 	"github.com/nicolasbonnici/gorest/crud"
 	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/logger"
+	"github.com/nicolasbonnici/gorest/pagination"
 	"github.com/nicolasbonnici/gorest/processor"
+	"github.com/nicolasbonnici/gorest/query"
 	rbac "github.com/nicolasbonnici/gorest/rbac"
+	"github.com/nicolasbonnici/gorest/response"
 )
 
 const MaxFilterValuesPerField = 50
 
 type CommentResource struct {
 	processor processor.Processor[Comment, CommentCreateDTO, CommentUpdateDTO, CommentResponseDTO]
+	db        database.Database
 	crud      *crud.CRUD[Comment]
+	revisions *crud.CRUD[CommentRevision]
 	hooks     *CommentHooks
 	config    *Config
 }
 
-func RegisterCommentRoutes(router fiber.Router, db database.Database, config *Config) {
+// RegisterCommentRoutes mounts the comment endpoints on router and returns
+// their hooks, whose background workers the caller starts and stops with
+// Start and Close.
+func RegisterCommentRoutes(router fiber.Router, db database.Database, config *Config) *CommentHooks {
 	rbacConfig := rbac.Config{
 		DefaultPolicy: rbac.DenyAll,
 		SuperuserRole: "admin",
@@ -37,8 +55,8 @@ func RegisterCommentRoutes(router fiber.Router, db database.Database, config *Co
 		panic("failed to create RBAC voter: " + err.Error())
 	}
 
-	commentCRUD := crud.New[Comment](db)
 	hooks := NewCommentHooks(db, config, voter)
+	commentCRUD := crud.NewWithHooks[Comment](db, newCommentReadHooks(voter, hooks.cipher))
 	converter := &CommentConverter{}
 
 	fieldMapping := map[string]string{
@@ -47,10 +65,19 @@ func RegisterCommentRoutes(router fiber.Router, db database.Database, config *Co
 		"commentableId": "commentable_id",
 		"commentable":   "commentable",
 		"parentId":      "parent_id",
+		"depth":         "depth",
+		"rootId":        "root_id",
 		"content":       "content",
 		"status":        "status",
 		"ipAddress":     "ip_address",
 		"userAgent":     "user_agent",
+		"publishedAt":   "published_at",
+		"score":         "score",
+		"upvotes":       "upvotes",
+		"downvotes":     "downvotes",
+		"editCount":     "edit_count",
+		"editedAt":      "edited_at",
+		"deletedAt":     "deleted_at",
 		"updatedAt":     "updated_at",
 		"createdAt":     "created_at",
 	}
@@ -62,31 +89,78 @@ func RegisterCommentRoutes(router fiber.Router, db database.Database, config *Co
 		PaginationLimit:    config.PaginationLimit,
 		PaginationMaxLimit: config.MaxPaginationLimit,
 		FieldMap:           fieldMapping,
-		AllowedFields:      []string{"id", "userId", "commentableId", "commentable", "parentId", "content", "status", "ipAddress", "userAgent", "updatedAt", "createdAt"},
+		AllowedFields:      []string{"id", "userId", "commentableId", "commentable", "parentId", "depth", "rootId", "content", "status", "ipAddress", "userAgent", "publishedAt", "score", "upvotes", "downvotes", "editCount", "editedAt", "deletedAt", "updatedAt", "createdAt"},
 	}).
-		WithCreateHook(hooks.Create).
-		WithUpdateHook(hooks.Update).
-		WithDeleteHook(hooks.Delete).
 		WithGetByIDHook(hooks.GetByID).
 		WithGetAllHook(hooks.GetAll)
 
 	res := &CommentResource{
 		processor: proc,
+		db:        db,
 		crud:      commentCRUD,
+		revisions: crud.New[CommentRevision](db),
 		hooks:     hooks,
 		config:    config,
 	}
 
 	router.Get("/comments", res.GetAll)
 	router.Get("/comments/thread", res.GetThread)
+	router.Get("/comments/search", res.Search)
+	router.Get("/comments/counts", res.GetCounts)
+	router.Get("/comments/moderation/queue", res.GetModerationQueue)
+	router.Post("/comments/moderation/bulk", res.BulkModerate)
+	router.Get("/comments/mentions", res.GetMentions)
+	router.Post("/comments/subscriptions", res.Subscribe)
+	router.Delete("/comments/subscriptions", res.Unsubscribe)
+	router.Get("/comments/notifications", res.GetNotifications)
+	router.Post("/comments/notifications/read", res.MarkNotificationsRead)
+	router.Get("/comments/webhooks/deliveries", res.GetWebhookDeliveries)
+	router.Get("/comments/export", res.Export)
+	router.Get("/comments/users/:userId/data", res.ExportUserData)
+	router.Post("/comments/users/:userId/erase", res.EraseUserData)
 	router.Get("/comments/:id", res.GetByID)
+	router.Get("/comments/:id/replies", res.GetReplies)
+	router.Get("/comments/:id/revisions", res.GetRevisions)
+	router.Post("/comments/:id/vote", res.Vote)
+	router.Delete("/comments/:id/vote", res.Unvote)
 	router.Post("/comments", res.Create)
 	router.Put("/comments/:id", res.Update)
 	router.Delete("/comments/:id", res.Delete)
+	return hooks
 }
 
+// Create runs the create hook and inserts the comment like the processor
+// would, then stores its mentions and notifies subscribers, which need the
+// comment row to exist, queues its webhooks and publishes it on the event bus.
 func (r *CommentResource) Create(c fiber.Ctx) error {
-	return r.processor.Create(c)
+	var dto CommentCreateDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+
+	conv := &CommentConverter{}
+	model := conv.CreateDTOToModel(dto)
+	if err := r.hooks.Create(c, dto, &model); err != nil {
+		return err
+	}
+
+	ctx := auth.Context(c)
+	if err := r.hooks.SaveCreate(ctx, &model); err != nil {
+		return fiber.NewError(500, "failed to create comment")
+	}
+
+	// Subscribers get the comment as stored, the caller only what its roles
+	// let it read.
+	if created, err := r.hooks.getComment(ctx, model.Id); err == nil {
+		model = *created
+	}
+
+	r.hooks.events.publishCreated(ctx, CommentCreatedEvent{Comment: model, ActorID: model.UserId})
+	out, err := r.hooks.responseDTO(ctx, model)
+	if err != nil {
+		return err
+	}
+	return response.SendFormatted(c, fiber.StatusCreated, out)
 }
 
 func (r *CommentResource) GetByID(c fiber.Ctx) error {
@@ -107,25 +181,713 @@ func (r *CommentResource) GetThread(c fiber.Ctx) error {
 		return fiber.NewError(400, "commentable type is not allowed")
 	}
 
-	roots, err := fetchThread(
+	opts, err := r.threadPageOptions(c, "", 0)
+	if err != nil {
+		return err
+	}
+
+	page, err := fetchThread(
 		auth.Context(c),
 		r.crud,
 		r.config,
 		commentableType,
 		commentableID,
 		r.hooks.statusConditions(c),
+		opts,
 	)
 	if err != nil {
 		return fiber.NewError(500, "failed to fetch comment thread")
 	}
 
-	return c.JSON(fiber.Map{"data": roots})
+	return sendThreadPage(c, page)
+}
+
+// GetCounts returns the number of comments the caller can see on each of
+// several targets of one commentable type, for listing pages. Ids are passed
+// as repeated commentableId (or commentableId[]) parameters.
+func (r *CommentResource) GetCounts(c fiber.Ctx) error {
+	commentableType := c.Query("commentable")
+	if commentableType == "" {
+		return fiber.NewError(400, "commentable is required")
+	}
+	if !r.config.IsAllowedType(commentableType) {
+		return fiber.NewError(400, "commentable type is not allowed")
+	}
+
+	args := c.Request().URI().QueryArgs()
+	var ids []string
+	for _, key := range []string{"commentableId", "commentableId[]"} {
+		for _, value := range args.PeekMulti(key) {
+			ids = append(ids, string(value))
+		}
+	}
+	ids = uniqueIDs(ids)
+	if len(ids) == 0 {
+		return fiber.NewError(400, "commentableId is required")
+	}
+	if len(ids) > MaxFilterValuesPerField {
+		return fiber.NewError(400, fmt.Sprintf("at most %d commentableId values are allowed", MaxFilterValuesPerField))
+	}
+
+	counts, err := countByTarget(auth.Context(c), r.db, commentableType, ids, r.hooks.statusConditions(c))
+	if err != nil {
+		return fiber.NewError(500, "failed to count comments")
+	}
+
+	return c.JSON(fiber.Map{"data": counts})
+}
+
+// GetReplies returns the next page of direct replies under a comment, each
+// with its nested replies, resuming from a childCursor of the thread endpoint.
+func (r *CommentResource) GetReplies(c fiber.Ctx) error {
+	ctx := auth.Context(c)
+	statusConds := r.hooks.statusConditions(c)
+
+	parent, err := r.findVisible(ctx, c.Params("id"), statusConds)
+	if err != nil {
+		return fiber.NewError(404, "Comment not found")
+	}
+
+	parentPath := ""
+	if parent.Path != nil {
+		parentPath = *parent.Path
+	}
+	opts, err := r.threadPageOptions(c, parentPath, parent.Depth+1)
+	if err != nil {
+		return err
+	}
+
+	page, err := fetchReplies(ctx, r.crud, r.config, parent, statusConds, opts)
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch comment replies")
+	}
+
+	return sendThreadPage(c, page)
+}
+
+// threadPageOptions reads sort, limit, childLimit and cursor for a thread
+// level whose comments sit at depth below parentPath. limit defaults to
+// PaginationLimit; childLimit defaults to none, so the replies are loaded in
+// one range scan unless the client pages them. Both are capped at
+// MaxPaginationLimit. A cursor is only valid with the sort it was issued for.
+func (r *CommentResource) threadPageOptions(c fiber.Ctx, parentPath string, depth int) (threadPageOptions, error) {
+	sortMode, err := parseSort(c.Query("sort"))
+	if err != nil {
+		return threadPageOptions{}, fiber.NewError(400, err.Error())
+	}
+
+	opts := threadPageOptions{
+		Sort:       sortMode,
+		Limit:      pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit),
+		ChildLimit: pagination.ParseIntQuery(c, "childLimit", 0, r.config.MaxPaginationLimit),
+	}
+	if opts.Limit < 1 {
+		opts.Limit = r.config.PaginationLimit
+	}
+
+	cursor := c.Query("cursor")
+	switch {
+	case cursor == "":
+	case rankColumn(sortMode) == "":
+		opts.After, err = decodeThreadCursor(cursor, parentPath, depth)
+	default:
+		opts.After, opts.AfterKey, err = decodeRankedCursor(cursor, parentPath, depth)
+	}
+	if err != nil {
+		return opts, fiber.NewError(400, err.Error())
+	}
+	return opts, nil
+}
+
+func sendThreadPage(c fiber.Ctx, page *threadPage) error {
+	body := fiber.Map{
+		"data":    page.Items,
+		"hasMore": page.NextCursor != "",
+	}
+	if page.NextCursor != "" {
+		body["nextCursor"] = page.NextCursor
+	}
+	return c.JSON(body)
+}
+
+// findVisible loads a comment by id only if the caller's status filter lets
+// them see it, so hidden comments cannot be used as an entry point into a
+// thread.
+func (r *CommentResource) findVisible(ctx context.Context, id string, statusConds []query.Condition) (*Comment, error) {
+	res, err := r.crud.GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      1,
+		Conditions: append([]query.Condition{query.Eq("id", id)}, statusConds...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(res.Items) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &res.Items[0], nil
+}
+
+// GetRevisions returns the edit history of a comment, oldest version first,
+// with a line-level diff between consecutive versions. It is restricted to
+// moderators and the comment's author; authors lose access once the comment
+// is deleted.
+func (r *CommentResource) GetRevisions(c fiber.Ctx) error {
+	ctx := auth.Context(c)
+
+	comment, err := r.hooks.getComment(ctx, c.Params("id"))
+	if err != nil {
+		return fiber.NewError(404, "Comment not found")
+	}
+
+	if !r.hooks.isModerator(c) {
+		user := auth.GetAuthenticatedUser(c)
+		if user == nil || comment.UserId == nil || *comment.UserId != user.UserID || comment.DeletedAt != nil {
+			return fiber.NewError(404, "Comment not found")
+		}
+	}
+
+	revisions, err := fetchRevisions(ctx, r.revisions, comment.Id)
+	if err == nil {
+		err = r.hooks.cipher.openRevisions(ctx, comment, revisions)
+	}
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch comment revisions")
+	}
+
+	return c.JSON(fiber.Map{"data": buildVersions(comment, revisions)})
+}
+
+// Search returns the comments containing every word of q that the caller may
+// see, most relevant first, with a snippet of their content highlighting the
+// words. It can be restricted to a type or one of its targets.
+func (r *CommentResource) Search(c fiber.Ctx) error {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		return fiber.NewError(400, "q is required")
+	}
+	if len(q) > MaxSearchQueryLength {
+		return fiber.NewError(400, fmt.Sprintf("q exceeds %d bytes", MaxSearchQueryLength))
+	}
+	terms := searchTerms(q)
+	if len(terms) == 0 {
+		return fiber.NewError(400, "q must contain at least one word")
+	}
+
+	conds := r.hooks.statusConditions(c)
+	commentable := c.Query("commentable")
+	commentableID := c.Query("commentableId")
+	if commentable != "" {
+		if !r.config.IsAllowedType(commentable) {
+			return fiber.NewError(400, "commentable type is not allowed")
+		}
+		conds = append(conds, query.Eq("commentable", commentable))
+	}
+	if commentableID != "" {
+		if commentable == "" {
+			return fiber.NewError(400, "commentable is required with commentableId")
+		}
+		conds = append(conds, query.Eq("commentable_id", commentableID))
+	}
+
+	limit := pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit)
+	if limit < 1 {
+		limit = r.config.PaginationLimit
+	}
+	page := pagination.ParseIntQuery(c, "page", 1, math.MaxInt32)
+	if page < 1 {
+		page = 1
+	}
+
+	results, err := fetchSearch(auth.Context(c), r.db, r.crud, terms, conds, limit, (page-1)*limit)
+	if err != nil {
+		return fiber.NewError(500, "failed to search comments")
+	}
+
+	conv := &CommentConverter{}
+	items := make([]CommentSearchResultDTO, len(results.Items))
+	for i, result := range results.Items {
+		items[i] = CommentSearchResultDTO{
+			CommentResponseDTO: conv.ModelToResponseDTO(result.Comment),
+			Rank:               result.Rank,
+			Snippet:            result.Snippet,
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    items,
+		"hasMore": results.HasMore,
+	})
+}
+
+// GetMentions returns the comments mentioning the authenticated user that
+// they may see, most recent mention first.
+func (r *CommentResource) GetMentions(c fiber.Ctx) error {
+	user := auth.GetAuthenticatedUser(c)
+	if user == nil {
+		return fiber.NewError(401, "authentication required")
+	}
+
+	limit := pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit)
+	if limit < 1 {
+		limit = r.config.PaginationLimit
+	}
+	page := pagination.ParseIntQuery(c, "page", 1, math.MaxInt32)
+	if page < 1 {
+		page = 1
+	}
+
+	ctx := auth.Context(c)
+	mentions, err := fetchMentions(ctx, r.db, r.crud, user.UserID, r.hooks.statusConditions(c), limit, (page-1)*limit)
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch mentions")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    (&CommentConverter{}).ModelsToResponseDTOs(mentions.Items),
+		"hasMore": mentions.HasMore,
+	})
+}
+
+// Subscribe follows the comments posted on a target, or the replies to one of
+// its comments the caller can see, for the authenticated user.
+func (r *CommentResource) Subscribe(c fiber.Ctx) error {
+	user, dto, err := r.subscriptionRequest(c)
+	if err != nil {
+		return err
+	}
+
+	subscription, err := subscribe(auth.Context(c), r.db, r.db, user.UserID, dto)
+	if err != nil {
+		return fiber.NewError(500, "failed to subscribe")
+	}
+	return c.Status(fiber.StatusCreated).JSON(subscription)
+}
+
+// Unsubscribe stops following a target or the replies to a comment, including
+// the subscription authors get to the replies to their own comments.
+func (r *CommentResource) Unsubscribe(c fiber.Ctx) error {
+	user, dto, err := r.subscriptionRequest(c)
+	if err != nil {
+		return err
+	}
+
+	if err := unsubscribe(auth.Context(c), r.db, user.UserID, dto); err != nil {
+		return fiber.NewError(500, "failed to unsubscribe")
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (r *CommentResource) subscriptionRequest(c fiber.Ctx) (*auth.AuthenticatedUser, CommentSubscriptionDTO, error) {
+	var dto CommentSubscriptionDTO
+	user := auth.GetAuthenticatedUser(c)
+	if user == nil {
+		return nil, dto, fiber.NewError(401, "authentication required")
+	}
+	if err := c.Bind().Body(&dto); err != nil {
+		return nil, dto, fiber.NewError(400, "invalid request body")
+	}
+	if dto.Commentable == "" || dto.CommentableId == "" {
+		return nil, dto, fiber.NewError(400, "commentable and commentableId are required")
+	}
+	if !r.config.IsAllowedType(dto.Commentable) {
+		return nil, dto, fiber.NewError(400, "commentable type is not allowed")
+	}
+	if dto.CommentId != nil {
+		comment, err := r.findVisible(auth.Context(c), *dto.CommentId, r.hooks.statusConditions(c))
+		if err != nil || comment.Commentable != dto.Commentable || comment.CommentableId != dto.CommentableId {
+			return nil, dto, fiber.NewError(404, "Comment not found")
+		}
+	}
+	return user, dto, nil
+}
+
+// GetNotifications returns the authenticated user's notifications about
+// comments they can see, most recent first, with the number of unread ones.
+// unread=true leaves out those already read.
+func (r *CommentResource) GetNotifications(c fiber.Ctx) error {
+	user := auth.GetAuthenticatedUser(c)
+	if user == nil {
+		return fiber.NewError(401, "authentication required")
+	}
+
+	limit := pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit)
+	if limit < 1 {
+		limit = r.config.PaginationLimit
+	}
+	page := pagination.ParseIntQuery(c, "page", 1, math.MaxInt32)
+	if page < 1 {
+		page = 1
+	}
+
+	notifications, err := fetchNotifications(
+		auth.Context(c),
+		r.db,
+		r.crud,
+		user.UserID,
+		r.hooks.statusConditions(c),
+		c.Query("unread") == "true",
+		limit,
+		(page-1)*limit,
+	)
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch notifications")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":        notifications.Items,
+		"unreadCount": notifications.UnreadCount,
+		"hasMore":     notifications.HasMore,
+	})
+}
+
+// MarkNotificationsRead marks some or all of the authenticated user's
+// notifications as read.
+func (r *CommentResource) MarkNotificationsRead(c fiber.Ctx) error {
+	user := auth.GetAuthenticatedUser(c)
+	if user == nil {
+		return fiber.NewError(401, "authentication required")
+	}
+
+	var dto MarkNotificationsReadDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+	var ids []string
+	if !dto.All {
+		ids = uniqueIDs(dto.IDs)
+		if len(ids) == 0 {
+			return fiber.NewError(400, "ids cannot be empty unless all is set")
+		}
+		if len(ids) > MaxFilterValuesPerField {
+			return fiber.NewError(400, fmt.Sprintf("at most %d ids can be marked at once", MaxFilterValuesPerField))
+		}
+	}
+
+	marked, err := markNotificationsRead(auth.Context(c), r.db, user.UserID, ids)
+	if err != nil {
+		return fiber.NewError(500, "failed to mark notifications as read")
+	}
+	return c.JSON(fiber.Map{"marked": marked})
+}
+
+// Vote casts or changes the authenticated user's vote on a comment they can
+// see. Authors cannot vote on their own comments, and tombstones cannot be
+// voted on.
+func (r *CommentResource) Vote(c fiber.Ctx) error {
+	var dto CommentVoteDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+	if dto.Value != VoteUp && dto.Value != VoteDown {
+		return fiber.NewError(400, "value must be 1 or -1")
+	}
+	return r.setVote(c, dto.Value)
+}
+
+// Unvote withdraws the authenticated user's vote on a comment, if any.
+func (r *CommentResource) Unvote(c fiber.Ctx) error {
+	return r.setVote(c, 0)
+}
+
+func (r *CommentResource) setVote(c fiber.Ctx, value int) error {
+	user := auth.GetAuthenticatedUser(c)
+	if user == nil {
+		return fiber.NewError(401, "authentication required")
+	}
+
+	ctx := auth.Context(c)
+	comment, err := r.findVisible(ctx, c.Params("id"), r.hooks.statusConditions(c))
+	if err != nil {
+		return fiber.NewError(404, "Comment not found")
+	}
+	if value != 0 {
+		if comment.DeletedAt != nil {
+			return fiber.NewError(400, "cannot vote on a deleted comment")
+		}
+		if comment.UserId != nil && *comment.UserId == user.UserID {
+			return fiber.NewError(403, "You cannot vote on your own comment")
+		}
+	}
+
+	result, err := r.hooks.Vote(ctx, comment.Id, user.UserID, value)
+	if err != nil {
+		return fiber.NewError(500, "failed to save vote")
+	}
+	return c.JSON(result)
 }
 
+// GetModerationQueue returns the comments awaiting moderation across all
+// allowed types, oldest first, together with the queue size per type.
+func (r *CommentResource) GetModerationQueue(c fiber.Ctx) error {
+	if !r.hooks.isModerator(c) {
+		return fiber.NewError(403, "Only moderators can access the moderation queue")
+	}
+
+	limit := pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit)
+	if limit < 1 {
+		limit = r.config.PaginationLimit
+	}
+	page := pagination.ParseIntQuery(c, "page", 1, math.MaxInt32)
+	if page < 1 {
+		page = 1
+	}
+
+	queue, err := fetchModerationQueue(auth.Context(c), r.db, r.crud, r.config, limit, (page-1)*limit)
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch moderation queue")
+	}
+
+	conv := &CommentConverter{}
+	items := make([]CommentResponseDTO, len(queue.Items))
+	for i := range queue.Items {
+		items[i] = conv.ModelToResponseDTO(queue.Items[i])
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    items,
+		"counts":  queue.Counts,
+		"total":   queue.Total,
+		"hasMore": page*limit < queue.Total,
+	})
+}
+
+// GetWebhookDeliveries returns the webhook delivery log, most recent first,
+// optionally filtered by status, event and commentId. Admin only.
+func (r *CommentResource) GetWebhookDeliveries(c fiber.Ctx) error {
+	if !r.hooks.isAdmin(c) {
+		return fiber.NewError(403, "Only admins can access webhook deliveries")
+	}
+
+	var conds []query.Condition
+	if status := c.Query("status"); status != "" {
+		if status != WebhookDeliveryPending && status != WebhookDeliveryDelivered && status != WebhookDeliveryFailed {
+			return fiber.NewError(400, fmt.Sprintf("invalid status (allowed: %s, %s, %s)", WebhookDeliveryPending, WebhookDeliveryDelivered, WebhookDeliveryFailed))
+		}
+		conds = append(conds, query.Eq("status", status))
+	}
+	if event := c.Query("event"); event != "" {
+		if !slices.Contains(ValidWebhookEvents, event) {
+			return fiber.NewError(400, fmt.Sprintf("invalid event (allowed: %v)", ValidWebhookEvents))
+		}
+		conds = append(conds, query.Eq("event", event))
+	}
+	if commentID := c.Query("commentId"); commentID != "" {
+		conds = append(conds, query.Eq("comment_id", commentID))
+	}
+
+	limit := pagination.ParseIntQuery(c, "limit", r.config.PaginationLimit, r.config.MaxPaginationLimit)
+	if limit < 1 {
+		limit = r.config.PaginationLimit
+	}
+	page := pagination.ParseIntQuery(c, "page", 1, math.MaxInt32)
+	if page < 1 {
+		page = 1
+	}
+
+	deliveries, hasMore, err := fetchWebhookDeliveries(auth.Context(c), r.db, conds, limit, (page-1)*limit)
+	if err != nil {
+		return fiber.NewError(500, "failed to fetch webhook deliveries")
+	}
+
+	return c.JSON(fiber.Map{
+		"data":    deliveries,
+		"hasMore": hasMore,
+	})
+}
+
+// BulkModerate approves, rejects or deletes several comments in one
+// transaction and reports the outcome for each id.
+func (r *CommentResource) BulkModerate(c fiber.Ctx) error {
+	var dto BulkModerationDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+
+	results, err := r.hooks.BulkModerate(c, dto)
+	if err != nil {
+		if _, ok := err.(*fiber.Error); ok {
+			return err
+		}
+		return fiber.NewError(500, "failed to moderate comments")
+	}
+
+	return c.JSON(fiber.Map{"data": results})
+}
+
+// Update runs the update hook, then writes only the columns it may change via
+// CommentHooks.SaveUpdate instead of the processor's full-row update.
 func (r *CommentResource) Update(c fiber.Ctx) error {
-	return r.processor.Update(c)
+	var dto CommentUpdateDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+
+	ctx := auth.Context(c)
+
+	// Subscribers are told what changed from the comment as the hook loaded
+	// it, before applying the update to the model.
+	var model Comment
+	previous, err := r.hooks.Update(c, dto, &model)
+	if err != nil {
+		return err
+	}
+
+	user := auth.GetAuthenticatedUser(c)
+	if err := r.hooks.SaveUpdate(ctx, dto, previous, &model, userIDOf(user)); err != nil {
+		return fiber.NewError(500, "failed to update comment")
+	}
+	r.hooks.publishUpdate(ctx, *previous, model, userIDOf(user))
+
+	out, err := r.hooks.responseDTO(ctx, model)
+	if err != nil {
+		return err
+	}
+	return response.SendFormatted(c, fiber.StatusOK, out)
 }
 
+// Delete authorizes through the delete hook, then tombstones or removes the
+// comment via CommentHooks.Remove instead of the processor's hard delete.
 func (r *CommentResource) Delete(c fiber.Ctx) error {
-	return r.processor.Delete(c)
+	id := c.Params("id")
+
+	if err := r.hooks.Delete(c, id); err != nil {
+		return err
+	}
+
+	if err := r.hooks.Remove(c, id); err != nil {
+		if _, ok := err.(*fiber.Error); ok {
+			return err
+		}
+		return fiber.NewError(500, "failed to delete comment")
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// exportContentTypes maps each export format to the type it is served as.
+var exportContentTypes = map[string]string{
+	ExportNDJSON: "application/x-ndjson",
+	ExportCSV:    "text/csv; charset=utf-8",
+	ExportJSON:   "application/json",
+}
+
+// Export streams the comments of a type, some of its targets or a date range
+// as NDJSON, CSV or nested JSON thread snapshots. Only admins may export, and
+// the authors' IP addresses and user agents are only included with pii=true.
+func (r *CommentResource) Export(c fiber.Ctx) error {
+	if !r.hooks.isAdmin(c) {
+		return fiber.NewError(403, "Only admins can export comments")
+	}
+
+	opts := ExportOptions{
+		Format:      c.Query("format", ExportNDJSON),
+		Commentable: c.Query("commentable"),
+		IncludePII:  c.Query("pii") == "true",
+		KeyProvider: r.hooks.cipher.provider(),
+	}
+	if !slices.Contains(ValidExportFormats, opts.Format) {
+		return fiber.NewError(400, fmt.Sprintf("invalid format (allowed: %v)", ValidExportFormats))
+	}
+	if opts.Commentable != "" && !r.config.IsAllowedType(opts.Commentable) {
+		return fiber.NewError(400, "commentable type is not allowed")
+	}
+
+	args := c.Request().URI().QueryArgs()
+	for _, key := range []string{"commentableId", "commentableId[]"} {
+		for _, value := range args.PeekMulti(key) {
+			opts.CommentableIds = append(opts.CommentableIds, string(value))
+		}
+	}
+	opts.CommentableIds = uniqueIDs(opts.CommentableIds)
+	if len(opts.CommentableIds) > 0 && opts.Commentable == "" {
+		return fiber.NewError(400, "commentable is required with commentableId")
+	}
+	if len(opts.CommentableIds) > MaxFilterValuesPerField {
+		return fiber.NewError(400, fmt.Sprintf("at most %d commentableId values are allowed", MaxFilterValuesPerField))
+	}
+
+	for key, dest := range map[string]**time.Time{"from": &opts.From, "to": &opts.To} {
+		value := c.Query(key)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fiber.NewError(400, fmt.Sprintf("%s must be an RFC 3339 date", key))
+		}
+		*dest = &t
+	}
+
+	// The body is written once the handler returned: the response is already
+	// under way when an error occurs, so it can only be logged.
+	ctx := context.WithoutCancel(auth.Context(c))
+	c.Set(fiber.HeaderContentType, exportContentTypes[opts.Format])
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="comments.%s"`, opts.Format))
+	return c.SendStreamWriter(func(w *bufio.Writer) {
+		if _, err := ExportComments(ctx, r.db, w, opts); err != nil {
+			logger.Log.Error("comment export failed", "error", err)
+		}
+	})
+}
+
+// canManageUserData reports whether the caller may export or erase the
+// comment data of userID: admins, and the user themselves.
+func (r *CommentResource) canManageUserData(c fiber.Ctx, userID string) bool {
+	if r.hooks.isAdmin(c) {
+		return true
+	}
+	user := auth.GetAuthenticatedUser(c)
+	return user != nil && user.UserID == userID
+}
+
+// ExportUserData downloads everything stored about the comments of a user as
+// a JSON archive. Admins and the user themselves only.
+func (r *CommentResource) ExportUserData(c fiber.Ctx) error {
+	userID := c.Params("userId")
+	if !r.canManageUserData(c, userID) {
+		return fiber.NewError(403, "You cannot export the data of this user")
+	}
+
+	archive, err := ExportUserData(auth.Context(c), r.db, userID, r.hooks.cipher.provider())
+	if err != nil {
+		return fiber.NewError(500, "failed to export user data")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="comments-%s.json"`, userID))
+	return c.JSON(archive)
+}
+
+// EraseUserData anonymizes or deletes the comments of a user. Admins and the
+// user themselves only.
+func (r *CommentResource) EraseUserData(c fiber.Ctx) error {
+	userID := c.Params("userId")
+	if !r.canManageUserData(c, userID) {
+		return fiber.NewError(403, "You cannot erase the data of this user")
+	}
+
+	var dto UserErasureDTO
+	if err := c.Bind().Body(&dto); err != nil {
+		return fiber.NewError(400, "invalid request body")
+	}
+	if dto.Mode == "" {
+		dto.Mode = ErasureAnonymize
+	}
+	if !slices.Contains(ValidErasureModes, dto.Mode) {
+		return fiber.NewError(400, fmt.Sprintf("invalid mode (allowed: %v)", ValidErasureModes))
+	}
+	if dto.Content != nil {
+		if dto.Mode != ErasureAnonymize {
+			return fiber.NewError(400, "content can only replace anonymized comments")
+		}
+		content, err := r.hooks.validateContent(*dto.Content)
+		if err != nil {
+			return err
+		}
+		dto.Content = &content
+	}
+
+	result, err := EraseUserData(auth.Context(c), r.db, userID, ErasureOptions{Mode: dto.Mode, Content: dto.Content})
+	if err != nil {
+		return fiber.NewError(500, "failed to erase user data")
+	}
+	return c.JSON(result)
 }
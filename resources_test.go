@@ -2,8 +2,11 @@ package commentable
 
 import (
 	"context"
+	"io"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gofiber/fiber/v3"
 	"github.com/nicolasbonnici/gorest/crud"
@@ -526,3 +529,204 @@ func TestCommentHooks_GetAll_ModeratorSeesAwaitingAndPublished(t *testing.T) {
 		})
 	}
 }
+
+func TestCommentHooks_CreateReplyValidation(t *testing.T) {
+	strPtr := func(s string) *string { return &s }
+
+	// root <- child <- grandchild on post-1, a root on another post and a
+	// root awaiting moderation.
+	db := setupThreadDB(t)
+	root := insertComment(t, db, nil, StatusPublished)
+	child := insertComment(t, db, &root, StatusPublished)
+	grandchild := insertComment(t, db, &child, StatusPublished)
+	other := insertComment(t, db, nil, StatusPublished)
+	if _, err := db.Exec(context.Background(), `UPDATE comment SET commentable_id = 'post-456' WHERE id = ?`, other); err != nil {
+		t.Fatal(err)
+	}
+	held := insertComment(t, db, nil, StatusAwaiting)
+
+	tests := []struct {
+		name           string
+		enableNesting  bool
+		maxDepth       int
+		parentId       *string
+		roles          []string
+		expectedStatus int
+	}{
+		{"root comment", false, 3, nil, nil, 201},
+		{"reply when nesting disabled", false, 3, strPtr(root), nil, 400},
+		{"reply to root", true, 3, strPtr(root), nil, 201},
+		{"reply at max depth", true, 3, strPtr(child), nil, 201},
+		{"reply beyond max depth", true, 3, strPtr(grandchild), nil, 400},
+		{"reply to missing parent", true, 3, strPtr("missing"), nil, 400},
+		{"reply to parent on another target", true, 3, strPtr(other), nil, 400},
+		{"reply to hidden parent", true, 3, strPtr(held), []string{"reader"}, 400},
+		{"reply to parent visible to moderators", true, 3, strPtr(held), []string{"moderator"}, 201},
+	}
+
+	bodies := map[string]string{}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{
+				AllowedTypes:     []string{"post"},
+				MaxContentLength: 10000,
+				AllowAnonymous:   true,
+				EnableNesting:    tt.enableNesting,
+				MaxNestingDepth:  tt.maxDepth,
+			}
+			hooks := NewCommentHooks(db, config, newTestVoter(t))
+
+			app := fiber.New()
+			app.Post("/", func(c fiber.Ctx) error {
+				c.SetContext(rbac.WithRoles(context.Background(), tt.roles))
+
+				dto := CommentCreateDTO{
+					Commentable:   "post",
+					CommentableId: "post-1",
+					ParentId:      tt.parentId,
+					Content:       "Reply",
+				}
+				if err := hooks.Create(c, dto, &Comment{}); err != nil {
+					return err
+				}
+				return c.SendStatus(201)
+			})
+
+			resp, err := app.Test(httptest.NewRequest("POST", "/", nil))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.StatusCode != tt.expectedStatus {
+				t.Errorf("expected status %d, got %d", tt.expectedStatus, resp.StatusCode)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			bodies[tt.name] = string(body)
+		})
+	}
+
+	// A hidden parent cannot be told apart from a missing one.
+	if bodies["reply to hidden parent"] != bodies["reply to missing parent"] {
+		t.Errorf("expected the same error for a hidden and a missing parent, got %q and %q",
+			bodies["reply to hidden parent"], bodies["reply to missing parent"])
+	}
+}
+
+func TestCommentHooks_RemoveTombstonesCommentsWithReplies(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	c := crud.New[Comment](db)
+	// Read as admin: crud filters moderator-only fields such as deleted_by.
+	ctx := rbac.WithRoles(context.Background(), []string{"admin"})
+
+	root := insertComment(t, db, nil, StatusPublished)
+	reply := insertComment(t, db, &root, StatusPublished)
+	leaf := insertComment(t, db, nil, StatusPublished)
+
+	remove := func(id string) {
+		t.Helper()
+		app := fiber.New()
+		app.Delete("/:id", func(fc fiber.Ctx) error {
+			fc.Locals("user_id", "moderator-user")
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{"moderator"}))
+			if err := hooks.Remove(fc, fc.Params("id")); err != nil {
+				return err
+			}
+			return fc.SendStatus(204)
+		})
+		resp, err := app.Test(httptest.NewRequest("DELETE", "/"+id, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 204 {
+			t.Fatalf("expected 204 removing %s, got %d", id, resp.StatusCode)
+		}
+	}
+
+	remove(leaf)
+	if _, err := c.GetByID(ctx, leaf); err == nil {
+		t.Error("expected a comment without replies to be hard-deleted")
+	}
+
+	remove(root)
+	tombstone, err := c.GetByID(ctx, root)
+	if err != nil {
+		t.Fatalf("expected a comment with replies to be kept as a tombstone: %v", err)
+	}
+	if tombstone.DeletedAt == nil || tombstone.Content != "" {
+		t.Errorf("expected tombstone with cleared content, got %+v", tombstone)
+	}
+	if tombstone.DeletedBy == nil || *tombstone.DeletedBy != "moderator-user" {
+		t.Errorf("expected deleted_by to record the moderator, got %v", tombstone.DeletedBy)
+	}
+
+	page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, threadPageOptions{})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	if len(page.Items) != 1 {
+		t.Fatalf("expected the tombstone to remain in the thread, got %d roots", len(page.Items))
+	}
+	node := page.Items[0]
+	if !node.Deleted || node.Content != DeletedContentPlaceholder || node.UserID != nil || node.IPAddress != nil {
+		t.Errorf("expected a stripped [deleted] placeholder, got %+v", node.CommentResponseDTO)
+	}
+	if len(node.Children) != 1 || node.Children[0].ID != reply {
+		t.Errorf("expected the reply to stay visible under the tombstone")
+	}
+
+	remove(reply)
+	if _, err := c.GetByID(ctx, root); err == nil {
+		t.Error("expected the tombstone to be pruned once its last reply is deleted")
+	}
+}
+
+func TestCommentConverter_TombstoneStripsAuthorAndContent(t *testing.T) {
+	userID := "user-123"
+	ip := "127.0.0.1"
+	now := time.Now()
+
+	dto := (&CommentConverter{}).ModelToResponseDTO(Comment{
+		Id:        "comment-123",
+		UserId:    &userID,
+		Content:   "secret",
+		IpAddress: &ip,
+		DeletedAt: &now,
+	})
+
+	if dto.Content != DeletedContentPlaceholder || dto.UserID != nil || dto.IPAddress != nil || !dto.Deleted {
+		t.Errorf("expected tombstone placeholder without author data, got %+v", dto)
+	}
+}
+
+func TestCommentCreate_FailedFollowUpWriteLeavesNoComment(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	app := newModerationApp(t, db, &cfg, "reader")
+	ctx := context.Background()
+
+	if _, err := db.Exec(ctx, `CREATE TRIGGER reject_stats BEFORE INSERT ON comment_target_stats
+		BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/comments", strings.NewReader(`{"commentable":"post","commentableId":"post-1","content":"hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 500 {
+		t.Fatalf("expected the create to fail, got %d", resp.StatusCode)
+	}
+
+	var count int
+	if err := db.QueryRow(ctx, `SELECT COUNT(*) FROM comment`).Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected the failed create to leave no comment, got %d", count)
+	}
+}
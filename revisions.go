@@ -0,0 +1,60 @@
+package commentable
+
+import (
+	"context"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// fetchRevisions loads the stored revisions of a comment, oldest first.
+func fetchRevisions(ctx context.Context, c *crud.CRUD[CommentRevision], commentID string) ([]CommentRevision, error) {
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Conditions: []query.Condition{query.Eq("comment_id", commentID)},
+		OrderBy:    []crud.OrderByClause{{Column: "version", Direction: query.ASC}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return res.Items, nil
+}
+
+// buildVersions lays out the full edit history of comment: each stored
+// revision followed by the live content as the last, current version. A
+// revision records who replaced its content and when, so version 1 is
+// attributed to the comment's author at creation time and every later version
+// to the editor of the revision before it. Each version but the first carries
+// its diff against the previous one.
+func buildVersions(comment *Comment, revisions []CommentRevision) []CommentVersionDTO {
+	versions := make([]CommentVersionDTO, 0, len(revisions)+1)
+
+	authorID := comment.UserId
+	createdAt := comment.CreatedAt
+	for _, revision := range revisions {
+		versions = append(versions, CommentVersionDTO{
+			Version:   revision.Version,
+			Content:   revision.Content,
+			AuthorID:  authorID,
+			CreatedAt: createdAt,
+		})
+		authorID = revision.EditedBy
+		createdAt = revision.CreatedAt
+	}
+
+	current := 1
+	if len(revisions) > 0 {
+		current = revisions[len(revisions)-1].Version + 1
+	}
+	versions = append(versions, CommentVersionDTO{
+		Version:   current,
+		Content:   comment.Content,
+		AuthorID:  authorID,
+		CreatedAt: createdAt,
+		Current:   true,
+	})
+
+	for i := 1; i < len(versions); i++ {
+		versions[i].Diff = diffLines(versions[i-1].Content, versions[i].Content)
+	}
+	return versions
+}
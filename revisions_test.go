@@ -0,0 +1,201 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("a\nb\nc\nd", "a\nx\nc\nd\ne")
+	want := []DiffLine{
+		{Op: DiffEqual, Line: "a"},
+		{Op: DiffDelete, Line: "b"},
+		{Op: DiffInsert, Line: "x"},
+		{Op: DiffEqual, Line: "c"},
+		{Op: DiffEqual, Line: "d"},
+		{Op: DiffInsert, Line: "e"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected diff:\n got %+v\nwant %+v", got, want)
+	}
+
+	// Past the table budget the changed block is replaced wholesale.
+	before := strings.Repeat("a\n", 3000) + "end"
+	after := strings.Repeat("b\n", 3000) + "end"
+	got = diffLines(before, after)
+	if len(got) != 6001 || got[0].Op != DiffDelete || got[3000].Op != DiffInsert || got[6000].Op != DiffEqual {
+		t.Errorf("expected delete-all/insert-all fallback, got %d lines", len(got))
+	}
+}
+
+func TestCommentHooks_UpdateRecordsRevisions(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	c := crud.New[Comment](db)
+	ctx := context.Background()
+
+	id := insertComment(t, db, nil, StatusPublished)
+	sql, args, err := query.New(db.Dialect()).Update("comment").
+		Set("user_id", "author-1").
+		Set("content", "first line\nsecond line").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(ctx, sql, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	edit := func(content string) {
+		t.Helper()
+		app := fiber.New()
+		app.Put("/:id", func(fc fiber.Ctx) error {
+			fc.Locals("user_id", "moderator-1")
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{"moderator"}))
+			var model Comment
+			loaded, err := hooks.Update(fc, CommentUpdateDTO{Content: &content}, &model)
+			if err != nil {
+				return err
+			}
+			editor := "moderator-1"
+			if err := hooks.SaveUpdate(ctx, CommentUpdateDTO{Content: &content}, loaded, &model, &editor); err != nil {
+				return err
+			}
+			return fc.SendStatus(200)
+		})
+		resp, err := app.Test(httptest.NewRequest("PUT", "/"+id, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200 editing comment, got %d", resp.StatusCode)
+		}
+	}
+
+	edit("first line\nsecond line edited")
+	edit("first line\nsecond line edited") // unchanged content is not a revision
+	edit("rewritten")
+
+	comment, err := c.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.EditCount != 2 || comment.EditedAt == nil {
+		t.Errorf("expected editCount 2 with editedAt set, got %d / %v", comment.EditCount, comment.EditedAt)
+	}
+
+	get := func(userID string, roles ...string) (int, []CommentVersionDTO) {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), roles))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+		resp, err := app.Test(httptest.NewRequest("GET", "/comments/"+id+"/revisions", nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data []CommentVersionDTO `json:"data"`
+		}
+		if resp.StatusCode == 200 {
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, body.Data
+	}
+
+	if status, _ := get("someone-else", "reader"); status != 404 {
+		t.Errorf("expected 404 for a non-author, got %d", status)
+	}
+
+	status, versions := get("author-1", "reader")
+	if status != 200 {
+		t.Fatalf("expected the author to read revisions, got %d", status)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 versions, got %d", len(versions))
+	}
+	if versions[0].Content != "first line\nsecond line" || versions[0].Diff != nil {
+		t.Errorf("expected the original content without diff first, got %+v", versions[0])
+	}
+	if versions[0].AuthorID == nil || *versions[0].AuthorID != "author-1" {
+		t.Errorf("expected version 1 attributed to the author, got %v", versions[0].AuthorID)
+	}
+	if versions[1].AuthorID == nil || *versions[1].AuthorID != "moderator-1" {
+		t.Errorf("expected version 2 attributed to its editor, got %v", versions[1].AuthorID)
+	}
+	wantDiff := []DiffLine{
+		{Op: DiffEqual, Line: "first line"},
+		{Op: DiffDelete, Line: "second line"},
+		{Op: DiffInsert, Line: "second line edited"},
+	}
+	if !reflect.DeepEqual(versions[1].Diff, wantDiff) {
+		t.Errorf("unexpected diff for version 2: %+v", versions[1].Diff)
+	}
+	last := versions[2]
+	if !last.Current || last.Version != 3 || last.Content != "rewritten" {
+		t.Errorf("expected the live content as current version 3, got %+v", last)
+	}
+
+	if status, versions := get("moderator-1", "moderator"); status != 200 || len(versions) != 3 {
+		t.Errorf("expected moderators to read revisions, got %d with %d versions", status, len(versions))
+	}
+}
+
+func TestCommentHooks_FailedUpdateLeavesNoRevision(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	ctx := context.Background()
+
+	id := insertComment(t, db, nil, StatusPublished)
+	if _, err := db.Exec(ctx, `CREATE TRIGGER reject_edit BEFORE UPDATE OF content ON comment
+		WHEN NEW.content = 'rejected' BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	app := fiber.New()
+	app.Put("/:id", func(fc fiber.Ctx) error {
+		fc.SetContext(rbac.WithRoles(context.Background(), []string{"moderator"}))
+		content := "rejected"
+		var model Comment
+		loaded, err := hooks.Update(fc, CommentUpdateDTO{Content: &content}, &model)
+		if err != nil {
+			return err
+		}
+		if err := hooks.SaveUpdate(ctx, CommentUpdateDTO{Content: &content}, loaded, &model, nil); err != nil {
+			return fiber.NewError(500, err.Error())
+		}
+		return fc.SendStatus(200)
+	})
+	resp, err := app.Test(httptest.NewRequest("PUT", "/"+id, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 500 {
+		t.Fatalf("expected the update to fail, got %d", resp.StatusCode)
+	}
+
+	revisions, err := fetchRevisions(ctx, crud.New[CommentRevision](db), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 0 {
+		t.Errorf("expected no revision left by the failed update, got %d", len(revisions))
+	}
+}
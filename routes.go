@@ -5,6 +5,6 @@ import (
 	"github.com/nicolasbonnici/gorest/database"
 )
 
-func RegisterRoutes(router fiber.Router, db database.Database, config *Config) {
-	RegisterCommentRoutes(router, db, config)
+func RegisterRoutes(router fiber.Router, db database.Database, config *Config) *CommentHooks {
+	return RegisterCommentRoutes(router, db, config)
 }
@@ -0,0 +1,248 @@
+package commentable
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+const (
+	// MaxSearchQueryLength bounds the q parameter of searches, in bytes.
+	MaxSearchQueryLength = 200
+	// maxSearchTerms is the number of words of a query that are searched.
+	maxSearchTerms = 10
+	// searchSnippetWords is the length of the snippets of search results.
+	searchSnippetWords = 24
+)
+
+// The databases put these around the matched terms of snippets, which are
+// only turned into <mark> elements once the content is escaped.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// CommentSearchResult is a comment matching a search, with its relevance
+// (higher is better, comparable within a search only) and a snippet of its
+// content in HTML, the matched terms in <mark> elements.
+type CommentSearchResult struct {
+	Comment Comment
+	Rank    float64
+	Snippet string
+}
+
+type searchPage struct {
+	Items   []CommentSearchResult
+	HasMore bool
+}
+
+// searchTerms returns the words of q that are searched, lowercased.
+func searchTerms(q string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(q), isNotWordRune) {
+		if !slices.Contains(terms, word) {
+			terms = append(terms, word)
+		}
+		if len(terms) == maxSearchTerms {
+			break
+		}
+	}
+	return terms
+}
+
+func isNotWordRune(r rune) bool {
+	return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+}
+
+// fetchSearch loads the comments containing every one of terms and matching
+// conds, most relevant first, through the full-text index of the dialect.
+// Tombstones have no content to match, and drafts encrypted at rest are left
+// out.
+func fetchSearch(
+	ctx context.Context,
+	db database.Database,
+	c *crud.CRUD[Comment],
+	terms []string,
+	conds []query.Condition,
+	limit, offset int,
+) (*searchPage, error) {
+	conds = append([]query.Condition{
+		query.IsNull("comment.deleted_at"),
+		query.NotLike("comment.content", encryptedPrefix+"%"),
+	}, conds...)
+
+	stmt, args, err := searchQuery(db, terms, conds).
+		OrderBy("search_rank", query.DESC).
+		OrderBy("comment.created_at", query.DESC).
+		OrderBy("comment.id", query.DESC).
+		Limit(limit + 1).
+		Offset(offset).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	type hit struct {
+		rank    float64
+		snippet string
+	}
+	var ids []any
+	hits := map[string]hit{}
+	for rows.Next() {
+		var id string
+		var h hit
+		if err := rows.Scan(&id, &h.rank, &h.snippet); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+		hits[id] = h
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	page := &searchPage{Items: []CommentSearchResult{}}
+	if len(ids) > limit {
+		page.HasMore = true
+		ids = ids[:limit]
+	}
+	if len(ids) == 0 {
+		return page, nil
+	}
+
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      len(ids),
+		Conditions: []query.Condition{query.In("id", ids...)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Comment, len(res.Items))
+	for _, comment := range res.Items {
+		byID[comment.Id] = comment
+	}
+	isMySQL := db.DriverName() == "mysql"
+	for _, id := range ids {
+		comment, ok := byID[id.(string)]
+		if !ok {
+			continue
+		}
+		h := hits[comment.Id]
+		if isMySQL {
+			h.snippet = markTerms(h.snippet, terms)
+		}
+		page.Items = append(page.Items, CommentSearchResult{
+			Comment: comment,
+			Rank:    h.rank,
+			Snippet: highlight(h.snippet),
+		})
+	}
+	return page, nil
+}
+
+// searchQuery selects the id, rank and snippet of the comments matching terms
+// and conds: Postgres matches the generated search_vector column, MySQL the
+// FULLTEXT index on content, and SQLite the comment_search FTS5 table. MySQL
+// has no snippet function, so its snippet is the content, marked by
+// markTerms.
+func searchQuery(db database.Database, terms []string, conds []query.Condition) *query.SelectBuilder {
+	b := query.New(db.Dialect())
+	switch db.DriverName() {
+	case "postgres":
+		text := strings.Join(terms, " ")
+		tsquery := "plainto_tsquery('simple', ?)"
+		options := fmt.Sprintf("StartSel=%s, StopSel=%s, MaxWords=%d, MinWords=%d", highlightStart, highlightStop, searchSnippetWords, searchSnippetWords/2)
+		return b.Select("comment.id").
+			SelectExpr(
+				query.RawExpr("ts_rank(search_vector, "+tsquery+") AS search_rank", text),
+				query.RawExpr("ts_headline('simple', content, "+tsquery+", ?) AS search_snippet", text, options),
+			).
+			From("comment").
+			Where(query.And(append(conds, query.Raw("search_vector @@ "+tsquery, text))...))
+	case "mysql":
+		// Every term is required, as with the other dialects.
+		match := "MATCH (content) AGAINST (? IN BOOLEAN MODE)"
+		required := "+" + strings.Join(terms, " +")
+		return b.Select("comment.id").
+			SelectExpr(
+				query.RawExpr(match+" AS search_rank", required),
+				query.RawExpr("content AS search_snippet"),
+			).
+			From("comment").
+			Where(query.And(append(conds, query.Raw(match, required))...))
+	}
+
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = `"` + term + `"`
+	}
+	return b.Select("comment.id").
+		SelectExpr(
+			// bm25 is lower for better matches.
+			query.RawExpr("-bm25(comment_search) AS search_rank"),
+			query.RawExpr("snippet(comment_search, 1, ?, ?, '…', ?) AS search_snippet", highlightStart, highlightStop, searchSnippetWords),
+		).
+		From("comment").
+		Join("comment_search", query.ColEq("comment_search.comment_id", "comment.id")).
+		Where(query.And(append(conds, query.Raw("comment_search MATCH ?", strings.Join(quoted, " ")))...))
+}
+
+// markTerms returns the snippet of content around its first matched term,
+// with the highlight markers around the words matching terms.
+func markTerms(content string, terms []string) string {
+	words := strings.Fields(content)
+	matches := make([]bool, len(words))
+	first := -1
+	for i, word := range words {
+		for _, part := range strings.FieldsFunc(strings.ToLower(word), isNotWordRune) {
+			matches[i] = matches[i] || slices.Contains(terms, part)
+		}
+		if matches[i] && first < 0 {
+			first = i
+		}
+	}
+
+	start := max(0, first-searchSnippetWords/3)
+	end := min(len(words), start+searchSnippetWords)
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString("… ")
+	}
+	for i := start; i < end; i++ {
+		if i > start {
+			sb.WriteByte(' ')
+		}
+		if matches[i] {
+			sb.WriteString(highlightStart + words[i] + highlightStop)
+		} else {
+			sb.WriteString(words[i])
+		}
+	}
+	if end < len(words) {
+		sb.WriteString(" …")
+	}
+	return sb.String()
+}
+
+// highlight escapes a snippet for HTML and turns its highlight markers into
+// <mark> elements.
+func highlight(snippet string) string {
+	return strings.NewReplacer(
+		highlightStart, "<mark>",
+		highlightStop, "</mark>",
+	).Replace(html.EscapeString(snippet))
+}
@@ -0,0 +1,116 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nicolasbonnici/gorest/database"
+)
+
+func setContent(t *testing.T, db database.Database, id, content string) {
+	t.Helper()
+	if _, err := db.Exec(context.Background(), `UPDATE comment SET content = ? WHERE id = ?`, content, id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSearchComments(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	best := insertComment(t, db, nil, StatusPublished)
+	setContent(t, db, best, "Gophers love concurrency. Concurrency is what gophers do best <script>")
+	other := insertComment(t, db, nil, StatusPublished)
+	setContent(t, db, other, "A long discussion about many things, gophers included, and concurrency too")
+	held := insertComment(t, db, nil, StatusAwaiting)
+	setContent(t, db, held, "gophers and concurrency, awaiting moderation")
+	unrelated := insertComment(t, db, nil, StatusPublished)
+	setContent(t, db, unrelated, "gophers only")
+	deleted := insertComment(t, db, nil, StatusPublished)
+	setContent(t, db, deleted, "gophers concurrency")
+	if _, err := db.Exec(context.Background(), `DELETE FROM comment WHERE id = ?`, deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	search := func(params url.Values, roles ...string) *httpResult {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/comments/search?"+params.Encode(), nil)
+		resp, err := newModerationApp(t, db, &cfg, roles...).Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+	ids := func(res *httpResult) []string {
+		var ids []string
+		for _, item := range res.body["data"].([]any) {
+			ids = append(ids, item.(map[string]any)["id"].(string))
+		}
+		return ids
+	}
+
+	res := search(url.Values{"q": {"Concurrency, GOPHERS!"}}, "reader")
+	if res.status != 200 {
+		t.Fatalf("expected 200, got %d %v", res.status, res.body)
+	}
+	if got := ids(res); len(got) != 2 || got[0] != best || got[1] != other {
+		t.Fatalf("expected the published matches, most relevant first, got %v", got)
+	}
+	first := res.body["data"].([]any)[0].(map[string]any)
+	snippet, _ := first["snippet"].(string)
+	if !strings.Contains(snippet, "<mark>Gophers</mark>") || !strings.Contains(snippet, "&lt;script&gt;") {
+		t.Errorf("expected an escaped snippet highlighting the terms, got %q", snippet)
+	}
+	if rank, _ := first["rank"].(float64); rank <= 0 {
+		t.Errorf("expected a positive rank, got %v", first["rank"])
+	}
+
+	if got := ids(search(url.Values{"q": {"gophers concurrency"}}, "moderator")); len(got) != 3 {
+		t.Errorf("expected moderators to find the awaiting comment too, got %v", got)
+	}
+
+	// Contents are indexed as they change.
+	setContent(t, db, unrelated, "gophers love concurrency")
+	if got := ids(search(url.Values{"q": {"gophers concurrency"}, "limit": {"1"}, "page": {"2"}}, "reader")); len(got) != 1 {
+		t.Errorf("expected the second page, got %v", got)
+	}
+	if got := ids(search(url.Values{"q": {"gophers concurrency"}}, "reader")); len(got) != 3 {
+		t.Errorf("expected the updated comment to match, got %v", got)
+	}
+
+	if res := search(url.Values{"q": {"gophers"}, "commentable": {"post"}, "commentableId": {"post-2"}}, "reader"); res.status != 200 || len(ids(res)) != 0 {
+		t.Errorf("expected no match on another target, got %d %v", res.status, res.body)
+	}
+
+	for _, params := range []url.Values{
+		{},
+		{"q": {"?!"}},
+		{"q": {strings.Repeat("a", MaxSearchQueryLength+1)}},
+		{"q": {"gophers"}, "commentable": {"video"}},
+		{"q": {"gophers"}, "commentableId": {"post-1"}},
+	} {
+		if res := search(params, "reader"); res.status != 400 {
+			t.Errorf("expected 400 for %v, got %d", params, res.status)
+		}
+	}
+}
+
+func TestMarkTerms(t *testing.T) {
+	content := strings.Repeat("word ", 20) + "the Gopher, <b>gopher</b> " + strings.Repeat("word ", 30)
+	snippet := highlight(markTerms(content, []string{"gopher"}))
+	if !strings.HasPrefix(snippet, "… ") || !strings.HasSuffix(snippet, " …") {
+		t.Errorf("expected a snippet cut on both sides, got %q", snippet)
+	}
+	if !strings.Contains(snippet, "<mark>Gopher,</mark> <mark>&lt;b&gt;gopher&lt;/b&gt;</mark>") {
+		t.Errorf("expected escaped highlighted matches, got %q", snippet)
+	}
+	if n := len(strings.Fields(snippet)); n != searchSnippetWords+2 {
+		t.Errorf("expected %d words, got %d", searchSnippetWords, n-2)
+	}
+}
@@ -0,0 +1,71 @@
+package commentable
+
+import (
+	"context"
+
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/hooks"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+// commentReadHooks filters every comment read through the resource's CRUD
+// layer with the plugin's voter, so that whatever endpoint builds a response
+// from it only carries the fields the caller's roles may read: the rbac tags
+// of Comment keep the authors' IP address and user agent, and the moderation
+// fields, for moderators. Comments encrypted at rest are decrypted first, so
+// that whoever may read a field reads it in clear.
+type commentReadHooks struct {
+	*hooks.NoOpHooks[Comment]
+	voter  rbac.Voter
+	cipher *commentCipher
+}
+
+func newCommentReadHooks(voter rbac.Voter, cipher *commentCipher) *commentReadHooks {
+	return &commentReadHooks{NoOpHooks: hooks.NewNoOpHooks[Comment](), voter: voter, cipher: cipher}
+}
+
+func (h *commentReadHooks) FilterRead(ctx context.Context, model *Comment) error {
+	if err := h.cipher.open(ctx, model); err != nil {
+		return err
+	}
+	return filterComment(ctx, h.voter, model)
+}
+
+// commentStoreHooks reads comments as they are stored, decrypted, for the
+// plugin's own use. The default hooks of crud.New filter fields by the roles
+// in ctx, without the voter's role hierarchy; these filter nothing, so what
+// they read goes through filterComment before reaching a caller.
+type commentStoreHooks struct {
+	*hooks.NoOpHooks[Comment]
+	cipher *commentCipher
+}
+
+// storedComments returns a CRUD layer reading comments through
+// commentStoreHooks.
+func storedComments(db database.Database, cipher *commentCipher) *crud.CRUD[Comment] {
+	return crud.NewWithHooks[Comment](db, &commentStoreHooks{NoOpHooks: hooks.NewNoOpHooks[Comment](), cipher: cipher})
+}
+
+func (h *commentStoreHooks) FilterRead(ctx context.Context, model *Comment) error {
+	return h.cipher.open(ctx, model)
+}
+
+// filterComment clears the fields of model the roles in ctx may not read.
+func filterComment(ctx context.Context, voter rbac.Voter, model *Comment) error {
+	filtered, err := voter.FilterRead(ctx, model)
+	if err != nil {
+		return err
+	}
+	*model = *filtered.(*Comment)
+	return nil
+}
+
+// responseDTO converts a comment that was not read through the resource's
+// CRUD layer, e.g. one just written, for the caller.
+func (h *CommentHooks) responseDTO(ctx context.Context, model Comment) (CommentResponseDTO, error) {
+	if err := filterComment(ctx, h.voter, &model); err != nil {
+		return CommentResponseDTO{}, err
+	}
+	return (&CommentConverter{}).ModelToResponseDTO(model), nil
+}
@@ -0,0 +1,130 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+// piiFields are the response fields only moderators may read.
+var piiFields = []string{`"ipAddress"`, `"userAgent"`, `"publishedAt"`, `"moderatedBy"`, `"deletedBy"`}
+
+func TestResponsesHidePIIFromNonModerators(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+
+	root := insertComment(t, db, nil, StatusPublished)
+	insertComment(t, db, &root, StatusPublished)
+	stmt, args, _ := query.New(db.Dialect()).Update("comment").
+		Set("ip_address", "203.0.113.7").
+		Set("user_agent", "Mozilla/5.0").
+		Set("published_at", time.Now()).
+		Set("moderated_by", "moderator-1").
+		Where(query.Eq("commentable_id", "post-1")).
+		Build()
+	if _, err := db.Exec(ctx, stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	request := func(userID, role, method, path string, body any) (int, string) {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			if userID != "" {
+				fc.Locals("user_id", userID)
+			}
+			var roles []string
+			if role != "" {
+				roles = []string{role}
+			}
+			fc.SetContext(rbac.WithRoles(context.Background(), roles))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "Mozilla/5.0")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+
+	reads := []string{
+		"/comments?commentable=post&commentableId=post-1",
+		"/comments/" + root,
+		"/comments/thread?commentable=post&commentableId=post-1",
+		"/comments/" + root + "/replies",
+	}
+	for _, role := range []string{"", "reader"} {
+		for _, path := range reads {
+			status, body := request("", role, "GET", path, nil)
+			if status != 200 {
+				t.Fatalf("expected 200 for %s as %q, got %d %s", path, role, status, body)
+			}
+			for _, field := range piiFields {
+				if strings.Contains(body, field) {
+					t.Errorf("expected no %s for %s as %q, got %s", field, path, role, body)
+				}
+			}
+		}
+	}
+	for _, role := range []string{"moderator", "admin"} {
+		for _, path := range reads {
+			if _, body := request("", role, "GET", path, nil); !strings.Contains(body, `"ipAddress":"203.0.113.7"`) {
+				t.Errorf("expected the IP address for %s as %s, got %s", path, role, body)
+			}
+		}
+	}
+
+	// Written comments are shaped like read ones.
+	status, body := request("u-alice", "reader", "POST", "/comments", CommentCreateDTO{
+		Commentable:   "post",
+		CommentableId: "post-1",
+		Content:       "hello",
+	})
+	if status != 201 {
+		t.Fatalf("expected 201, got %d %s", status, body)
+	}
+	for _, field := range piiFields {
+		if strings.Contains(body, field) {
+			t.Errorf("expected no %s in the created comment, got %s", field, body)
+		}
+	}
+	var created CommentResponseDTO
+	_ = json.Unmarshal([]byte(body), &created)
+
+	content := "hello again"
+	status, body = request("u-alice", "reader", "PUT", "/comments/"+created.ID, CommentUpdateDTO{Content: &content})
+	if status != 200 {
+		t.Fatalf("expected 200, got %d %s", status, body)
+	}
+	for _, field := range piiFields {
+		if strings.Contains(body, field) {
+			t.Errorf("expected no %s in the updated comment, got %s", field, body)
+		}
+	}
+
+	moderated := StatusModerated
+	if _, body := request("moderator-1", "moderator", "PUT", "/comments/"+created.ID, CommentUpdateDTO{Status: &moderated}); !strings.Contains(body, `"moderatedBy":"moderator-1"`) {
+		t.Errorf("expected moderators to see who moderated the comment, got %s", body)
+	}
+}
@@ -0,0 +1,374 @@
+package commentable
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// CommentTarget identifies the resource a comment is attached to.
+type CommentTarget struct {
+	Commentable   string
+	CommentableId string
+}
+
+// CommentTargetStats summarizes the discussion on one target so that list
+// views and "recently active" pages do not have to aggregate the comment
+// table. Tombstones are not counted; the last comment and participants only
+// consider published comments.
+type CommentTargetStats struct {
+	Commentable      string     `json:"commentable" db:"commentable"`
+	CommentableId    string     `json:"commentableId" db:"commentable_id"`
+	PublishedCount   int        `json:"publishedCount" db:"published_count"`
+	TotalCount       int        `json:"totalCount" db:"total_count"`
+	ParticipantCount int        `json:"participantCount" db:"participant_count"`
+	LastCommentAt    *time.Time `json:"lastCommentAt,omitempty" db:"last_comment_at"`
+	LastCommenterId  *string    `json:"lastCommenterId,omitempty" db:"last_commenter_id"`
+	UpdatedAt        *time.Time `json:"updatedAt,omitempty" db:"updated_at"`
+}
+
+func (CommentTargetStats) TableName() string {
+	return "comment_target_stats"
+}
+
+// statsEntry is what the stats of a target retain of one of its comments.
+type statsEntry struct {
+	id        string
+	userID    *string
+	live      bool
+	published bool
+}
+
+// statsEntryOf returns the stats entry of comment, or the empty entry of a
+// comment that does not exist (yet or anymore) when comment is nil.
+func statsEntryOf(comment *Comment) statsEntry {
+	if comment == nil {
+		return statsEntry{}
+	}
+	live := comment.DeletedAt == nil
+	return statsEntry{
+		id:        comment.Id,
+		userID:    comment.UserId,
+		live:      live,
+		published: live && comment.Status == StatusPublished,
+	}
+}
+
+// loadStatsEntry loads the target and stats entry of a comment, reporting
+// false when there is no such comment.
+func loadStatsEntry(ctx context.Context, db database.Database, q sqlExecutor, id string) (CommentTarget, statsEntry, bool, error) {
+	stmt, args, err := query.New(db.Dialect()).
+		Select("commentable", "commentable_id", "user_id", "status", "deleted_at").
+		From("comment").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		return CommentTarget{}, statsEntry{}, false, err
+	}
+
+	var target CommentTarget
+	var userID sql.NullString
+	var status string
+	var deletedAt sql.NullTime
+	found, err := scanFirst(ctx, q, stmt, args, &target.Commentable, &target.CommentableId, &userID, &status, &deletedAt)
+	if err != nil || !found {
+		return target, statsEntry{}, found, err
+	}
+	comment := Comment{Id: id, Status: status}
+	if userID.Valid {
+		comment.UserId = &userID.String
+	}
+	if deletedAt.Valid {
+		comment.DeletedAt = &deletedAt.Time
+	}
+	return target, statsEntryOf(&comment), true, nil
+}
+
+// adjustTargetStats applies to the stats row of target the change of one of
+// its comments from before to after, on the executor of that change so the
+// row follows the comments it summarizes. The counters are incremented in
+// place by an upsert, which also locks the row: the participants and the last
+// comment, looked up afterwards when the published comments changed, see
+// every write committed before. The row is removed once the target has no
+// comment left.
+func adjustTargetStats(ctx context.Context, db database.Database, q sqlExecutor, target CommentTarget, before, after statsEntry) error {
+	total := countDelta(before.live, after.live)
+	published := countDelta(before.published, after.published)
+	if total == 0 && published == 0 {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	stmt := upsertStatement(db, "comment_target_stats",
+		[]string{"commentable", "commentable_id"},
+		[]string{"commentable", "commentable_id", "published_count", "total_count", "updated_at"},
+		[]string{"published_count", "total_count"},
+	)
+	if _, err := q.Exec(ctx, stmt, target.Commentable, target.CommentableId, published, total, now); err != nil {
+		return err
+	}
+
+	if published != 0 {
+		entry := after
+		if published < 0 {
+			entry = before
+		}
+		participants := 0
+		if entry.userID != nil {
+			// The author joins or leaves the participants with their only
+			// published comment.
+			others, err := hasOtherPublished(ctx, db, q, target, entry)
+			if err != nil {
+				return err
+			}
+			if !others {
+				participants = published
+			}
+		}
+		lastAt, lastBy, err := lastPublished(ctx, db, q, target)
+		if err != nil {
+			return err
+		}
+
+		// The update builder only binds values, so the increment is written
+		// by hand.
+		dialect := db.Dialect()
+		stmt := fmt.Sprintf(
+			"UPDATE comment_target_stats SET participant_count = participant_count + %s, last_comment_at = %s, last_commenter_id = %s WHERE commentable = %s AND commentable_id = %s",
+			dialect.Placeholder(1), dialect.Placeholder(2), dialect.Placeholder(3), dialect.Placeholder(4), dialect.Placeholder(5),
+		)
+		if _, err := q.Exec(ctx, stmt, participants, lastAt, lastBy, target.Commentable, target.CommentableId); err != nil {
+			return err
+		}
+	}
+
+	if total < 0 {
+		stmt, args, err := query.New(db.Dialect()).Delete("comment_target_stats").
+			Where(query.And(
+				query.Eq("commentable", target.Commentable),
+				query.Eq("commentable_id", target.CommentableId),
+				query.Lte("total_count", 0),
+			)).
+			Build()
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, stmt, args...)
+		return err
+	}
+	return nil
+}
+
+// countDelta is the change of a counter when a comment goes from being
+// counted (or not) before to after.
+func countDelta(before, after bool) int {
+	switch {
+	case after && !before:
+		return 1
+	case before && !after:
+		return -1
+	}
+	return 0
+}
+
+// liveConditions selects the comments of target its stats count, which
+// leaves tombstones out.
+func liveConditions(target CommentTarget) []query.Condition {
+	return []query.Condition{
+		query.Eq("commentable", target.Commentable),
+		query.Eq("commentable_id", target.CommentableId),
+		query.IsNull("deleted_at"),
+	}
+}
+
+// publishedConditions selects the comments of target its stats count as
+// published.
+func publishedConditions(target CommentTarget) []query.Condition {
+	return append(liveConditions(target), query.Eq("status", StatusPublished))
+}
+
+// hasOtherPublished reports whether the author of entry has another published
+// comment on target.
+func hasOtherPublished(ctx context.Context, db database.Database, q sqlExecutor, target CommentTarget, entry statsEntry) (bool, error) {
+	conds := append(publishedConditions(target),
+		query.Eq("user_id", *entry.userID),
+		query.Ne("id", entry.id),
+	)
+	stmt, args, err := query.New(db.Dialect()).
+		Select("id").
+		From("comment").
+		Where(query.And(conds...)).
+		Limit(1).
+		Build()
+	if err != nil {
+		return false, err
+	}
+	var id string
+	return scanFirst(ctx, q, stmt, args, &id)
+}
+
+// lastPublished returns the time and author of the latest published comment
+// on target, nil when there is none.
+func lastPublished(ctx context.Context, db database.Database, q sqlExecutor, target CommentTarget) (*time.Time, *string, error) {
+	stmt, args, err := query.New(db.Dialect()).
+		Select("created_at", "user_id").
+		From("comment").
+		Where(query.And(publishedConditions(target)...)).
+		OrderBy("created_at", query.DESC).
+		OrderBy("id", query.DESC).
+		Limit(1).
+		Build()
+	if err != nil {
+		return nil, nil, err
+	}
+	var lastAt sql.NullTime
+	var lastBy sql.NullString
+	if _, err := scanFirst(ctx, q, stmt, args, &lastAt, &lastBy); err != nil {
+		return nil, nil, err
+	}
+	var at *time.Time
+	var by *string
+	if lastAt.Valid {
+		at = &lastAt.Time
+	}
+	if lastBy.Valid {
+		by = &lastBy.String
+	}
+	return at, by, nil
+}
+
+// refreshTargetStats recomputes the stats row of target from its comments.
+// The writes of single comments adjust the row with adjustTargetStats
+// instead; a full recompute is left to the bulk paths that rewrite many
+// comments or their authors at once (rebuilds, imports and erasures), and
+// repairs any drift. The row is removed once the target has no comment left.
+func refreshTargetStats(ctx context.Context, db database.Database, q sqlExecutor, target CommentTarget) error {
+	builder := query.New(db.Dialect())
+
+	stats := CommentTargetStats{Commentable: target.Commentable, CommentableId: target.CommentableId}
+
+	stmt, args, err := builder.Select().
+		SelectExpr(
+			query.Count(query.Col("id")),
+			query.RawExpr("COALESCE(SUM(CASE WHEN status = ? THEN 1 ELSE 0 END), 0)", StatusPublished),
+		).
+		From("comment").
+		Where(query.And(liveConditions(target)...)).
+		Build()
+	if err != nil {
+		return err
+	}
+	if _, err := scanFirst(ctx, q, stmt, args, &stats.TotalCount, &stats.PublishedCount); err != nil {
+		return err
+	}
+
+	if stats.TotalCount == 0 {
+		stmt, args, err = builder.Delete("comment_target_stats").
+			Where(query.And(
+				query.Eq("commentable", target.Commentable),
+				query.Eq("commentable_id", target.CommentableId),
+			)).
+			Build()
+		if err != nil {
+			return err
+		}
+		_, err = q.Exec(ctx, stmt, args...)
+		return err
+	}
+
+	if stats.PublishedCount > 0 {
+		stmt, args, err = builder.Select().
+			SelectExpr(query.CountDistinct(query.Col("user_id"))).
+			From("comment").
+			Where(query.And(publishedConditions(target)...)).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := scanFirst(ctx, q, stmt, args, &stats.ParticipantCount); err != nil {
+			return err
+		}
+		if stats.LastCommentAt, stats.LastCommenterId, err = lastPublished(ctx, db, q, target); err != nil {
+			return err
+		}
+	}
+
+	stmt = upsertStatement(db, "comment_target_stats",
+		[]string{"commentable", "commentable_id"},
+		[]string{"commentable", "commentable_id", "published_count", "total_count",
+			"participant_count", "last_comment_at", "last_commenter_id", "updated_at"},
+		nil,
+	)
+	_, err = q.Exec(ctx, stmt, stats.Commentable, stats.CommentableId, stats.PublishedCount, stats.TotalCount,
+		stats.ParticipantCount, stats.LastCommentAt, stats.LastCommenterId, time.Now().UTC())
+	return err
+}
+
+// updateTargetStats refreshes the stats of target in a transaction of its
+// own, for writes that are not already part of one.
+func updateTargetStats(ctx context.Context, db database.Database, target CommentTarget) error {
+	tx, err := db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	if err := refreshTargetStats(ctx, db, tx, target); err != nil {
+		_ = tx.Rollback(ctx)
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// RebuildTargetStats recomputes comment_target_stats from the comment table,
+// for every target that has comments or a stats row, restricted to
+// commentableTypes when any are given. It repairs drift, e.g. after comments
+// were written directly to the database, and returns the number of targets
+// refreshed.
+func RebuildTargetStats(ctx context.Context, db database.Database, commentableTypes ...string) (int, error) {
+	targets := map[CommentTarget]bool{}
+	for _, table := range []string{"comment", "comment_target_stats"} {
+		b := query.New(db.Dialect()).
+			Select("commentable", "commentable_id").
+			Distinct().
+			From(table)
+		if len(commentableTypes) > 0 {
+			types := make([]any, len(commentableTypes))
+			for i, t := range commentableTypes {
+				types[i] = t
+			}
+			b = b.Where(query.In("commentable", types...))
+		}
+		stmt, args, err := b.Build()
+		if err != nil {
+			return 0, err
+		}
+
+		rows, err := db.Query(ctx, stmt, args...)
+		if err != nil {
+			return 0, err
+		}
+		for rows.Next() {
+			var target CommentTarget
+			if err := rows.Scan(&target.Commentable, &target.CommentableId); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			targets[target] = true
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	for target := range targets {
+		if err := updateTargetStats(ctx, db, target); err != nil {
+			return 0, err
+		}
+	}
+	return len(targets), nil
+}
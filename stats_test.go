@@ -0,0 +1,125 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/plugin"
+)
+
+func loadTargetStats(t *testing.T, db database.Database, commentableID string) *CommentTargetStats {
+	t.Helper()
+	stats := CommentTargetStats{Commentable: "post", CommentableId: commentableID}
+	var lastCommenter *string
+	var lastAt sql.NullTime
+	found, err := scanFirst(context.Background(), db,
+		`SELECT published_count, total_count, participant_count, last_comment_at, last_commenter_id FROM comment_target_stats WHERE commentable = 'post' AND commentable_id = ?`,
+		[]any{commentableID},
+		&stats.PublishedCount, &stats.TotalCount, &stats.ParticipantCount, &lastAt, &lastCommenter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		return nil
+	}
+	stats.LastCommenterId = lastCommenter
+	if lastAt.Valid {
+		stats.LastCommentAt = &lastAt.Time
+	}
+	return &stats
+}
+
+func TestTargetStats(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	app := newModerationApp(t, db, &cfg, "moderator")
+
+	send := func(method, path string, body any) int {
+		t.Helper()
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+	expect := func(published, total, participants int) {
+		t.Helper()
+		stats := loadTargetStats(t, db, "post-1")
+		if stats == nil {
+			t.Fatalf("expected a stats row")
+		}
+		if stats.PublishedCount != published || stats.TotalCount != total || stats.ParticipantCount != participants {
+			t.Errorf("expected published=%d total=%d participants=%d, got %+v", published, total, participants, stats)
+		}
+	}
+
+	if status := send("POST", "/comments", CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "first"}); status != 201 {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	expect(1, 1, 1)
+	if stats := loadTargetStats(t, db, "post-1"); stats.LastCommenterId == nil || *stats.LastCommenterId != "moderator-1" {
+		t.Errorf("expected moderator-1 as last commenter, got %v", stats.LastCommenterId)
+	}
+
+	// Written behind the hooks' back: the stats drift until rebuilt.
+	awaiting := insertComment(t, db, nil, StatusAwaiting)
+	expect(1, 1, 1)
+	if n, err := RebuildTargetStats(context.Background(), db); err != nil || n != 1 {
+		t.Fatalf("expected one target rebuilt, got %d (%v)", n, err)
+	}
+	expect(1, 2, 1)
+
+	if status := send("POST", "/comments/moderation/bulk", BulkModerationDTO{Action: ModerationApprove, IDs: []string{awaiting}}); status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	// The approved comment has no author, so participants do not change.
+	expect(2, 2, 1)
+
+	reason := "spam"
+	rejected := StatusModerated
+	if status := send("PUT", "/comments/"+awaiting, CommentUpdateDTO{Status: &rejected, Reason: &reason}); status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+	expect(1, 2, 1)
+
+	if status := send("DELETE", "/comments/"+awaiting, nil); status != 204 {
+		t.Fatalf("expected 204, got %d", status)
+	}
+	expect(1, 1, 1)
+
+	// A second comment of the same author is not another participant, and
+	// becomes the last comment until it is deleted.
+	first := loadTargetStats(t, db, "post-1").LastCommentAt
+	if status := send("POST", "/comments", CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "second"}); status != 201 {
+		t.Fatalf("expected 201, got %d", status)
+	}
+	expect(2, 2, 1)
+	var second string
+	if err := db.QueryRow(context.Background(), `SELECT id FROM comment WHERE content = 'second'`).Scan(&second); err != nil {
+		t.Fatal(err)
+	}
+	if status := send("DELETE", "/comments/"+second, nil); status != 204 {
+		t.Fatalf("expected 204, got %d", status)
+	}
+	expect(1, 1, 1)
+	if last := loadTargetStats(t, db, "post-1").LastCommentAt; last == nil || !last.Equal(*first) {
+		t.Errorf("expected the first comment to be the last one again, got %v", last)
+	}
+
+	result := (&CommentablePlugin{db: db}).Commands()[0].Run(&plugin.CommandContext{Args: []string{"article"}})
+	if !result.Success || result.Message != "Rebuilt comment stats for 0 targets" {
+		t.Errorf("expected the rebuild to be limited to articles, got %+v", result)
+	}
+}
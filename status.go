@@ -0,0 +1,104 @@
+package commentable
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	auth "github.com/nicolasbonnici/gorest/auth"
+)
+
+// Actors of a status transition. A moderator acting on their own comment acts
+// as its author, so moderation rights never let anyone overturn a decision
+// about their own comment. Admins may apply any transition.
+const (
+	ActorAuthor    = "author"
+	ActorModerator = "moderator"
+	ActorAdmin     = "admin"
+)
+
+// StatusTransition allows Actors to move a comment from one status to another.
+type StatusTransition struct {
+	From   string
+	To     string
+	Actors []string
+}
+
+// StatusTransitions is the status state machine. Any transition not listed
+// here is rejected, except for admins.
+var StatusTransitions = []StatusTransition{
+	// Authors submit and withdraw their own comments.
+	{From: StatusDraft, To: StatusAwaiting, Actors: []string{ActorAuthor}},
+	{From: StatusAwaiting, To: StatusDraft, Actors: []string{ActorAuthor}},
+	{From: StatusPublished, To: StatusDraft, Actors: []string{ActorAuthor}},
+
+	// Moderators decide on everything that was submitted.
+	{From: StatusAwaiting, To: StatusPublished, Actors: []string{ActorModerator}},
+	{From: StatusAwaiting, To: StatusModerated, Actors: []string{ActorModerator}},
+	{From: StatusPublished, To: StatusModerated, Actors: []string{ActorModerator}},
+	{From: StatusModerated, To: StatusPublished, Actors: []string{ActorModerator}},
+	{From: StatusModerated, To: StatusAwaiting, Actors: []string{ActorModerator}},
+}
+
+// transitionActor returns the actor a user with the given privileges plays on
+// a comment owned by ownerID.
+func transitionActor(admin, moderator bool, user *auth.AuthenticatedUser, ownerID *string) string {
+	if admin {
+		return ActorAdmin
+	}
+	own := user != nil && ownerID != nil && *ownerID == user.UserID
+	if moderator && !own {
+		return ActorModerator
+	}
+	return ActorAuthor
+}
+
+// checkTransition reports whether actor may move a comment from one status to
+// another. Keeping the same status is always allowed. On top of the table, an
+// author may submit a draft straight to defaultStatus, since that is where a
+// new comment would have landed.
+func checkTransition(from, to, actor, defaultStatus string) error {
+	if from == to || actor == ActorAdmin {
+		return nil
+	}
+	if actor == ActorAuthor && from == StatusDraft && to == defaultStatus {
+		return nil
+	}
+
+	known := false
+	for _, t := range StatusTransitions {
+		if t.From != from || t.To != to {
+			continue
+		}
+		known = true
+		for _, a := range t.Actors {
+			if a == actor {
+				return nil
+			}
+		}
+	}
+
+	if !known {
+		return fiber.NewError(400, fmt.Sprintf("invalid status transition from %s to %s", from, to))
+	}
+	return fiber.NewError(403, fmt.Sprintf("status transition from %s to %s is not allowed", from, to))
+}
+
+// applyTransition moves model to status and records it: publishing stamps
+// published_at, and a decision taken by a moderator or admin stamps
+// moderated_at/moderated_by with its (optional) reason.
+func applyTransition(model *Comment, status, actor string, userID, reason *string, now time.Time) {
+	if model.Status == status {
+		return
+	}
+
+	model.Status = status
+	if status == StatusPublished {
+		model.PublishedAt = &now
+	}
+	if actor != ActorAuthor {
+		model.ModeratedAt = &now
+		model.ModeratedBy = userID
+		model.ModerationReason = reason
+	}
+}
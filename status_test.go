@@ -0,0 +1,141 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to string
+		actor    string
+		want     int
+	}{
+		{"author submits draft", StatusDraft, StatusAwaiting, ActorAuthor, 0},
+		{"author submits draft to default status", StatusDraft, StatusPublished, ActorAuthor, 0},
+		{"author withdraws", StatusPublished, StatusDraft, ActorAuthor, 0},
+		{"author cannot overturn moderation", StatusModerated, StatusPublished, ActorAuthor, 403},
+		{"author cannot publish", StatusAwaiting, StatusPublished, ActorAuthor, 403},
+		{"moderator approves", StatusAwaiting, StatusPublished, ActorModerator, 0},
+		{"moderator reinstates", StatusModerated, StatusPublished, ActorModerator, 0},
+		{"moderator cannot submit drafts", StatusDraft, StatusAwaiting, ActorModerator, 403},
+		{"nobody drafts a moderated comment", StatusModerated, StatusDraft, ActorModerator, 400},
+		{"admin does anything", StatusModerated, StatusDraft, ActorAdmin, 0},
+		{"same status", StatusModerated, StatusModerated, ActorAuthor, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkTransition(tt.from, tt.to, tt.actor, StatusPublished)
+			got := 0
+			if fe, ok := err.(*fiber.Error); ok {
+				got = fe.Code
+			} else if err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("expected %d, got %d (%v)", tt.want, got, err)
+			}
+		})
+	}
+}
+
+func TestCommentUpdate_StatusTransitions(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	c := crud.New[Comment](db)
+	ctx := rbac.WithRoles(context.Background(), []string{"admin"})
+
+	id := insertComment(t, db, nil, StatusAwaiting)
+	stmt, args, err := query.New(db.Dialect()).Update("comment").
+		Set("user_id", "author-1").
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+
+	update := func(userID string, roles []string, dto CommentUpdateDTO) int {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), roles))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		payload, _ := json.Marshal(dto)
+		req := httptest.NewRequest("PUT", "/comments/"+id, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	published, moderated := StatusPublished, StatusModerated
+	reason := "off-topic"
+
+	// A moderator (writers inherit it) acts as the author on their own comment.
+	if status := update("author-1", []string{"writer"}, CommentUpdateDTO{Status: &published}); status != 403 {
+		t.Errorf("expected 403 for an author approving their own comment, got %d", status)
+	}
+
+	if status := update("moderator-1", []string{"moderator"}, CommentUpdateDTO{Status: &moderated, Reason: &reason}); status != 200 {
+		t.Fatalf("expected 200 rejecting as moderator, got %d", status)
+	}
+	comment, err := c.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.Status != StatusModerated || comment.ModeratedAt == nil ||
+		comment.ModeratedBy == nil || *comment.ModeratedBy != "moderator-1" ||
+		comment.ModerationReason == nil || *comment.ModerationReason != reason {
+		t.Errorf("expected the moderation decision to be recorded, got %+v", comment)
+	}
+	if comment.PublishedAt != nil {
+		t.Errorf("expected published_at to stay empty, got %v", comment.PublishedAt)
+	}
+
+	if status := update("author-1", []string{"writer"}, CommentUpdateDTO{Status: &published}); status != 403 {
+		t.Errorf("expected 403 for an author overturning moderation, got %d", status)
+	}
+
+	// An author edit must not wipe the moderator-only columns it cannot read.
+	content := "edited"
+	if status := update("author-1", []string{"writer"}, CommentUpdateDTO{Content: &content}); status != 200 {
+		t.Fatalf("expected 200 editing content, got %d", status)
+	}
+	comment, err = c.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.ModeratedBy == nil || comment.ModerationReason == nil {
+		t.Errorf("expected moderation columns to survive an author edit, got %+v", comment)
+	}
+
+	if status := update("moderator-1", []string{"moderator"}, CommentUpdateDTO{Status: &published}); status != 200 {
+		t.Fatalf("expected 200 reinstating as moderator, got %d", status)
+	}
+	comment, err = c.GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.PublishedAt == nil || comment.ModerationReason != nil {
+		t.Errorf("expected published_at set and reason cleared, got %+v", comment)
+	}
+}
@@ -0,0 +1,368 @@
+package commentable
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Why a notification was sent.
+const (
+	NotificationReasonReply  = "reply"
+	NotificationReasonThread = "thread"
+)
+
+// CommentSubscription follows the comments posted on a target or, when
+// CommentId is set, the replies to that comment. Authors are subscribed to
+// the replies to their own comments when they post them.
+type CommentSubscription struct {
+	Id            string     `json:"id" db:"id"`
+	UserId        string     `json:"userId" db:"user_id"`
+	Commentable   string     `json:"commentable" db:"commentable"`
+	CommentableId string     `json:"commentableId" db:"commentable_id"`
+	CommentId     *string    `json:"commentId,omitempty" db:"comment_id"`
+	CreatedAt     *time.Time `json:"createdAt,omitempty" db:"created_at"`
+}
+
+func (CommentSubscription) TableName() string {
+	return "comment_subscription"
+}
+
+// CommentNotification tells a subscriber about a new comment.
+type CommentNotification struct {
+	Id        string     `json:"id" db:"id"`
+	UserId    string     `json:"userId" db:"user_id"`
+	CommentId string     `json:"commentId" db:"comment_id"`
+	Reason    string     `json:"reason" db:"reason"`
+	ReadAt    *time.Time `json:"readAt,omitempty" db:"read_at"`
+	CreatedAt *time.Time `json:"createdAt,omitempty" db:"created_at"`
+}
+
+func (CommentNotification) TableName() string {
+	return "comment_notification"
+}
+
+// subscriptionConditions matches the subscription of userID to sub. Thread
+// subscriptions have no comment, which the unique index cannot tell apart,
+// so subscribing checks for an existing row first.
+func subscriptionConditions(userID string, sub CommentSubscriptionDTO) query.Condition {
+	conds := []query.Condition{
+		query.Eq("user_id", userID),
+		query.Eq("commentable", sub.Commentable),
+		query.Eq("commentable_id", sub.CommentableId),
+	}
+	if sub.CommentId != nil {
+		conds = append(conds, query.Eq("comment_id", *sub.CommentId))
+	} else {
+		conds = append(conds, query.IsNull("comment_id"))
+	}
+	return query.And(conds...)
+}
+
+// subscribe subscribes userID to sub unless already subscribed, and returns
+// the subscription.
+func subscribe(ctx context.Context, db database.Database, q sqlExecutor, userID string, sub CommentSubscriptionDTO) (*CommentSubscription, error) {
+	builder := query.New(db.Dialect())
+	subscription := CommentSubscription{
+		UserId:        userID,
+		Commentable:   sub.Commentable,
+		CommentableId: sub.CommentableId,
+		CommentId:     sub.CommentId,
+	}
+
+	stmt, args, err := builder.Select("id", "created_at").
+		From("comment_subscription").
+		Where(subscriptionConditions(userID, sub)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	var createdAt sql.NullTime
+	found, err := scanFirst(ctx, q, stmt, args, &subscription.Id, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	if found {
+		if createdAt.Valid {
+			subscription.CreatedAt = &createdAt.Time
+		}
+		return &subscription, nil
+	}
+
+	now := time.Now().UTC()
+	subscription.Id = uuid.New().String()
+	subscription.CreatedAt = &now
+	stmt, args, err = builder.Insert("comment_subscription").
+		Columns("id", "user_id", "commentable", "commentable_id", "comment_id", "created_at").
+		Values(subscription.Id, userID, sub.Commentable, sub.CommentableId, sub.CommentId, now).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return nil, err
+	}
+	return &subscription, nil
+}
+
+// unsubscribe removes the subscription of userID to sub, if any.
+func unsubscribe(ctx context.Context, db database.Database, userID string, sub CommentSubscriptionDTO) error {
+	stmt, args, err := query.New(db.Dialect()).
+		Delete("comment_subscription").
+		Where(subscriptionConditions(userID, sub)).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(ctx, stmt, args...)
+	return err
+}
+
+// NotifySubscribers subscribes the author of a new comment to its replies
+// and notifies the users following its parent or its target. A user
+// following both is notified once, for the reply; the author is never
+// notified of their own comment.
+func (h *CommentHooks) NotifySubscribers(ctx context.Context, q sqlExecutor, model *Comment) error {
+	if model.UserId != nil {
+		commentID := model.Id
+		if _, err := subscribe(ctx, h.db, q, *model.UserId, CommentSubscriptionDTO{
+			Commentable:   model.Commentable,
+			CommentableId: model.CommentableId,
+			CommentId:     &commentID,
+		}); err != nil {
+			return err
+		}
+	}
+
+	followers := query.IsNull("comment_id")
+	if model.ParentId != nil {
+		followers = query.Or(followers, query.Eq("comment_id", *model.ParentId))
+	}
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("user_id", "comment_id").
+		From("comment_subscription").
+		Where(query.And(
+			query.Eq("commentable", model.Commentable),
+			query.Eq("commentable_id", model.CommentableId),
+			followers,
+		)).
+		Build()
+	if err != nil {
+		return err
+	}
+
+	rows, err := q.Query(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	reasons := map[string]string{}
+	var recipients []string
+	for rows.Next() {
+		var userID string
+		var commentID sql.NullString
+		if err := rows.Scan(&userID, &commentID); err != nil {
+			rows.Close()
+			return err
+		}
+		if model.UserId != nil && userID == *model.UserId {
+			continue
+		}
+		if _, ok := reasons[userID]; !ok {
+			recipients = append(recipients, userID)
+		}
+		if commentID.Valid {
+			reasons[userID] = NotificationReasonReply
+		} else if reasons[userID] == "" {
+			reasons[userID] = NotificationReasonThread
+		}
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+
+	builder := query.New(h.db.Dialect())
+	now := time.Now().UTC()
+	for _, userID := range recipients {
+		stmt, args, err := builder.Insert("comment_notification").
+			Columns("id", "user_id", "comment_id", "reason", "created_at").
+			Values(uuid.New().String(), userID, model.Id, reasons[userID], now).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// notificationsPage is one page of the notifications inbox.
+type notificationsPage struct {
+	Items       []CommentNotificationDTO
+	UnreadCount int
+	HasMore     bool
+}
+
+// fetchNotifications loads the notifications of userID about comments the
+// caller may see, most recent first, with the number of unread ones. A
+// notification about a comment awaiting moderation shows up once it is
+// published; tombstones are left out.
+func fetchNotifications(
+	ctx context.Context,
+	db database.Database,
+	c *crud.CRUD[Comment],
+	userID string,
+	statusConds []query.Condition,
+	unreadOnly bool,
+	limit, offset int,
+) (*notificationsPage, error) {
+	visible := append([]query.Condition{
+		query.Eq("comment_notification.user_id", userID),
+		query.IsNull("comment.deleted_at"),
+	}, statusConds...)
+	unread := append(append([]query.Condition{}, visible...), query.IsNull("comment_notification.read_at"))
+	conds := visible
+	if unreadOnly {
+		conds = unread
+	}
+
+	builder := query.New(db.Dialect())
+	page := &notificationsPage{Items: []CommentNotificationDTO{}}
+
+	stmt, args, err := builder.Select().
+		SelectExpr(query.Count(query.Col("comment_notification.id"))).
+		From("comment_notification").
+		Join("comment", query.ColEq("comment.id", "comment_notification.comment_id")).
+		Where(query.And(unread...)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := scanFirst(ctx, db, stmt, args, &page.UnreadCount); err != nil {
+		return nil, err
+	}
+
+	stmt, args, err = builder.
+		Select(
+			"comment_notification.id",
+			"comment_notification.comment_id",
+			"comment_notification.reason",
+			"comment_notification.read_at",
+			"comment_notification.created_at",
+		).
+		From("comment_notification").
+		Join("comment", query.ColEq("comment.id", "comment_notification.comment_id")).
+		Where(query.And(conds...)).
+		OrderBy("comment_notification.created_at", query.DESC).
+		OrderBy("comment_notification.id", query.DESC).
+		Limit(limit + 1).
+		Offset(offset).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	var notifications []CommentNotification
+	for rows.Next() {
+		var n CommentNotification
+		var readAt, createdAt sql.NullTime
+		if err := rows.Scan(&n.Id, &n.CommentId, &n.Reason, &readAt, &createdAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if readAt.Valid {
+			n.ReadAt = &readAt.Time
+		}
+		if createdAt.Valid {
+			n.CreatedAt = &createdAt.Time
+		}
+		notifications = append(notifications, n)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(notifications) > limit {
+		page.HasMore = true
+		notifications = notifications[:limit]
+	}
+	if len(notifications) == 0 {
+		return page, nil
+	}
+
+	ids := make([]any, len(notifications))
+	for i, n := range notifications {
+		ids[i] = n.CommentId
+	}
+	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      len(ids),
+		Conditions: []query.Condition{query.In("id", ids...)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	conv := &CommentConverter{}
+	byID := make(map[string]CommentResponseDTO, len(res.Items))
+	for _, comment := range res.Items {
+		byID[comment.Id] = conv.ModelToResponseDTO(comment)
+	}
+	for _, n := range notifications {
+		comment, ok := byID[n.CommentId]
+		if !ok {
+			continue
+		}
+		page.Items = append(page.Items, CommentNotificationDTO{
+			ID:        n.Id,
+			Reason:    n.Reason,
+			Read:      n.ReadAt != nil,
+			ReadAt:    n.ReadAt,
+			CreatedAt: n.CreatedAt,
+			Comment:   comment,
+		})
+	}
+	return page, nil
+}
+
+// markNotificationsRead marks the unread notifications of userID among ids,
+// or all of them when ids is nil, as read and returns how many were.
+func markNotificationsRead(ctx context.Context, db database.Database, userID string, ids []string) (int64, error) {
+	conds := []query.Condition{
+		query.Eq("user_id", userID),
+		query.IsNull("read_at"),
+	}
+	if ids != nil {
+		values := make([]any, len(ids))
+		for i, id := range ids {
+			values[i] = id
+		}
+		conds = append(conds, query.In("id", values...))
+	}
+
+	stmt, args, err := query.New(db.Dialect()).
+		Update("comment_notification").
+		Set("read_at", time.Now().UTC()).
+		Where(query.And(conds...)).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+	res, err := db.Exec(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,149 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gofiber/fiber/v3"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+func TestSubscriptionsAndNotifications(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"u-alice", "u-bob", "u-carol"} {
+		if _, err := db.Exec(ctx, `INSERT INTO users (id) VALUES (?)`, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+
+	request := func(userID, method, path string, body any) *httpResult {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{"writer"}))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+	posted := 0
+	post := func(userID string, parentID *string) string {
+		t.Helper()
+		posted++
+		created := request(userID, "POST", "/comments", CommentCreateDTO{
+			Commentable:   "post",
+			CommentableId: "post-1",
+			ParentId:      parentID,
+			Content:       fmt.Sprintf("comment %d by %s", posted, userID),
+		})
+		if created.status != 201 {
+			t.Fatalf("expected 201, got %d", created.status)
+		}
+		return created.body["id"].(string)
+	}
+	inbox := func(userID, query string) ([]any, int) {
+		t.Helper()
+		result := request(userID, "GET", "/comments/notifications"+query, nil)
+		if result.status != 200 {
+			t.Fatalf("expected 200, got %d", result.status)
+		}
+		data, _ := result.body["data"].([]any)
+		unread, _ := result.body["unreadCount"].(float64)
+		return data, int(unread)
+	}
+	reasons := func(data []any) []string {
+		var out []string
+		for _, item := range data {
+			out = append(out, item.(map[string]any)["reason"].(string))
+		}
+		return out
+	}
+
+	thread := CommentSubscriptionDTO{Commentable: "post", CommentableId: "post-1"}
+	first := request("u-carol", "POST", "/comments/subscriptions", thread)
+	again := request("u-carol", "POST", "/comments/subscriptions", thread)
+	if first.status != 201 || again.status != 201 || first.body["id"] != again.body["id"] {
+		t.Fatalf("expected subscribing twice to return the same subscription, got %v and %v", first.body, again.body)
+	}
+
+	root := post("u-alice", nil)
+	reply := post("u-bob", &root)
+
+	// Alice is subscribed to the replies to her comment; Carol follows the
+	// whole target and hears about both comments.
+	if data, unread := inbox("u-alice", ""); unread != 1 || len(data) != 1 || reasons(data)[0] != NotificationReasonReply {
+		t.Errorf("expected one reply notification for alice, got %d unread in %v", unread, data)
+	}
+	carol, unread := inbox("u-carol", "")
+	if unread != 2 || len(carol) != 2 || reasons(carol)[0] != NotificationReasonThread {
+		t.Errorf("expected two thread notifications for carol, got %d unread in %v", unread, carol)
+	}
+	if data, _ := inbox("u-bob", ""); len(data) != 0 {
+		t.Errorf("expected bob not to be notified of his own reply, got %v", data)
+	}
+
+	latest := carol[0].(map[string]any)
+	if latest["comment"].(map[string]any)["id"] != reply || latest["read"] != false {
+		t.Errorf("expected the latest notification to be the unread reply, got %v", latest)
+	}
+	marked := request("u-carol", "POST", "/comments/notifications/read", MarkNotificationsReadDTO{IDs: []string{latest["id"].(string)}})
+	if marked.status != 200 || marked.body["marked"] != float64(1) {
+		t.Fatalf("expected one notification marked, got %d %v", marked.status, marked.body)
+	}
+	if data, unread := inbox("u-carol", "?unread=true"); unread != 1 || len(data) != 1 {
+		t.Errorf("expected one unread notification left, got %d unread in %v", unread, data)
+	}
+	other := carol[1].(map[string]any)["id"].(string)
+	if marked := request("u-bob", "POST", "/comments/notifications/read", MarkNotificationsReadDTO{IDs: []string{other}}); marked.body["marked"] != float64(0) {
+		t.Errorf("expected bob not to be able to mark carol's notification, got %v", marked.body)
+	}
+	request("u-carol", "POST", "/comments/notifications/read", MarkNotificationsReadDTO{All: true})
+	if _, unread := inbox("u-carol", ""); unread != 0 {
+		t.Errorf("expected all notifications read, got %d unread", unread)
+	}
+
+	replies := CommentSubscriptionDTO{Commentable: "post", CommentableId: "post-1", CommentId: &root}
+	if result := request("u-alice", "DELETE", "/comments/subscriptions", replies); result.status != 204 {
+		t.Fatalf("expected 204, got %d", result.status)
+	}
+	post("u-bob", &root)
+	if _, unread := inbox("u-alice", ""); unread != 1 {
+		t.Errorf("expected no notification after unsubscribing, got %d unread", unread)
+	}
+	if _, unread := inbox("u-carol", ""); unread != 1 {
+		t.Errorf("expected carol to be notified of the new reply, got %d unread", unread)
+	}
+
+	unknown := "00000000-0000-0000-0000-000000000000"
+	for _, dto := range []CommentSubscriptionDTO{
+		{Commentable: "article", CommentableId: "post-1"},
+		{Commentable: "post"},
+		{Commentable: "post", CommentableId: "post-1", CommentId: &unknown},
+	} {
+		if result := request("u-carol", "POST", "/comments/subscriptions", dto); result.status != 400 && result.status != 404 {
+			t.Errorf("expected %+v to be rejected, got %d", dto, result.status)
+		}
+	}
+}
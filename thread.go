@@ -2,6 +2,11 @@ package commentable
 
 import (
 	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/nicolasbonnici/gorest/crud"
 	"github.com/nicolasbonnici/gorest/query"
@@ -12,62 +17,369 @@ import (
 type CommentThreadDTO struct {
 	CommentResponseDTO
 	Children []*CommentThreadDTO `json:"children,omitempty"`
+	// HasMoreChildren reports replies left out by the per-node child limit;
+	// ChildCursor resumes them via GET /comments/:id/replies.
+	HasMoreChildren bool   `json:"hasMoreChildren"`
+	ChildCursor     string `json:"childCursor,omitempty"`
 }
 
-// fetchThread loads a full comment subtree for a commentable target.
+// pathSegmentLength is the width of one path segment: 11 hex digits of
+// creation time in milliseconds followed by the 32 hex digits of the UUID.
+const pathSegmentLength = 43
+
+// pathSegment returns the path segment contributed by one comment.
+//
+// The path is a plain concatenation of fixed-width, lowercase-hex segments from
+// the root down, with no separator. Restricting it to [0-9a-f] keeps the
+// ordering identical under byte-wise and locale-aware collations on every
+// dialect, so ORDER BY path yields depth-first order with siblings sorted
+// oldest first, and a subtree is the half-open range [path, path+"g").
+//
+// The backfill migration formats segments independently and must stay in
+// sync with this function.
+func pathSegment(id string, createdAt time.Time) string {
+	return fmt.Sprintf("%011x", createdAt.UTC().UnixMilli()) + strings.ReplaceAll(id, "-", "")
+}
+
+// setThreadPosition fills the denormalized depth, root_id and path columns of
+// a new comment from its (already validated) parent, or as a root when parent
+// is nil.
+func setThreadPosition(model *Comment, parent *Comment, createdAt time.Time) {
+	segment := pathSegment(model.Id, createdAt)
+
+	if parent == nil {
+		rootID := model.Id
+		model.Depth = 0
+		model.RootId = &rootID
+		model.Path = &segment
+		return
+	}
+
+	path := segment
+	if parent.Path != nil {
+		path = *parent.Path + segment
+	}
+	rootID := parent.Id
+	if parent.RootId != nil {
+		rootID = *parent.RootId
+	}
+
+	model.Depth = parent.Depth + 1
+	model.RootId = &rootID
+	model.Path = &path
+}
+
+// subtreeConditions restricts a query to the strict descendants of the comment
+// at parentPath, which all share it as a path prefix.
+func subtreeConditions(parentPath string) []query.Condition {
+	return []query.Condition{
+		query.Gt("path", parentPath),
+		query.Lt("path", parentPath+"g"),
+	}
+}
+
+// threadPageOptions controls how much of a thread one request returns. A zero
+// Limit loads every comment on the level, a zero ChildLimit keeps every reply.
+type threadPageOptions struct {
+	// Limit caps the number of comments on the requested level (the roots, or
+	// the direct replies of a parent).
+	Limit int
+	// ChildLimit caps the replies kept under each nested comment; the rest
+	// are announced through HasMoreChildren/ChildCursor.
+	ChildLimit int
+	// Sort orders every level of the page; empty means SortOld.
+	Sort string
+	// After is the decoded cursor: the path of the last comment already seen
+	// on the requested level. AfterKey is its rank for the score-based sorts.
+	After    string
+	AfterKey float64
+}
+
+// threadPage is one page of a thread level with its nested replies.
+type threadPage struct {
+	Items      []*CommentThreadDTO
+	NextCursor string
+}
+
+// fetchThread loads one page of root comments of a commentable target, each
+// with its nested replies.
 //
-// The gorest/query builder cannot express a portable recursive CTE (its
-// recursive CTE helper has no UNION ALL self-reference and SelectBuilder has no
-// UNION), so instead of walking the tree node by node (N+1 queries) it fetches
-// one level at a time: every child of the previous level is loaded in a single
-// IN-query. The walk is bounded to MaxNestingDepth levels, giving at most that
-// many queries regardless of how many comments the thread contains.
+// Every comment carries its materialized path. One query picks the comments
+// of the requested level; without a ChildLimit, one range scan of
+// idx_comment_thread_path between the first and last comment of the page then
+// returns them together with all their descendants, already in depth-first
+// display order. With a ChildLimit, each nested level is loaded from the
+// comments shown on the level above instead: a window over parent_id ranks
+// the replies of each parent in sort order and only the first ChildLimit+1
+// are read, so a comment with thousands of replies costs no more than one
+// with a few. Levels deeper than MaxNestingDepth are never loaded.
 func fetchThread(
 	ctx context.Context,
 	c *crud.CRUD[Comment],
 	cfg *Config,
 	commentableType, commentableID string,
 	statusConds []query.Condition,
-) ([]*CommentThreadDTO, error) {
-	maxDepth := cfg.MaxNestingDepth
-	if maxDepth < 1 {
-		maxDepth = 1
+	opts threadPageOptions,
+) (*threadPage, error) {
+	return fetchPage(ctx, c, cfg, commentableType, commentableID, nil, statusConds, opts)
+}
+
+// fetchReplies loads one page of the direct replies of parent, each with its
+// nested replies, using the same queries as fetchThread.
+func fetchReplies(
+	ctx context.Context,
+	c *crud.CRUD[Comment],
+	cfg *Config,
+	parent *Comment,
+	statusConds []query.Condition,
+	opts threadPageOptions,
+) (*threadPage, error) {
+	if parent.Path == nil {
+		return &threadPage{Items: []*CommentThreadDTO{}}, nil
 	}
+	return fetchPage(ctx, c, cfg, parent.Commentable, parent.CommentableId, parent, statusConds, opts)
+}
 
-	rootConds := append([]query.Condition{
+func fetchPage(
+	ctx context.Context,
+	c *crud.CRUD[Comment],
+	cfg *Config,
+	commentableType, commentableID string,
+	parent *Comment,
+	statusConds []query.Condition,
+	opts threadPageOptions,
+) (*threadPage, error) {
+	sortMode := sortOrDefault(opts.Sort)
+	target := []query.Condition{
 		query.Eq("commentable", commentableType),
 		query.Eq("commentable_id", commentableID),
-		query.IsNull("parent_id"),
-	}, statusConds...)
+	}
 
-	level, err := fetchLevel(ctx, c, rootConds)
-	if err != nil {
-		return nil, err
+	var parentID *string
+	var bounds []query.Condition
+	depth := 0
+	if parent != nil {
+		parentID = &parent.Id
+		bounds = subtreeConditions(*parent.Path)
+		depth = parent.Depth + 1
+	}
+	if opts.After != "" {
+		bounds = append(bounds, afterConditions(opts)...)
 	}
 
-	all := append([]Comment(nil), level...)
+	page := &threadPage{Items: []*CommentThreadDTO{}}
+
+	var level []Comment
+	if opts.Limit > 0 || opts.ChildLimit > 0 {
+		levelConds := append(append([]query.Condition{}, target...), bounds...)
+		if parent != nil {
+			levelConds = append(levelConds, query.Eq("parent_id", parent.Id))
+		} else {
+			levelConds = append(levelConds, query.Eq("depth", 0))
+		}
+		levelConds = append(levelConds, statusConds...)
+
+		levelOpts := crud.PaginationOptions{
+			Conditions: levelConds,
+			OrderBy:    threadOrder(sortMode),
+		}
+		if opts.Limit > 0 {
+			levelOpts.Limit = opts.Limit + 1
+		}
+		res, err := c.GetAllPaginated(ctx, levelOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		level = res.Items
+		if len(level) == 0 {
+			return page, nil
+		}
+		if opts.Limit > 0 && len(level) > opts.Limit {
+			level = level[:opts.Limit]
+			page.NextCursor = threadCursor(sortMode, &level[len(level)-1])
+		}
 
-	for depth := 1; depth < maxDepth && len(level) > 0; depth++ {
-		parentIDs := make([]any, len(level))
+		bounds = levelBounds(level, sortMode)
+	}
+
+	var flat []Comment
+	if opts.ChildLimit > 0 {
+		flat = level
+		parents := make([]any, len(level))
 		for i := range level {
-			parentIDs[i] = level[i].Id
+			parents[i] = level[i].Id
+		}
+		for depth++; depth < maxThreadDepth(cfg) && len(parents) > 0; depth++ {
+			var replies []Comment
+			var err error
+			replies, parents, err = fetchReplyLevel(ctx, c, parents, statusConds, sortMode, opts.ChildLimit)
+			if err != nil {
+				return nil, err
+			}
+			flat = append(flat, replies...)
 		}
+	} else {
+		conds := append(append([]query.Condition{}, target...), bounds...)
+		conds = append(conds, query.Lt("depth", maxThreadDepth(cfg)))
+		conds = append(conds, statusConds...)
 
-		childConds := append([]query.Condition{query.In("parent_id", parentIDs...)}, statusConds...)
-		level, err = fetchLevel(ctx, c, childConds)
+		var err error
+		flat, err = fetchOrdered(ctx, c, conds)
 		if err != nil {
 			return nil, err
 		}
-		all = append(all, level...)
 	}
 
-	return assembleTree(all), nil
+	page.Items = assembleTree(flat, parentID, opts.ChildLimit, sortMode)
+	return page, nil
 }
 
-func fetchLevel(ctx context.Context, c *crud.CRUD[Comment], conds []query.Condition) ([]Comment, error) {
+// replyLevelBatch bounds the number of replies one query of fetchReplyLevel
+// may return, and with it the number of ids the following query binds.
+const replyLevelBatch = 1000
+
+// fetchReplyLevel loads the first childLimit+1 replies in sort order of each
+// of parentIDs that statusConds let through, in path order: the extra reply
+// tells assembleTree that there are more to continue from. It also returns
+// the ids of the replies shown, whose own replies make the next level.
+func fetchReplyLevel(
+	ctx context.Context,
+	c *crud.CRUD[Comment],
+	parentIDs []any,
+	statusConds []query.Condition,
+	sortMode string,
+	childLimit int,
+) ([]Comment, []any, error) {
+	batch := max(1, replyLevelBatch/(childLimit+1))
+
+	var replies []Comment
+	var shown []any
+	for len(parentIDs) > 0 {
+		n := min(batch, len(parentIDs))
+		conds := append([]query.Condition{query.In("parent_id", parentIDs[:n]...)}, statusConds...)
+		parentIDs = parentIDs[n:]
+
+		kept := map[string]bool{}
+		ids, err := rankedReplyIDs(ctx, c, conds, sortMode, childLimit, kept)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+
+		items, err := fetchOrdered(ctx, c, []query.Condition{query.In("id", ids...)})
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, reply := range items {
+			if kept[reply.Id] {
+				shown = append(shown, reply.Id)
+			}
+		}
+		replies = append(replies, items...)
+	}
+	return replies, shown, nil
+}
+
+// rankedReplyIDs returns the ids of the first childLimit+1 comments matching
+// conds under each parent, in sort order, and marks the first childLimit of
+// each in kept.
+func rankedReplyIDs(
+	ctx context.Context,
+	c *crud.CRUD[Comment],
+	conds []query.Condition,
+	sortMode string,
+	childLimit int,
+	kept map[string]bool,
+) ([]any, error) {
+	window := query.Window().PartitionBy(query.Col("parent_id"))
+	for _, order := range threadOrder(sortMode) {
+		window = window.OrderBy(query.Col(order.Column), order.Direction)
+	}
+
+	b := query.New(c.DB.Dialect())
+	ranked := b.Select("id").
+		SelectExpr(query.As(query.RowNumber(window), "reply_rank")).
+		From("comment").
+		Where(query.And(conds...))
+	stmt, args, err := b.WithCTE("ranked_reply", ranked).
+		Select("id", "reply_rank").
+		From("ranked_reply").
+		Where(query.Lte("reply_rank", childLimit+1)).
+		Build()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := c.DB.Query(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []any
+	for rows.Next() {
+		var id string
+		var rank int
+		if err := rows.Scan(&id, &rank); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+		if rank <= childLimit {
+			kept[id] = true
+		}
+	}
+	return ids, rows.Err()
+}
+
+func sortOrDefault(sortMode string) string {
+	if sortMode == "" {
+		return SortOld
+	}
+	return sortMode
+}
+
+// levelBounds restricts the subtree query to the comments of a level page and
+// their descendants. In chronological order they all lie between the first
+// comment's path and the end of the last comment's subtree; ranked pages are
+// not contiguous, so each comment contributes its own subtree range.
+func levelBounds(level []Comment, sortMode string) []query.Condition {
+	switch sortOrDefault(sortMode) {
+	case SortOld:
+		return []query.Condition{
+			query.Gte("path", *level[0].Path),
+			query.Lt("path", *level[len(level)-1].Path+"g"),
+		}
+	case SortNew:
+		return []query.Condition{
+			query.Gte("path", *level[len(level)-1].Path),
+			query.Lt("path", *level[0].Path+"g"),
+		}
+	}
+
+	ranges := make([]query.Condition, len(level))
+	for i := range level {
+		ranges[i] = query.And(
+			query.Gte("path", *level[i].Path),
+			query.Lt("path", *level[i].Path+"g"),
+		)
+	}
+	return []query.Condition{query.Or(ranges...)}
+}
+
+func maxThreadDepth(cfg *Config) int {
+	if cfg.MaxNestingDepth < 1 {
+		return 1
+	}
+	return cfg.MaxNestingDepth
+}
+
+func fetchOrdered(ctx context.Context, c *crud.CRUD[Comment], conds []query.Condition) ([]Comment, error) {
 	res, err := c.GetAllPaginated(ctx, crud.PaginationOptions{
 		Conditions: conds,
-		OrderBy:    []crud.OrderByClause{{Column: "created_at", Direction: query.ASC}},
+		OrderBy:    []crud.OrderByClause{{Column: "path", Direction: query.ASC}},
 	})
 	if err != nil {
 		return nil, err
@@ -75,23 +387,94 @@ func fetchLevel(ctx context.Context, c *crud.CRUD[Comment], conds []query.Condit
 	return res.Items, nil
 }
 
-func assembleTree(flat []Comment) []*CommentThreadDTO {
+// assembleTree nests a flat list under rootParentID (nil for the thread
+// roots). The list is in path order, or level by level with the replies of
+// each level in path order; either way parents precede their children, so a
+// comment whose parent was filtered out (e.g. by status) is dropped together
+// with its whole branch instead of surfacing as a spurious root. Siblings are
+// then ordered by sortMode.
+//
+// When childLimit is positive, nested comments keep at most that many replies;
+// the remaining ones are dropped with their branches, and the parent is
+// flagged with a cursor to continue from through the replies endpoint.
+func assembleTree(flat []Comment, rootParentID *string, childLimit int, sortMode string) []*CommentThreadDTO {
 	conv := &CommentConverter{}
 	nodes := make(map[string]*CommentThreadDTO, len(flat))
-	for i := range flat {
-		nodes[flat[i].Id] = &CommentThreadDTO{CommentResponseDTO: conv.ModelToResponseDTO(flat[i])}
-	}
+	models := make(map[*CommentThreadDTO]*Comment, len(flat))
 
 	roots := make([]*CommentThreadDTO, 0)
 	for i := range flat {
-		node := nodes[flat[i].Id]
-		if flat[i].ParentId != nil {
-			if parent, ok := nodes[*flat[i].ParentId]; ok {
-				parent.Children = append(parent.Children, node)
-				continue
-			}
+		node := &CommentThreadDTO{CommentResponseDTO: conv.ModelToResponseDTO(flat[i])}
+
+		switch {
+		case sameID(flat[i].ParentId, rootParentID):
+			roots = append(roots, node)
+		case flat[i].ParentId != nil && nodes[*flat[i].ParentId] != nil:
+			parent := nodes[*flat[i].ParentId]
+			parent.Children = append(parent.Children, node)
+		default:
+			continue
+		}
+		nodes[flat[i].Id] = node
+		models[node] = &flat[i]
+	}
+
+	less := threadLess(sortMode)
+	if sortMode != SortOld {
+		sortSiblings(roots, models, less)
+	}
+	for _, node := range nodes {
+		if sortMode != SortOld {
+			sortSiblings(node.Children, models, less)
+		}
+		if childLimit > 0 && len(node.Children) > childLimit {
+			node.Children = node.Children[:childLimit]
+			node.HasMoreChildren = true
+			// A cursor is only useful where there is something left to fetch.
+			node.ChildCursor = threadCursor(sortMode, models[node.Children[childLimit-1]])
 		}
-		roots = append(roots, node)
 	}
 	return roots
 }
+
+func sameID(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// encodeThreadCursor turns the path of the last comment of a page into an
+// opaque cursor.
+func encodeThreadCursor(path string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(path))
+}
+
+// decodeThreadCursor validates a cursor against the level it is used on: it
+// must decode to the path of a comment at depth, below parentPath.
+func decodeThreadCursor(cursor, parentPath string, depth int) (string, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", errors.New("invalid cursor")
+	}
+
+	path := string(raw)
+	if err := validateThreadPath(path, parentPath, depth); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// validateThreadPath checks that path is the path of a comment at depth,
+// below parentPath.
+func validateThreadPath(path, parentPath string, depth int) error {
+	if len(path) != (depth+1)*pathSegmentLength || !strings.HasPrefix(path, parentPath) {
+		return errors.New("invalid cursor")
+	}
+	for _, r := range path {
+		if (r < '0' || r > '9') && (r < 'a' || r > 'f') {
+			return errors.New("invalid cursor")
+		}
+	}
+	return nil
+}
@@ -2,8 +2,11 @@ package commentable
 
 import (
 	"context"
+	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/gofiber/fiber/v3"
 	"github.com/google/uuid"
 	"github.com/nicolasbonnici/gorest/crud"
 	"github.com/nicolasbonnici/gorest/database"
@@ -14,15 +17,34 @@ import (
 )
 
 // countingDB wraps a Database to count Query/QueryRow calls so tests can assert
-// the batch-by-depth fetch issues one query per level rather than one per node.
+// the batch-by-depth fetch issues one query per level rather than one per node,
+// and the rows those queries return.
 type countingDB struct {
 	database.Database
 	queries int
+	rows    int
 }
 
 func (c *countingDB) Query(ctx context.Context, q string, args ...interface{}) (database.Rows, error) {
 	c.queries++
-	return c.Database.Query(ctx, q, args...)
+	rows, err := c.Database.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	return &countingRows{Rows: rows, db: c}, nil
+}
+
+type countingRows struct {
+	database.Rows
+	db *countingDB
+}
+
+func (r *countingRows) Next() bool {
+	if !r.Rows.Next() {
+		return false
+	}
+	r.db.rows++
+	return true
 }
 
 func (c *countingDB) QueryRow(ctx context.Context, q string, args ...interface{}) database.Row {
@@ -33,7 +55,8 @@ func (c *countingDB) QueryRow(ctx context.Context, q string, args ...interface{}
 func setupThreadDB(t *testing.T) *countingDB {
 	t.Helper()
 
-	db, err := database.Open("sqlite", "file:"+t.TempDir()+"/thread.db")
+	// Concurrent writers wait for the lock rather than failing at once.
+	db, err := database.Open("sqlite", "file:"+t.TempDir()+"/thread.db?_pragma=busy_timeout(5000)")
 	if err != nil {
 		t.Fatalf("open sqlite: %v", err)
 	}
@@ -59,23 +82,35 @@ func setupThreadDB(t *testing.T) *countingDB {
 }
 
 // insertComment persists one comment and returns its id, chaining parents to
-// build a nesting tree of arbitrary depth.
+// build a nesting tree of arbitrary depth. Thread position columns are filled
+// the same way CommentHooks.Create does.
 func insertComment(t *testing.T, db database.Database, parentID *string, status string) string {
 	t.Helper()
-	id := uuid.New().String()
 	c := crud.New[Comment](db)
-	err := c.Create(context.Background(), Comment{
-		Id:            id,
+
+	var parent *Comment
+	if parentID != nil {
+		p, err := c.GetByID(context.Background(), *parentID)
+		if err != nil {
+			t.Fatalf("load parent: %v", err)
+		}
+		parent = p
+	}
+
+	comment := Comment{
+		Id:            uuid.New().String(),
 		CommentableId: "post-1",
 		Commentable:   "post",
 		ParentId:      parentID,
 		Content:       "c",
 		Status:        status,
-	})
-	if err != nil {
+	}
+	setThreadPosition(&comment, parent, time.Now())
+
+	if err := c.Create(context.Background(), comment); err != nil {
 		t.Fatalf("insert comment: %v", err)
 	}
-	return id
+	return comment.Id
 }
 
 func TestFetchThread_BatchesPerDepthNotPerNode(t *testing.T) {
@@ -98,15 +133,15 @@ func TestFetchThread_BatchesPerDepthNotPerNode(t *testing.T) {
 
 	c := crud.New[Comment](db)
 	db.queries = 0
-	roots, err := fetchThread(context.Background(), c, &cfg, "post", "post-1",
-		[]query.Condition{query.Eq("status", StatusPublished)})
+	page, err := fetchThread(context.Background(), c, &cfg, "post", "post-1",
+		[]query.Condition{query.Eq("status", StatusPublished)}, threadPageOptions{})
 	if err != nil {
 		t.Fatalf("fetchThread: %v", err)
 	}
+	roots := page.Items
 
-	if db.queries > cfg.MaxNestingDepth {
-		t.Errorf("expected at most %d queries (one per level), got %d for %d nodes",
-			cfg.MaxNestingDepth, db.queries, total)
+	if db.queries != 1 {
+		t.Errorf("expected a single path-ordered query, got %d for %d nodes", db.queries, total)
 	}
 
 	if got := countNodes(roots); got != total {
@@ -128,10 +163,11 @@ func TestFetchThread_RespectsMaxDepth(t *testing.T) {
 
 	c := crud.New[Comment](db)
 	db.queries = 0
-	roots, err := fetchThread(context.Background(), c, &cfg, "post", "post-1", nil)
+	page, err := fetchThread(context.Background(), c, &cfg, "post", "post-1", nil, threadPageOptions{})
 	if err != nil {
 		t.Fatalf("fetchThread: %v", err)
 	}
+	roots := page.Items
 
 	if db.queries > cfg.MaxNestingDepth {
 		t.Errorf("expected at most %d queries, got %d", cfg.MaxNestingDepth, db.queries)
@@ -150,11 +186,12 @@ func TestFetchThread_FiltersStatus(t *testing.T) {
 	insertComment(t, db, &root, StatusPublished)
 
 	c := crud.New[Comment](db)
-	roots, err := fetchThread(context.Background(), c, &cfg, "post", "post-1",
-		[]query.Condition{query.Eq("status", StatusPublished)})
+	page, err := fetchThread(context.Background(), c, &cfg, "post", "post-1",
+		[]query.Condition{query.Eq("status", StatusPublished)}, threadPageOptions{})
 	if err != nil {
 		t.Fatalf("fetchThread: %v", err)
 	}
+	roots := page.Items
 
 	if got := countNodes(roots); got != 2 {
 		t.Errorf("expected 2 published comments, got %d", got)
@@ -168,3 +205,379 @@ func countNodes(nodes []*CommentThreadDTO) int {
 	}
 	return n
 }
+
+func TestFetchThread_OrdersDepthFirst(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	first := insertComment(t, db, nil, StatusPublished)
+	time.Sleep(2 * time.Millisecond)
+	second := insertComment(t, db, nil, StatusPublished)
+	time.Sleep(2 * time.Millisecond)
+	reply := insertComment(t, db, &first, StatusPublished)
+
+	page, err := fetchThread(context.Background(), crud.New[Comment](db), &cfg, "post", "post-1", nil, threadPageOptions{})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	roots := page.Items
+
+	if len(roots) != 2 || roots[0].ID != first || roots[1].ID != second {
+		t.Fatalf("expected roots [%s %s] oldest first, got %+v", first, second, roots)
+	}
+	if len(roots[0].Children) != 1 || roots[0].Children[0].ID != reply {
+		t.Errorf("expected reply %s nested under the first root", reply)
+	}
+	if roots[0].Children[0].Depth != 1 || *roots[0].Children[0].RootID != first {
+		t.Errorf("expected reply at depth 1 under root %s, got depth %d root %v",
+			first, roots[0].Children[0].Depth, roots[0].Children[0].RootID)
+	}
+}
+
+func TestFetchThread_DropsBranchesUnderHiddenParents(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	root := insertComment(t, db, nil, StatusPublished)
+	hidden := insertComment(t, db, &root, StatusAwaiting)
+	insertComment(t, db, &hidden, StatusPublished)
+
+	page, err := fetchThread(context.Background(), crud.New[Comment](db), &cfg, "post", "post-1",
+		[]query.Condition{query.Eq("status", StatusPublished)}, threadPageOptions{})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	roots := page.Items
+
+	if got := countNodes(roots); got != 1 {
+		t.Errorf("expected only the root to be visible, got %d comments", got)
+	}
+}
+
+func TestFetchReplies_LoadsOnlyDescendants(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	root := insertComment(t, db, nil, StatusPublished)
+	branch := insertComment(t, db, &root, StatusPublished)
+	leaf := insertComment(t, db, &branch, StatusPublished)
+	insertComment(t, db, &leaf, StatusPublished)
+	insertComment(t, db, &root, StatusPublished) // sibling of branch
+	insertComment(t, db, nil, StatusPublished)   // unrelated root
+
+	c := crud.New[Comment](db)
+	parent, err := c.GetByID(context.Background(), branch)
+	if err != nil {
+		t.Fatalf("load branch: %v", err)
+	}
+
+	db.queries = 0
+	page, err := fetchReplies(context.Background(), c, &cfg, parent, nil, threadPageOptions{})
+	if err != nil {
+		t.Fatalf("fetchReplies: %v", err)
+	}
+	children := page.Items
+
+	if db.queries != 1 {
+		t.Errorf("expected a single range query, got %d", db.queries)
+	}
+	if len(children) != 1 || children[0].ID != leaf {
+		t.Fatalf("expected the leaf as only direct child, got %+v", children)
+	}
+	if got := countNodes(children); got != 2 {
+		t.Errorf("expected 2 descendants, got %d", got)
+	}
+}
+
+func TestBackfillThreadPaths(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+
+	root := insertComment(t, db, nil, StatusPublished)
+	child := insertComment(t, db, &root, StatusPublished)
+	insertComment(t, db, &child, StatusPublished)
+
+	// Simulate rows written before the path columns existed.
+	if _, err := db.Exec(ctx, `UPDATE comment SET depth = 0, root_id = NULL, path = NULL`); err != nil {
+		t.Fatalf("reset paths: %v", err)
+	}
+
+	list, err := migrations.GetMigrations().Migrations()
+	if err != nil {
+		t.Fatalf("load migrations: %v", err)
+	}
+	for _, m := range list {
+		if m.Name == "backfill_thread_path_on_comments" {
+			if err := m.ExecuteUp(ctx, db); err != nil {
+				t.Fatalf("backfill: %v", err)
+			}
+		}
+	}
+
+	page, err := fetchThread(ctx, crud.New[Comment](db), &cfg, "post", "post-1", nil, threadPageOptions{})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	roots := page.Items
+	if len(roots) != 1 || countNodes(roots) != 3 {
+		t.Fatalf("expected one root with a 3-comment chain, got %d roots / %d comments",
+			len(roots), countNodes(roots))
+	}
+	grandchild := roots[0].Children[0].Children[0]
+	if grandchild.Depth != 2 || grandchild.RootID == nil || *grandchild.RootID != root {
+		t.Errorf("expected grandchild at depth 2 under root %s, got depth %d root %v",
+			root, grandchild.Depth, grandchild.RootID)
+	}
+}
+
+func TestCommentHooks_CreatePathMatchesCreatedAt(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	ctx := context.Background()
+
+	app := fiber.New()
+	app.Post("/", func(fc fiber.Ctx) error {
+		var model Comment
+		dto := CommentCreateDTO{Commentable: "post", CommentableId: "post-1", Content: "hello"}
+		if err := hooks.Create(fc, dto, &model); err != nil {
+			return err
+		}
+		// Stored a little later, as under load.
+		time.Sleep(5 * time.Millisecond)
+		if err := hooks.SaveCreate(ctx, &model); err != nil {
+			return err
+		}
+		return fc.SendStatus(201)
+	})
+	resp, err := app.Test(httptest.NewRequest("POST", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+
+	// The backfill derives the paths from created_at, so new comments must
+	// get the same ones.
+	comments, err := crud.New[Comment](db).GetAll(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, comment := range comments {
+		if comment.Path == nil || comment.CreatedAt == nil {
+			t.Fatalf("expected a path and created_at, got %+v", comment)
+		}
+		if want := pathSegment(comment.Id, *comment.CreatedAt); *comment.Path != want {
+			t.Errorf("expected the path to derive from created_at %v, got %s want %s", *comment.CreatedAt, *comment.Path, want)
+		}
+	}
+}
+
+func TestFetchThread_PaginatesRoots(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+	c := crud.New[Comment](db)
+
+	var roots []string
+	for i := 0; i < 5; i++ {
+		id := insertComment(t, db, nil, StatusPublished)
+		insertComment(t, db, &id, StatusPublished)
+		roots = append(roots, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	var seen []string
+	opts := threadPageOptions{Limit: 2}
+	for pages := 0; pages < 5; pages++ {
+		db.queries = 0
+		page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, opts)
+		if err != nil {
+			t.Fatalf("fetchThread: %v", err)
+		}
+		if db.queries > 2 {
+			t.Errorf("expected at most 2 queries per page, got %d", db.queries)
+		}
+		for _, root := range page.Items {
+			if len(root.Children) != 1 {
+				t.Errorf("expected root %s to come with its reply", root.ID)
+			}
+			seen = append(seen, root.ID)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		after, err := decodeThreadCursor(page.NextCursor, "", 0)
+		if err != nil {
+			t.Fatalf("decode cursor: %v", err)
+		}
+		opts.After = after
+	}
+
+	if len(seen) != len(roots) {
+		t.Fatalf("expected %d roots across pages, got %d", len(roots), len(seen))
+	}
+	for i := range roots {
+		if seen[i] != roots[i] {
+			t.Errorf("page order mismatch at %d: want %s, got %s", i, roots[i], seen[i])
+		}
+	}
+}
+
+func TestThreadRoute_LoadsRepliesInOneRangeScan(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+
+	var parent *string
+	for depth := 0; depth < 4; depth++ {
+		id := insertComment(t, db, parent, StatusPublished)
+		insertComment(t, db, parent, StatusPublished)
+		parent = &id
+	}
+
+	app := fiber.New()
+	RegisterCommentRoutes(app, db, &cfg)
+	get := func(path string) {
+		t.Helper()
+		resp, err := app.Test(httptest.NewRequest("GET", path, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 {
+			t.Fatalf("expected 200, got %d", resp.StatusCode)
+		}
+	}
+
+	// Without a childLimit the level and the replies are two queries,
+	// however deep the thread.
+	db.queries = 0
+	get("/comments/thread?commentable=post&commentableId=post-1")
+	if db.queries != 2 {
+		t.Errorf("expected 2 queries without a childLimit, got %d", db.queries)
+	}
+
+	db.queries = 0
+	get("/comments/thread?commentable=post&commentableId=post-1&childLimit=1")
+	if db.queries <= 2 {
+		t.Errorf("expected the replies to be paged level by level with a childLimit, got %d queries", db.queries)
+	}
+}
+
+func TestFetchThread_ChildLimitAndContinuation(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+	c := crud.New[Comment](db)
+
+	root := insertComment(t, db, nil, StatusPublished)
+	var replies []string
+	for i := 0; i < 5; i++ {
+		id := insertComment(t, db, &root, StatusPublished)
+		insertComment(t, db, &id, StatusPublished)
+		replies = append(replies, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, threadPageOptions{Limit: 10, ChildLimit: 2})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	node := page.Items[0]
+	if len(node.Children) != 2 || !node.HasMoreChildren || node.ChildCursor == "" {
+		t.Fatalf("expected 2 replies with a continuation, got %d (more=%v cursor=%q)",
+			len(node.Children), node.HasMoreChildren, node.ChildCursor)
+	}
+	if node.Children[0].HasMoreChildren || node.Children[0].ChildCursor != "" {
+		t.Errorf("expected no continuation on a reply with a single child")
+	}
+
+	parent, err := c.GetByID(ctx, root)
+	if err != nil {
+		t.Fatalf("load root: %v", err)
+	}
+	after, err := decodeThreadCursor(node.ChildCursor, *parent.Path, parent.Depth+1)
+	if err != nil {
+		t.Fatalf("decode child cursor: %v", err)
+	}
+
+	next, err := fetchReplies(ctx, c, &cfg, parent, nil, threadPageOptions{Limit: 2, ChildLimit: 2, After: after})
+	if err != nil {
+		t.Fatalf("fetchReplies: %v", err)
+	}
+	if len(next.Items) != 2 || next.Items[0].ID != replies[2] || next.Items[1].ID != replies[3] {
+		t.Fatalf("expected replies %v, got %+v", replies[2:4], next.Items)
+	}
+	if len(next.Items[0].Children) != 1 {
+		t.Errorf("expected continued replies to carry their own children")
+	}
+	if next.NextCursor == "" {
+		t.Errorf("expected a cursor for the last remaining reply")
+	}
+}
+
+func TestFetchThread_ChildLimitBoundsRowsRead(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+	c := crud.New[Comment](db)
+
+	root := insertComment(t, db, nil, StatusPublished)
+	for i := 0; i < 40; i++ {
+		id := insertComment(t, db, &root, StatusPublished)
+		insertComment(t, db, &id, StatusPublished)
+	}
+
+	db.queries, db.rows = 0, 0
+	page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, threadPageOptions{Limit: 10, ChildLimit: 2})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	node := page.Items[0]
+	if len(node.Children) != 2 || !node.HasMoreChildren {
+		t.Fatalf("expected 2 replies with a continuation, got %d (more=%v)", len(node.Children), node.HasMoreChildren)
+	}
+	for _, child := range node.Children {
+		if len(child.Children) != 1 {
+			t.Errorf("expected reply %s to come with its own reply", child.ID)
+		}
+	}
+
+	// The root, then ids and rows of its first 3 replies, then ids and rows
+	// of the replies to the 2 shown, then the empty level below them:
+	// 1 + 2*3 + 2*2 rows over 6 queries.
+	if db.rows != 11 || db.queries != 6 {
+		t.Errorf("expected 11 rows over 6 queries, got %d rows over %d queries", db.rows, db.queries)
+	}
+}
+
+func TestDecodeThreadCursor_RejectsForeignCursors(t *testing.T) {
+	rootPath := pathSegment(uuid.New().String(), time.Now())
+	childPath := rootPath + pathSegment(uuid.New().String(), time.Now())
+	otherRoot := pathSegment(uuid.New().String(), time.Now())
+
+	tests := []struct {
+		name       string
+		cursor     string
+		parentPath string
+		depth      int
+		wantErr    bool
+	}{
+		{"root cursor on root level", encodeThreadCursor(rootPath), "", 0, false},
+		{"child cursor on its parent", encodeThreadCursor(childPath), rootPath, 1, false},
+		{"root cursor on a reply level", encodeThreadCursor(rootPath), rootPath, 1, true},
+		{"child cursor under another parent", encodeThreadCursor(childPath), otherRoot, 1, true},
+		{"not base64", "%%%", "", 0, true},
+		{"not a path", encodeThreadCursor("' OR 1=1 --"), "", 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeThreadCursor(tt.cursor, tt.parentPath, tt.depth)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeThreadCursor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package commentable
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/nicolasbonnici/gorest/query"
+)
+
+// Vote values accepted by POST /comments/:id/vote.
+const (
+	VoteUp   = 1
+	VoteDown = -1
+)
+
+// voteCounts are the denormalized vote counters of a comment.
+type voteCounts struct {
+	Upvotes   int
+	Downvotes int
+}
+
+// voteDelta is the change to the counters when one vote goes from one value to
+// another, where 0 means no vote.
+func voteDelta(from, to int) voteCounts {
+	var d voteCounts
+	switch from {
+	case VoteUp:
+		d.Upvotes--
+	case VoteDown:
+		d.Downvotes--
+	}
+	switch to {
+	case VoteUp:
+		d.Upvotes++
+	case VoteDown:
+		d.Downvotes++
+	}
+	return d
+}
+
+// Vote sets userID's vote on commentID to value, or withdraws it when value
+// is 0, and returns the comment's counters afterwards. The vote row and the
+// counters are written in one transaction, which locks the comment's row
+// before reading the previous vote: concurrent votes on the same comment
+// serialize on it, so each applies its delta to the vote the one before it
+// left. Subscribers are told once the vote actually changed.
+func (h *CommentHooks) Vote(ctx context.Context, commentID, userID string, value int) (*CommentVoteResultDTO, error) {
+	tx, err := h.db.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	counts, previous, err := h.vote(ctx, tx, commentID, userID, value)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	if previous != value {
+		h.events.publishVoted(ctx, CommentVotedEvent{
+			CommentID: commentID,
+			UserID:    userID,
+			Value:     value,
+			Previous:  previous,
+			Score:     counts.Upvotes - counts.Downvotes,
+			Upvotes:   counts.Upvotes,
+			Downvotes: counts.Downvotes,
+		})
+	}
+	return &CommentVoteResultDTO{
+		Score:     counts.Upvotes - counts.Downvotes,
+		Upvotes:   counts.Upvotes,
+		Downvotes: counts.Downvotes,
+		Vote:      value,
+	}, nil
+}
+
+func (h *CommentHooks) vote(ctx context.Context, q sqlExecutor, commentID, userID string, value int) (voteCounts, int, error) {
+	builder := query.New(h.db.Dialect())
+	byUser := query.And(query.Eq("comment_id", commentID), query.Eq("user_id", userID))
+
+	// Writing the comment's row locks it until the transaction ends, on
+	// every dialect, so the previous vote read below is the latest one.
+	dialect := h.db.Dialect()
+	stmt := fmt.Sprintf("UPDATE comment SET upvotes = upvotes WHERE id = %s", dialect.Placeholder(1))
+	if _, err := q.Exec(ctx, stmt, commentID); err != nil {
+		return voteCounts{}, 0, err
+	}
+
+	stmt, args, err := builder.Select("value").From("comment_vote").Where(byUser).Build()
+	if err != nil {
+		return voteCounts{}, 0, err
+	}
+	var previous int
+	if _, err := scanFirst(ctx, q, stmt, args, &previous); err != nil {
+		return voteCounts{}, 0, err
+	}
+
+	now := time.Now().UTC()
+	switch {
+	case previous == value:
+		counts, err := h.voteCounts(ctx, q, commentID)
+		return counts, previous, err
+	case value == 0:
+		stmt, args, err = builder.Delete("comment_vote").Where(byUser).Build()
+	case previous == 0:
+		stmt, args, err = builder.Insert("comment_vote").
+			Columns("id", "comment_id", "user_id", "value", "created_at").
+			Values(uuid.New().String(), commentID, userID, value, now).
+			Build()
+	default:
+		stmt, args, err = builder.Update("comment_vote").
+			Set("value", value).
+			Set("updated_at", now).
+			Where(byUser).
+			Build()
+	}
+	if err != nil {
+		return voteCounts{}, 0, err
+	}
+	if _, err := q.Exec(ctx, stmt, args...); err != nil {
+		return voteCounts{}, 0, err
+	}
+
+	// The update builder only binds values, so the increment is written by
+	// hand.
+	d := voteDelta(previous, value)
+	stmt = fmt.Sprintf(
+		"UPDATE comment SET upvotes = upvotes + %s, downvotes = downvotes + %s, score = score + %s WHERE id = %s",
+		dialect.Placeholder(1), dialect.Placeholder(2), dialect.Placeholder(3), dialect.Placeholder(4),
+	)
+	if _, err := q.Exec(ctx, stmt, d.Upvotes, d.Downvotes, d.Upvotes-d.Downvotes, commentID); err != nil {
+		return voteCounts{}, 0, err
+	}
+
+	counts, err := h.voteCounts(ctx, q, commentID)
+	if err != nil {
+		return voteCounts{}, 0, err
+	}
+
+	stmt, args, err = builder.Update("comment").
+		Set("wilson_score", wilsonScore(counts.Upvotes, counts.Downvotes)).
+		Set("controversy_score", controversyScore(counts.Upvotes, counts.Downvotes)).
+		Where(query.Eq("id", commentID)).
+		Build()
+	if err != nil {
+		return voteCounts{}, 0, err
+	}
+	_, err = q.Exec(ctx, stmt, args...)
+	return counts, previous, err
+}
+
+func (h *CommentHooks) voteCounts(ctx context.Context, q sqlExecutor, commentID string) (voteCounts, error) {
+	stmt, args, err := query.New(h.db.Dialect()).
+		Select("upvotes", "downvotes").
+		From("comment").
+		Where(query.Eq("id", commentID)).
+		Build()
+	if err != nil {
+		return voteCounts{}, err
+	}
+
+	var counts voteCounts
+	_, err = scanFirst(ctx, q, stmt, args, &counts.Upvotes, &counts.Downvotes)
+	return counts, err
+}
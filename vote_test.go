@@ -0,0 +1,271 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+// setVotes sets the denormalized counters of a comment as if up and down
+// votes had been cast.
+func setVotes(t *testing.T, db database.Database, id string, up, down int) {
+	t.Helper()
+	stmt, args, err := query.New(db.Dialect()).Update("comment").
+		Set("upvotes", up).
+		Set("downvotes", down).
+		Set("score", up-down).
+		Set("wilson_score", wilsonScore(up, down)).
+		Set("controversy_score", controversyScore(up, down)).
+		Where(query.Eq("id", id)).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(context.Background(), stmt, args...); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRankingScores(t *testing.T) {
+	if wilsonScore(0, 0) != 0 || controversyScore(3, 0) != 0 {
+		t.Errorf("expected comments without votes on both sides to score 0")
+	}
+	if got := wilsonScore(1, 0); math.Abs(got-0.2065) > 0.001 {
+		t.Errorf("expected wilson(1, 0) ≈ 0.2065, got %f", got)
+	}
+	if wilsonScore(1, 0) >= wilsonScore(40, 5) {
+		t.Errorf("expected many mostly positive votes to beat a single upvote")
+	}
+	if controversyScore(10, 10) <= controversyScore(19, 1) || controversyScore(10, 10) <= controversyScore(3, 3) {
+		t.Errorf("expected evenly split, heavily voted comments to be the most controversial")
+	}
+}
+
+func TestCommentVotes(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	for _, id := range []string{"author", "voter-1", "voter-2"} {
+		if _, err := db.Exec(ctx, `INSERT INTO users (id) VALUES (?)`, id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := DefaultConfig()
+
+	id := insertComment(t, db, nil, StatusPublished)
+	if _, err := db.Exec(ctx, `UPDATE comment SET user_id = 'author' WHERE id = ?`, id); err != nil {
+		t.Fatal(err)
+	}
+
+	vote := func(userID, method string, value int) *httpResult {
+		t.Helper()
+		app := fiber.New()
+		app.Use(func(fc fiber.Ctx) error {
+			fc.Locals("user_id", userID)
+			fc.SetContext(rbac.WithRoles(context.Background(), []string{"reader"}))
+			return fc.Next()
+		})
+		RegisterCommentRoutes(app, db, &cfg)
+
+		payload, _ := json.Marshal(CommentVoteDTO{Value: value})
+		req := httptest.NewRequest(method, "/comments/"+id+"/vote", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := &httpResult{status: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(&result.body)
+		return result
+	}
+	expect := func(result *httpResult, score, up, down, own float64) {
+		t.Helper()
+		if result.status != 200 {
+			t.Fatalf("expected 200, got %d", result.status)
+		}
+		want := map[string]any{"score": score, "upvotes": up, "downvotes": down, "vote": own}
+		for key, value := range want {
+			if result.body[key] != value {
+				t.Errorf("expected %s=%v, got %v", key, value, result.body)
+			}
+		}
+	}
+
+	expect(vote("voter-1", "POST", VoteUp), 1, 1, 0, 1)
+	expect(vote("voter-1", "POST", VoteUp), 1, 1, 0, 1)
+	expect(vote("voter-2", "POST", VoteDown), 0, 1, 1, -1)
+	expect(vote("voter-2", "POST", VoteUp), 2, 2, 0, 1)
+	expect(vote("voter-1", "DELETE", 0), 1, 1, 0, 0)
+	expect(vote("voter-1", "DELETE", 0), 1, 1, 0, 0)
+
+	if result := vote("author", "POST", VoteUp); result.status != 403 {
+		t.Errorf("expected 403 when voting on one's own comment, got %d", result.status)
+	}
+	if result := vote("voter-1", "POST", 2); result.status != 400 {
+		t.Errorf("expected 400 for an invalid vote value, got %d", result.status)
+	}
+
+	comment, err := crud.New[Comment](db).GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.Score != 1 || comment.Upvotes != 1 || comment.Downvotes != 0 || comment.WilsonScore != wilsonScore(1, 0) {
+		t.Errorf("unexpected stored counters %+v", comment)
+	}
+}
+
+func TestCommentVotes_Concurrent(t *testing.T) {
+	db := setupThreadDB(t).Database
+	cfg := DefaultConfig()
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	ctx := context.Background()
+	id := insertComment(t, db, nil, StatusPublished)
+
+	// The same user changing their vote and several users voting for the
+	// first time, all at once.
+	values := []int{VoteUp, VoteDown, 0, VoteUp, VoteDown, VoteUp}
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*len(values))
+	for i, value := range values {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := hooks.Vote(ctx, id, "voter-1", value)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := hooks.Vote(ctx, id, fmt.Sprintf("voter-%d", i+2), VoteUp)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("expected every vote to succeed, got %v", err)
+		}
+	}
+
+	var up, down int
+	if err := db.QueryRow(ctx, `SELECT
+		COALESCE(SUM(CASE WHEN value = 1 THEN 1 ELSE 0 END), 0),
+		COALESCE(SUM(CASE WHEN value = -1 THEN 1 ELSE 0 END), 0)
+		FROM comment_vote WHERE comment_id = ?`, id).Scan(&up, &down); err != nil {
+		t.Fatal(err)
+	}
+	comment, err := crud.New[Comment](db).GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comment.Upvotes != up || comment.Downvotes != down || comment.Score != up-down {
+		t.Errorf("expected the counters to match the %d/%d votes cast, got %d/%d (score %d)",
+			up, down, comment.Upvotes, comment.Downvotes, comment.Score)
+	}
+}
+
+func TestFetchThread_SortsByScore(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	ctx := context.Background()
+	c := crud.New[Comment](db)
+
+	// Roots ranked by score: b (5), d (3), a and c tied at 1 (oldest first).
+	scores := map[string]int{}
+	var roots []string
+	for _, score := range []int{1, 5, 1, 3} {
+		id := insertComment(t, db, nil, StatusPublished)
+		setVotes(t, db, id, score, 0)
+		scores[id] = score
+		roots = append(roots, id)
+		time.Sleep(2 * time.Millisecond)
+	}
+	low := insertComment(t, db, &roots[1], StatusPublished)
+	high := insertComment(t, db, &roots[1], StatusPublished)
+	setVotes(t, db, high, 2, 0)
+
+	want := []string{roots[1], roots[3], roots[0], roots[2]}
+	var seen []string
+	opts := threadPageOptions{Sort: SortTop, Limit: 3}
+	for pages := 0; pages < 4; pages++ {
+		page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, opts)
+		if err != nil {
+			t.Fatalf("fetchThread: %v", err)
+		}
+		for _, root := range page.Items {
+			seen = append(seen, root.ID)
+			if root.ID == roots[1] {
+				if len(root.Children) != 2 || root.Children[0].ID != high || root.Children[1].ID != low {
+					t.Errorf("expected replies sorted by score, got %+v", root.Children)
+				}
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		opts.After, opts.AfterKey, err = decodeRankedCursor(page.NextCursor, "", 0)
+		if err != nil {
+			t.Fatalf("decode cursor: %v", err)
+		}
+	}
+
+	if len(seen) != len(want) {
+		t.Fatalf("expected %d roots across pages, got %v", len(want), seen)
+	}
+	for i := range want {
+		if seen[i] != want[i] {
+			t.Errorf("rank %d: want score %d, got score %d", i, scores[want[i]], scores[seen[i]])
+		}
+	}
+
+	page, err := fetchThread(ctx, c, &cfg, "post", "post-1", nil, threadPageOptions{Sort: SortNew, Limit: 1})
+	if err != nil {
+		t.Fatalf("fetchThread: %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].ID != roots[3] {
+		t.Errorf("expected the newest root first, got %+v", page.Items)
+	}
+}
+
+func TestCommentList_Sort(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	app := newModerationApp(t, db, &cfg, "reader")
+
+	first := insertComment(t, db, nil, StatusPublished)
+	second := insertComment(t, db, nil, StatusPublished)
+	setVotes(t, db, second, 1, 0)
+
+	resp, err := app.Test(httptest.NewRequest("GET", "/comments?sort=top", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body struct {
+		Data []CommentResponseDTO `json:"hydra:member"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Data) != 2 || body.Data[0].ID != second || body.Data[1].ID != first {
+		t.Errorf("expected the upvoted comment first, got %+v", body.Data)
+	}
+
+	resp, err = app.Test(httptest.NewRequest("GET", "/comments?sort=hot", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 400 {
+		t.Errorf("expected 400 for an unknown sort, got %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,493 @@
+package commentable
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	auth "github.com/nicolasbonnici/gorest/auth"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+// Comment lifecycle events webhooks can subscribe to.
+const (
+	WebhookCommentCreated   = "comment.created"
+	WebhookCommentUpdated   = "comment.updated"
+	WebhookCommentPublished = "comment.published"
+	WebhookCommentModerated = "comment.moderated"
+	WebhookCommentDeleted   = "comment.deleted"
+)
+
+var ValidWebhookEvents = []string{
+	WebhookCommentCreated,
+	WebhookCommentUpdated,
+	WebhookCommentPublished,
+	WebhookCommentModerated,
+	WebhookCommentDeleted,
+}
+
+// Delivery states of comment_webhook_delivery.
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliveryDelivered = "delivered"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Headers set on every webhook request. The signature is the hex encoded
+// HMAC-SHA256 of the raw body keyed with the endpoint's secret, prefixed with
+// "sha256=".
+const (
+	WebhookEventHeader     = "X-Comment-Event"
+	WebhookDeliveryHeader  = "X-Comment-Delivery"
+	WebhookSignatureHeader = "X-Comment-Signature"
+)
+
+// WebhookConfig is an endpoint notified of comment events. An empty Events
+// list subscribes it to all of them.
+type WebhookConfig struct {
+	URL    string   `json:"url" yaml:"url"`
+	Secret string   `json:"secret" yaml:"secret"`
+	Events []string `json:"events" yaml:"events"`
+}
+
+// Subscribes reports whether the endpoint wants event.
+func (w WebhookConfig) Subscribes(event string) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookPayload is the JSON body POSTed to endpoints. ID identifies the
+// event and is the same for every endpoint notified of it.
+type WebhookPayload struct {
+	ID         string             `json:"id"`
+	Event      string             `json:"event"`
+	OccurredAt time.Time          `json:"occurredAt"`
+	Comment    CommentResponseDTO `json:"comment"`
+}
+
+// WebhookDelivery is one queued POST of an event to an endpoint.
+type WebhookDelivery struct {
+	Id             string     `json:"id" db:"id"`
+	EventId        string     `json:"eventId" db:"event_id"`
+	Event          string     `json:"event" db:"event"`
+	CommentId      string     `json:"commentId" db:"comment_id"`
+	Url            string     `json:"url" db:"url"`
+	Payload        string     `json:"payload" db:"payload"`
+	Status         string     `json:"status" db:"status"`
+	Attempts       int        `json:"attempts" db:"attempts"`
+	NextAttemptAt  *time.Time `json:"nextAttemptAt,omitempty" db:"next_attempt_at"`
+	LastStatusCode *int       `json:"lastStatusCode,omitempty" db:"last_status_code"`
+	LastError      *string    `json:"lastError,omitempty" db:"last_error"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty" db:"delivered_at"`
+	UpdatedAt      *time.Time `json:"updatedAt,omitempty" db:"updated_at"`
+	CreatedAt      *time.Time `json:"createdAt,omitempty" db:"created_at"`
+}
+
+func (WebhookDelivery) TableName() string {
+	return "comment_webhook_delivery"
+}
+
+const (
+	// webhookPollInterval is how often due retries are looked for when no
+	// new event wakes the dispatcher up.
+	webhookPollInterval = 15 * time.Second
+	webhookBatchSize    = 50
+	webhookBaseBackoff  = 30 * time.Second
+	webhookMaxBackoff   = 6 * time.Hour
+	webhookMaxErrorSize = 500
+	// webhookPruneInterval is how often finished deliveries past their
+	// retention are deleted.
+	webhookPruneInterval = time.Hour
+)
+
+// webhookBackoff is the delay before retrying a delivery that failed for the
+// attempts-th time: 30s, doubling up to 6h.
+func webhookBackoff(attempts int) time.Duration {
+	delay := webhookBaseBackoff
+	for i := 1; i < attempts && delay < webhookMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, webhookMaxBackoff)
+}
+
+// signWebhook returns the signature header value of body for secret.
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookDispatcher queues comment events in comment_webhook_delivery, in the
+// transaction of the change that caused them, and POSTs them from a
+// background worker. Failed deliveries are retried with exponential backoff
+// until Config.WebhookMaxAttempts is reached. Deliveries are claimed before
+// being sent, so several instances can share the queue.
+type webhookDispatcher struct {
+	db          database.Database
+	voter       rbac.Voter
+	endpoints   map[string]WebhookConfig
+	client      *http.Client
+	timeout     time.Duration
+	maxAttempts int
+	retention   time.Duration
+	// drafts is set when drafts are encrypted at rest: their payloads leave
+	// their content out.
+	drafts bool
+	wake   chan struct{}
+}
+
+// newWebhookDispatcher returns nil when no webhook is configured. The worker
+// is not started; see run.
+func newWebhookDispatcher(db database.Database, cfg *Config, voter rbac.Voter) *webhookDispatcher {
+	if len(cfg.Webhooks) == 0 || db == nil {
+		return nil
+	}
+
+	d := &webhookDispatcher{
+		db:          db,
+		voter:       voter,
+		endpoints:   make(map[string]WebhookConfig, len(cfg.Webhooks)),
+		timeout:     time.Duration(cfg.WebhookTimeoutSeconds) * time.Second,
+		maxAttempts: cfg.WebhookMaxAttempts,
+		retention:   time.Duration(cfg.WebhookRetentionDays) * 24 * time.Hour,
+		drafts:      cfg.EncryptDrafts,
+		wake:        make(chan struct{}, 1),
+	}
+	d.client = &http.Client{Timeout: d.timeout}
+	for _, endpoint := range cfg.Webhooks {
+		d.endpoints[endpoint.URL] = endpoint
+	}
+	return d
+}
+
+// enqueue queues event for every endpoint subscribed to it. The payload is
+// the public view of the comment, filtered as for a reader without any role
+// whoever caused the event: moderator-only fields such as the author's IP
+// address or the moderation reason are left out. The payloads of drafts
+// encrypted at rest leave their content out too, as they are stored in clear.
+func (d *webhookDispatcher) enqueue(ctx context.Context, q sqlExecutor, event string, comment Comment) error {
+	if d == nil {
+		return nil
+	}
+
+	if err := filterComment(context.Background(), d.voter, &comment); err != nil {
+		return err
+	}
+	if d.drafts && comment.Status == StatusDraft {
+		comment.Content, comment.ContentHtml, comment.Mentions = "", nil, nil
+	}
+	dto := (&CommentConverter{}).ModelToResponseDTO(comment)
+	eventID := uuid.New().String()
+	now := time.Now().UTC()
+	body, err := json.Marshal(WebhookPayload{
+		ID:         eventID,
+		Event:      event,
+		OccurredAt: now,
+		Comment:    dto,
+	})
+	if err != nil {
+		return err
+	}
+
+	builder := query.New(d.db.Dialect())
+	for url, endpoint := range d.endpoints {
+		if !endpoint.Subscribes(event) {
+			continue
+		}
+		stmt, args, err := builder.Insert("comment_webhook_delivery").
+			Columns("id", "event_id", "event", "comment_id", "url", "payload", "status", "attempts", "next_attempt_at", "created_at").
+			Values(uuid.New().String(), eventID, event, comment.Id, url, string(body), WebhookDeliveryPending, 0, now, now).
+			Build()
+		if err != nil {
+			return err
+		}
+		if _, err := q.Exec(ctx, stmt, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchWebhookDeliveries loads one page of the delivery log matching conds,
+// most recent first, and whether more follow.
+func fetchWebhookDeliveries(ctx context.Context, db database.Database, conds []query.Condition, limit, offset int) ([]WebhookDelivery, bool, error) {
+	res, err := crud.New[WebhookDelivery](db).GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      limit + 1,
+		Offset:     offset,
+		Conditions: conds,
+		OrderBy: []crud.OrderByClause{
+			{Column: "created_at", Direction: query.DESC},
+			{Column: "id", Direction: query.DESC},
+		},
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	if len(res.Items) > limit {
+		return res.Items[:limit], true, nil
+	}
+	return res.Items, false, nil
+}
+
+// statusWebhookEvent is the event of a comment moving to status.
+func statusWebhookEvent(status string) string {
+	switch status {
+	case StatusPublished:
+		return WebhookCommentPublished
+	case StatusModerated:
+		return WebhookCommentModerated
+	default:
+		return WebhookCommentUpdated
+	}
+}
+
+// eventComments loads the comments of ids that a transaction is about to
+// change, so their webhook payloads can be built inside it and their previous
+// state passed to event subscribers. It loads nothing when neither needs it.
+func (h *CommentHooks) eventComments(ctx context.Context, ids []string) (map[string]Comment, error) {
+	if (h.webhooks == nil && !h.events.observes()) || len(ids) == 0 {
+		return nil, nil
+	}
+
+	values := make([]any, len(ids))
+	for i, id := range ids {
+		values[i] = id
+	}
+	res, err := storedComments(h.db, h.cipher).GetAllPaginated(ctx, crud.PaginationOptions{
+		Limit:      len(ids),
+		Conditions: []query.Condition{query.In("id", values...)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]Comment, len(res.Items))
+	for _, comment := range res.Items {
+		byID[comment.Id] = comment
+	}
+	return byID, nil
+}
+
+// deletedComment is comment as removed by user, for the payload of
+// comment.deleted: a tombstone whose content is no longer exposed.
+func deletedComment(comment Comment, user *auth.AuthenticatedUser) Comment {
+	now := time.Now().UTC()
+	comment.DeletedAt = &now
+	comment.UpdatedAt = &now
+	if user != nil {
+		comment.DeletedBy = &user.UserID
+	}
+	return comment
+}
+
+// notify wakes the worker up once newly queued deliveries are committed.
+func (d *webhookDispatcher) notify() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the worker loop, until ctx is cancelled. It starts with a pass over
+// the queue, so deliveries left pending by a previous run are retried without
+// waiting for a new event, then delivers whenever woken up or polled.
+func (d *webhookDispatcher) run(ctx context.Context) {
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	var pruned time.Time
+	for {
+		for ctx.Err() == nil {
+			n, err := d.deliverDue(ctx, time.Now().UTC())
+			if err != nil || n < webhookBatchSize {
+				break
+			}
+		}
+		if now := time.Now().UTC(); d.retention > 0 && now.Sub(pruned) >= webhookPruneInterval {
+			// A failed pass is retried at the next interval.
+			_ = d.prune(ctx, now)
+			pruned = now
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune deletes the delivered and failed deliveries whose last attempt is
+// older than the retention period, along with the payloads they hold.
+func (d *webhookDispatcher) prune(ctx context.Context, now time.Time) error {
+	stmt, args, err := query.New(d.db.Dialect()).
+		Delete("comment_webhook_delivery").
+		Where(query.And(
+			query.In("status", WebhookDeliveryDelivered, WebhookDeliveryFailed),
+			query.Lt("updated_at", now.Add(-d.retention)),
+		)).
+		Build()
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(ctx, stmt, args...)
+	return err
+}
+
+// deliverDue sends the pending deliveries due at now and returns how many it
+// looked at.
+func (d *webhookDispatcher) deliverDue(ctx context.Context, now time.Time) (int, error) {
+	stmt, args, err := query.New(d.db.Dialect()).
+		Select("id", "url", "event", "payload", "attempts").
+		From("comment_webhook_delivery").
+		Where(query.And(
+			query.Eq("status", WebhookDeliveryPending),
+			query.Lte("next_attempt_at", now),
+		)).
+		OrderBy("next_attempt_at", query.ASC).
+		Limit(webhookBatchSize).
+		Build()
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := d.db.Query(ctx, stmt, args...)
+	if err != nil {
+		return 0, err
+	}
+	var due []WebhookDelivery
+	for rows.Next() {
+		var delivery WebhookDelivery
+		if err := rows.Scan(&delivery.Id, &delivery.Url, &delivery.Event, &delivery.Payload, &delivery.Attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, delivery)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range due {
+		if err := d.deliver(ctx, &due[i], now); err != nil {
+			return len(due), err
+		}
+	}
+	return len(due), nil
+}
+
+// deliver claims a due delivery, POSTs it and records the outcome. A
+// delivery claimed by another instance in the meantime is skipped.
+func (d *webhookDispatcher) deliver(ctx context.Context, delivery *WebhookDelivery, now time.Time) error {
+	builder := query.New(d.db.Dialect())
+
+	// Claiming counts the attempt and pushes the retry past the request
+	// timeout, so a crash mid-request still leads to a retry.
+	attempts := delivery.Attempts + 1
+	stmt, args, err := builder.Update("comment_webhook_delivery").
+		Set("attempts", attempts).
+		Set("next_attempt_at", now.Add(d.timeout+webhookBackoff(attempts))).
+		Set("updated_at", now).
+		Where(query.And(
+			query.Eq("id", delivery.Id),
+			query.Eq("status", WebhookDeliveryPending),
+			query.Eq("attempts", delivery.Attempts),
+		)).
+		Build()
+	if err != nil {
+		return err
+	}
+	res, err := d.db.Exec(ctx, stmt, args...)
+	if err != nil {
+		return err
+	}
+	if claimed, err := res.RowsAffected(); err != nil || claimed == 0 {
+		return err
+	}
+
+	statusCode, sendErr := d.send(ctx, delivery)
+
+	done := time.Now().UTC()
+	b := builder.Update("comment_webhook_delivery").
+		Set("updated_at", done)
+	if statusCode != 0 {
+		b = b.Set("last_status_code", statusCode)
+	}
+	switch {
+	case sendErr == nil:
+		b = b.Set("status", WebhookDeliveryDelivered).
+			Set("delivered_at", done).
+			Set("last_error", nil)
+	default:
+		message := sendErr.Error()
+		if len(message) > webhookMaxErrorSize {
+			message = message[:webhookMaxErrorSize]
+		}
+		b = b.Set("last_error", message)
+		if attempts >= d.maxAttempts {
+			b = b.Set("status", WebhookDeliveryFailed)
+		} else {
+			b = b.Set("next_attempt_at", done.Add(webhookBackoff(attempts)))
+		}
+	}
+	stmt, args, err = b.Where(query.Eq("id", delivery.Id)).Build()
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(ctx, stmt, args...)
+	return err
+}
+
+// send POSTs a delivery and returns the response status, with an error
+// unless it is a 2xx.
+func (d *webhookDispatcher) send(ctx context.Context, delivery *WebhookDelivery) (int, error) {
+	endpoint, ok := d.endpoints[delivery.Url]
+	if !ok {
+		return 0, fmt.Errorf("endpoint no longer configured")
+	}
+
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gorest-commentable-webhooks")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.Id)
+	req.Header.Set(WebhookSignatureHeader, signWebhook(endpoint.Secret, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("endpoint responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,464 @@
+package commentable
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v3"
+	"github.com/nicolasbonnici/gorest/crud"
+	"github.com/nicolasbonnici/gorest/database"
+	"github.com/nicolasbonnici/gorest/query"
+	rbac "github.com/nicolasbonnici/gorest/rbac"
+)
+
+type webhookRequest struct {
+	event     string
+	signature string
+	body      []byte
+}
+
+// newWebhookReceiver records the requests it gets and responds with the
+// status returned by respond for the n-th of them, counting from 1.
+func newWebhookReceiver(t *testing.T, respond func(n int) int) (*httptest.Server, chan webhookRequest) {
+	t.Helper()
+	received := make(chan webhookRequest, 16)
+	var n atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- webhookRequest{
+			event:     r.Header.Get(WebhookEventHeader),
+			signature: r.Header.Get(WebhookSignatureHeader),
+			body:      body,
+		}
+		w.WriteHeader(respond(int(n.Add(1))))
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func loadDeliveries(t *testing.T, db database.Database, conds ...query.Condition) []WebhookDelivery {
+	t.Helper()
+	res, err := crud.New[WebhookDelivery](db).GetAllPaginated(context.Background(), crud.PaginationOptions{
+		Limit:      100,
+		Conditions: conds,
+		OrderBy:    []crud.OrderByClause{{Column: "created_at", Direction: query.ASC}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res.Items
+}
+
+func TestWebhookLifecycleEvents(t *testing.T) {
+	// The worker reads concurrently, which the query counts are not safe
+	// for.
+	db := setupThreadDB(t).Database
+	srv, received := newWebhookReceiver(t, func(int) int { return http.StatusNoContent })
+
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.Webhooks = []WebhookConfig{{
+		URL:    srv.URL,
+		Secret: "s3cret",
+		Events: []string{WebhookCommentCreated, WebhookCommentDeleted},
+	}}
+	app := newModerationApp(t, db, &cfg, "moderator")
+
+	// The outcome is recorded right after the response is read. Waiting for
+	// it keeps the worker from writing while a request holds the SQLite lock;
+	// polling may itself hit the lock and is then retried.
+	waitDelivered := func(n int) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			res, err := crud.New[WebhookDelivery](db).GetAllPaginated(context.Background(), crud.PaginationOptions{
+				Limit:      100,
+				Conditions: []query.Condition{query.Eq("status", WebhookDeliveryDelivered)},
+			})
+			if err == nil && len(res.Items) >= n {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d delivered, got %+v", n, loadDeliveries(t, db))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	next := func() (webhookRequest, WebhookPayload) {
+		t.Helper()
+		select {
+		case req := <-received:
+			var payload WebhookPayload
+			if err := json.Unmarshal(req.body, &payload); err != nil {
+				t.Fatal(err)
+			}
+			return req, payload
+		case <-time.After(5 * time.Second):
+			t.Fatal("no webhook received")
+		}
+		return webhookRequest{}, WebhookPayload{}
+	}
+
+	req := httptest.NewRequest("POST", "/comments", strings.NewReader(`{"commentable":"post","commentableId":"post-1","content":"hello"}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var created CommentResponseDTO
+	_ = json.NewDecoder(resp.Body).Decode(&created)
+
+	// comment.published is not subscribed to, so only comment.created is sent.
+	got, payload := next()
+	if got.event != WebhookCommentCreated || payload.Event != WebhookCommentCreated {
+		t.Errorf("expected %s, got header %q and payload %q", WebhookCommentCreated, got.event, payload.Event)
+	}
+	if got.signature != signWebhook("s3cret", got.body) {
+		t.Errorf("invalid signature %q", got.signature)
+	}
+	if payload.Comment.ID != created.ID || payload.Comment.Content != "hello" {
+		t.Errorf("unexpected payload comment %+v", payload.Comment)
+	}
+	if payload.Comment.IPAddress != nil || payload.Comment.UserAgent != nil {
+		t.Errorf("expected the author's IP address and user agent to be left out")
+	}
+	waitDelivered(1)
+
+	resp, err = app.Test(httptest.NewRequest("DELETE", "/comments/"+created.ID, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 204 {
+		t.Fatalf("expected 204, got %d", resp.StatusCode)
+	}
+	got, payload = next()
+	if got.event != WebhookCommentDeleted || payload.Comment.ID != created.ID || payload.Comment.DeletedAt == nil {
+		t.Errorf("expected a tombstone in %s, got %q with %+v", WebhookCommentDeleted, got.event, payload.Comment)
+	}
+
+	waitDelivered(2)
+
+	deliveries := func(roles, params string) (int, []WebhookDelivery) {
+		t.Helper()
+		resp, err := newModerationApp(t, db, &cfg, roles).Test(httptest.NewRequest("GET", "/comments/webhooks/deliveries?"+params, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body struct {
+			Data []WebhookDelivery `json:"data"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body.Data
+	}
+
+	status, log := deliveries("admin", "event=comment.deleted&commentId="+created.ID)
+	if status != 200 || len(log) != 1 {
+		t.Fatalf("expected one comment.deleted delivery, got %d %+v", status, log)
+	}
+	if log[0].Attempts != 1 || log[0].LastStatusCode == nil || *log[0].LastStatusCode != http.StatusNoContent {
+		t.Errorf("unexpected delivery %+v", log[0])
+	}
+	if status, _ := deliveries("admin", "status=unknown"); status != 400 {
+		t.Errorf("expected 400 for an unknown status, got %d", status)
+	}
+	if status, _ := deliveries("moderator", ""); status != 403 {
+		t.Errorf("expected 403 for moderators, got %d", status)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	srv, received := newWebhookReceiver(t, func(n int) int {
+		if n == 1 {
+			return http.StatusServiceUnavailable
+		}
+		return http.StatusOK
+	})
+	failing, _ := newWebhookReceiver(t, func(int) int { return http.StatusInternalServerError })
+
+	cfg := DefaultConfig()
+	cfg.WebhookMaxAttempts = 2
+	cfg.Webhooks = []WebhookConfig{
+		{URL: srv.URL, Secret: "s3cret"},
+		{URL: failing.URL, Secret: "s3cret"},
+	}
+	// No worker is started: deliveries only happen when the test asks.
+	d := newWebhookDispatcher(db, &cfg, newTestVoter(t))
+
+	id := insertComment(t, db, nil, StatusPublished)
+	comment, err := crud.New[Comment](db).GetByID(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.enqueue(ctx, db, WebhookCommentUpdated, *comment); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	if n, err := d.deliverDue(ctx, now); err != nil || n != 2 {
+		t.Fatalf("expected two due deliveries, got %d (%v)", n, err)
+	}
+	if n, _ := d.deliverDue(ctx, now); n != 0 {
+		t.Errorf("expected failed deliveries to wait before being retried, got %d due", n)
+	}
+	for _, delivery := range loadDeliveries(t, db) {
+		if delivery.Status != WebhookDeliveryPending || delivery.Attempts != 1 || delivery.LastError == nil {
+			t.Errorf("expected a pending retry, got %+v", delivery)
+		}
+	}
+
+	later := now.Add(time.Hour)
+	if n, err := d.deliverDue(ctx, later); err != nil || n != 2 {
+		t.Fatalf("expected two due retries, got %d (%v)", n, err)
+	}
+	for _, delivery := range loadDeliveries(t, db) {
+		want := WebhookDeliveryDelivered
+		if delivery.Url == failing.URL {
+			want = WebhookDeliveryFailed
+		}
+		if delivery.Status != want || delivery.Attempts != 2 {
+			t.Errorf("expected %s after 2 attempts, got %+v", want, delivery)
+		}
+	}
+	if n, _ := d.deliverDue(ctx, later.Add(24*time.Hour)); n != 0 {
+		t.Errorf("expected nothing left to deliver, got %d", n)
+	}
+
+	first, second := <-received, <-received
+	if first.event != WebhookCommentUpdated || string(first.body) != string(second.body) {
+		t.Errorf("expected the retry to resend the same event")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	for attempts, want := range map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		5:  8 * time.Minute,
+		20: 6 * time.Hour,
+	} {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestWebhookQueuedInTheWriteTransaction(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := DefaultConfig()
+	cfg.DefaultStatus = StatusPublished
+	cfg.Webhooks = []WebhookConfig{{URL: "http://127.0.0.1:1/hook"}}
+	ctx := context.Background()
+
+	// Set up before the worker starts, whose first pass would hold the lock.
+	id := insertComment(t, db, nil, StatusPublished)
+	if _, err := db.Exec(ctx, `CREATE TRIGGER reject_delivery BEFORE INSERT ON comment_webhook_delivery
+		BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+	app := newModerationApp(t, db, &cfg, "moderator")
+
+	send := func(method, path, body string) int {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode
+	}
+
+	// Queueing fails, so neither write may be kept.
+	if status := send("POST", "/comments", `{"commentable":"post","commentableId":"post-1","content":"hello"}`); status != 500 {
+		t.Errorf("expected the create to fail, got %d", status)
+	}
+	if status := send("PUT", "/comments/"+id, `{"content":"edited"}`); status != 500 {
+		t.Errorf("expected the update to fail, got %d", status)
+	}
+
+	var count int
+	var content string
+	if err := db.QueryRow(ctx, `SELECT COUNT(*), MAX(content) FROM comment`).Scan(&count, &content); err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || content == "edited" {
+		t.Errorf("expected the failed writes to be rolled back, got %d comments, content %q", count, content)
+	}
+}
+
+func TestWebhookWorkerStopsOnClose(t *testing.T) {
+	db := setupThreadDB(t)
+	srv, received := newWebhookReceiver(t, func(int) int { return http.StatusNoContent })
+
+	cfg := DefaultConfig()
+	cfg.Webhooks = []WebhookConfig{{URL: srv.URL}}
+	hooks := NewCommentHooks(db, &cfg, newTestVoter(t))
+	hooks.Start()
+
+	closed := make(chan struct{})
+	go func() {
+		hooks.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Close to stop the worker")
+	}
+
+	id := insertComment(t, db, nil, StatusPublished)
+	if err := hooks.webhooks.enqueue(context.Background(), db, WebhookCommentCreated, Comment{Id: id}); err != nil {
+		t.Fatal(err)
+	}
+	hooks.webhooks.notify()
+	select {
+	case <-received:
+		t.Error("expected no delivery once the worker is stopped")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebhookPayloadIsAnonymousView(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := rbac.WithRoles(context.Background(), []string{"admin"})
+	cfg := DefaultConfig()
+	cfg.Webhooks = []WebhookConfig{{URL: "http://127.0.0.1:1/hook"}}
+	d := newWebhookDispatcher(db, &cfg, newTestVoter(t))
+
+	reason, by, verdict, score := "spam", "moderator-1", VerdictHold, 0.7
+	comment := Comment{
+		Id:               insertComment(t, db, nil, StatusModerated),
+		Content:          "hello",
+		Status:           StatusModerated,
+		ModerationReason: &reason,
+		ModeratedBy:      &by,
+		CheckVerdict:     &verdict,
+		CheckScore:       &score,
+		CheckReasons:     &reason,
+	}
+	// The event is caused by an admin, who could read every field.
+	if err := d.enqueue(ctx, db, WebhookCommentModerated, comment); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := loadDeliveries(t, db)
+	if len(deliveries) != 1 {
+		t.Fatalf("expected one delivery, got %d", len(deliveries))
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal([]byte(deliveries[0].Payload), &payload); err != nil {
+		t.Fatal(err)
+	}
+	got := payload.Comment
+	if got.Content != "hello" || got.Status != StatusModerated {
+		t.Errorf("expected the public fields to be sent, got %+v", got)
+	}
+	if got.ModerationReason != nil || got.ModeratedBy != nil || got.CheckVerdict != nil ||
+		got.CheckScore != nil || got.CheckReasons != nil {
+		t.Errorf("expected the moderator-only fields to be left out, got %s", deliveries[0].Payload)
+	}
+}
+
+func TestWebhookDraftPayloadsLeaveEncryptedContentOut(t *testing.T) {
+	db := setupThreadDB(t)
+	cfg := encryptionConfig("k1")
+	cfg.EncryptDrafts = true
+	cfg.DefaultStatus = StatusDraft
+	cfg.Webhooks = []WebhookConfig{{URL: "http://127.0.0.1:1/hook"}}
+
+	// The worker is not started: only the queue is looked at.
+	app := fiber.New()
+	app.Use(func(fc fiber.Ctx) error {
+		fc.Locals("user_id", "moderator-1")
+		fc.SetContext(rbac.WithRoles(context.Background(), []string{"admin"}))
+		return fc.Next()
+	})
+	RegisterCommentRoutes(app, db, &cfg)
+	send := func(method, path, body string) *http.Response {
+		t.Helper()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := app.Test(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	resp := send("POST", "/comments", `{"commentable":"post","commentableId":"post-1","content":"secret plans"}`)
+	if resp.StatusCode != 201 {
+		t.Fatalf("expected 201, got %d", resp.StatusCode)
+	}
+	var dto CommentResponseDTO
+	if err := json.NewDecoder(resp.Body).Decode(&dto); err != nil {
+		t.Fatal(err)
+	}
+	if resp := send("PUT", "/comments/"+dto.ID, `{"content":"new plans"}`); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if resp := send("PUT", "/comments/"+dto.ID, `{"status":"published"}`); resp.StatusCode != 200 {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+
+	// Payloads are stored in clear, so those of the draft leave its content
+	// out.
+	var published bool
+	for _, delivery := range loadDeliveries(t, db) {
+		if delivery.Event == WebhookCommentPublished {
+			published = strings.Contains(delivery.Payload, `"content":"new plans"`)
+		} else if strings.Contains(delivery.Payload, "plans") || strings.Contains(delivery.Payload, encryptedPrefix) {
+			t.Errorf("expected the draft content to be left out of %s, got %s", delivery.Event, delivery.Payload)
+		}
+	}
+	if !published {
+		t.Errorf("expected the published comment to be sent with its content")
+	}
+}
+
+func TestWebhookPruneFinishedDeliveries(t *testing.T) {
+	db := setupThreadDB(t)
+	ctx := context.Background()
+	srv, _ := newWebhookReceiver(t, func(int) int { return http.StatusOK })
+	cfg := DefaultConfig()
+	cfg.Webhooks = []WebhookConfig{{URL: srv.URL}}
+	d := newWebhookDispatcher(db, &cfg, newTestVoter(t))
+
+	comment := Comment{Id: insertComment(t, db, nil, StatusPublished)}
+	if err := d.enqueue(ctx, db, WebhookCommentCreated, comment); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UTC()
+	if n, err := d.deliverDue(ctx, now); err != nil || n != 1 {
+		t.Fatalf("expected one delivery, got %d (%v)", n, err)
+	}
+	if err := d.enqueue(ctx, db, WebhookCommentUpdated, comment); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.prune(ctx, now.Add(24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if got := loadDeliveries(t, db); len(got) != 2 {
+		t.Fatalf("expected deliveries within the retention to be kept, got %d", len(got))
+	}
+
+	if err := d.prune(ctx, now.Add(31*24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	got := loadDeliveries(t, db)
+	if len(got) != 1 || got[0].Status != WebhookDeliveryPending {
+		t.Errorf("expected only the pending delivery to be left, got %+v", got)
+	}
+}